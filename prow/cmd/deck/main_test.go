@@ -188,16 +188,19 @@ func TestRerun(t *testing.T) {
 
 func TestTide(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		pools := []tide.Pool{
-			{
-				Org: "o",
+		status := tide.Status{
+			SchemaVersion: tide.SchemaVersion,
+			Pools: []tide.Pool{
+				{
+					Org: "o",
+				},
 			},
 		}
-		b, err := json.Marshal(pools)
+		b, err := json.Marshal(status)
 		if err != nil {
 			t.Fatalf("Marshaling: %v", err)
 		}
-		fmt.Fprintf(w, string(b))
+		fmt.Fprint(w, string(b))
 	}))
 	ta := tideAgent{
 		path: s.URL,
@@ -50,7 +50,7 @@ func (ta *tideAgent) start() {
 }
 
 func (ta *tideAgent) update() error {
-	var pools []tide.Pool
+	var status tide.Status
 	var resp *http.Response
 	var err error
 	for i := 0; i < 3; i++ {
@@ -65,7 +65,7 @@ func (ta *tideAgent) update() error {
 				err = fmt.Errorf("response has status code %d", resp.StatusCode)
 				continue
 			}
-			if err := json.NewDecoder(resp.Body).Decode(&pools); err != nil {
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
 				return err
 			}
 			break
@@ -74,8 +74,11 @@ func (ta *tideAgent) update() error {
 	if err != nil {
 		return err
 	}
+	if status.SchemaVersion != tide.SchemaVersion {
+		return fmt.Errorf("unsupported tide schema version %d, expected %d", status.SchemaVersion, tide.SchemaVersion)
+	}
 	ta.Lock()
 	defer ta.Unlock()
-	ta.pools = pools
+	ta.pools = status.Pools
 	return nil
 }
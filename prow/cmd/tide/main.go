@@ -22,23 +22,33 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
 	"k8s.io/test-infra/prow/config"
 	"k8s.io/test-infra/prow/git"
 	"k8s.io/test-infra/prow/github"
 	"k8s.io/test-infra/prow/kube"
+	m "k8s.io/test-infra/prow/metrics"
 	"k8s.io/test-infra/prow/tide"
 )
 
 var (
 	port = flag.Int("port", 8888, "Port to listen on.")
 
-	dryRun  = flag.Bool("dry-run", true, "Whether to mutate any real-world state.")
-	runOnce = flag.Bool("run-once", false, "If true, run only once then quit.")
+	dryRun   = flag.Bool("dry-run", true, "Whether to mutate any real-world state.")
+	planFile = flag.String("dry-run-plan-file", "", "Path to a file, or - for stdout, to append the actions planned in dry-run mode to as JSON lines.")
+	runOnce  = flag.Bool("run-once", false, "If true, run only once then quit.")
+
+	enableSyncEndpoint   = flag.Bool("enable-sync-endpoint", false, "Whether to serve /sync, which runs a sync on demand.")
+	enableConfigEndpoint = flag.Bool("enable-config-endpoint", false, "Whether to serve /config, which shows the Tide config in use.")
+	enableQueryEndpoint  = flag.Bool("enable-queries-endpoint", false, "Whether to serve /queries, which shows the most recent search requests sent to GitHub.")
+	enableResetEndpoint  = flag.Bool("enable-reset-endpoint", false, "Whether to serve /reset, which makes Tide forget what it remembers about a PR.")
+	enablePauseEndpoint  = flag.Bool("enable-pause-endpoint", false, "Whether to serve /pause, which stops or resumes merging. It is not authenticated.")
 
 	configPath = flag.String("config-path", "/etc/config/config", "Path to config.yaml.")
 	cluster    = flag.String("cluster", "", "Path to kube.Cluster YAML file. If empty, uses the local cluster.")
@@ -46,6 +56,11 @@ var (
 	_               = flag.String("github-bot-name", "", "Deprecated.")
 	githubEndpoint  = flag.String("github-endpoint", "https://api.github.com", "GitHub's API endpoint.")
 	githubTokenFile = flag.String("github-token-file", "/etc/github/oauth", "Path to the file containing the GitHub OAuth token.")
+
+	githubAppID      = flag.Int("github-app-id", 0, "ID of the GitHub App to authenticate as. If zero, use the OAuth token instead.")
+	githubAppKeyFile = flag.String("github-app-private-key-file", "/etc/github/app-key", "Path to the file containing the GitHub App's private key.")
+
+	webhookSecretFile = flag.String("decision-webhook-secret-file", "", "Path to the file containing the secret that decisions posted to the decision webhook are signed with.")
 )
 
 func main() {
@@ -58,18 +73,28 @@ func main() {
 		logger.WithError(err).Fatal("Error starting config agent.")
 	}
 
-	oauthSecretRaw, err := ioutil.ReadFile(*githubTokenFile)
-	if err != nil {
-		logger.WithError(err).Fatalf("Could not read oauth secret file.")
-	}
-	oauthSecret := string(bytes.TrimSpace(oauthSecretRaw))
-
-	_, err = url.Parse(*githubEndpoint)
+	_, err := url.Parse(*githubEndpoint)
 	if err != nil {
 		logger.WithError(err).Fatalf("Must specify a valid --github-endpoint URL.")
 	}
 
-	ghc := github.NewClient(oauthSecret, *githubEndpoint)
+	var tokens github.TokenSource
+	if *githubAppID != 0 {
+		key, err := ioutil.ReadFile(*githubAppKeyFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not read GitHub App private key file.")
+		}
+		tokens, err = github.NewAppTokenSource(*githubAppID, key, *githubEndpoint)
+		if err != nil {
+			logger.WithError(err).Fatal("Error creating GitHub App token source.")
+		}
+	} else {
+		oauthSecretRaw, err := ioutil.ReadFile(*githubTokenFile)
+		if err != nil {
+			logger.WithError(err).Fatalf("Could not read oauth secret file.")
+		}
+		tokens = github.StaticTokenSource(bytes.TrimSpace(oauthSecretRaw))
+	}
 
 	var kc *kube.Client
 	if *cluster == "" {
@@ -90,7 +115,29 @@ func main() {
 	}
 	defer gc.Clean()
 
-	c := tide.NewController(ghc, kc, configAgent, gc, *dryRun, logger)
+	// Push metrics to the configured prometheus pushgateway endpoint.
+	if endpoint := configAgent.Config().PushGateway.Endpoint; endpoint != "" {
+		go m.PushMetrics("tide", endpoint)
+	}
+
+	c := tide.NewController(tokens, *githubEndpoint, kc, configAgent, gc, *dryRun, logger)
+	if *webhookSecretFile != "" {
+		secret, err := ioutil.ReadFile(*webhookSecretFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not read decision webhook secret file.")
+		}
+		c.SetWebhookSecret(bytes.TrimSpace(secret))
+	}
+	if *planFile == "-" {
+		c.SetPlanWriter(os.Stdout)
+	} else if *planFile != "" {
+		f, err := os.OpenFile(*planFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not open dry-run plan file.")
+		}
+		defer f.Close()
+		c.SetPlanWriter(f)
+	}
 
 	sync(c)
 	if *runOnce {
@@ -101,7 +148,27 @@ func main() {
 			sync(c)
 		}
 	}()
-	logger.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), c))
+	mux := http.NewServeMux()
+	mux.Handle("/", c)
+	mux.HandleFunc("/costs", c.ServeCosts)
+	mux.HandleFunc("/pool-metrics", c.ServePoolMetrics)
+	mux.Handle("/metrics", promhttp.Handler())
+	if *enableSyncEndpoint {
+		mux.HandleFunc("/sync", c.ServeSync)
+	}
+	if *enableConfigEndpoint {
+		mux.HandleFunc("/config", c.ServeConfig)
+	}
+	if *enableQueryEndpoint {
+		mux.HandleFunc("/queries", c.ServeQueries)
+	}
+	if *enableResetEndpoint {
+		mux.HandleFunc("/reset", c.ServeReset)
+	}
+	if *enablePauseEndpoint {
+		mux.HandleFunc("/pause", c.ServePause)
+	}
+	logger.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), mux))
 }
 
 func sync(c *tide.Controller) {
@@ -80,9 +80,589 @@ type PushGateway struct {
 
 // Tide is config for the tide pool.
 type Tide struct {
-	// These must be valid GitHub search queries. They should not overlap,
-	// which is to say two queries should never return the same PR.
+	// These must be valid GitHub search queries. They may overlap, but a PR
+	// returned by more than one query is only considered once.
 	Queries []string `json:"queries,omitempty"`
+
+	// QueryPriorities order the queries, keyed by query. Queries with a higher
+	// priority are run first, so that their pools are computed before the
+	// rate limit budget runs low. Queries default to priority 0 and otherwise
+	// keep their order.
+	QueryPriorities map[string]int `json:"query_priorities,omitempty"`
+
+	// RequirePresubmits makes Tide refuse to merge in repos that are only
+	// reached through org-wide queries and have no presubmits or external
+	// contexts configured. Tide always warns about such repos, since every PR
+	// in them looks like it passes.
+	RequirePresubmits bool `json:"require_presubmits,omitempty"`
+
+	// BlockOnFailingBase makes Tide wait rather than act on a subpool whose
+	// base branch is failing its own tests, according to the combined status
+	// of the branch's head commit, so that merges do not pile up on a broken
+	// branch.
+	BlockOnFailingBase bool `json:"block_on_failing_base,omitempty"`
+
+	// RetestLabel is the label contributors can add to a PR to ask Tide to
+	// discard the existing results for it and trigger fresh presubmits. Tide
+	// removes the label once it has acted on it. Defaults to "tide/retest".
+	RetestLabel string `json:"retest_label,omitempty"`
+
+	// ForceMergeLabel is the label that lets a PR that passes its own tests be
+	// merged without waiting for a pending batch. It is meant for critical
+	// fixes only. Disabled if empty.
+	ForceMergeLabel string `json:"force_merge_label,omitempty"`
+
+	// BatchPriorityLabel is the label that makes Tide try a passing PR first
+	// when putting the next batch together, such as to get a release fix
+	// tested. A PR that does not apply cleanly is still left out. Disabled if
+	// empty.
+	BatchPriorityLabel string `json:"batch_priority_label,omitempty"`
+
+	// DependencyLabelPrefix is the prefix of labels that make a PR depend on
+	// another PR in the same repo, such as "depends-on/123" for the prefix
+	// "depends-on/". Tide does not merge a PR before the PRs it depends on.
+	// PRs in the same batch are merged in dependency order. Disabled if empty.
+	DependencyLabelPrefix string `json:"dependency_label_prefix,omitempty"`
+
+	// RequiredLabels are labels that a PR must all carry to be in the pool, on
+	// top of whatever the queries ask for. Disabled if empty.
+	RequiredLabels []string `json:"required_labels,omitempty"`
+	// BlockingLabels are labels that keep a PR out of the pool. A PR that
+	// carries both a required and a blocking label, say because two bots
+	// raced, is kept out: the blocking label wins. Disabled if empty.
+	BlockingLabels []string `json:"blocking_labels,omitempty"`
+
+	// CloseLabels are labels, such as "wontfix", that make Tide close the PRs
+	// in its pool that carry them instead of merging them. Disabled if empty.
+	CloseLabels []string `json:"close_labels,omitempty"`
+
+	// QueryConcurrency is the maximum number of queries that will be run
+	// against GitHub at once. Defaults to 1.
+	QueryConcurrency int `json:"query_concurrency,omitempty"`
+
+	// GetRefConcurrency is the maximum number of branches whose heads are
+	// looked up on GitHub at once when dividing the pool. Defaults to 4.
+	GetRefConcurrency int `json:"get_ref_concurrency,omitempty"`
+
+	// MaxConcurrency bounds the number of operations, such as queries and
+	// subpool actions, that Tide runs at once across all repos. Unbounded if
+	// zero.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// MaxClonedRepos bounds how many repos Tide keeps in its git cache for
+	// assembling batches. Past it, the least recently cloned repos are removed
+	// from the cache. Unbounded if zero.
+	MaxClonedRepos int `json:"max_cloned_repos,omitempty"`
+
+	// MaxPoolSize bounds the number of PRs that Tide pulls into the pool
+	// across all queries, as a safety valve against runaway queries. Once it
+	// is reached, Tide stops paginating and the pool is truncated. Unlimited
+	// if zero.
+	MaxPoolSize int `json:"max_pool_size,omitempty"`
+
+	// MaxSubpoolsPerSync bounds the number of subpools Tide acts on in one
+	// sync. The rest are left to the following syncs, in turn, so that every
+	// subpool is eventually synced. Unbounded if zero.
+	MaxSubpoolsPerSync int `json:"max_subpools_per_sync,omitempty"`
+
+	// SubpoolTimeoutString compiles into SubpoolTimeout at load time.
+	SubpoolTimeoutString string `json:"subpool_timeout,omitempty"`
+	// SubpoolTimeout is how long Tide will wait for the action on a single
+	// org/repo/branch subpool before abandoning it and moving on to the next.
+	// Defaults to no timeout.
+	SubpoolTimeout time.Duration `json:"-"`
+
+	// MissingJobGracePeriodString compiles into MissingJobGracePeriod at load
+	// time.
+	MissingJobGracePeriodString string `json:"missing_job_grace_period,omitempty"`
+	// MissingJobGracePeriod is how long after a PR enters the pool its
+	// required contexts that have no job yet count as pending rather than
+	// missing, for jobs that are created by systems other than Tide. Defaults
+	// to no grace period.
+	MissingJobGracePeriod time.Duration `json:"-"`
+
+	// MergeCooldownString compiles into MergeCooldown at load time.
+	MergeCooldownString string `json:"merge_cooldown,omitempty"`
+	// MergeCooldown is the minimum time between two merges into the same
+	// branch, to give post-merge CI time to react. Tide waits on a branch
+	// until it has passed. Defaults to no cooldown.
+	MergeCooldown time.Duration `json:"-"`
+	// MergeCooldownScope is what shares a merge cooldown: each "branch", all
+	// branches of a "repo" or all repos of an "org". Defaults to "branch".
+	MergeCooldownScope string `json:"merge_cooldown_scope,omitempty"`
+	// MergeCooldownBranches, if set, is a regex of the branches the merge
+	// cooldown applies to. Merges into other branches neither wait for nor
+	// start a cooldown.
+	MergeCooldownBranches string `json:"merge_cooldown_branches,omitempty"`
+	// MergeCooldownBranchRegex compiles from MergeCooldownBranches at load
+	// time.
+	MergeCooldownBranchRegex *regexp.Regexp `json:"-"`
+
+	// FrozenBranches are regexes of the branches that nothing is merged into,
+	// such as during a code freeze. PRs against them are still tested.
+	FrozenBranches []string `json:"frozen_branches,omitempty"`
+	// FrozenBranchRegexes compile from FrozenBranches at load time.
+	FrozenBranchRegexes []*regexp.Regexp `json:"-"`
+
+	// PostMergeFailureWindowString compiles into PostMergeFailureWindow at
+	// load time.
+	PostMergeFailureWindowString string `json:"post_merge_failure_window,omitempty"`
+	// PostMergeFailureWindow is how long after Tide merges into a branch a
+	// failing combined status of the branch's head is blamed on the merge.
+	// Tide then pauses on the branch until the branch passes again, even once
+	// the window is over. Disabled if zero.
+	PostMergeFailureWindow time.Duration `json:"-"`
+
+	// ReportStatus makes Tide report the state of each PR in the pool to
+	// GitHub under the "tide" context.
+	ReportStatus bool `json:"report_status,omitempty"`
+	// UseCheckRuns makes Tide report with check runs, which carry a summary
+	// and details, rather than with commit statuses. Requires ReportStatus.
+	UseCheckRuns bool `json:"use_check_runs,omitempty"`
+
+	// DecisionWebhookURL is where Tide posts the action it took on each
+	// subpool, for external dashboards and audit systems. Posting is best
+	// effort. The payload is signed with the secret passed to Tide on the
+	// command line. Disabled if empty.
+	DecisionWebhookURL string `json:"decision_webhook_url,omitempty"`
+
+	// CommitterName and CommitterEmail are the identity that the merge commits
+	// Tide creates are attributed to. They default to "prow" and
+	// "prow@localhost". The GitHub merge API does not allow choosing the
+	// author of a merge, so this applies to the commits made when assembling
+	// batches for testing.
+	CommitterName  string `json:"committer_name,omitempty"`
+	CommitterEmail string `json:"committer_email,omitempty"`
+
+	// JobLabels are labels added to every ProwJob that Tide triggers, on top
+	// of the presubmit's own labels, for dashboards to tell them apart. Tide
+	// also labels the jobs with whether they test a batch and which query
+	// found the PRs.
+	JobLabels map[string]string `json:"job_labels,omitempty"`
+
+	// IgnoredPRs are PRs, in "org/repo#number" form, that Tide leaves out of
+	// the pool even though they match a query.
+	IgnoredPRs []string `json:"ignored_prs,omitempty"`
+
+	// PathRequirements make presubmits required, and triggered, by Tide only
+	// for PRs that change files matching a path. A presubmit with several
+	// requirements is required if any of them match.
+	PathRequirements []TidePathRequirement `json:"path_requirements,omitempty"`
+	// ProtectedPaths keep PRs that change files matching a path, such as
+	// OWNERS files, from being merged until they carry the path's label.
+	ProtectedPaths []TideProtectedPath `json:"protected_paths,omitempty"`
+
+	// AccumulationStrategy decides which result counts when a presubmit ran
+	// more than once for a PR, or several presubmits report to the same
+	// context: "best" takes the most successful one, "latest" the one that
+	// started last and "all" needs the best run of every presubmit to pass.
+	// Defaults to "best".
+	AccumulationStrategy string `json:"accumulation_strategy,omitempty"`
+	// RepoAccumulationStrategies overrides AccumulationStrategy for repos,
+	// keyed by "org/repo".
+	RepoAccumulationStrategies map[string]string `json:"repo_accumulation_strategies,omitempty"`
+
+	// EnableBatches turns batches on or off for repos, keyed by "org/repo".
+	// Repos with batches off, such as those whose tests depend on the order
+	// of changes, only merge PRs serially. Batches are on for repos without an
+	// entry.
+	EnableBatches map[string]bool `json:"enable_batches,omitempty"`
+	// MinBatchSize is the fewest PRs Tide will test together in a batch.
+	// Smaller batches are not triggered and the PRs are merged serially
+	// instead. Defaults to 2.
+	MinBatchSize int `json:"min_batch_size,omitempty"`
+	// MaxPendingBatches is the most repos that may have a pending batch at
+	// once, across everything Tide manages, to keep batches from saturating
+	// the cluster. Other repos wait to trigger batches. Unlimited if zero.
+	MaxPendingBatches int `json:"max_pending_batches,omitempty"`
+	// MaxBatchChangedFiles caps the number of files that the PRs in a batch
+	// may change between them. PRs that would take a batch over the cap are
+	// left out of it and merged serially instead. Disabled if zero.
+	MaxBatchChangedFiles int `json:"max_batch_changed_files,omitempty"`
+
+	// BatchMergeStrategies decide how Tide puts a batch together to check
+	// that its PRs apply cleanly, keyed by "org/repo": "merge" merges each PR
+	// and "rebase" rebases it onto the ones before. Repos that rebase PRs when
+	// merging them should use "rebase". Defaults to "merge".
+	BatchMergeStrategies map[string]string `json:"batch_merge_strategies,omitempty"`
+	// SkipConflictingPRs makes Tide leave PRs that GitHub reports as
+	// conflicting with their base branch out of batches without trying to
+	// merge them locally, and skip cloning the repo when no PR is left.
+	SkipConflictingPRs bool `json:"skip_conflicting_prs,omitempty"`
+
+	// FallbackToRollupStatus lets Tide keep merging when it cannot list
+	// ProwJobs. PRs are then judged by their combined GitHub status alone,
+	// and nothing is triggered until ProwJobs can be listed again.
+	FallbackToRollupStatus bool `json:"fallback_to_rollup_status,omitempty"`
+
+	// VerifyMerges makes Tide check that GitHub reports each PR as merged
+	// after merging it. PRs that are not are left in the pool, so that the
+	// merge is retried on the next sync.
+	VerifyMerges bool `json:"verify_merges,omitempty"`
+
+	// MergeMethods are the merge methods Tide tries, in order, keyed by
+	// "org/repo". When a repo does not allow a method, Tide falls back to the
+	// next one. Repos without an entry use GitHub's default method. On
+	// branches that require a linear history, merges are squashed instead.
+	MergeMethods map[string][]string `json:"merge_methods,omitempty"`
+
+	// ApproveBeforeMerge makes Tide leave an approving review on each PR right
+	// before merging it, unless it has already approved it, so that merges
+	// are attributable in the review UI.
+	ApproveBeforeMerge bool `json:"approve_before_merge,omitempty"`
+
+	// CommentOnBatchMerge makes Tide comment on each PR it merges in a batch,
+	// listing the other PRs that were merged with it.
+	CommentOnBatchMerge bool `json:"comment_on_batch_merge,omitempty"`
+
+	// ErrorRetriggers is how many times Tide retriggers a required presubmit
+	// that ended in the error state on the same PR head. Errors usually come
+	// from the infrastructure rather than the change, unlike failures, which
+	// are never retriggered. Zero disables this.
+	ErrorRetriggers int `json:"error_retriggers,omitempty"`
+	// BatchErrorRetriggers is how many times Tide retriggers the jobs of a
+	// batch that ended in the error state, testing the same PRs again rather
+	// than picking a new batch. A batch with a failed job is never
+	// retriggered. Zero disables this.
+	BatchErrorRetriggers int `json:"batch_error_retriggers,omitempty"`
+
+	// RequireResolvedThreads lists the repos, keyed by "org/repo", whose PRs
+	// Tide only merges once all of their review threads are resolved, for
+	// branch protection that requires it.
+	RequireResolvedThreads map[string]bool `json:"require_resolved_threads,omitempty"`
+
+	// UpdateBranches lists the repos, keyed by "org/repo", whose PRs Tide
+	// brings up to date with the base branch before merging them on their
+	// own, for branch protection that requires it. A passing PR that is
+	// behind has its branch updated and waits to be tested again.
+	UpdateBranches map[string]bool `json:"update_branches,omitempty"`
+	// BranchUpdateLimit is how many times Tide updates the branch of a PR,
+	// so that a busy base branch cannot keep it updating forever. Past it,
+	// Tide tries to merge the PR as it is. Defaults to 3.
+	BranchUpdateLimit int `json:"branch_update_limit,omitempty"`
+
+	// MergeRequeues is how many times per sync Tide may re-run a subpool
+	// right after merging into it, so that PRs can be retriggered against the
+	// new base without waiting for the next sync. Each re-run looks up the
+	// branch head again, so its decisions never use the base SHA from before
+	// the merge. Zero disables this.
+	MergeRequeues int `json:"merge_requeues,omitempty"`
+	// RefreshBaseAfterMerge makes Tide look up the branch head again right
+	// after merging into it, and trigger the tests of the PRs left against it
+	// in the same sync. Unlike the re-runs of MergeRequeues, this never
+	// merges, and it applies once MergeRequeues are used up.
+	RefreshBaseAfterMerge bool `json:"refresh_base_after_merge,omitempty"`
+	// BatchAfterMerge makes the re-runs of MergeRequeues and
+	// RefreshBaseAfterMerge trigger a batch against the new base when there
+	// are enough PRs for one, rather than testing a single PR. It has no
+	// effect without either.
+	BatchAfterMerge bool `json:"batch_after_merge,omitempty"`
+
+	// MergeScoring decides which passing PR Tide acts on next when not
+	// batching. Without it, the smallest PR number goes first.
+	MergeScoring TideMergeScoring `json:"merge_scoring,omitempty"`
+
+	// Repos are the repos that Tide manages, as "org/repo" or "org" for every
+	// repo in the org. PRs from other repos are dropped even if they match a
+	// query. If empty, every repo is managed.
+	Repos []string `json:"repos,omitempty"`
+	// ExcludedRepos are repos, in the same form, that Tide never manages. They
+	// take precedence over Repos.
+	ExcludedRepos []string `json:"excluded_repos,omitempty"`
+
+	// ExternalContexts are status contexts, keyed by "org/repo", that Tide
+	// requires but that are reported by systems other than Prow. Tide waits
+	// for these rather than triggering anything for them.
+	ExternalContexts map[string][]string `json:"external_contexts,omitempty"`
+	// ExternalContextPatternStrings compile into ExternalContextPatterns at
+	// load time. They are keyed by "org/repo".
+	ExternalContextPatternStrings map[string][]string `json:"external_context_patterns,omitempty"`
+	// ExternalContextPatterns are regular expressions that must match the
+	// whole name of a context. Every status context or check run on a PR's
+	// head that one matches is required as if it were listed in
+	// ExternalContexts, unless a presubmit of the repo reports to it. A PR
+	// without any matching context is not held back by them.
+	ExternalContextPatterns map[string][]*regexp.Regexp `json:"-"`
+
+	// BlockingChecks are status contexts or check runs, keyed by "org/repo",
+	// that must pass before Tide merges a PR, such as security scans. Unlike
+	// ExternalContexts, they are judged on each PR after its presubmits, and
+	// a batch is only merged if all of its PRs pass them.
+	BlockingChecks map[string][]string `json:"blocking_checks,omitempty"`
+
+	// RequiredJobs are presubmits, keyed by "org/repo", that Tide triggers and
+	// requires for merging even though they do not always run. This mirrors a
+	// human asking for them with /test before merging.
+	RequiredJobs map[string][]string `json:"required_jobs,omitempty"`
+	// BatchRequiredJobs are presubmits, keyed by "org/repo", that Tide
+	// triggers and requires for batches only, such as a slow integration
+	// suite. PRs merged on their own do not need them.
+	BatchRequiredJobs map[string][]string `json:"batch_required_jobs,omitempty"`
+	// OptionalJobs are presubmits, keyed by "org/repo", that Tide neither
+	// triggers nor requires even though they always run, such as jobs that
+	// only inform reviewers.
+	OptionalJobs map[string][]string `json:"optional_jobs,omitempty"`
+
+	// StatusOverrides let a label, set by admins for emergencies, stand in
+	// for required contexts that are failing, keyed by "org/repo". A PR that
+	// carries the label has only the override's contexts treated as passing.
+	// Every override that Tide applies is logged as a warning and reported in
+	// the pool.
+	StatusOverrides map[string][]TideStatusOverride `json:"status_overrides,omitempty"`
+
+	// BatchCommitTemplateStrings compile into BatchCommitTemplates at load
+	// time. They are keyed by "org/repo".
+	BatchCommitTemplateStrings map[string]string `json:"batch_commit_templates,omitempty"`
+	// BatchCommitTemplates are compiled at load time from
+	// BatchCommitTemplateStrings. They are passed the PRs merged in a batch,
+	// each with its Number, Title and Author, as .PRs, and produce the commit
+	// message of every merge in the batch.
+	BatchCommitTemplates map[string]*template.Template `json:"-"`
+}
+
+// ExternalContextsFor returns the externally-provided contexts that Tide
+// requires for the repo.
+func (t *Tide) ExternalContextsFor(org, repo string) []string {
+	return t.ExternalContexts[org+"/"+repo]
+}
+
+// ExternalContextPatternsFor returns the patterns of externally-provided
+// contexts that Tide requires for the repo.
+func (t *Tide) ExternalContextPatternsFor(org, repo string) []*regexp.Regexp {
+	return t.ExternalContextPatterns[org+"/"+repo]
+}
+
+// BlockingChecksFor returns the checks that must pass before Tide merges a PR
+// in the repo.
+func (t *Tide) BlockingChecksFor(org, repo string) []string {
+	return t.BlockingChecks[org+"/"+repo]
+}
+
+// StatusOverridesFor returns the status overrides configured for the repo.
+func (t *Tide) StatusOverridesFor(org, repo string) []TideStatusOverride {
+	return t.StatusOverrides[org+"/"+repo]
+}
+
+// RequiredJobsFor returns the presubmits that Tide requires for the repo in
+// addition to those that always run.
+func (t *Tide) RequiredJobsFor(org, repo string) []string {
+	return t.RequiredJobs[org+"/"+repo]
+}
+
+// OptionalJobsFor returns the presubmits that always run for the repo but that
+// Tide does not require.
+func (t *Tide) OptionalJobsFor(org, repo string) []string {
+	return t.OptionalJobs[org+"/"+repo]
+}
+
+// BatchRequiredJobsFor returns the presubmits that Tide requires for batches
+// of the repo in addition to those it requires for every PR.
+func (t *Tide) BatchRequiredJobsFor(org, repo string) []string {
+	return t.BatchRequiredJobs[org+"/"+repo]
+}
+
+// BatchCommitTemplateFor returns the template for the commit messages of
+// batch merges in the repo, or nil to keep GitHub's default messages.
+func (t *Tide) BatchCommitTemplateFor(org, repo string) *template.Template {
+	return t.BatchCommitTemplates[org+"/"+repo]
+}
+
+// ManagesRepo returns true if Tide is configured to manage the repo.
+func (t *Tide) ManagesRepo(org, repo string) bool {
+	matches := func(entries []string) bool {
+		for _, entry := range entries {
+			if entry == org || entry == org+"/"+repo {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(t.ExcludedRepos) {
+		return false
+	}
+	return len(t.Repos) == 0 || matches(t.Repos)
+}
+
+// MergeMethodsFor returns the merge methods to try for the repo. The empty
+// method asks GitHub for its default.
+func (t *Tide) MergeMethodsFor(org, repo string) []string {
+	if methods := t.MergeMethods[org+"/"+repo]; len(methods) > 0 {
+		return methods
+	}
+	return []string{""}
+}
+
+// TideMergeScoring weighs PRs against each other. Each PR's score is the sum
+// of the weights of its labels, AgeWeight times the hours since it was
+// opened, and ApprovalWeight times the number of approving reviews. The
+// highest score goes first, and ties go to the smallest PR number.
+type TideMergeScoring struct {
+	LabelWeights   map[string]float64 `json:"label_weights,omitempty"`
+	AgeWeight      float64            `json:"age_weight,omitempty"`
+	ApprovalWeight float64            `json:"approval_weight,omitempty"`
+}
+
+// Score returns the score of a PR with the labels, age, and approvals.
+func (s TideMergeScoring) Score(labels []string, age time.Duration, approvals int) float64 {
+	var score float64
+	for _, label := range labels {
+		score += s.LabelWeights[label]
+	}
+	return score + s.AgeWeight*age.Hours() + s.ApprovalWeight*float64(approvals)
+}
+
+// Merge methods that Tide can use.
+const (
+	MergeMerge  = "merge"
+	MergeSquash = "squash"
+	MergeRebase = "rebase"
+)
+
+// BatchesEnabledFor returns whether Tide tests and merges PRs of the repo in
+// batches.
+func (t *Tide) BatchesEnabledFor(org, repo string) bool {
+	if enabled, ok := t.EnableBatches[org+"/"+repo]; ok {
+		return enabled
+	}
+	return true
+}
+
+// RequireResolvedThreadsFor returns whether the repo's PRs need all of their
+// review threads resolved to be merged.
+func (t *Tide) RequireResolvedThreadsFor(org, repo string) bool {
+	return t.RequireResolvedThreads[org+"/"+repo]
+}
+
+// Frozen returns whether the branch is frozen, so that nothing is merged into
+// it.
+func (t *Tide) Frozen(branch string) bool {
+	for _, re := range t.FrozenBranchRegexes {
+		if re.MatchString(branch) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateBranchesFor returns whether Tide updates the branches of the repo's
+// PRs that are behind before merging them.
+func (t *Tide) UpdateBranchesFor(org, repo string) bool {
+	return t.UpdateBranches[org+"/"+repo]
+}
+
+// BatchMergeStrategyFor returns how batches are put together for the repo.
+func (t *Tide) BatchMergeStrategyFor(org, repo string) string {
+	if strategy, ok := t.BatchMergeStrategies[org+"/"+repo]; ok {
+		return strategy
+	}
+	return MergeMerge
+}
+
+// Tide accumulation strategies.
+const (
+	TideAccumulateBest   = "best"
+	TideAccumulateLatest = "latest"
+	TideAccumulateAll    = "all"
+)
+
+func validAccumulationStrategy(strategy string) bool {
+	return strategy == TideAccumulateBest || strategy == TideAccumulateLatest || strategy == TideAccumulateAll
+}
+
+// Tide merge cooldown scopes.
+const (
+	TideCooldownBranch = "branch"
+	TideCooldownRepo   = "repo"
+	TideCooldownOrg    = "org"
+)
+
+// AccumulationStrategyFor returns the accumulation strategy for the repo.
+func (t *Tide) AccumulationStrategyFor(org, repo string) string {
+	if strategy, ok := t.RepoAccumulationStrategies[org+"/"+repo]; ok {
+		return strategy
+	}
+	return t.AccumulationStrategy
+}
+
+// TideStatusOverride treats required contexts as passing on PRs that carry a
+// label.
+type TideStatusOverride struct {
+	// Label is the label that overrides the contexts.
+	Label string `json:"label"`
+	// Contexts are the required contexts that the label overrides. Other
+	// required contexts must still pass.
+	Contexts []string `json:"contexts"`
+}
+
+// TidePathRequirement makes a presubmit required by Tide only for PRs that
+// change certain files.
+type TidePathRequirement struct {
+	// Presubmit is the name of the presubmit job.
+	Presubmit string `json:"presubmit"`
+	// Path is a regular expression matched against the changed file names.
+	Path string `json:"path"`
+
+	re *regexp.Regexp // from Path.
+}
+
+// Matches returns true if any of the changed files match the path.
+func (r TidePathRequirement) Matches(changes []string) bool {
+	for _, change := range changes {
+		if r.re.MatchString(change) {
+			return true
+		}
+	}
+	return false
+}
+
+// TideProtectedPath keeps PRs that change certain files from being merged by
+// Tide unless they carry a label.
+type TideProtectedPath struct {
+	// Path is a regular expression matched against the changed file names.
+	Path string `json:"path"`
+	// Label is the label that PRs changing the files must carry, such as one
+	// that records an extra approval.
+	Label string `json:"label"`
+
+	re *regexp.Regexp // from Path.
+}
+
+// Matches returns true if any of the changed files match the path.
+func (p TideProtectedPath) Matches(changes []string) bool {
+	for _, change := range changes {
+		if p.re.MatchString(change) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetProtectedPathRegexes compiles and validates the provided protected paths.
+func SetProtectedPathRegexes(ps []TideProtectedPath) error {
+	for i, p := range ps {
+		if p.Label == "" {
+			return fmt.Errorf("protected path %q has no label", p.Path)
+		}
+		re, err := regexp.Compile(p.Path)
+		if err != nil {
+			return fmt.Errorf("could not compile protected path regex %q: %v", p.Path, err)
+		}
+		ps[i].re = re
+	}
+	return nil
+}
+
+// SetPathRequirementRegexes compiles and validates the paths of the provided
+// requirements.
+func SetPathRequirementRegexes(rs []TidePathRequirement) error {
+	for i, r := range rs {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return fmt.Errorf("could not compile path regex for %s: %v", r.Presubmit, err)
+		}
+		rs[i].re = re
+	}
+	return nil
 }
 
 // Controller holds configuration applicable to all agent-specific
@@ -181,6 +761,11 @@ func Load(path string) (*Config, error) {
 	return nc, nil
 }
 
+var (
+	ignoredPRRegex = regexp.MustCompile(`^[^/#]+/[^/#]+#[0-9]+$`)
+	tideRepoRegex  = regexp.MustCompile(`^[^/#]+(/[^/#]+)?$`)
+)
+
 func parseConfig(c *Config) error {
 	// Ensure that presubmit regexes are valid.
 	for _, vs := range c.Presubmits {
@@ -312,6 +897,208 @@ func parseConfig(c *Config) error {
 		c.Sinker.MaxPodAge = maxPodAge
 	}
 
+	if c.Tide.RetestLabel == "" {
+		c.Tide.RetestLabel = "tide/retest"
+	}
+	if c.Tide.QueryConcurrency < 0 {
+		return fmt.Errorf("tide has invalid query_concurrency (%d), it needs to be a non-negative number", c.Tide.QueryConcurrency)
+	} else if c.Tide.QueryConcurrency == 0 {
+		c.Tide.QueryConcurrency = 1
+	}
+	if c.Tide.GetRefConcurrency < 0 {
+		return fmt.Errorf("tide has invalid get_ref_concurrency (%d), it needs to be a non-negative number", c.Tide.GetRefConcurrency)
+	} else if c.Tide.GetRefConcurrency == 0 {
+		c.Tide.GetRefConcurrency = 4
+	}
+	if c.Tide.UseCheckRuns && !c.Tide.ReportStatus {
+		return fmt.Errorf("tide has use_check_runs set, but it needs report_status to be set as well")
+	}
+	if c.Tide.MaxConcurrency < 0 {
+		return fmt.Errorf("tide has invalid max_concurrency (%d), it needs to be a non-negative number", c.Tide.MaxConcurrency)
+	}
+	if c.Tide.MaxClonedRepos < 0 {
+		return fmt.Errorf("tide has invalid max_cloned_repos (%d), it needs to be a non-negative number", c.Tide.MaxClonedRepos)
+	}
+	if c.Tide.MaxPoolSize < 0 {
+		return fmt.Errorf("tide has invalid max_pool_size (%d), it needs to be a non-negative number", c.Tide.MaxPoolSize)
+	}
+	if c.Tide.MaxSubpoolsPerSync < 0 {
+		return fmt.Errorf("tide has invalid max_subpools_per_sync (%d), it needs to be a non-negative number", c.Tide.MaxSubpoolsPerSync)
+	}
+	if c.Tide.SubpoolTimeoutString != "" {
+		subpoolTimeout, err := time.ParseDuration(c.Tide.SubpoolTimeoutString)
+		if err != nil {
+			return fmt.Errorf("cannot parse duration for subpool_timeout: %v", err)
+		}
+		c.Tide.SubpoolTimeout = subpoolTimeout
+	}
+	if c.Tide.MissingJobGracePeriodString != "" {
+		gracePeriod, err := time.ParseDuration(c.Tide.MissingJobGracePeriodString)
+		if err != nil {
+			return fmt.Errorf("cannot parse duration for missing_job_grace_period: %v", err)
+		}
+		c.Tide.MissingJobGracePeriod = gracePeriod
+	}
+	if c.Tide.MergeCooldownString != "" {
+		cooldown, err := time.ParseDuration(c.Tide.MergeCooldownString)
+		if err != nil {
+			return fmt.Errorf("cannot parse duration for merge_cooldown: %v", err)
+		}
+		c.Tide.MergeCooldown = cooldown
+	}
+	switch c.Tide.MergeCooldownScope {
+	case "":
+		c.Tide.MergeCooldownScope = TideCooldownBranch
+	case TideCooldownBranch, TideCooldownRepo, TideCooldownOrg:
+	default:
+		return fmt.Errorf("tide has invalid merge_cooldown_scope %q, it needs to be %q, %q or %q", c.Tide.MergeCooldownScope, TideCooldownBranch, TideCooldownRepo, TideCooldownOrg)
+	}
+	if c.Tide.MergeCooldownBranches != "" {
+		re, err := regexp.Compile("^(?:" + c.Tide.MergeCooldownBranches + ")$")
+		if err != nil {
+			return fmt.Errorf("could not compile merge_cooldown_branches regex %q: %v", c.Tide.MergeCooldownBranches, err)
+		}
+		c.Tide.MergeCooldownBranchRegex = re
+	}
+	for _, branch := range c.Tide.FrozenBranches {
+		re, err := regexp.Compile("^(?:" + branch + ")$")
+		if err != nil {
+			return fmt.Errorf("could not compile frozen_branches regex %q: %v", branch, err)
+		}
+		c.Tide.FrozenBranchRegexes = append(c.Tide.FrozenBranchRegexes, re)
+	}
+	if c.Tide.PostMergeFailureWindowString != "" {
+		window, err := time.ParseDuration(c.Tide.PostMergeFailureWindowString)
+		if err != nil {
+			return fmt.Errorf("cannot parse duration for post_merge_failure_window: %v", err)
+		}
+		c.Tide.PostMergeFailureWindow = window
+	}
+	for _, pr := range c.Tide.IgnoredPRs {
+		if !ignoredPRRegex.MatchString(pr) {
+			return fmt.Errorf("tide ignored PR %q is not of the form org/repo#number", pr)
+		}
+	}
+	for _, repos := range [][]string{c.Tide.Repos, c.Tide.ExcludedRepos} {
+		for _, repo := range repos {
+			if !tideRepoRegex.MatchString(repo) {
+				return fmt.Errorf("tide repo %q is not of the form org/repo or org", repo)
+			}
+		}
+	}
+	if err := SetPathRequirementRegexes(c.Tide.PathRequirements); err != nil {
+		return fmt.Errorf("validating tide config: %v", err)
+	}
+	if err := SetProtectedPathRegexes(c.Tide.ProtectedPaths); err != nil {
+		return fmt.Errorf("validating tide config: %v", err)
+	}
+	if c.Tide.AccumulationStrategy == "" {
+		c.Tide.AccumulationStrategy = TideAccumulateBest
+	}
+	if !validAccumulationStrategy(c.Tide.AccumulationStrategy) {
+		return fmt.Errorf("tide has invalid accumulation_strategy %q, it needs to be %q, %q or %q", c.Tide.AccumulationStrategy, TideAccumulateBest, TideAccumulateLatest, TideAccumulateAll)
+	}
+	for repo, strategy := range c.Tide.RepoAccumulationStrategies {
+		if !validAccumulationStrategy(strategy) {
+			return fmt.Errorf("tide has invalid accumulation strategy %q for %s, it needs to be %q, %q or %q", strategy, repo, TideAccumulateBest, TideAccumulateLatest, TideAccumulateAll)
+		}
+	}
+	for repo, methods := range c.Tide.MergeMethods {
+		for _, method := range methods {
+			if method != MergeMerge && method != MergeSquash && method != MergeRebase {
+				return fmt.Errorf("tide has invalid merge method %q for %s, it needs to be %q, %q or %q", method, repo, MergeMerge, MergeSquash, MergeRebase)
+			}
+		}
+	}
+	for repo, strategy := range c.Tide.BatchMergeStrategies {
+		if strategy != MergeMerge && strategy != MergeRebase {
+			return fmt.Errorf("tide has invalid batch merge strategy %q for %s, it needs to be %q or %q", strategy, repo, MergeMerge, MergeRebase)
+		}
+	}
+	for _, listed := range []struct {
+		field string
+		jobs  map[string][]string
+	}{
+		{"required_jobs", c.Tide.RequiredJobs},
+		{"batch_required_jobs", c.Tide.BatchRequiredJobs},
+		{"optional_jobs", c.Tide.OptionalJobs},
+	} {
+		for repo, jobs := range listed.jobs {
+			for _, job := range jobs {
+				found := false
+				for _, ps := range c.Presubmits[repo] {
+					if ps.Name == job {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("tide has job %q in %s for %s, but it is not a presubmit of the repo", job, listed.field, repo)
+				}
+			}
+		}
+	}
+	for repo, jobs := range c.Tide.OptionalJobs {
+		for _, job := range jobs {
+			for _, required := range c.Tide.RequiredJobs[repo] {
+				if job == required {
+					return fmt.Errorf("tide has job %q for %s in both required_jobs and optional_jobs", job, repo)
+				}
+			}
+		}
+	}
+	for repo, overrides := range c.Tide.StatusOverrides {
+		for _, override := range overrides {
+			if override.Label == "" || len(override.Contexts) == 0 {
+				return fmt.Errorf("tide has invalid status override for %s, it needs a label and at least one context", repo)
+			}
+		}
+	}
+	c.Tide.ExternalContextPatterns = make(map[string][]*regexp.Regexp)
+	for repo, patterns := range c.Tide.ExternalContextPatternStrings {
+		for _, pattern := range patterns {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("tide has invalid external context pattern %q for %s: %v", pattern, repo, err)
+			}
+			c.Tide.ExternalContextPatterns[repo] = append(c.Tide.ExternalContextPatterns[repo], re)
+		}
+	}
+	c.Tide.BatchCommitTemplates = make(map[string]*template.Template)
+	for repo, tmpl := range c.Tide.BatchCommitTemplateStrings {
+		batchTmpl, err := template.New("BatchCommit").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("tide has invalid batch commit template for %s: %v", repo, err)
+		}
+		c.Tide.BatchCommitTemplates[repo] = batchTmpl
+	}
+	if c.Tide.ErrorRetriggers < 0 {
+		return fmt.Errorf("tide has invalid error_retriggers (%d), it needs to be a non-negative number", c.Tide.ErrorRetriggers)
+	}
+	if c.Tide.BatchErrorRetriggers < 0 {
+		return fmt.Errorf("tide has invalid batch_error_retriggers (%d), it needs to be a non-negative number", c.Tide.BatchErrorRetriggers)
+	}
+	if c.Tide.BranchUpdateLimit == 0 {
+		c.Tide.BranchUpdateLimit = 3
+	}
+	if c.Tide.BranchUpdateLimit < 0 {
+		return fmt.Errorf("tide has invalid branch_update_limit (%d), it needs to be a positive number", c.Tide.BranchUpdateLimit)
+	}
+	if c.Tide.MergeRequeues < 0 {
+		return fmt.Errorf("tide has invalid merge_requeues (%d), it needs to be a non-negative number", c.Tide.MergeRequeues)
+	}
+	if c.Tide.MinBatchSize == 0 {
+		c.Tide.MinBatchSize = 2
+	} else if c.Tide.MinBatchSize < 2 {
+		return fmt.Errorf("tide has invalid min_batch_size (%d), it needs to be at least 2", c.Tide.MinBatchSize)
+	}
+	if c.Tide.MaxPendingBatches < 0 {
+		return fmt.Errorf("tide has invalid max_pending_batches (%d), it needs to be a non-negative number", c.Tide.MaxPendingBatches)
+	}
+	if c.Tide.MaxBatchChangedFiles < 0 {
+		return fmt.Errorf("tide has invalid max_batch_changed_files (%d), it needs to be a non-negative number", c.Tide.MaxBatchChangedFiles)
+	}
+
 	if c.ProwJobNamespace == "" {
 		c.ProwJobNamespace = "default"
 	}
@@ -869,3 +869,258 @@ func TestLatestUsesImagePullPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestExternalContextPatterns(t *testing.T) {
+	c := &Config{Tide: Tide{ExternalContextPatternStrings: map[string][]string{"o/r": {"pull-foo-e2e-.*"}}}}
+	if err := parseConfig(c); err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	patterns := c.Tide.ExternalContextPatternsFor("o", "r")
+	if len(patterns) != 1 {
+		t.Fatalf("Expected one pattern, got %v.", patterns)
+	}
+	for context, expected := range map[string]bool{
+		"pull-foo-e2e-gce":   true,
+		"pull-foo-unit":      false,
+		"x-pull-foo-e2e-gce": false,
+	} {
+		if actual := patterns[0].MatchString(context); actual != expected {
+			t.Errorf("Expected matching %q to be %t, got %t.", context, expected, actual)
+		}
+	}
+
+	c = &Config{Tide: Tide{ExternalContextPatternStrings: map[string][]string{"o/r": {"pull-foo-(e2e"}}}}
+	if err := parseConfig(c); err == nil {
+		t.Error("Expected an invalid pattern to be rejected.")
+	}
+}
+
+func TestParseTideConfig(t *testing.T) {
+	presubmits := map[string][]Presubmit{"o/r": {{Name: "unit", Agent: "jenkins"}, {Name: "e2e", Agent: "jenkins"}}}
+	testcases := []struct {
+		name       string
+		tide       Tide
+		presubmits map[string][]Presubmit
+
+		expectedErr string
+	}{
+		{
+			name: "valid",
+			tide: Tide{
+				SubpoolTimeoutString: "1m",
+				MergeCooldownScope:   TideCooldownRepo,
+				IgnoredPRs:           []string{"o/r#1"},
+				ReportStatus:         true,
+				UseCheckRuns:         true,
+				RequiredJobs:         map[string][]string{"o/r": {"unit"}},
+				OptionalJobs:         map[string][]string{"o/r": {"e2e"}},
+			},
+			presubmits: presubmits,
+		},
+		{
+			name:        "negative query concurrency",
+			tide:        Tide{QueryConcurrency: -1},
+			expectedErr: "query_concurrency",
+		},
+		{
+			name:        "negative get ref concurrency",
+			tide:        Tide{GetRefConcurrency: -1},
+			expectedErr: "get_ref_concurrency",
+		},
+		{
+			name:        "check runs without status reports",
+			tide:        Tide{UseCheckRuns: true},
+			expectedErr: "use_check_runs",
+		},
+		{
+			name:        "negative max concurrency",
+			tide:        Tide{MaxConcurrency: -1},
+			expectedErr: "max_concurrency",
+		},
+		{
+			name:        "negative max cloned repos",
+			tide:        Tide{MaxClonedRepos: -1},
+			expectedErr: "max_cloned_repos",
+		},
+		{
+			name:        "negative max pool size",
+			tide:        Tide{MaxPoolSize: -1},
+			expectedErr: "max_pool_size",
+		},
+		{
+			name:        "negative max subpools per sync",
+			tide:        Tide{MaxSubpoolsPerSync: -1},
+			expectedErr: "max_subpools_per_sync",
+		},
+		{
+			name:        "unparsable subpool timeout",
+			tide:        Tide{SubpoolTimeoutString: "soon"},
+			expectedErr: "subpool_timeout",
+		},
+		{
+			name:        "unparsable missing job grace period",
+			tide:        Tide{MissingJobGracePeriodString: "soon"},
+			expectedErr: "missing_job_grace_period",
+		},
+		{
+			name:        "unparsable merge cooldown",
+			tide:        Tide{MergeCooldownString: "soon"},
+			expectedErr: "merge_cooldown",
+		},
+		{
+			name:        "unparsable post merge failure window",
+			tide:        Tide{PostMergeFailureWindowString: "soon"},
+			expectedErr: "post_merge_failure_window",
+		},
+		{
+			name:        "unknown merge cooldown scope",
+			tide:        Tide{MergeCooldownScope: "cluster"},
+			expectedErr: "merge_cooldown_scope",
+		},
+		{
+			name:        "bad merge cooldown branches regex",
+			tide:        Tide{MergeCooldownBranches: "release-(1"},
+			expectedErr: "merge_cooldown_branches",
+		},
+		{
+			name:        "bad frozen branches regex",
+			tide:        Tide{FrozenBranches: []string{"release-(1"}},
+			expectedErr: "frozen_branches",
+		},
+		{
+			name:        "malformed ignored PR",
+			tide:        Tide{IgnoredPRs: []string{"o/r/1"}},
+			expectedErr: "ignored PR",
+		},
+		{
+			name:        "malformed repo",
+			tide:        Tide{Repos: []string{"o/r/x"}},
+			expectedErr: "tide repo",
+		},
+		{
+			name:        "malformed excluded repo",
+			tide:        Tide{ExcludedRepos: []string{"o/"}},
+			expectedErr: "tide repo",
+		},
+		{
+			name:        "bad path requirement regex",
+			tide:        Tide{PathRequirements: []TidePathRequirement{{Presubmit: "unit", Path: "docs/(.*"}}},
+			expectedErr: "path regex",
+		},
+		{
+			name:        "protected path without a label",
+			tide:        Tide{ProtectedPaths: []TideProtectedPath{{Path: "OWNERS"}}},
+			expectedErr: "no label",
+		},
+		{
+			name:        "unknown accumulation strategy",
+			tide:        Tide{AccumulationStrategy: "worst"},
+			expectedErr: "accumulation_strategy",
+		},
+		{
+			name:        "unknown repo accumulation strategy",
+			tide:        Tide{RepoAccumulationStrategies: map[string]string{"o/r": "worst"}},
+			expectedErr: "accumulation strategy",
+		},
+		{
+			name:        "unknown merge method",
+			tide:        Tide{MergeMethods: map[string][]string{"o/r": {MergeSquash, "octopus"}}},
+			expectedErr: "merge method",
+		},
+		{
+			name:        "unknown batch merge strategy",
+			tide:        Tide{BatchMergeStrategies: map[string]string{"o/r": MergeSquash}},
+			expectedErr: "batch merge strategy",
+		},
+		{
+			name:        "required job that is not a presubmit",
+			tide:        Tide{RequiredJobs: map[string][]string{"o/r": {"lint"}}},
+			presubmits:  presubmits,
+			expectedErr: "required_jobs",
+		},
+		{
+			name:        "batch required job that is not a presubmit",
+			tide:        Tide{BatchRequiredJobs: map[string][]string{"o/r": {"lint"}}},
+			presubmits:  presubmits,
+			expectedErr: "batch_required_jobs",
+		},
+		{
+			name:        "optional job that is not a presubmit",
+			tide:        Tide{OptionalJobs: map[string][]string{"o/r": {"lint"}}},
+			presubmits:  presubmits,
+			expectedErr: "optional_jobs",
+		},
+		{
+			name: "job both required and optional",
+			tide: Tide{
+				RequiredJobs: map[string][]string{"o/r": {"unit"}},
+				OptionalJobs: map[string][]string{"o/r": {"unit"}},
+			},
+			presubmits:  presubmits,
+			expectedErr: "both required_jobs and optional_jobs",
+		},
+		{
+			name:        "status override without contexts",
+			tide:        Tide{StatusOverrides: map[string][]TideStatusOverride{"o/r": {{Label: "override"}}}},
+			expectedErr: "status override",
+		},
+		{
+			name:        "bad external context pattern",
+			tide:        Tide{ExternalContextPatternStrings: map[string][]string{"o/r": {"ci-(e2e"}}},
+			expectedErr: "external context pattern",
+		},
+		{
+			name:        "bad batch commit template",
+			tide:        Tide{BatchCommitTemplateStrings: map[string]string{"o/r": "{{range .PRs}"}},
+			expectedErr: "batch commit template",
+		},
+		{
+			name:        "negative error retriggers",
+			tide:        Tide{ErrorRetriggers: -1},
+			expectedErr: "error_retriggers",
+		},
+		{
+			name:        "negative batch error retriggers",
+			tide:        Tide{BatchErrorRetriggers: -1},
+			expectedErr: "batch_error_retriggers",
+		},
+		{
+			name:        "negative branch update limit",
+			tide:        Tide{BranchUpdateLimit: -1},
+			expectedErr: "branch_update_limit",
+		},
+		{
+			name:        "negative merge requeues",
+			tide:        Tide{MergeRequeues: -1},
+			expectedErr: "merge_requeues",
+		},
+		{
+			name:        "min batch size of one",
+			tide:        Tide{MinBatchSize: 1},
+			expectedErr: "min_batch_size",
+		},
+		{
+			name:        "negative max pending batches",
+			tide:        Tide{MaxPendingBatches: -1},
+			expectedErr: "max_pending_batches",
+		},
+		{
+			name:        "negative max batch changed files",
+			tide:        Tide{MaxBatchChangedFiles: -1},
+			expectedErr: "max_batch_changed_files",
+		},
+	}
+	for _, tc := range testcases {
+		c := &Config{Tide: tc.tide, Presubmits: tc.presubmits}
+		err := parseConfig(c)
+		if tc.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected an error about %s, got none.", tc.name, tc.expectedErr)
+		} else if !strings.Contains(err.Error(), tc.expectedErr) {
+			t.Errorf("%s: expected an error about %s, got: %v", tc.name, tc.expectedErr, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// repoCache tracks the repos in the git cache by when they were last cloned,
+// so that the least recently used ones can be removed past a limit.
+type repoCache struct {
+	sync.Mutex
+	// max is how many repos are kept. Zero means no limit.
+	max int
+	// recent are the cached repos, least recently used first.
+	recent []string
+}
+
+// SetMaxRepos bounds how many repos are kept in the cache. Past it, the least
+// recently cloned repos are removed from the cache after each clone. Zero, the
+// default, keeps every repo.
+func (c *Client) SetMaxRepos(n int) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	c.cache.max = n
+}
+
+// used records that the repo was just cloned. The caller must hold the lock
+// of the repo.
+func (c *Client) used(repo string) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	for i, r := range c.cache.recent {
+		if r == repo {
+			c.cache.recent = append(c.cache.recent[:i], c.cache.recent[i+1:]...)
+			break
+		}
+	}
+	c.cache.recent = append(c.cache.recent, repo)
+}
+
+// evict removes the least recently cloned repos from the cache until it is
+// within its limit. Each is removed under its own lock, so the caller must not
+// hold the lock of any repo. Repos that cannot be removed are only logged,
+// since the clone that was asked for did not fail.
+func (c *Client) evict() {
+	for {
+		c.cache.Lock()
+		if c.cache.max <= 0 || len(c.cache.recent) <= c.cache.max {
+			c.cache.Unlock()
+			return
+		}
+		repo := c.cache.recent[0]
+		c.cache.Unlock()
+
+		c.lockRepo(repo)
+		// The repo may have been cloned again while waiting for its lock.
+		c.cache.Lock()
+		stale := len(c.cache.recent) > c.cache.max && c.cache.recent[0] == repo
+		if stale {
+			c.cache.recent = c.cache.recent[1:]
+		}
+		c.cache.Unlock()
+		if stale {
+			c.logger.Infof("Removing %s from the cache.", repo)
+			if err := os.RemoveAll(filepath.Join(c.dir, repo) + ".git"); err != nil {
+				c.logger.WithError(err).Warningf("Error removing %s from the cache.", repo)
+			}
+		}
+		c.unlockRepo(repo)
+	}
+}
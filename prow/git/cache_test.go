@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatalf("Error making the cache dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Client{
+		logger:    logrus.WithField("client", "git"),
+		dir:       dir,
+		repoLocks: make(map[string]*sync.Mutex),
+	}
+	cached := func(repo string) bool {
+		_, err := os.Stat(filepath.Join(dir, repo) + ".git")
+		return err == nil
+	}
+	use := func(repo string) {
+		if err := os.MkdirAll(filepath.Join(dir, repo)+".git", os.ModePerm); err != nil {
+			t.Fatalf("Error caching %s: %v", repo, err)
+		}
+		c.used(repo)
+		c.evict()
+	}
+
+	use("o/a")
+	use("o/b")
+	use("o/a")
+	if !cached("o/a") || !cached("o/b") {
+		t.Fatal("Expected an unbounded cache to keep every repo.")
+	}
+	c.SetMaxRepos(2)
+	use("o/c")
+	if cached("o/b") {
+		t.Error("Expected the least recently used repo to be removed.")
+	}
+	if !cached("o/a") || !cached("o/c") {
+		t.Error("Expected the recently used repos to be kept.")
+	}
+	use("o/b")
+	if cached("o/a") || !cached("o/b") || !cached("o/c") {
+		t.Error("Expected a removed repo to be cached again once it is used.")
+	}
+}
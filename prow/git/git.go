@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,6 +52,9 @@ type Client struct {
 	// Lock with Client.lockRepo, unlock with Client.unlockRepo.
 	rlm       sync.Mutex
 	repoLocks map[string]*sync.Mutex
+
+	// cache bounds how many repos are kept in the git cache.
+	cache repoCache
 }
 
 // Clean removes the local repo cache. The Client is unusable after calling.
@@ -106,8 +110,15 @@ func (c *Client) unlockRepo(repo string) {
 // This function may take a long time if it is the first time cloning the repo.
 // In that case, it must do a full git mirror clone. For large repos, this can
 // take a while. Once that is done, it will do a git fetch instead of a clone,
-// which will usually take at most a few seconds.
+// which will usually take at most a few seconds. If the cache is bounded with
+// SetMaxRepos, the least recently cloned repos are removed from it afterwards.
 func (c *Client) Clone(repo string) (*Repo, error) {
+	r, err := c.clone(repo)
+	c.evict()
+	return r, err
+}
+
+func (c *Client) clone(repo string) (*Repo, error) {
 	c.lockRepo(repo)
 	defer c.unlockRepo(repo)
 
@@ -131,6 +142,7 @@ func (c *Client) Clone(repo string) (*Repo, error) {
 			return nil, fmt.Errorf("git fetch error: %v. output: %s", err, string(b))
 		}
 	}
+	c.used(repo)
 	t, err := ioutil.TempDir("", "git")
 	if err != nil {
 		return nil, err
@@ -220,6 +232,29 @@ func (r *Repo) Merge(commitlike string) (bool, error) {
 	return false, nil
 }
 
+// Rebase attempts to replay the commits of commitlike that are not on the
+// current HEAD onto it, leaving HEAD detached at the result. It returns true if
+// the rebase completes. Otherwise the rebase is aborted and HEAD is restored.
+// It returns an error if that fails.
+func (r *Repo) Rebase(commitlike string) (bool, error) {
+	r.logger.Infof("Rebasing %s.", commitlike)
+	head, err := r.RevParse("HEAD")
+	if err != nil {
+		return false, err
+	}
+	head = strings.TrimSpace(head)
+	co := r.gitCommand("rebase", head, commitlike)
+	if b, err := co.CombinedOutput(); err == nil {
+		return true, nil
+	} else {
+		r.logger.WithError(err).Warningf("Rebase failed with output: %s", string(b))
+	}
+	if b, err := r.gitCommand("rebase", "--abort").CombinedOutput(); err != nil {
+		return false, fmt.Errorf("error aborting rebase for commitlike %s: %v. output: %s", commitlike, err, string(b))
+	}
+	return false, r.Checkout(head)
+}
+
 // Apply tries to apply the patch in the given path into the current branch.
 // It returns an error if the patch cannot be applied.
 func (r *Repo) Apply(path string) error {
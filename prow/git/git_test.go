@@ -18,6 +18,7 @@ package git_test
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -133,3 +134,84 @@ func TestCheckoutPR(t *testing.T) {
 		t.Errorf("Didn't find file in PR after checking out: %v", err)
 	}
 }
+
+func TestRebase(t *testing.T) {
+	lg, c, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Making local git repo: %v", err)
+	}
+	defer func() {
+		if err := lg.Clean(); err != nil {
+			t.Errorf("Error cleaning LocalGit: %v", err)
+		}
+		if err := c.Clean(); err != nil {
+			t.Errorf("Error cleaning Client: %v", err)
+		}
+	}()
+	if err := lg.MakeFakeRepo("foo", "bar"); err != nil {
+		t.Fatalf("Making fake repo: %v", err)
+	}
+	branches := map[string]map[string][]byte{
+		"one":      {"one": []byte("1")},
+		"two":      {"two": []byte("2")},
+		"conflict": {"one": []byte("conflict")},
+	}
+	for branch, files := range branches {
+		if err := lg.CheckoutNewBranch("foo", "bar", branch); err != nil {
+			t.Fatalf("Checkout new branch: %v", err)
+		}
+		if err := lg.AddCommit("foo", "bar", files); err != nil {
+			t.Fatalf("Add commit: %v", err)
+		}
+		if err := lg.Checkout("foo", "bar", "master"); err != nil {
+			t.Fatalf("Checkout master: %v", err)
+		}
+	}
+	r, err := c.Clone("foo/bar")
+	if err != nil {
+		t.Fatalf("Cloning: %v", err)
+	}
+	defer func() {
+		if err := r.Clean(); err != nil {
+			t.Errorf("Cleaning repo: %v", err)
+		}
+	}()
+	if err := r.Config("user.name", "test"); err != nil {
+		t.Fatalf("Configuring name: %v", err)
+	}
+	if err := r.Config("user.email", "test@example.com"); err != nil {
+		t.Fatalf("Configuring email: %v", err)
+	}
+	if err := r.Checkout("master"); err != nil {
+		t.Fatalf("Checkout master: %v", err)
+	}
+
+	for _, branch := range []string{"one", "two"} {
+		if ok, err := r.Rebase("origin/" + branch); err != nil || !ok {
+			t.Fatalf("Expected %s to rebase cleanly, got %t and error %v.", branch, ok, err)
+		}
+	}
+	for file, content := range map[string]string{"one": "1", "two": "2"} {
+		if b, err := ioutil.ReadFile(filepath.Join(r.Dir, file)); err != nil || string(b) != content {
+			t.Errorf("Expected %s to contain %q, got %q and error %v.", file, content, string(b), err)
+		}
+	}
+	merges := exec.Command("git", "rev-list", "--merges", "HEAD")
+	merges.Dir = r.Dir
+	if b, err := merges.CombinedOutput(); err != nil {
+		t.Fatalf("git rev-list: %v, %s", err, string(b))
+	} else if len(bytes.TrimSpace(b)) != 0 {
+		t.Errorf("Expected a linear history, found merge commits: %s", string(b))
+	}
+
+	head, err := r.RevParse("HEAD")
+	if err != nil {
+		t.Fatalf("RevParse: %v", err)
+	}
+	if ok, err := r.Rebase("origin/conflict"); err != nil || ok {
+		t.Fatalf("Expected the conflicting branch not to rebase, got %t and error %v.", ok, err)
+	}
+	if after, err := r.RevParse("HEAD"); err != nil || after != head {
+		t.Errorf("Expected HEAD to be restored to %s, got %s and error %v.", head, after, err)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenSource produces the token to use when acting on an org. An empty org
+// asks for a token that is not scoped to any org, which not every source can
+// provide.
+type TokenSource interface {
+	Token(org string) (string, error)
+}
+
+// StaticTokenSource uses the same token, such as an OAuth token, for every
+// org.
+type StaticTokenSource string
+
+// Token returns the static token.
+func (s StaticTokenSource) Token(string) (string, error) {
+	return string(s), nil
+}
+
+// NotInstalledError is returned by an AppTokenSource for an org that the
+// GitHub App is not installed on.
+type NotInstalledError struct {
+	Org string
+}
+
+func (e *NotInstalledError) Error() string {
+	return fmt.Sprintf("the GitHub App is not installed on %s", e.Org)
+}
+
+// ErrNoOrg is returned by an AppTokenSource when it is asked for a token
+// without an org, such as for a search across several orgs.
+var ErrNoOrg = errors.New("installation tokens are scoped to an org, but none was given")
+
+const (
+	machineManPreview = "application/vnd.github.machine-man-preview+json"
+	// tokenRefreshMargin is how long before it expires that an installation
+	// token is replaced.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+type installationToken struct {
+	token   string
+	expires time.Time
+}
+
+// AppTokenSource produces installation tokens for a GitHub App. These are
+// scoped to a single org and have higher rate limits than OAuth tokens.
+type AppTokenSource struct {
+	appID  int
+	key    *rsa.PrivateKey
+	base   string
+	client *http.Client
+
+	// tokens is keyed by org and protected by this mutex.
+	lock   sync.Mutex
+	tokens map[string]installationToken
+}
+
+// NewAppTokenSource creates a token source for the app using its PEM encoded
+// RSA private key.
+func NewAppTokenSource(appID int, privateKey []byte, base string) (*AppTokenSource, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+	return &AppTokenSource{
+		appID:  appID,
+		key:    key,
+		base:   base,
+		client: &http.Client{},
+		tokens: make(map[string]installationToken),
+	}, nil
+}
+
+// Token returns an installation token for the org, reusing the last one until
+// it is about to expire. It returns a *NotInstalledError if the app is not
+// installed on the org. Installation tokens are always scoped to an org, so
+// it returns ErrNoOrg for an empty org.
+func (s *AppTokenSource) Token(org string) (string, error) {
+	if org == "" {
+		return "", ErrNoOrg
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.tokens[org]; ok && time.Until(t.expires) > tokenRefreshMargin {
+		return t.token, nil
+	}
+	jwt, err := s.jwt()
+	if err != nil {
+		return "", err
+	}
+	var installation struct {
+		ID int `json:"id"`
+	}
+	code, err := s.do(http.MethodGet, fmt.Sprintf("%s/orgs/%s/installation", s.base, org), jwt, &installation)
+	if err != nil {
+		return "", err
+	}
+	if code == http.StatusNotFound {
+		return "", &NotInstalledError{Org: org}
+	} else if code != http.StatusOK {
+		return "", fmt.Errorf("status code %d looking up the installation on %s", code, org)
+	}
+	var res struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	code, err = s.do(http.MethodPost, fmt.Sprintf("%s/installations/%d/access_tokens", s.base, installation.ID), jwt, &res)
+	if err != nil {
+		return "", err
+	}
+	if code != http.StatusCreated {
+		return "", fmt.Errorf("status code %d creating an installation token for %s", code, org)
+	}
+	s.tokens[org] = installationToken{token: res.Token, expires: res.ExpiresAt}
+	return res.Token, nil
+}
+
+// do makes a request authenticated as the app. The body is only decoded on
+// success.
+func (s *AppTokenSource) do(method, path, jwt string, ret interface{}) (int, error) {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", machineManPreview)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(ret)
+}
+
+// jwt signs a short-lived JSON Web Token that identifies the app.
+func (s *AppTokenSource) jwt() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// Allow for clock drift between us and GitHub.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": int64(s.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
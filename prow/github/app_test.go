@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			t.Fatalf("Bad JWT: %q", r.Header.Get("Authorization"))
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Fatalf("Bad JWT signature encoding: %v", err)
+		}
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+			t.Errorf("Bad JWT signature: %v", err)
+		}
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Fatalf("Bad JWT claims encoding: %v", err)
+		}
+		var c struct {
+			Iss int `json:"iss"`
+		}
+		if err := json.Unmarshal(claims, &c); err != nil || c.Iss != 42 {
+			t.Errorf("Bad JWT claims %s: %v", claims, err)
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/orgs/k8s/installation":
+			fmt.Fprint(w, `{"id": 7}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/orgs/other/installation":
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Path == "/installations/7/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "installation-token", "expires_at": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	s, err := NewAppTokenSource(42, pemKey, ts.URL)
+	if err != nil {
+		t.Fatalf("Error creating token source: %v", err)
+	}
+	token, err := s.Token("k8s")
+	if err != nil {
+		t.Fatalf("Error getting token: %v", err)
+	}
+	if token != "installation-token" {
+		t.Errorf("Wrong token. Got %q, expected installation-token.", token)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d.", requests)
+	}
+	if token, err := s.Token("k8s"); err != nil || token != "installation-token" {
+		t.Errorf("Expected the cached token, got %q and %v.", token, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected the token to be cached, but made %d requests.", requests)
+	}
+	if _, err := s.Token(""); err != ErrNoOrg {
+		t.Errorf("Expected ErrNoOrg without an org, got %v.", err)
+	}
+	if _, err := s.Token("other"); err == nil {
+		t.Error("Expected an error for an org without the app installed.")
+	} else if _, ok := err.(*NotInstalledError); !ok {
+		t.Errorf("Expected a *NotInstalledError, got %v.", err)
+	}
+}
+
+func TestNewAppTokenSourceBadKey(t *testing.T) {
+	if _, err := NewAppTokenSource(42, []byte("not a key"), "https://api.github.com"); err == nil {
+		t.Error("Expected an error for a key that isn't PEM encoded.")
+	}
+}
@@ -569,6 +569,20 @@ func (c *Client) CreateStatus(org, repo, ref string, s Status) error {
 	return err
 }
 
+// CreateCheckRun creates a check run on a commit.
+func (c *Client) CreateCheckRun(org, repo string, cr CheckRun) error {
+	c.log("CreateCheckRun", org, repo, cr)
+	_, err := c.request(&request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("%s/repos/%s/%s/check-runs", c.base, org, repo),
+		// This accept header enables the checks preview.
+		accept:      "application/vnd.github.antiope-preview+json",
+		requestBody: &cr,
+		exitCodes:   []int{201},
+	}, nil)
+	return err
+}
+
 func (c *Client) GetRepos(org string, isUser bool) ([]Repo, error) {
 	c.log("GetRepos", org, isUser)
 	var (
@@ -940,18 +954,101 @@ func (c *Client) ReopenPR(org, repo string, number int) error {
 	return stateCannotBeChangedOrOriginalError(err)
 }
 
+// RefNotFound is returned by GetRef when the ref does not exist.
+type RefNotFound struct {
+	org, repo, ref string
+}
+
+func (e *RefNotFound) Error() string {
+	return fmt.Sprintf("%s/%s ref %s not found", e.org, e.repo, e.ref)
+}
+
 // GetRef returns the SHA of the given ref, such as "heads/master".
+// It returns a *RefNotFound error if the ref does not exist.
 func (c *Client) GetRef(org, repo, ref string) (string, error) {
 	c.log("GetRef", org, repo, ref)
 	var res struct {
 		Object map[string]string `json:"object"`
 	}
-	_, err := c.request(&request{
+	code, err := c.request(&request{
 		method:    http.MethodGet,
 		path:      fmt.Sprintf("%s/repos/%s/%s/git/refs/%s", c.base, org, repo, ref),
+		exitCodes: []int{200, 404},
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	if code == 404 {
+		return "", &RefNotFound{org: org, repo: repo, ref: ref}
+	}
+	return res.Object["sha"], nil
+}
+
+// GetBranchProtection returns the protection of the branch, or nil if it is
+// not protected.
+//
+// See https://developer.github.com/v3/repos/branches/#get-branch-protection
+func (c *Client) GetBranchProtection(org, repo, branch string) (*BranchProtection, error) {
+	c.log("GetBranchProtection", org, repo, branch)
+	var res BranchProtection
+	code, err := c.request(&request{
+		method: http.MethodGet,
+		path:   fmt.Sprintf("%s/repos/%s/%s/branches/%s/protection", c.base, org, repo, branch),
+		// This accept header enables the branch protection preview.
+		accept:    "application/vnd.github.luke-cage-preview+json",
+		exitCodes: []int{200, 404},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if code == 404 {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+// CompareCommits compares the head commit with the base commit. Either may be
+// a branch or a SHA.
+//
+// See https://developer.github.com/v3/repos/commits/#compare-two-commits
+func (c *Client) CompareCommits(org, repo, base, head string) (*CommitComparison, error) {
+	c.log("CompareCommits", org, repo, base, head)
+	var res CommitComparison
+	_, err := c.request(&request{
+		method:    http.MethodGet,
+		path:      fmt.Sprintf("%s/repos/%s/%s/compare/%s...%s", c.base, org, repo, base, head),
 		exitCodes: []int{200},
 	}, &res)
-	return res.Object["sha"], err
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdateBranch merges the base branch of the PR into its head branch. GitHub
+// does so asynchronously. It fails if the head is no longer expectedHeadSHA.
+//
+// See https://developer.github.com/v3/pulls/#update-a-pull-request-branch
+func (c *Client) UpdateBranch(org, repo string, number int, expectedHeadSHA string) error {
+	c.log("UpdateBranch", org, repo, number, expectedHeadSHA)
+	var res struct {
+		Message string `json:"message"`
+	}
+	ec, err := c.request(&request{
+		method: http.MethodPut,
+		path:   fmt.Sprintf("%s/repos/%s/%s/pulls/%d/update-branch", c.base, org, repo, number),
+		// This accept header enables the update branch preview.
+		accept:      "application/vnd.github.lydian-preview+json",
+		requestBody: map[string]string{"expected_head_sha": expectedHeadSHA},
+		exitCodes:   []int{202, 422},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if ec == 422 {
+		return fmt.Errorf("could not update the branch of %s/%s#%d: %s", org, repo, number, res.Message)
+	}
+	return nil
 }
 
 // FindIssues uses the github search API to find issues which match a particular query.
@@ -1127,6 +1224,20 @@ func (c *Client) Merge(org, repo string, pr int, details MergeDetails) error {
 	return nil
 }
 
+// IsMerged returns true if the PR has been merged.
+func (c *Client) IsMerged(org, repo string, pr int) (bool, error) {
+	c.log("IsMerged", org, repo, pr)
+	code, err := c.request(&request{
+		method:    http.MethodGet,
+		path:      fmt.Sprintf("%s/repos/%s/%s/pulls/%d/merge", c.base, org, repo, pr),
+		exitCodes: []int{204, 404},
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return code == 204, nil
+}
+
 // ListCollaborators gets a list of all users who have access to a repo (and can become assignees
 // or requested reviewers). This includes, org members with access, outside collaborators, and org
 // owners.
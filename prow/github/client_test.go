@@ -268,6 +268,207 @@ func TestGetRef(t *testing.T) {
 	}
 }
 
+func TestGetRefNotFound(t *testing.T) {
+	timeSleep = func(time.Duration) {}
+	defer func() { timeSleep = time.Sleep }()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	_, err := c.GetRef("k8s", "kuber", "heads/gone")
+	if _, ok := err.(*RefNotFound); !ok {
+		t.Errorf("Expected a *RefNotFound error, got %v", err)
+	}
+}
+
+func TestGetBranchProtection(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/repos/k8s/kuber/branches/mastah/protection":
+			fmt.Fprint(w, `{"required_linear_history": {"enabled": true}}`)
+		case "/repos/k8s/kuber/branches/open/protection":
+			http.Error(w, `{"message": "Branch not protected"}`, http.StatusNotFound)
+		default:
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	protection, err := c.GetBranchProtection("k8s", "kuber", "mastah")
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if protection == nil || !protection.RequiredLinearHistory.Enabled {
+		t.Errorf("Expected linear history to be required, got %+v", protection)
+	}
+	protection, err = c.GetBranchProtection("k8s", "kuber", "open")
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if protection != nil {
+		t.Errorf("Expected no protection, got %+v", protection)
+	}
+}
+
+func TestCompareCommits(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/compare/abc...def" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"status": "diverged", "ahead_by": 1, "behind_by": 2}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	comparison, err := c.CompareCommits("k8s", "kuber", "abc", "def")
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if comparison.Status != "diverged" || comparison.AheadBy != 1 || comparison.BehindBy != 2 {
+		t.Errorf("Wrong comparison: %+v", comparison)
+	}
+}
+
+func TestUpdateBranch(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		}
+		switch r.URL.Path {
+		case "/repos/k8s/kuber/pulls/5/update-branch":
+			if body["expected_head_sha"] != "abc" {
+				t.Errorf("Wrong expected head SHA: %s", body["expected_head_sha"])
+			}
+			http.Error(w, `{"message": "Updating pull request branch."}`, http.StatusAccepted)
+		case "/repos/k8s/kuber/pulls/6/update-branch":
+			http.Error(w, `{"message": "expected head sha didn't match current head ref."}`, http.StatusUnprocessableEntity)
+		default:
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	if err := c.UpdateBranch("k8s", "kuber", 5, "abc"); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	}
+	if err := c.UpdateBranch("k8s", "kuber", 6, "abc"); err == nil {
+		t.Error("Expected an error for a moved head.")
+	}
+}
+
+func TestIsMerged(t *testing.T) {
+	timeSleep = func(time.Duration) {}
+	defer func() { timeSleep = time.Sleep }()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/repos/k8s/kuber/pulls/5/merge":
+			http.Error(w, "204 No Content", http.StatusNoContent)
+		case "/repos/k8s/kuber/pulls/6/merge":
+			http.Error(w, "404 Not Found", http.StatusNotFound)
+		default:
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	if merged, err := c.IsMerged("k8s", "kuber", 5); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if !merged {
+		t.Error("Expected PR 5 to be merged.")
+	}
+	if merged, err := c.IsMerged("k8s", "kuber", 6); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if merged {
+		t.Error("Expected PR 6 not to be merged.")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	testcases := []struct {
+		code    int
+		message string
+
+		checkErr func(error) bool
+	}{
+		{
+			code:     http.StatusOK,
+			checkErr: func(err error) bool { return err == nil },
+		},
+		{
+			code:    http.StatusMethodNotAllowed,
+			message: "Pull Request is not mergeable",
+			checkErr: func(err error) bool {
+				_, ok := err.(UnmergablePRError)
+				return ok
+			},
+		},
+		{
+			code:    http.StatusMethodNotAllowed,
+			message: "Squash merges are not allowed on this repository.",
+			checkErr: func(err error) bool {
+				_, ok := err.(UnmergablePRError)
+				return ok
+			},
+		},
+		{
+			code:    http.StatusUnprocessableEntity,
+			message: "Invalid merge_method",
+			checkErr: func(err error) bool {
+				switch err.(type) {
+				case nil, UnmergablePRError, ModifiedHeadError:
+					return false
+				}
+				return true
+			},
+		},
+		{
+			code:    http.StatusConflict,
+			message: "Head branch was modified. Review and try the merge again.",
+			checkErr: func(err error) bool {
+				_, ok := err.(ModifiedHeadError)
+				return ok
+			},
+		},
+	}
+	for _, tc := range testcases {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut {
+				t.Errorf("Bad method: %s", r.Method)
+			}
+			if r.URL.Path != "/repos/k8s/kuber/pulls/5/merge" {
+				t.Errorf("Bad request path: %s", r.URL.Path)
+			}
+			var details MergeDetails
+			if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+				t.Errorf("Could not unmarshal request: %v", err)
+			} else if details.MergeMethod != "squash" {
+				t.Errorf("Wrong merge method: %s", details.MergeMethod)
+			}
+			w.WriteHeader(tc.code)
+			fmt.Fprintf(w, `{"message": %q}`, tc.message)
+		}))
+		c := getClient(ts.URL)
+		if err := c.Merge("k8s", "kuber", 5, MergeDetails{MergeMethod: "squash"}); !tc.checkErr(err) {
+			t.Errorf("Unexpected error for status code %d and message %q: %v", tc.code, tc.message, err)
+		}
+		ts.Close()
+	}
+}
+
 func TestCreateStatus(t *testing.T) {
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -297,6 +498,39 @@ func TestCreateStatus(t *testing.T) {
 	}
 }
 
+func TestCreateCheckRun(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/check-runs" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var cr CheckRun
+		if err := json.Unmarshal(b, &cr); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		} else if cr.Name != "c" || cr.HeadSHA != "abcdef" {
+			t.Errorf("Wrong check run: %+v", cr)
+		} else if cr.Output == nil || cr.Output.Title != "t" {
+			t.Errorf("Wrong output: %+v", cr.Output)
+		}
+		http.Error(w, "201 Created", http.StatusCreated)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	if err := c.CreateCheckRun("k8s", "kuber", CheckRun{
+		Name:    "c",
+		HeadSHA: "abcdef",
+		Output:  &CheckRunOutput{Title: "t"},
+	}); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	}
+}
+
 func TestListIssueComments(t *testing.T) {
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -63,6 +63,28 @@ type Status struct {
 	Context     string `json:"context,omitempty"`
 }
 
+// CheckRun is used to create a check run on a commit.
+// See https://developer.github.com/v3/checks/runs/#create-a-check-run
+type CheckRun struct {
+	Name    string `json:"name"`
+	HeadSHA string `json:"head_sha"`
+	// Status is one of "queued", "in_progress" or "completed".
+	Status string `json:"status,omitempty"`
+	// Conclusion is required if Status is "completed". It is one of
+	// "success", "failure", "neutral", "cancelled", "timed_out" or
+	// "action_required".
+	Conclusion string          `json:"conclusion,omitempty"`
+	DetailsURL string          `json:"details_url,omitempty"`
+	Output     *CheckRunOutput `json:"output,omitempty"`
+}
+
+// CheckRunOutput is the rich description shown for a check run.
+type CheckRunOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Text    string `json:"text,omitempty"`
+}
+
 // CombinedStatus is the latest statuses for a ref.
 type CombinedStatus struct {
 	Statuses []Status `json:"statuses"`
@@ -413,6 +435,26 @@ type DraftReviewComment struct {
 	Body     string `json:"body"`
 }
 
+// BranchProtection is the protection of a branch. Only the settings that
+// are in use are included.
+type BranchProtection struct {
+	RequiredLinearHistory BranchProtectionSetting `json:"required_linear_history"`
+}
+
+// BranchProtectionSetting is a branch protection setting that is simply
+// enabled or not.
+type BranchProtectionSetting struct {
+	Enabled bool `json:"enabled"`
+}
+
+// CommitComparison compares two commits. BehindBy counts the commits of the
+// base that the head lacks.
+type CommitComparison struct {
+	Status   string `json:"status"`
+	AheadBy  int    `json:"ahead_by"`
+	BehindBy int    `json:"behind_by"`
+}
+
 // Content is some base64 encoded github file content
 type Content struct {
 	Content string `json:"content"`
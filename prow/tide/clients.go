@@ -0,0 +1,97 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"strings"
+	"sync"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// tokenClients builds a GitHub client for each org from the token that the
+// source hands out for it. A GitHub App gets a different token per org.
+type tokenClients struct {
+	tokens   github.TokenSource
+	endpoint string
+
+	// clients is keyed by org and protected by this mutex.
+	lock    sync.Mutex
+	clients map[string]tokenClient
+}
+
+type tokenClient struct {
+	token  string
+	client githubClient
+}
+
+// clientFor returns the client for the org, replacing it once its token has
+// been rotated.
+func (tc *tokenClients) clientFor(org string) (githubClient, error) {
+	token, err := tc.tokens.Token(org)
+	if err != nil {
+		return nil, err
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if cached, ok := tc.clients[org]; ok && cached.token == token {
+		return cached.client, nil
+	}
+	if tc.clients == nil {
+		tc.clients = make(map[string]tokenClient)
+	}
+	client := github.NewClient(token, tc.endpoint)
+	tc.clients[org] = tokenClient{token: token, client: client}
+	return client, nil
+}
+
+// github returns the client to act on the org with. An empty org asks for a
+// client that is not scoped to any org.
+func (c *Controller) github(org string) (githubClient, error) {
+	if c.clientFor == nil {
+		return c.ghc, nil
+	}
+	return c.clientFor(org)
+}
+
+// queryOrg returns the one org that the search query is limited to with org:
+// or repo: qualifiers, or the empty string if there isn't exactly one.
+func queryOrg(q string) string {
+	var org string
+	for _, term := range strings.Fields(q) {
+		var o string
+		if strings.HasPrefix(term, "org:") {
+			o = strings.TrimPrefix(term, "org:")
+		} else if strings.HasPrefix(term, "repo:") {
+			o = strings.SplitN(strings.TrimPrefix(term, "repo:"), "/", 2)[0]
+		} else {
+			continue
+		}
+		if org != "" && o != org {
+			return ""
+		}
+		org = o
+	}
+	return org
+}
+
+// isNotInstalled returns true if the error is because the GitHub App is not
+// installed on an org.
+func isNotInstalled(err error) bool {
+	_, ok := err.(*github.NotInstalledError)
+	return ok
+}
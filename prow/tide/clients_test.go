@@ -0,0 +1,153 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shurcooL/githubql"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/github"
+)
+
+func TestQueryOrg(t *testing.T) {
+	testcases := []struct {
+		query    string
+		expected string
+	}{
+		{query: "is:pr state:open org:kubernetes label:lgtm", expected: "kubernetes"},
+		{query: "is:pr repo:kubernetes/test-infra repo:kubernetes/kubernetes", expected: "kubernetes"},
+		{query: "is:pr org:kubernetes repo:kubernetes/test-infra", expected: "kubernetes"},
+		{query: "is:pr org:kubernetes org:kubernetes-incubator", expected: ""},
+		{query: "is:pr label:lgtm", expected: ""},
+	}
+	for _, tc := range testcases {
+		if actual := queryOrg(tc.query); actual != tc.expected {
+			t.Errorf("For query %q, expected org %q, got %q.", tc.query, tc.expected, actual)
+		}
+	}
+}
+
+type rotatingTokens struct {
+	tokens []string
+}
+
+func (r *rotatingTokens) Token(org string) (string, error) {
+	token := r.tokens[0]
+	if len(r.tokens) > 1 {
+		r.tokens = r.tokens[1:]
+	}
+	return token, nil
+}
+
+func TestTokenClients(t *testing.T) {
+	tc := &tokenClients{tokens: &rotatingTokens{tokens: []string{"a", "a", "b"}}}
+	first, err := tc.clientFor("o")
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	second, err := tc.clientFor("o")
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	if first != second {
+		t.Error("Expected the client to be reused while its token is unchanged.")
+	}
+	third, err := tc.clientFor("o")
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	if third == second {
+		t.Error("Expected a new client once the token was rotated.")
+	}
+}
+
+func TestSkipNotInstalledOrgs(t *testing.T) {
+	installed := &fgc{
+		refs:     map[string]string{"o/r heads/master": "123"},
+		queryPRs: map[string][]PullRequest{"org:o": {{}}},
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		ca:     ca,
+		clientFor: func(org string) (githubClient, error) {
+			if org == "o" {
+				return installed, nil
+			}
+			return nil, &github.NotInstalledError{Org: org}
+		},
+	}
+
+	pool, costs, err := c.searchAll(context.Background(), []string{"org:o", "org:other"}, 1, 0)
+	if err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	if len(pool) != 1 {
+		t.Errorf("Expected only the installed org's PR, got %d PRs.", len(pool))
+	}
+	if len(costs) != 2 || costs[1].Cost != 0 {
+		t.Errorf("Expected the skipped query to cost nothing, got %+v.", costs)
+	}
+
+	newPR := func(org string) PullRequest {
+		var pr PullRequest
+		pr.BaseRef.Name = "master"
+		pr.BaseRef.Prefix = "refs/heads/"
+		pr.Repository.Name = "r"
+		pr.Repository.Owner.Login = githubql.String(org)
+		return pr
+	}
+	sps, err := c.dividePool([]PullRequest{newPR("o"), newPR("other")}, nil)
+	if err != nil {
+		t.Fatalf("Error dividing pool: %v", err)
+	}
+	if len(sps) != 1 || sps[0].org != "o" || sps[0].sha != "123" {
+		t.Errorf("Expected only the installed org's subpool, got %+v.", sps)
+	}
+}
+
+func TestSkipMultiOrgQueries(t *testing.T) {
+	installed := &fgc{queryPRs: map[string][]PullRequest{"org:o": {{}}}}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		ca:     ca,
+		clientFor: func(org string) (githubClient, error) {
+			if org == "" {
+				return nil, github.ErrNoOrg
+			}
+			return installed, nil
+		},
+	}
+
+	pool, costs, err := c.searchAll(context.Background(), []string{"org:o", "org:o org:other"}, 1, 0)
+	if err != nil {
+		t.Fatalf("Expected the multi-org query not to fail the search, got: %v", err)
+	}
+	if len(pool) != 1 {
+		t.Errorf("Expected only the single-org query's PR, got %d PRs.", len(pool))
+	}
+	if len(costs) != 2 || costs[1].Cost != 0 {
+		t.Errorf("Expected the skipped query to cost nothing, got %+v.", costs)
+	}
+}
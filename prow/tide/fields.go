@@ -0,0 +1,119 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"reflect"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// prPath is where the PRs are in searchQuery.
+const prPath = "Search.Nodes.PullRequest"
+
+// unusedFields returns the fields of PullRequest, as dotted paths, that only
+// some features use and that none of the configured ones do. Every field adds
+// to the cost of a search, so these are left out of the query.
+func unusedFields(t config.Tide) []string {
+	var unused []string
+	if len(t.BatchCommitTemplateStrings) == 0 {
+		unused = append(unused, "Title")
+	}
+	if t.MergeScoring.AgeWeight == 0 {
+		unused = append(unused, "CreatedAt")
+	}
+	if t.MergeScoring.ApprovalWeight == 0 {
+		unused = append(unused, "Reviews")
+	}
+	if len(t.RequireResolvedThreads) == 0 {
+		unused = append(unused, "ReviewThreads")
+	}
+	if !t.BlockOnFailingBase && t.PostMergeFailureWindow <= 0 {
+		unused = append(unused, "BaseRef.Target")
+	}
+	return unused
+}
+
+// searchQueryType returns the type of searchQuery without the PullRequest
+// fields that are not used. It is searchQuery itself if they are all used.
+func searchQueryType(unused []string) reflect.Type {
+	skip := make(map[string]bool)
+	for _, field := range unused {
+		skip[prPath+"."+field] = true
+	}
+	return pruneType(reflect.TypeOf(searchQuery{}), "", skip)
+}
+
+// pruneType returns the type without the struct fields at the skipped paths,
+// or the type itself if none of them are in it. Slices are pruned by element,
+// without adding to the path.
+func pruneType(t reflect.Type, path string, skip map[string]bool) reflect.Type {
+	switch t.Kind() {
+	case reflect.Slice:
+		if elem := pruneType(t.Elem(), path, skip); elem != t.Elem() {
+			return reflect.SliceOf(elem)
+		}
+		return t
+	case reflect.Struct:
+	default:
+		return t
+	}
+	var fields []reflect.StructField
+	pruned := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fieldPath := f.Name
+		if path != "" {
+			fieldPath = path + "." + f.Name
+		}
+		if skip[fieldPath] {
+			pruned = true
+			continue
+		}
+		if ft := pruneType(f.Type, fieldPath, skip); ft != f.Type {
+			f.Type = ft
+			pruned = true
+		}
+		fields = append(fields, f)
+	}
+	if !pruned {
+		return t
+	}
+	return reflect.StructOf(fields)
+}
+
+// copyFields copies src into dst, field by field for structs whose types
+// differ only by pruned fields. Fields of dst that src lacks are left alone.
+func copyFields(dst, src reflect.Value) {
+	if dst.Type() == src.Type() {
+		dst.Set(src)
+		return
+	}
+	switch dst.Kind() {
+	case reflect.Slice:
+		dst.Set(reflect.MakeSlice(dst.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			copyFields(dst.Index(i), src.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			if field := src.FieldByName(dst.Type().Field(i).Name); field.IsValid() {
+				copyFields(dst.Field(i), field)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubql"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// recordingTransport records the GraphQL query of each request and responds
+// with the response.
+type recordingTransport struct {
+	queries  []string
+	response string
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body struct{ Query string }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	rt.queries = append(rt.queries, body.Query)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(rt.response)),
+		Request:    r,
+	}, nil
+}
+
+func TestSearchQueryFields(t *testing.T) {
+	testcases := []struct {
+		name   string
+		config config.Tide
+
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "no optional features",
+			present: []string{"number", "baseRef{name,prefix}", "labels(first: 100)", "mergeable"},
+			absent:  []string{"title", "createdAt", "reviews", "reviewThreads", "target{... on Commit"},
+		},
+		{
+			name: "merge scoring by age and approvals",
+			config: config.Tide{MergeScoring: config.TideMergeScoring{
+				AgeWeight:      1,
+				ApprovalWeight: 1,
+			}},
+			present: []string{"createdAt", "reviews(states: APPROVED)"},
+			absent:  []string{"title", "target{... on Commit"},
+		},
+		{
+			name: "batch commit templates and base status",
+			config: config.Tide{
+				BatchCommitTemplateStrings: map[string]string{"o/r": "{{.PRs}}"},
+				PostMergeFailureWindow:     time.Hour,
+			},
+			present: []string{"title", "target{... on Commit{oid,status{state}}}"},
+			absent:  []string{"createdAt", "reviews"},
+		},
+		{
+			name:    "resolved review threads",
+			config:  config.Tide{RequireResolvedThreads: map[string]bool{"o/r": true}},
+			present: []string{"reviewThreads(first: 100){nodes{isResolved}}"},
+			absent:  []string{"title", "createdAt", "reviews(states: APPROVED)"},
+		},
+	}
+	for _, tc := range testcases {
+		rt := &recordingTransport{response: `{"data": {"search": {"nodes": [{"number": 5, "baseRef": {"name": "master"}}]}}}`}
+		client := githubql.NewClient(&http.Client{Transport: rt})
+		selected := reflect.New(searchQueryType(unusedFields(tc.config)))
+		vars := map[string]interface{}{
+			"query":        githubql.String("is:pr"),
+			"searchCursor": (*githubql.String)(nil),
+		}
+		if err := client.Query(context.Background(), selected.Interface(), vars); err != nil {
+			t.Fatalf("For case %q, error querying: %v", tc.name, err)
+		}
+		query := rt.queries[0]
+		for _, field := range tc.present {
+			if !strings.Contains(query, field) {
+				t.Errorf("For case %q, expected the query to select %s, got %s.", tc.name, field, query)
+			}
+		}
+		for _, field := range tc.absent {
+			if strings.Contains(query, field) {
+				t.Errorf("For case %q, expected the query not to select %s, got %s.", tc.name, field, query)
+			}
+		}
+
+		var sq searchQuery
+		copyFields(reflect.ValueOf(&sq).Elem(), selected.Elem())
+		if len(sq.Search.Nodes) != 1 {
+			t.Fatalf("For case %q, expected one PR, got %d.", tc.name, len(sq.Search.Nodes))
+		}
+		if pr := sq.Search.Nodes[0].PullRequest; pr.Number != 5 || pr.BaseRef.Name != "master" {
+			t.Errorf("For case %q, expected the selected fields to be copied, got %+v.", tc.name, pr)
+		}
+	}
+
+	// Without unused fields, the query is searchQuery itself.
+	if actual := searchQueryType(nil); actual != reflect.TypeOf(searchQuery{}) {
+		t.Errorf("Expected searchQuery without unused fields, got %v.", actual)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// PRFilter decides whether a PR that matched the queries belongs in the pool.
+type PRFilter interface {
+	// Include returns true if the PR is kept. Otherwise it also returns the
+	// reason it was left out.
+	Include(PullRequest) (bool, string)
+}
+
+// PRFilterFunc lets an ordinary function be used as a PRFilter.
+type PRFilterFunc func(PullRequest) (bool, string)
+
+// Include calls f(pr).
+func (f PRFilterFunc) Include(pr PullRequest) (bool, string) {
+	return f(pr)
+}
+
+// AddFilters appends filters to the chain that each sync applies to the pool,
+// after the built-in filters.
+func (c *Controller) AddFilters(filters ...PRFilter) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.filters = append(c.filters, filters...)
+}
+
+// prFilters returns the chain of filters for a sync. The built-in filters are
+// made from the current config so changes take effect without a restart. The
+// caller must hold m.
+func (c *Controller) prFilters() []PRFilter {
+	tideConfig := c.ca.Config().Tide
+	filters := []PRFilter{ignoredFilter(tideConfig), repoFilter(tideConfig), labelFilter(tideConfig)}
+	return append(filters, c.filters...)
+}
+
+// filterPool applies the filter chain to the pool, logging why PRs were left
+// out and recording the ones with conflicting labels. The caller must hold m.
+func (c *Controller) filterPool(pool []PullRequest) []PullRequest {
+	kept, excluded := applyFilters(pool, c.prFilters())
+	for key, reason := range excluded {
+		c.logger.Infof("Leaving %s out of the pool: %s.", key, reason)
+	}
+	c.labelConflicts = labelConflicts(pool, c.ca.Config().Tide)
+	return kept
+}
+
+// applyFilters returns the PRs that every filter includes, along with the
+// reason each of the others was left out, keyed by prKey. A PR is only tested
+// against filters until one leaves it out.
+func applyFilters(pool []PullRequest, filters []PRFilter) ([]PullRequest, map[string]string) {
+	var kept []PullRequest
+	excluded := make(map[string]string)
+	for _, pr := range pool {
+		include := true
+		for _, filter := range filters {
+			var reason string
+			if include, reason = filter.Include(pr); !include {
+				excluded[prKey(pr)] = reason
+				break
+			}
+		}
+		if include {
+			kept = append(kept, pr)
+		}
+	}
+	return kept, excluded
+}
+
+// ignoredFilter leaves out the PRs that are on the configured ignore list.
+func ignoredFilter(tideConfig config.Tide) PRFilter {
+	ignored := make(map[string]bool)
+	for _, pr := range tideConfig.IgnoredPRs {
+		ignored[pr] = true
+	}
+	return PRFilterFunc(func(pr PullRequest) (bool, string) {
+		if ignored[prKey(pr)] {
+			return false, "ignored as configured"
+		}
+		return true, ""
+	})
+}
+
+// repoFilter leaves out PRs from repos that Tide is not configured to manage.
+func repoFilter(tideConfig config.Tide) PRFilter {
+	return PRFilterFunc(func(pr PullRequest) (bool, string) {
+		if !tideConfig.ManagesRepo(string(pr.Repository.Owner.Login), string(pr.Repository.Name)) {
+			return false, "Tide does not manage its repo"
+		}
+		return true, ""
+	})
+}
+
+// labelFilter leaves out PRs that carry a blocking label or lack a required
+// one. Blocking labels are checked first, so a PR with both is left out.
+func labelFilter(tideConfig config.Tide) PRFilter {
+	return PRFilterFunc(func(pr PullRequest) (bool, string) {
+		for _, blocking := range tideConfig.BlockingLabels {
+			if !hasLabel(pr, blocking) {
+				continue
+			}
+			for _, required := range tideConfig.RequiredLabels {
+				if hasLabel(pr, required) {
+					return false, fmt.Sprintf("it carries the blocking label %q, which wins over the required label %q", blocking, required)
+				}
+			}
+			return false, fmt.Sprintf("it carries the blocking label %q", blocking)
+		}
+		for _, required := range tideConfig.RequiredLabels {
+			if !hasLabel(pr, required) {
+				return false, fmt.Sprintf("it lacks the required label %q", required)
+			}
+		}
+		return true, ""
+	})
+}
+
+// labelConflicts returns the sorted keys of the PRs that carry both a required
+// and a blocking label.
+func labelConflicts(pool []PullRequest, tideConfig config.Tide) []string {
+	var conflicts []string
+	for _, pr := range pool {
+		if len(withAnyLabel([]PullRequest{pr}, tideConfig.BlockingLabels)) > 0 &&
+			len(withAnyLabel([]PullRequest{pr}, tideConfig.RequiredLabels)) > 0 {
+			conflicts = append(conflicts, prKey(pr))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
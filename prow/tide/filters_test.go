@@ -0,0 +1,225 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/githubql"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestFilterIgnored(t *testing.T) {
+	var pool []PullRequest
+	for _, n := range []int{1, 2, 3} {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Repository.NameWithOwner = "o/r"
+		pool = append(pool, pr)
+	}
+	ca := &config.Agent{}
+	c := newTestController(ca, nil, nil)
+
+	ca.Set(&config.Config{})
+	testPullsMatchList(t, "no ignore list", c.filterPool(pool), []int{1, 2, 3})
+
+	ca.Set(&config.Config{Tide: config.Tide{IgnoredPRs: []string{"o/r#2", "o/other#3"}}})
+	filtered := c.filterPool(pool)
+	testPullsMatchList(t, "ignore list", filtered, []int{1, 3})
+	successes, pendings, nones := accumulate(requireAll(nil, filtered), nil, "", filtered, nil, config.TideAccumulateBest)
+	testPullsMatchList(t, "accumulated", append(append(successes, pendings...), nones...), []int{1, 3})
+
+	// Reconfiguring takes effect on the next call.
+	ca.Set(&config.Config{Tide: config.Tide{IgnoredPRs: []string{"o/r#1"}}})
+	testPullsMatchList(t, "reconfigured ignore list", c.filterPool(pool), []int{2, 3})
+}
+
+func TestFilterRepos(t *testing.T) {
+	var pool []PullRequest
+	for i, repo := range []string{"o/onboarded", "o/other", "o/excluded", "p/r"} {
+		parts := strings.Split(repo, "/")
+		var pr PullRequest
+		pr.Number = githubql.Int(i + 1)
+		pr.Repository.Owner.Login = githubql.String(parts[0])
+		pr.Repository.Name = githubql.String(parts[1])
+		pr.Repository.NameWithOwner = githubql.String(repo)
+		pool = append(pool, pr)
+	}
+	testcases := []struct {
+		name     string
+		repos    []string
+		excluded []string
+
+		expected []int
+	}{
+		{
+			name:     "no lists, manage everything",
+			expected: []int{1, 2, 3, 4},
+		},
+		{
+			name:     "allowlist of a repo",
+			repos:    []string{"o/onboarded"},
+			expected: []int{1},
+		},
+		{
+			name:     "allowlist of an org",
+			repos:    []string{"o"},
+			expected: []int{1, 2, 3},
+		},
+		{
+			name:     "denylist only",
+			excluded: []string{"o/excluded"},
+			expected: []int{1, 2, 4},
+		},
+		{
+			name:     "denylist takes precedence over allowlisted org",
+			repos:    []string{"o"},
+			excluded: []string{"o/excluded"},
+			expected: []int{1, 2},
+		},
+		{
+			name:     "denylist takes precedence over allowlisted repo",
+			repos:    []string{"o/onboarded", "p/r"},
+			excluded: []string{"o/onboarded"},
+			expected: []int{4},
+		},
+		{
+			name:     "denylisted org",
+			repos:    []string{"o/onboarded", "p/r"},
+			excluded: []string{"o"},
+			expected: []int{4},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{Repos: tc.repos, ExcludedRepos: tc.excluded}})
+		c := newTestController(ca, nil, nil)
+		testPullsMatchList(t, tc.name, c.filterPool(pool), tc.expected)
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	var pool []PullRequest
+	for _, n := range []int{1, 2, 3, 4} {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Author.Login = githubql.String(fmt.Sprintf("user%d", n))
+		pr.Repository.NameWithOwner = "o/r"
+		pool = append(pool, pr)
+	}
+	byAuthor := PRFilterFunc(func(pr PullRequest) (bool, string) {
+		if pr.Author.Login == "user1" {
+			return false, "author is blocked"
+		}
+		return true, ""
+	})
+	odd := PRFilterFunc(func(pr PullRequest) (bool, string) {
+		if pr.Number%2 == 1 {
+			return false, "number is odd"
+		}
+		return true, ""
+	})
+	ignored := ignoredFilter(config.Tide{IgnoredPRs: []string{"o/r#4"}})
+
+	kept, excluded := applyFilters(pool, []PRFilter{byAuthor, odd, ignored})
+	testPullsMatchList(t, "composed filters", kept, []int{2})
+	expected := map[string]string{
+		// The first filter to leave a PR out gives the reason.
+		"o/r#1": "author is blocked",
+		"o/r#3": "number is odd",
+		"o/r#4": "ignored as configured",
+	}
+	if !reflect.DeepEqual(excluded, expected) {
+		t.Errorf("Expected exclusion reasons %v, got %v.", expected, excluded)
+	}
+
+	kept, excluded = applyFilters(pool, nil)
+	testPullsMatchList(t, "no filters", kept, []int{1, 2, 3, 4})
+	if len(excluded) != 0 {
+		t.Errorf("Expected nothing excluded without filters, got %v.", excluded)
+	}
+}
+
+func TestAddFilters(t *testing.T) {
+	var pool []PullRequest
+	for _, n := range []int{1, 2, 3} {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Repository.NameWithOwner = "o/r"
+		pool = append(pool, pr)
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{IgnoredPRs: []string{"o/r#1"}}})
+	c := newTestController(ca, nil, nil)
+	c.AddFilters(PRFilterFunc(func(pr PullRequest) (bool, string) {
+		return pr.Number != 3, "custom filter"
+	}))
+	testPullsMatchList(t, "built-in and custom filters", c.filterPool(pool), []int{2})
+}
+
+func TestFilterLabels(t *testing.T) {
+	var pool []PullRequest
+	for i, labels := range [][]string{
+		{"lgtm"},
+		{"lgtm", "do-not-merge/hold"},
+		{"do-not-merge/hold"},
+		{},
+	} {
+		var pr PullRequest
+		pr.Number = githubql.Int(i + 1)
+		pr.Repository.NameWithOwner = "o/r"
+		for _, l := range labels {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(l)})
+		}
+		pool = append(pool, pr)
+	}
+	tideConfig := config.Tide{RequiredLabels: []string{"lgtm"}, BlockingLabels: []string{"do-not-merge/hold"}}
+
+	kept, excluded := applyFilters(pool, []PRFilter{labelFilter(tideConfig)})
+	testPullsMatchList(t, "labels", kept, []int{1})
+	expected := map[string]string{
+		"o/r#2": `it carries the blocking label "do-not-merge/hold", which wins over the required label "lgtm"`,
+		"o/r#3": `it carries the blocking label "do-not-merge/hold"`,
+		"o/r#4": `it lacks the required label "lgtm"`,
+	}
+	if !reflect.DeepEqual(excluded, expected) {
+		t.Errorf("Expected exclusion reasons %v, got %v.", expected, excluded)
+	}
+
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: tideConfig})
+	c := newTestController(ca, nil, nil)
+	testPullsMatchList(t, "filtered pool", c.filterPool(pool), []int{1})
+	if expected := []string{"o/r#2"}; !reflect.DeepEqual(c.labelConflicts, expected) {
+		t.Errorf("Expected the label conflicts %v, got %v.", expected, c.labelConflicts)
+	}
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var status Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("JSON decoding error: %v", err)
+	}
+	if !reflect.DeepEqual(status.LabelConflicts, c.labelConflicts) {
+		t.Errorf("Expected the status to report the label conflicts %v, got %v.", c.labelConflicts, status.LabelConflicts)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+var (
+	timeInPoolHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tide_pr_time_in_pool_seconds",
+		Help: "Time merged PRs spent in the tide pool.",
+		// One minute to about two weeks.
+		Buckets: prometheus.ExponentialBuckets(60, 3, 10),
+	}, []string{"org", "repo"})
+	githubRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tide_github_requests_total",
+		Help: "GitHub API calls made by tide, by method, org, and result.",
+	}, []string{"method", "org", "result"})
+	oldestMergeableGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tide_pool_oldest_mergeable_pr_seconds",
+		Help: "How long the PR that has been mergeable the longest without being merged has been so, by pool. It is 0 for pools without mergeable PRs.",
+	}, []string{"org", "repo", "branch"})
+	emptyPoolSyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tide_empty_pool_syncs_total",
+		Help: "Syncs that found no PRs in the pool.",
+	})
+	queryPRsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tide_query_prs",
+		Help: "PRs returned by each configured query in the last sync, by the index of the query in the config and the query.",
+	}, []string{"index", "query"})
+)
+
+func init() {
+	prometheus.MustRegister(timeInPoolHistogram)
+	prometheus.MustRegister(githubRequests)
+	prometheus.MustRegister(oldestMergeableGauge)
+	prometheus.MustRegister(emptyPoolSyncs)
+	prometheus.MustRegister(queryPRsGauge)
+}
+
+// recordQueryPRs sets the gauge of PRs returned by each of the configured
+// queries from their costs, and drops the queries no longer configured.
+func recordQueryPRs(queries []string, costs []QueryCost) {
+	prs := make(map[string]int)
+	for _, cost := range costs {
+		prs[cost.Query] = cost.PRs
+	}
+	queryPRsGauge.Reset()
+	for i, q := range queries {
+		queryPRsGauge.WithLabelValues(strconv.Itoa(i), q).Set(float64(prs[q]))
+	}
+}
+
+var (
+	poolPRsDesc = prometheus.NewDesc(
+		"tide_pool_prs",
+		"PRs in each pool as of the last sync, by state.",
+		[]string{"org", "repo", "branch", "state"}, nil,
+	)
+	poolActionDesc = prometheus.NewDesc(
+		"tide_pool_action",
+		"The action taken on each pool in the last sync. It is always 1.",
+		[]string{"org", "repo", "branch", "action"}, nil,
+	)
+)
+
+// poolCollector exposes a snapshot of the pools as gauges. Unlike the metrics
+// above, it is not registered globally, since it belongs to a controller.
+type poolCollector struct {
+	pools []Pool
+}
+
+func (pc poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolPRsDesc
+	ch <- poolActionDesc
+}
+
+func (pc poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pool := range pc.pools {
+		for state, prs := range map[string][]PullRequest{
+			"success": pool.SuccessPRs,
+			"pending": pool.PendingPRs,
+			"missing": pool.MissingPRs,
+		} {
+			ch <- prometheus.MustNewConstMetric(poolPRsDesc, prometheus.GaugeValue, float64(len(prs)), pool.Org, pool.Repo, pool.Branch, state)
+		}
+		ch <- prometheus.MustNewConstMetric(poolActionDesc, prometheus.GaugeValue, 1, pool.Org, pool.Repo, pool.Branch, string(pool.Action))
+	}
+}
+
+// ServePoolMetrics serves the pools of the last sync as gauges in the
+// Prometheus exposition format, for setups that scrape pool state rather than
+// read the JSON status.
+func (c *Controller) ServePoolMetrics(w http.ResponseWriter, r *http.Request) {
+	c.m.Lock()
+	pools := make([]Pool, len(c.pools))
+	copy(pools, c.pools)
+	c.m.Unlock()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(poolCollector{pools: pools})
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// poolTimes remembers when each PR was first seen in the pool.
+type poolTimes struct {
+	sync.Mutex
+	// firstSeen is keyed by prKey.
+	firstSeen map[string]time.Time
+}
+
+// recordPoolTimes notes when new PRs entered the pool and forgets the ones
+// that left it.
+func (c *Controller) recordPoolTimes(pool []PullRequest) {
+	c.poolTimes.Lock()
+	defer c.poolTimes.Unlock()
+	now := c.now()
+	seen := make(map[string]time.Time, len(pool))
+	for _, pr := range pool {
+		key := prKey(pr)
+		if t, ok := c.poolTimes.firstSeen[key]; ok {
+			seen[key] = t
+		} else {
+			seen[key] = now
+		}
+	}
+	c.poolTimes.firstSeen = seen
+}
+
+// timeInPool returns how long the PR has been in the pool, if it is in it.
+func (c *Controller) timeInPool(pr PullRequest) (time.Duration, bool) {
+	c.poolTimes.Lock()
+	defer c.poolTimes.Unlock()
+	t, ok := c.poolTimes.firstSeen[prKey(pr)]
+	if !ok {
+		return 0, false
+	}
+	return c.now().Sub(t), true
+}
+
+// poolTimesFor returns the time in pool of each PR, keyed by number.
+func (c *Controller) poolTimesFor(prs []PullRequest) map[int]time.Duration {
+	times := make(map[int]time.Duration, len(prs))
+	for _, pr := range prs {
+		if d, ok := c.timeInPool(pr); ok {
+			times[int(pr.Number)] = d
+		}
+	}
+	return times
+}
+
+// mergeableTimes remembers when each PR became mergeable, keyed by subpool
+// and then by PR number. A PR that stops being mergeable is forgotten, so the
+// times only cover continuous stretches.
+type mergeableTimes struct {
+	sync.Mutex
+	firstSeen map[branchKey]map[int]time.Time
+}
+
+// branchKey identifies the branch of a subpool.
+type branchKey struct {
+	org, repo, branch string
+}
+
+// recordMergeable notes when the subpool's mergeable PRs became so and sets
+// oldestMergeableGauge to the age of the oldest one, which operators alert on
+// to catch PRs starved by others that keep being picked first.
+func (c *Controller) recordMergeable(sp subpool, mergeable []PullRequest) {
+	c.mergeableTimes.Lock()
+	defer c.mergeableTimes.Unlock()
+	if c.mergeableTimes.firstSeen == nil {
+		c.mergeableTimes.firstSeen = make(map[branchKey]map[int]time.Time)
+	}
+	key := branchKey{sp.org, sp.repo, sp.branch}
+	now := c.now()
+	previous := c.mergeableTimes.firstSeen[key]
+	seen := make(map[int]time.Time, len(mergeable))
+	var oldest time.Duration
+	for _, pr := range mergeable {
+		t, ok := previous[int(pr.Number)]
+		if !ok {
+			t = now
+		}
+		seen[int(pr.Number)] = t
+		if age := now.Sub(t); age > oldest {
+			oldest = age
+		}
+	}
+	c.mergeableTimes.firstSeen[key] = seen
+	oldestMergeableGauge.WithLabelValues(sp.org, sp.repo, sp.branch).Set(oldest.Seconds())
+}
+
+// pruneMergeable forgets the subpools that are no longer in the pool and drops
+// their oldestMergeableGauge series, so that a branch that went away does not
+// keep reporting its last value.
+func (c *Controller) pruneMergeable(sps []subpool) {
+	current := make(map[branchKey]bool)
+	for _, sp := range sps {
+		current[branchKey{sp.org, sp.repo, sp.branch}] = true
+	}
+	c.mergeableTimes.Lock()
+	defer c.mergeableTimes.Unlock()
+	for key := range c.mergeableTimes.firstSeen {
+		if !current[key] {
+			delete(c.mergeableTimes.firstSeen, key)
+			oldestMergeableGauge.DeleteLabelValues(key.org, key.repo, key.branch)
+		}
+	}
+}
+
+// observeMerge records the time in pool of a PR that was merged.
+func (c *Controller) observeMerge(sp subpool, pr PullRequest) {
+	if d, ok := c.timeInPool(pr); ok {
+		timeInPoolHistogram.WithLabelValues(sp.org, sp.repo).Observe(d.Seconds())
+	}
+}
+
+// instrumentClients wraps the clients returned by clientFor so that they count
+// their calls in githubRequests.
+func instrumentClients(clientFor func(string) (githubClient, error)) func(string) (githubClient, error) {
+	return func(org string) (githubClient, error) {
+		client, err := clientFor(org)
+		if err != nil {
+			return nil, err
+		}
+		return &instrumentedClient{client: client, org: org}, nil
+	}
+}
+
+// instrumentedClient counts the calls made with the client. Calls are counted
+// against the org they act on, or for queries, the org the client is for.
+type instrumentedClient struct {
+	client githubClient
+	org    string
+}
+
+// count records a call and passes its error through.
+func count(method, org string, err error) error {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	githubRequests.WithLabelValues(method, org, result).Inc()
+	return err
+}
+
+func (ic *instrumentedClient) GetRef(org, repo, ref string) (string, error) {
+	sha, err := ic.client.GetRef(org, repo, ref)
+	return sha, count("GetRef", org, err)
+}
+
+func (ic *instrumentedClient) Query(ctx context.Context, q interface{}, vars map[string]interface{}) error {
+	return count("Query", ic.org, ic.client.Query(ctx, q, vars))
+}
+
+func (ic *instrumentedClient) Merge(org, repo string, number int, details github.MergeDetails) error {
+	return count("Merge", org, ic.client.Merge(org, repo, number, details))
+}
+
+func (ic *instrumentedClient) IsMerged(org, repo string, number int) (bool, error) {
+	merged, err := ic.client.IsMerged(org, repo, number)
+	return merged, count("IsMerged", org, err)
+}
+
+func (ic *instrumentedClient) RemoveLabel(org, repo string, number int, label string) error {
+	return count("RemoveLabel", org, ic.client.RemoveLabel(org, repo, number, label))
+}
+
+func (ic *instrumentedClient) CreateComment(org, repo string, number int, comment string) error {
+	return count("CreateComment", org, ic.client.CreateComment(org, repo, number, comment))
+}
+
+func (ic *instrumentedClient) ClosePR(org, repo string, number int) error {
+	return count("ClosePR", org, ic.client.ClosePR(org, repo, number))
+}
+
+func (ic *instrumentedClient) ListReviews(org, repo string, number int) ([]github.Review, error) {
+	reviews, err := ic.client.ListReviews(org, repo, number)
+	return reviews, count("ListReviews", org, err)
+}
+
+func (ic *instrumentedClient) GetBranchProtection(org, repo, branch string) (*github.BranchProtection, error) {
+	protection, err := ic.client.GetBranchProtection(org, repo, branch)
+	return protection, count("GetBranchProtection", org, err)
+}
+
+func (ic *instrumentedClient) CreateReview(org, repo string, number int, review github.DraftReview) error {
+	return count("CreateReview", org, ic.client.CreateReview(org, repo, number, review))
+}
+
+func (ic *instrumentedClient) GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error) {
+	changes, err := ic.client.GetPullRequestChanges(org, repo, number)
+	return changes, count("GetPullRequestChanges", org, err)
+}
+
+func (ic *instrumentedClient) CreateStatus(org, repo, ref string, status github.Status) error {
+	return count("CreateStatus", org, ic.client.CreateStatus(org, repo, ref, status))
+}
+
+func (ic *instrumentedClient) CreateCheckRun(org, repo string, run github.CheckRun) error {
+	return count("CreateCheckRun", org, ic.client.CreateCheckRun(org, repo, run))
+}
+
+func (ic *instrumentedClient) CompareCommits(org, repo, base, head string) (*github.CommitComparison, error) {
+	comparison, err := ic.client.CompareCommits(org, repo, base, head)
+	return comparison, count("CompareCommits", org, err)
+}
+
+func (ic *instrumentedClient) UpdateBranch(org, repo string, number int, expectedHeadSHA string) error {
+	return count("UpdateBranch", org, ic.client.UpdateBranch(org, repo, number, expectedHeadSHA))
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/shurcooL/githubql"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/github"
+)
+
+func TestPoolTimes(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	c := &Controller{clock: clock}
+	var first, second PullRequest
+	first.Number = 1
+	first.Repository.NameWithOwner = "o/r"
+	second.Number = 2
+	second.Repository.NameWithOwner = "o/r"
+
+	c.recordPoolTimes([]PullRequest{first})
+	clock.Advance(5 * time.Minute)
+	c.recordPoolTimes([]PullRequest{first, second})
+	clock.Advance(time.Minute)
+	expected := map[int]time.Duration{1: 6 * time.Minute, 2: time.Minute}
+	if actual := c.poolTimesFor([]PullRequest{first, second}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected times in pool %v, got %v.", expected, actual)
+	}
+
+	// The first PR leaves the pool, so it starts over when it comes back.
+	c.recordPoolTimes([]PullRequest{second})
+	if _, ok := c.timeInPool(first); ok {
+		t.Error("Expected a PR that left the pool to be forgotten.")
+	}
+	c.recordPoolTimes([]PullRequest{first, second})
+	clock.Advance(time.Minute)
+	expected = map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute}
+	if actual := c.poolTimesFor([]PullRequest{first, second}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected times in pool %v, got %v.", expected, actual)
+	}
+}
+
+func TestObserveTimeInPoolOnMerge(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	fgc := &fgc{}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := newTestController(ca, fgc, nil)
+	c.clock = clock
+	var pr PullRequest
+	pr.Number = 1
+	pr.Repository.NameWithOwner = "metrics/test"
+	c.recordPoolTimes([]PullRequest{pr})
+	clock.Advance(time.Hour)
+
+	sp := subpool{org: "metrics", repo: "test", branch: "master"}
+	if err := c.mergePRs(context.Background(), sp, []PullRequest{pr}); err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	var m dto.Metric
+	if err := timeInPoolHistogram.WithLabelValues("metrics", "test").Write(&m); err != nil {
+		t.Fatalf("Error reading metric: %v", err)
+	}
+	if count := m.GetHistogram().GetSampleCount(); count != 1 {
+		t.Errorf("Expected one observation, got %d.", count)
+	}
+	if sum := m.GetHistogram().GetSampleSum(); sum != time.Hour.Seconds() {
+		t.Errorf("Expected an observation of %v seconds, got %v.", time.Hour.Seconds(), sum)
+	}
+}
+
+func TestOldestMergeableGauge(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	c := &Controller{clock: clock}
+	sp := subpool{org: "metrics", repo: "mergeable", branch: "master"}
+	prs := func(numbers ...int) []PullRequest {
+		var prs []PullRequest
+		for _, n := range numbers {
+			var pr PullRequest
+			pr.Number = githubql.Int(n)
+			prs = append(prs, pr)
+		}
+		return prs
+	}
+	check := func(name string, expected time.Duration) {
+		var m dto.Metric
+		if err := oldestMergeableGauge.WithLabelValues(sp.org, sp.repo, sp.branch).Write(&m); err != nil {
+			t.Fatalf("Error reading metric: %v", err)
+		}
+		if actual := m.GetGauge().GetValue(); actual != expected.Seconds() {
+			t.Errorf("For %s, expected the oldest mergeable PR to be %v seconds old, got %v.", name, expected.Seconds(), actual)
+		}
+	}
+
+	c.recordMergeable(sp, prs(1, 2))
+	check("newly mergeable PRs", 0)
+	clock.Advance(time.Hour)
+	c.recordMergeable(sp, prs(1, 3))
+	check("one sync later", time.Hour)
+	clock.Advance(time.Hour)
+	// PR 2 stopped being mergeable, so it starts over.
+	c.recordMergeable(sp, prs(1, 2, 3))
+	check("PR 1 still mergeable", 2*time.Hour)
+	clock.Advance(time.Hour)
+	c.recordMergeable(sp, prs(2, 3))
+	check("PR 1 merged", 2*time.Hour)
+	c.recordMergeable(sp, nil)
+	check("no mergeable PRs", 0)
+
+	// A subpool that left the pool stops being reported.
+	c.recordMergeable(sp, prs(1))
+	c.pruneMergeable(nil)
+	if oldestMergeableGauge.DeleteLabelValues(sp.org, sp.repo, sp.branch) {
+		t.Error("Expected the gauge of a subpool that left the pool to be dropped.")
+	}
+	if len(c.mergeableTimes.firstSeen) != 0 {
+		t.Errorf("Expected the subpool to be forgotten, got %v.", c.mergeableTimes.firstSeen)
+	}
+}
+
+func TestInstrumentedClient(t *testing.T) {
+	fgc := &fgc{
+		refs:    map[string]string{"instrumented/r heads/master": "123"},
+		refErrs: []error{errors.New("injected")},
+	}
+	clientFor := instrumentClients(func(org string) (githubClient, error) {
+		return fgc, nil
+	})
+	ghc, err := clientFor("instrumented")
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	if _, err := ghc.GetRef("instrumented", "r", "heads/master"); err == nil {
+		t.Error("Expected the injected error.")
+	}
+	if sha, err := ghc.GetRef("instrumented", "r", "heads/master"); err != nil || sha != "123" {
+		t.Errorf("Expected SHA 123, got %q and error %v.", sha, err)
+	}
+	if err := ghc.Merge("instrumented", "r", 1, github.MergeDetails{}); err != nil {
+		t.Errorf("Error merging: %v", err)
+	}
+
+	expected := []struct {
+		method, result string
+		count          float64
+	}{
+		{"GetRef", "success", 1},
+		{"GetRef", "error", 1},
+		{"Merge", "success", 1},
+		{"Merge", "error", 0},
+		{"Query", "success", 0},
+	}
+	for _, e := range expected {
+		var m dto.Metric
+		if err := githubRequests.WithLabelValues(e.method, "instrumented", e.result).Write(&m); err != nil {
+			t.Fatalf("Error reading metric: %v", err)
+		}
+		if actual := m.GetCounter().GetValue(); actual != e.count {
+			t.Errorf("Expected %v %s calls with result %s, got %v.", e.count, e.method, e.result, actual)
+		}
+	}
+}
+
+func TestServePoolMetrics(t *testing.T) {
+	var pr PullRequest
+	c := &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		pools: []Pool{
+			{
+				Org:        "o",
+				Repo:       "r",
+				Branch:     "master",
+				SuccessPRs: []PullRequest{pr, pr},
+				PendingPRs: []PullRequest{pr},
+				Action:     Merge,
+			},
+			{
+				Org:        "o",
+				Repo:       "other",
+				Branch:     "dev",
+				MissingPRs: []PullRequest{pr},
+				Action:     Wait,
+			},
+		},
+	}
+	rec := httptest.NewRecorder()
+	c.ServePoolMetrics(rec, httptest.NewRequest("GET", "/pool-metrics", nil))
+	expected := `# HELP tide_pool_action The action taken on each pool in the last sync. It is always 1.
+# TYPE tide_pool_action gauge
+tide_pool_action{action="MERGE",branch="master",org="o",repo="r"} 1
+tide_pool_action{action="WAIT",branch="dev",org="o",repo="other"} 1
+# HELP tide_pool_prs PRs in each pool as of the last sync, by state.
+# TYPE tide_pool_prs gauge
+tide_pool_prs{branch="dev",org="o",repo="other",state="missing"} 1
+tide_pool_prs{branch="dev",org="o",repo="other",state="pending"} 0
+tide_pool_prs{branch="dev",org="o",repo="other",state="success"} 0
+tide_pool_prs{branch="master",org="o",repo="r",state="missing"} 0
+tide_pool_prs{branch="master",org="o",repo="r",state="pending"} 1
+tide_pool_prs{branch="master",org="o",repo="r",state="success"} 2
+`
+	if actual := rec.Body.String(); actual != expected {
+		t.Errorf("Expected the exposition:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestQueryPRsGauge(t *testing.T) {
+	fc := &fgc{queryPRs: map[string][]PullRequest{"is:pr a": {{Number: 1}, {Number: 2}}}}
+	c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+	queries := []string{"is:pr a", "is:pr b"}
+	_, costs, err := c.searchAll(context.Background(), queries, 1, 0)
+	if err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	recordQueryPRs(queries, costs)
+	for i, expected := range []float64{2, 0} {
+		var m dto.Metric
+		if err := queryPRsGauge.WithLabelValues(strconv.Itoa(i), queries[i]).Write(&m); err != nil {
+			t.Fatalf("Error reading metric: %v", err)
+		}
+		if actual := m.GetGauge().GetValue(); actual != expected {
+			t.Errorf("Expected query %q to have returned %v PRs, got %v.", queries[i], expected, actual)
+		}
+	}
+
+	// Queries that are no longer configured are dropped.
+	recordQueryPRs(queries[1:], costs)
+	ch := make(chan prometheus.Metric, len(queries))
+	queryPRsGauge.Collect(ch)
+	close(ch)
+	if len(ch) != 1 {
+		t.Errorf("Expected one query to be reported, got %d.", len(ch))
+	}
+}
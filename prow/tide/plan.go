@@ -0,0 +1,71 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// PlannedAction is what Tide writes to the plan for each subpool it syncs in
+// dry-run mode: the action it would have taken.
+type PlannedAction struct {
+	Time time.Time
+	Decision
+	// WaitReason explains why the Wait action was planned.
+	WaitReason string `json:",omitempty"`
+}
+
+// SetPlanWriter sets where the actions planned in dry-run mode are written, one
+// JSON object per line. Nothing is written if it is nil, or outside of dry-run
+// mode.
+func (c *Controller) SetPlanWriter(w io.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.planWriter = w
+}
+
+// recordPlan writes the action planned for the pool to the plan writer, if
+// Tide is in dry-run mode and has one. Failures are logged but are not fatal.
+// The caller must hold m.
+func (c *Controller) recordPlan(pool Pool) {
+	if !c.dryRun || c.planWriter == nil {
+		return
+	}
+	planned := PlannedAction{
+		Time: c.now(),
+		Decision: Decision{
+			Org:    pool.Org,
+			Repo:   pool.Repo,
+			Branch: pool.Branch,
+			Action: pool.Action,
+		},
+		WaitReason: pool.WaitReason,
+	}
+	for _, pr := range pool.Target {
+		planned.Targets = append(planned.Targets, int(pr.Number))
+	}
+	b, err := json.Marshal(planned)
+	if err != nil {
+		c.logger.WithError(err).Warningf("Failed to encode the planned action for %s/%s %s.", pool.Org, pool.Repo, pool.Branch)
+		return
+	}
+	if _, err := c.planWriter.Write(append(b, '\n')); err != nil {
+		c.logger.WithError(err).Warningf("Failed to write the planned action for %s/%s %s.", pool.Org, pool.Repo, pool.Branch)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubql"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestRecordPlan(t *testing.T) {
+	newPR := func(number int, state string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		return pr
+	}
+	now := time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+	subpools := []subpool{
+		{org: "o", repo: "r", branch: "master", prs: []PullRequest{newPR(1, "SUCCESS"), newPR(2, "SUCCESS")}, rollupOnly: true},
+		{org: "o", repo: "r", branch: "release", prs: []PullRequest{newPR(3, "PENDING")}, rollupOnly: true},
+		{org: "o", repo: "other", branch: "master", rollupOnly: true},
+	}
+	run := func(dryRun bool) string {
+		var plan bytes.Buffer
+		fgc := &fgc{}
+		c := newTestController(newConfigAgent(config.Tide{}), fgc, &fkc{})
+		c.clock = &fakeClock{now: now}
+		c.dryRun = dryRun
+		c.SetPlanWriter(&plan)
+		for _, sp := range subpools {
+			if err := c.syncSubpool(sp); err != nil {
+				t.Fatalf("Error syncing %s/%s %s: %v", sp.org, sp.repo, sp.branch, err)
+			}
+		}
+		if dryRun && fgc.merged != 0 {
+			t.Errorf("Expected nothing to be merged in dry-run mode, got %d merges.", fgc.merged)
+		}
+		return plan.String()
+	}
+
+	var planned []PlannedAction
+	for _, line := range strings.Split(strings.TrimSuffix(run(true), "\n"), "\n") {
+		var action PlannedAction
+		if err := json.Unmarshal([]byte(line), &action); err != nil {
+			t.Fatalf("Error decoding planned action %q: %v", line, err)
+		}
+		planned = append(planned, action)
+	}
+	expected := []PlannedAction{
+		{Time: now, Decision: Decision{Org: "o", Repo: "r", Branch: "master", Action: Merge, Targets: []int{1}}},
+		{Time: now, Decision: Decision{Org: "o", Repo: "r", Branch: "release", Action: Wait}, WaitReason: waitPending},
+		{Time: now, Decision: Decision{Org: "o", Repo: "other", Branch: "master", Action: Wait}, WaitReason: waitNoCandidates},
+	}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Errorf("Expected the plan %+v, got %+v.", expected, planned)
+	}
+
+	if plan := run(false); plan != "" {
+		t.Errorf("Expected no plan outside of dry-run mode, got %q.", plan)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// statusContext is the context Tide reports PR state under.
+const statusContext = "tide"
+
+// prStatus is what Tide reports to GitHub for a PR in the pool.
+type prStatus struct {
+	// State is the bucket the PR was accumulated into.
+	State simpleState
+	// Description is short enough to be used as a commit status description
+	// or check run title.
+	Description string
+	// Details list the presubmits Tide requires for the PR.
+	Details string
+}
+
+func newPRStatus(bucket simpleState, presubmits []string) prStatus {
+	var desc string
+	switch bucket {
+	case successState:
+		desc = "In merge pool. Tests are passing."
+	case pendingState:
+		desc = "In merge pool. Waiting for tests."
+	default:
+		desc = "In merge pool. Tests are missing or failing."
+	}
+	details := "Tide does not require any presubmits for this PR."
+	if len(presubmits) > 0 {
+		details = fmt.Sprintf("Tide requires these presubmits to pass: %s.", strings.Join(presubmits, ", "))
+	}
+	return prStatus{State: bucket, Description: desc, Details: details}
+}
+
+// statusState returns the commit status state to report for the bucket. PRs
+// with missing or failing tests are blocked, so they are not reported as
+// passing.
+func statusState(bucket simpleState) string {
+	switch bucket {
+	case successState:
+		return github.StatusSuccess
+	case pendingState:
+		return github.StatusPending
+	default:
+		return github.StatusFailure
+	}
+}
+
+// checkRunState returns the status and conclusion of the check run to report
+// for the bucket. Pending PRs have a check run in progress, without a
+// conclusion.
+func checkRunState(bucket simpleState) (string, string) {
+	switch bucket {
+	case successState:
+		return "completed", "success"
+	case pendingState:
+		return "in_progress", ""
+	default:
+		return "completed", "failure"
+	}
+}
+
+// reportStatuses reports the state of each PR in the subpool to GitHub, either
+// as a commit status or as a check run. PRs whose state has not changed since
+// the last report are skipped. Failures are logged but are not fatal.
+func (c *Controller) reportStatuses(sp subpool, presubmits map[int][]string, successes, pendings, nones []PullRequest) {
+	tideConfig := c.ca.Config().Tide
+	if !tideConfig.ReportStatus || c.dryRun {
+		return
+	}
+	buckets := []struct {
+		state simpleState
+		prs   []PullRequest
+	}{
+		{successState, successes},
+		{pendingState, pendings},
+		{noneState, nones},
+	}
+	for _, bucket := range buckets {
+		for _, pr := range bucket.prs {
+			status := newPRStatus(bucket.state, presubmits[int(pr.Number)])
+			key := changeKey(pr)
+			if c.reported[key] == status {
+				continue
+			}
+			if err := c.reportStatus(sp, pr, status, tideConfig.UseCheckRuns); err != nil {
+				c.logger.WithError(err).Warningf("Failed to report status for %s/%s#%d.", sp.org, sp.repo, int(pr.Number))
+				continue
+			}
+			if c.reported == nil {
+				c.reported = make(map[string]prStatus)
+			}
+			c.reported[key] = status
+		}
+	}
+}
+
+func (c *Controller) reportStatus(sp subpool, pr PullRequest, status prStatus, useCheckRuns bool) error {
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		return err
+	}
+	sha := string(pr.HeadRef.Target.OID)
+	if useCheckRuns {
+		state, conclusion := checkRunState(status.State)
+		return ghc.CreateCheckRun(sp.org, sp.repo, github.CheckRun{
+			Name:       statusContext,
+			HeadSHA:    sha,
+			Status:     state,
+			Conclusion: conclusion,
+			Output: &github.CheckRunOutput{
+				Title:   status.Description,
+				Summary: status.Description,
+				Text:    status.Details,
+			},
+		})
+	}
+	return ghc.CreateStatus(sp.org, sp.repo, sha, github.Status{
+		State:       statusState(status.State),
+		Description: status.Description,
+		Context:     statusContext,
+	})
+}
+
+// pruneReported forgets what was reported for PR heads no longer in the pool.
+func (c *Controller) pruneReported(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[changeKey(pr)] = true
+	}
+	for key := range c.reported {
+		if !inPool[key] {
+			delete(c.reported, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"testing"
+
+	"github.com/shurcooL/githubql"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestReportStatuses(t *testing.T) {
+	var passing, pending, missing PullRequest
+	passing.Number = 1
+	passing.HeadRef.Target.OID = githubql.String("a")
+	pending.Number = 2
+	pending.HeadRef.Target.OID = githubql.String("b")
+	missing.Number = 3
+	missing.HeadRef.Target.OID = githubql.String("c")
+	presubmits := map[int][]string{1: {"foo"}, 2: {"foo", "bar"}, 3: {"foo"}}
+	sp := subpool{org: "o", repo: "r", branch: "master"}
+
+	testcases := []struct {
+		name   string
+		config config.Tide
+		dryRun bool
+
+		statuses  int
+		checkRuns int
+	}{
+		{
+			name: "reporting disabled",
+		},
+		{
+			name:   "dry run",
+			config: config.Tide{ReportStatus: true},
+			dryRun: true,
+		},
+		{
+			name:     "statuses",
+			config:   config.Tide{ReportStatus: true},
+			statuses: 3,
+		},
+		{
+			name:      "check runs",
+			config:    config.Tide{ReportStatus: true, UseCheckRuns: true},
+			checkRuns: 3,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: tc.config})
+		fc := &fgc{}
+		c := newTestController(ca, fc, nil)
+		c.dryRun = tc.dryRun
+		// Reporting the same state twice should only reach GitHub once.
+		for i := 0; i < 2; i++ {
+			c.reportStatuses(sp, presubmits, []PullRequest{passing}, []PullRequest{pending}, []PullRequest{missing})
+		}
+		if len(fc.statuses) != tc.statuses {
+			t.Errorf("For case %q, expected %d statuses, got %d.", tc.name, tc.statuses, len(fc.statuses))
+		}
+		if len(fc.checkRuns) != tc.checkRuns {
+			t.Errorf("For case %q, expected %d check runs, got %d.", tc.name, tc.checkRuns, len(fc.checkRuns))
+		}
+		// The PRs are reported passing, pending, then missing.
+		expectedStates := []string{"success", "pending", "failure"}
+		for i, s := range fc.statuses {
+			if s.Context != statusContext {
+				t.Errorf("For case %q, wrong status context %q.", tc.name, s.Context)
+			}
+			if s.State != expectedStates[i] {
+				t.Errorf("For case %q, expected status %d to be %q, got %q.", tc.name, i, expectedStates[i], s.State)
+			}
+		}
+		expectedRuns := [][2]string{{"completed", "success"}, {"in_progress", ""}, {"completed", "failure"}}
+		for i, cr := range fc.checkRuns {
+			if cr.Name != statusContext || cr.Output == nil || cr.Output.Text == "" {
+				t.Errorf("For case %q, bad check run %+v.", tc.name, cr)
+			}
+			if actual := [2]string{cr.Status, cr.Conclusion}; actual != expectedRuns[i] {
+				t.Errorf("For case %q, expected check run %d to be %v, got %v.", tc.name, i, expectedRuns[i], actual)
+			}
+		}
+	}
+}
+
+func TestNewPRStatus(t *testing.T) {
+	status := newPRStatus(pendingState, []string{"foo", "bar"})
+	if status.Description != "In merge pool. Waiting for tests." {
+		t.Errorf("Wrong description %q.", status.Description)
+	}
+	if status.Details != "Tide requires these presubmits to pass: foo, bar." {
+		t.Errorf("Wrong details %q.", status.Details)
+	}
+}
@@ -18,12 +18,19 @@ limitations under the License.
 package tide
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/shurcooL/githubql"
 	"github.com/sirupsen/logrus"
@@ -44,33 +51,283 @@ type githubClient interface {
 	GetRef(string, string, string) (string, error)
 	Query(context.Context, interface{}, map[string]interface{}) error
 	Merge(string, string, int, github.MergeDetails) error
+	IsMerged(string, string, int) (bool, error)
+	RemoveLabel(string, string, int, string) error
+	CreateComment(string, string, int, string) error
+	ClosePR(string, string, int) error
+	ListReviews(string, string, int) ([]github.Review, error)
+	CreateReview(string, string, int, github.DraftReview) error
+	GetBranchProtection(string, string, string) (*github.BranchProtection, error)
+	GetPullRequestChanges(string, string, int) ([]github.PullRequestChange, error)
+	CreateStatus(string, string, string, github.Status) error
+	CreateCheckRun(string, string, github.CheckRun) error
+	CompareCommits(string, string, string, string) (*github.CommitComparison, error)
+	UpdateBranch(string, string, int, string) error
+}
+
+// clock provides the current time. Time-based decisions use it rather than
+// calling time.Now directly so that they can be tested.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
 }
 
 // Controller knows how to sync PRs and PJs.
 type Controller struct {
 	logger *logrus.Entry
 	dryRun bool
+	clock  clock
 	ca     *config.Agent
-	ghc    githubClient
 	kc     kubeClient
-	gc     *git.Client
+	// gc clones the repos that batches are assembled in, unless cloneFor is
+	// set. Use clone to get a repo.
+	gc       *git.Client
+	cloneFor func(repo string) (gitRepo, error)
+
+	// ghc is the GitHub client for every org, unless clientFor is set. Use
+	// github to get the client for an org.
+	ghc githubClient
+	// clientFor returns the GitHub client for an org. It returns a
+	// *github.NotInstalledError for orgs that the GitHub App is not installed
+	// on, which Tide skips with a warning.
+	clientFor func(org string) (githubClient, error)
 
 	m     sync.Mutex
 	pools []Pool
+	costs []QueryCost
+
+	// lastSubpool is the subpool that the last sync ended with when it could
+	// not sync them all, as "org/repo branch". Guarded by m.
+	lastSubpool string
+
+	// lastSyncErr is the error from the last sync, or nil if it succeeded.
+	// lastSyncErrTime is when that sync failed. Both are guarded by m.
+	lastSyncErr     error
+	lastSyncErrTime time.Time
+
+	// The state below is remembered across syncs. Rather than being guarded
+	// by m, each has its own lock: actions run in their own goroutine, which
+	// may outlive the sync when abandoned for the subpool timeout, queries run
+	// concurrently, and resetPR clears PRs from it without holding m.
+	retests retestTimes
+
+	changes changeCache
+
+	batchComments batchComments
+
+	lastMerges lastMerges
+
+	branchUpdates branchUpdates
+
+	mergeRefusals mergeRefusals
+
+	pendingBatches pendingBatches
+
+	sentQueries sentQueries
+	prQueries   prQueries
+
+	poolTimes      poolTimes
+	mergeableTimes mergeableTimes
+
+	// webhookSecret signs the decisions posted to the decision webhook.
+	webhookSecret []byte
+	decisions     decisionQueue
+	// planWriter receives the actions planned in dry-run mode. Guarded by m.
+	planWriter io.Writer
+
+	// filters are applied to the pool after the built-in ones. They are
+	// guarded by m.
+	filters []PRFilter
+	// labelConflicts are the PRs left out of the last pool because they carry
+	// both a required and a blocking label. Guarded by m.
+	labelConflicts []string
+
+	// reported is the last status reported for each PR head, keyed by
+	// changeKey.
+	reported map[string]prStatus
+
+	// pauseLock guards paused. It is separate from m so that pausing takes
+	// effect in the middle of a sync, including for actions still running.
+	pauseLock sync.Mutex
+	// paused makes takeAction behave as in dry run mode. Unlike dryRun, it
+	// can be toggled while running.
+	paused bool
+
+	// semLock guards sem, which bounds the work done concurrently by the
+	// whole controller. A nil sem means there is no bound.
+	semLock sync.Mutex
+	sem     chan struct{}
+}
+
+// retestTimes records when Tide retriggered a PR for a retest request, keyed
+// by prKey. Presubmits that started before then are considered stale.
+type retestTimes struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+// changeCache remembers the files changed by each PR head so that they are
+// only fetched from GitHub once per commit.
+type changeCache struct {
+	sync.Mutex
+	// changes is keyed by prKey and head SHA.
+	changes map[string][]github.PullRequestChange
+}
+
+// batchComments remembers which PRs Tide has commented on after merging them
+// in a batch, so that a merge that is retried does not comment twice.
+type batchComments struct {
+	sync.Mutex
+	// commented is keyed by prKey.
+	commented map[string]bool
+}
+
+// mergeRefusals remembers why GitHub last refused to merge PRs, to report it
+// in the pool.
+type mergeRefusals struct {
+	sync.Mutex
+	// reasons is keyed by prKey.
+	reasons map[string]string
+}
+
+// branchUpdates remembers the PRs whose branches Tide updated, to wait for
+// the updates and to bound them.
+type branchUpdates struct {
+	sync.Mutex
+	// updates is keyed by prKey.
+	updates map[string]branchUpdate
 }
 
+// branchUpdate is the last base SHA a PR's branch was updated to, the head SHA
+// it was updated from, and how many times it has been updated.
+type branchUpdate struct {
+	baseSHA string
+	headSHA string
+	count   int
+}
+
+// lastMerges remembers when Tide last merged into each branch, to enforce the
+// merge cooldown and to blame branch failures on merges.
+type lastMerges struct {
+	sync.Mutex
+	// times and broken are keyed by "org/repo branch", times also by the
+	// cooldown key of the merge if that is wider. broken holds the branches
+	// that started failing after a merge and have not recovered.
+	times  map[string]time.Time
+	broken map[string]bool
+}
+
+// pendingBatches counts the repos with a pending batch, as of the start of the
+// sync and including the batches triggered since.
+type pendingBatches struct {
+	sync.Mutex
+	// repos is keyed by "org/repo".
+	repos map[string]bool
+}
+
+// sentQueryLimit is how many of the most recent search requests are kept.
+const sentQueryLimit = 100
+
+// SentQuery is a search request as sent to GitHub.
+type SentQuery struct {
+	Time  time.Time
+	Org   string
+	Query string
+	// Cursor is where the page starts. It is empty for the first page.
+	Cursor string `json:",omitempty"`
+}
+
+// sentQueries keeps the most recent search requests, oldest first.
+type sentQueries struct {
+	sync.Mutex
+	queries []SentQuery
+}
+
+// prQueries remembers the query that found each PR in the last search, keyed
+// by prKey, to label the jobs triggered for it.
+type prQueries struct {
+	sync.Mutex
+	queries map[string]string
+}
+
+// Labels that Tide adds to the ProwJobs it triggers.
+const (
+	// createdByTideLabel marks the jobs as triggered by Tide.
+	createdByTideLabel = "created-by-tide"
+	// triggerLabel is "serial" for jobs that test a single PR and "batch" for
+	// jobs that test a batch.
+	triggerLabel = "tide.prow.k8s.io/trigger"
+	// queryLabel is the index, among the configured queries, of the query
+	// that found the PR, or the first PR of a batch. Queries are not valid
+	// label values themselves.
+	queryLabel = "tide.prow.k8s.io/query"
+)
+
 // Action represents what actions the controller can take. It will take
-// exactly one action each sync.
+// exactly one action per subpool each sync. Its values are the enum below.
 type Action string
 
 const (
-	Wait         Action = "WAIT"
-	Trigger             = "TRIGGER"
-	TriggerBatch        = "TRIGGER_BATCH"
-	Merge               = "MERGE"
-	MergeBatch          = "MERGE_BATCH"
+	// Wait means no action was taken.
+	Wait Action = "WAIT"
+	// Trigger means presubmits were started for a single PR.
+	Trigger Action = "TRIGGER"
+	// TriggerBatch means batch jobs were started for several PRs.
+	TriggerBatch Action = "TRIGGER_BATCH"
+	// Merge means a single PR was merged.
+	Merge Action = "MERGE"
+	// MergeBatch means the PRs of a passing batch were merged.
+	MergeBatch Action = "MERGE_BATCH"
+	// Close means PRs carrying a close label were closed without merging.
+	Close Action = "CLOSE"
 )
 
+// Reasons recorded in a Pool for taking the Wait action.
+const (
+	waitNoCandidates   = "There are no PRs in the pool."
+	waitBatchPending   = "Waiting for the pending batch to finish."
+	waitPending        = "Waiting for pending tests to finish."
+	waitBatchTooSmall  = "Too few PRs are eligible to trigger a batch."
+	waitIneligible     = "No PR is eligible to merge or test."
+	waitNotRequired    = "The branch has presubmits but none are required."
+	waitUnconfigured   = "The repo has no presubmits configured."
+	waitFailingBase    = "The base branch is failing its own tests."
+	waitMergeCooldown  = "Waiting for the merge cooldown of the branch to pass."
+	waitBrokenByMerge  = "The base branch started failing after a merge."
+	waitBatchLimit     = "Too many repos have a pending batch."
+	waitPickBatchError = "Failed to pick a batch."
+	waitBranchUpdate   = "Waiting for the branch of a PR to be updated and tested again."
+	waitFrozen         = "The branch is frozen."
+	waitTimedOut       = "The action timed out. A merge or trigger that was under way may still land."
+)
+
+// SchemaVersion is the version of the Status served by the controller. It is
+// incremented whenever Status or Pool change incompatibly.
+const SchemaVersion = 1
+
+// Status is the response served by the controller.
+type Status struct {
+	// SchemaVersion is the version of this response. Consumers should check it
+	// before reading the pools.
+	SchemaVersion int
+	Pools         []Pool
+
+	// LastSyncError is set if the last sync failed, in which case the pools
+	// may be stale or incomplete. It is cleared by the next successful sync.
+	LastSyncError string `json:",omitempty"`
+	// LastSyncErrorTime is when the last sync failed.
+	LastSyncErrorTime *time.Time `json:",omitempty"`
+
+	// LabelConflicts are the PRs, as "org/repo#number", that were left out of
+	// the pool because they carry both a required and a blocking label.
+	LabelConflicts []string `json:",omitempty"`
+}
+
 // Pool represents information about a tide pool. There is one for every
 // org/repo/branch combination that has PRs in the pool.
 type Pool struct {
@@ -85,69 +342,546 @@ type Pool struct {
 	PendingPRs []PullRequest
 	MissingPRs []PullRequest
 
+	// BatchPending are the PRs in the batch that is currently being tested.
+	BatchPending []PullRequest
+
+	// HeldPRs are PRs that Tide will not merge because they change protected
+	// paths without carrying the label those paths require.
+	HeldPRs []PullRequest `json:",omitempty"`
+	// UnresolvedPRs are PRs that Tide will not merge because the repo requires
+	// their review threads to be resolved and some are not.
+	UnresolvedPRs []PullRequest `json:",omitempty"`
+	// OverriddenContexts are the required contexts that were treated as
+	// passing because the PR carries a status override label, keyed by PR
+	// number.
+	OverriddenContexts map[int][]string `json:",omitempty"`
+
+	// TimeInPool is how long each PR has been in the pool as of the sync,
+	// keyed by PR number.
+	TimeInPool map[int]time.Duration `json:",omitempty"`
+
+	// BlockedByBatch is set, keyed by PR number, for the passing PRs that
+	// Tide would merge now if it were not waiting for the pending batch.
+	BlockedByBatch map[int]bool `json:",omitempty"`
+
 	// Which action did we last take, and to what target(s), if any.
 	Action Action
 	Target []PullRequest
+	// WaitReason explains why the Wait action was taken.
+	WaitReason string `json:",omitempty"`
+
+	// Error is set if the action could not be completed, such as when it was
+	// abandoned for taking too long.
+	Error string `json:",omitempty"`
+	// MergeRefusals are the reasons GitHub gave for refusing to merge PRs,
+	// such as a disallowed merge method or branch protection, keyed by PR
+	// number. A PR keeps its reason until it is merged or leaves the pool.
+	MergeRefusals map[int]string `json:",omitempty"`
+
+	// Jobs are the presubmits matched to each PR when accumulating, keyed by
+	// PR number. They are only served when debugging is requested.
+	Jobs map[int][]PoolJob `json:",omitempty"`
+	// Contexts are the states that accumulate found for each PR's required
+	// contexts, keyed by PR number and then by context: success, pending,
+	// error, or none when failing or missing. Like Jobs, they are only served
+	// when debugging is requested.
+	Contexts map[int]map[string]string `json:",omitempty"`
+	// MissingContexts are the required contexts of each PR that have not
+	// been reported at all, and FailingContexts those that failed or errored,
+	// keyed by PR number. They are only served when debugging is requested.
+	MissingContexts map[int][]string `json:",omitempty"`
+	FailingContexts map[int][]string `json:",omitempty"`
+}
+
+// PoolJob is a ProwJob that Tide considered for a PR.
+type PoolJob struct {
+	Name    string
+	Context string
+	State   kube.ProwJobState
 }
 
-// NewController makes a Controller out of the given clients.
-func NewController(ghc *github.Client, kc *kube.Client, ca *config.Agent, gc *git.Client, dryRun bool, logger *logrus.Entry) *Controller {
+// QueryCost is the GitHub GraphQL rate limit cost incurred by one of the
+// configured queries during the last sync.
+type QueryCost struct {
+	Query string
+	// Cost is the total cost of all pages fetched for the query.
+	Cost int
+	// Remaining is the rate limit budget left after the query ran.
+	Remaining int
+	// PRs is how many PRs the query returned.
+	PRs int
+}
+
+// NewController makes a Controller out of the given clients. GitHub clients
+// are made against the endpoint for each org using the tokens from the source,
+// so that Tide can run as a GitHub App. In that case every query must be
+// limited to a single org with org: or repo: qualifiers.
+func NewController(tokens github.TokenSource, githubEndpoint string, kc *kube.Client, ca *config.Agent, gc *git.Client, dryRun bool, logger *logrus.Entry) *Controller {
+	tc := &tokenClients{tokens: tokens, endpoint: githubEndpoint}
 	return &Controller{
-		logger: logger,
-		dryRun: dryRun,
-		ghc:    ghc,
-		kc:     kc,
-		ca:     ca,
-		gc:     gc,
+		logger:    logger,
+		dryRun:    dryRun,
+		clock:     realClock{},
+		clientFor: instrumentClients(tc.clientFor),
+		kc:        kc,
+		ca:        ca,
+		gc:        gc,
+	}
+}
+
+// now returns the current time according to the controller's clock.
+func (c *Controller) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
 	}
+	return c.clock.Now()
 }
 
-// Sync runs one sync iteration.
+// Sync runs one sync iteration. Concurrent calls run one after the other.
 func (c *Controller) Sync() error {
+	// This may take a while, which may cause ServeHTTP requests to block for
+	// some time. This is not a frontend service, so that's okay. Holding the
+	// lock throughout also keeps on-demand and scheduled syncs from
+	// overlapping.
+	c.m.Lock()
+	defer c.m.Unlock()
+	err := c.sync()
+	if err != nil {
+		c.lastSyncErr, c.lastSyncErrTime = err, c.now()
+	} else {
+		c.lastSyncErr, c.lastSyncErrTime = nil, time.Time{}
+	}
+	return err
+}
+
+// sync does the work of Sync. The caller must hold m.
+func (c *Controller) sync() error {
 	ctx := context.Background()
 	c.logger.Info("Building tide pool.")
-	var pool []PullRequest
-	for _, q := range c.ca.Config().Tide.Queries {
-		prs, err := c.search(ctx, q)
-		if err != nil {
-			return err
-		}
-		pool = append(pool, prs...)
+	tideConfig := c.ca.Config().Tide
+	c.setMaxConcurrency(tideConfig.MaxConcurrency)
+	if c.gc != nil {
+		c.gc.SetMaxRepos(tideConfig.MaxClonedRepos)
 	}
-	var pjs []kube.ProwJob
-	var err error
-	if len(pool) > 0 {
-		pjs, err = c.kc.ListProwJobs(kube.EmptySelector)
-		if err != nil {
-			return err
-		}
+	queries := prioritizeQueries(tideConfig.Queries, tideConfig.QueryPriorities)
+	pool, costs, err := c.searchAll(ctx, queries, tideConfig.QueryConcurrency, tideConfig.MaxPoolSize)
+	if err != nil {
+		return err
+	}
+	recordQueryPRs(tideConfig.Queries, costs)
+	pool = c.filterPool(dedupePRs(pool))
+	c.pruneRetests(pool)
+	c.pruneChanges(pool)
+	c.pruneBatchComments(pool)
+	c.pruneBranchUpdates(pool)
+	c.pruneMergeRefusals(pool)
+	c.pruneReported(pool)
+	c.recordPoolTimes(pool)
+	if len(pool) == 0 {
+		// With no PRs there is nothing to act on, and the pools of the last
+		// sync, including those of skipped subpools, no longer apply.
+		c.logger.Info("The pool is empty.")
+		emptyPoolSyncs.Inc()
+		c.countPendingBatches(nil)
+		c.pruneMergeable(nil)
+		c.costs = costs
+		c.pools = []Pool{}
+		c.lastSubpool = ""
+		return nil
 	}
+	var rollupOnly bool
+	pjs, err := c.kc.ListProwJobs(kube.EmptySelector)
+	if err != nil && tideConfig.FallbackToRollupStatus {
+		c.logger.WithError(err).Error("Error listing ProwJobs. Falling back to the combined status of each PR: Tide will merge passing PRs but trigger nothing this sync.")
+		pjs, rollupOnly = nil, true
+	} else if err != nil {
+		return err
+	}
+	c.countPendingBatches(pjs)
 	sps, err := c.dividePool(pool, pjs)
 	if err != nil {
 		return err
 	}
-	// This may take a while, which may cause ServeHTTP requests to block for
-	// some time. This is not a frontend service, so that's okay.
-	c.m.Lock()
-	defer c.m.Unlock()
-	c.pools = make([]Pool, 0, len(sps))
+	c.pruneMergeable(sps)
+	c.costs = costs
+	sps, skipped := c.nextSubpools(sps, tideConfig.MaxSubpoolsPerSync)
+	previous := c.pools
+	c.pools = make([]Pool, 0, len(sps)+len(skipped))
+	requeues := tideConfig.MergeRequeues
 	for _, sp := range sps {
-		if err := c.syncSubpool(sp); err != nil {
-			return err
+		sp.rollupOnly = rollupOnly
+		sp.linearHistory = c.requiresLinearHistory(sp)
+		for {
+			if err := c.syncSubpool(sp); err != nil {
+				return err
+			}
+			pool := c.pools[len(c.pools)-1]
+			if pool.Error != "" || (pool.Action != Merge && pool.Action != MergeBatch) || c.dryRun || c.isPaused() {
+				break
+			}
+			if requeues <= 0 && (!tideConfig.RefreshBaseAfterMerge || sp.rollupOnly) {
+				break
+			}
+			next, err := c.requeueSubpool(sp, pool.Target)
+			if err != nil {
+				return err
+			} else if len(next.prs) == 0 {
+				break
+			}
+			if requeues > 0 {
+				requeues--
+				c.logger.Infof("Re-running %s/%s %s after merging into it.", sp.org, sp.repo, sp.branch)
+			} else {
+				next.triggerOnly = true
+				c.logger.Infof("Testing the PRs left in %s/%s %s against its new head %s.", sp.org, sp.repo, sp.branch, next.sha)
+			}
+			// The re-run's pool replaces this one.
+			c.pools = c.pools[:len(c.pools)-1]
+			sp = next
+		}
+	}
+	// Subpools that wait for a later sync keep their last results.
+	for _, pool := range previous {
+		if skipped[fmt.Sprintf("%s/%s %s", pool.Org, pool.Repo, pool.Branch)] {
+			c.pools = append(c.pools, pool)
 		}
 	}
 	return nil
 }
 
+// nextSubpools returns at most max of the subpools, in turn across syncs: they
+// are taken in order starting after the one the last sync ended with. The
+// names of the subpools that are left out are returned as well. The caller
+// must hold m.
+func (c *Controller) nextSubpools(sps []subpool, max int) ([]subpool, map[string]bool) {
+	if max <= 0 || len(sps) <= max {
+		c.lastSubpool = ""
+		return sps, nil
+	}
+	name := func(sp subpool) string {
+		return fmt.Sprintf("%s/%s %s", sp.org, sp.repo, sp.branch)
+	}
+	sort.Slice(sps, func(i, j int) bool { return name(sps[i]) < name(sps[j]) })
+	start := sort.Search(len(sps), func(i int) bool { return name(sps[i]) > c.lastSubpool })
+	var next []subpool
+	skipped := make(map[string]bool)
+	for i := range sps {
+		sp := sps[(start+i)%len(sps)]
+		if i < max {
+			next = append(next, sp)
+		} else {
+			skipped[name(sp)] = true
+		}
+	}
+	c.lastSubpool = name(next[len(next)-1])
+	return next, skipped
+}
+
+// requeueSubpool returns the subpool as it is after the PRs were merged into
+// it: without them, at the new head of the branch, and without the jobs that
+// ran against the old one. It has no PRs if the branch is gone.
+func (c *Controller) requeueSubpool(sp subpool, merged []PullRequest) (subpool, error) {
+	sha, err := c.getRef(sp.org, sp.repo, "heads/"+sp.branch)
+	if _, ok := err.(*github.RefNotFound); ok || isNotInstalled(err) {
+		c.logger.WithError(err).Warningf("Not re-running %s/%s %s.", sp.org, sp.repo, sp.branch)
+		return subpool{}, nil
+	} else if err != nil {
+		return subpool{}, err
+	} else if sha == sp.sha {
+		// Nothing landed, so re-running would only repeat this run.
+		return subpool{}, nil
+	}
+	wasMerged := make(map[int]bool)
+	for _, pr := range merged {
+		wasMerged[int(pr.Number)] = true
+	}
+	next := sp
+	next.sha = sha
+	next.afterMerge = true
+	next.prs, next.pjs = nil, nil
+	for _, pr := range sp.prs {
+		if !wasMerged[int(pr.Number)] {
+			next.prs = append(next.prs, pr)
+		}
+	}
+	for _, pj := range sp.pjs {
+		if pj.Spec.Refs.BaseSHA == sha {
+			next.pjs = append(next.pjs, pj)
+		}
+	}
+	return next, nil
+}
+
+// ServeHTTP serves the Status. Pass debug=true to include the jobs that were
+// matched to each PR and the states of its required contexts, including which
+// of them are missing or failing.
 func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	debug, _ := strconv.ParseBool(r.URL.Query().Get("debug"))
+	c.m.Lock()
+	defer c.m.Unlock()
+	pools := make([]interface{}, 0, len(c.pools))
+	for _, pool := range c.pools {
+		if !debug {
+			pool.Jobs = nil
+			pool.Contexts = nil
+			pool.MissingContexts = nil
+			pool.FailingContexts = nil
+		}
+		pools = append(pools, pool)
+	}
+	w.Write(marshalPools(c.logger, pools, c.labelConflicts, c.lastSyncErr, c.lastSyncErrTime))
+}
+
+// setMaxConcurrency bounds the number of concurrent operations. Operations
+// already holding a slot release it to the semaphore they acquired it from.
+func (c *Controller) setMaxConcurrency(max int) {
+	c.semLock.Lock()
+	defer c.semLock.Unlock()
+	if max <= 0 {
+		c.sem = nil
+	} else if c.sem == nil || cap(c.sem) != max {
+		c.sem = make(chan struct{}, max)
+	}
+}
+
+// acquire blocks until the controller may start another concurrent operation
+// and returns the function that releases its slot.
+func (c *Controller) acquire() func() {
+	c.semLock.Lock()
+	sem := c.sem
+	c.semLock.Unlock()
+	if sem == nil {
+		return func() {}
+	}
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+// SetPaused stops or resumes merging and triggering. A paused controller
+// still syncs, reports statuses, and records the actions it would take.
+func (c *Controller) SetPaused(paused bool) {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	c.paused = paused
+}
+
+func (c *Controller) isPaused() bool {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	return c.paused
+}
+
+// ServePause pauses the controller on POST. Pass paused=false to resume.
+func (c *Controller) ServePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	paused := true
+	if v := r.URL.Query().Get("paused"); v != "" {
+		var err error
+		if paused, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid paused value %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	c.SetPaused(paused)
+	c.logger.Infof("Set paused to %t.", paused)
+	fmt.Fprintf(w, "paused: %t\n", paused)
+}
+
+// ServeReset makes Tide forget everything it remembers about a PR on POST, so
+// that the next sync treats it as new. The PR is given by the org, repo and
+// number parameters. It waits for a sync that is running to finish.
+func (c *Controller) ServeReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	org, repo := query.Get("org"), query.Get("repo")
+	number, err := strconv.Atoi(query.Get("number"))
+	if org == "" || repo == "" || err != nil {
+		http.Error(w, "org, repo and number are required", http.StatusBadRequest)
+		return
+	}
+	c.resetPR(org, repo, number)
+	c.logger.Infof("Reset the state of %s/%s#%d.", org, repo, number)
+	fmt.Fprintf(w, "reset %s/%s#%d\n", org, repo, number)
+}
+
+// resetPR forgets the retest requests, reported statuses, changes, batch
+// comments, branch updates, merge refusals, query and times that Tide
+// remembers for the PR.
+func (c *Controller) resetPR(org, repo string, number int) {
+	key := fmt.Sprintf("%s/%s#%d", org, repo, number)
+	c.m.Lock()
+	for k := range c.reported {
+		if strings.HasPrefix(k, key+"@") {
+			delete(c.reported, k)
+		}
+	}
+	c.m.Unlock()
+
+	c.retests.Lock()
+	delete(c.retests.times, key)
+	c.retests.Unlock()
+
+	c.changes.Lock()
+	for k := range c.changes.changes {
+		if strings.HasPrefix(k, key+"@") {
+			delete(c.changes.changes, k)
+		}
+	}
+	c.changes.Unlock()
+
+	c.batchComments.Lock()
+	delete(c.batchComments.commented, key)
+	c.batchComments.Unlock()
+
+	c.branchUpdates.Lock()
+	delete(c.branchUpdates.updates, key)
+	c.branchUpdates.Unlock()
+
+	c.mergeRefusals.Lock()
+	delete(c.mergeRefusals.reasons, key)
+	c.mergeRefusals.Unlock()
+
+	c.prQueries.Lock()
+	delete(c.prQueries.queries, key)
+	c.prQueries.Unlock()
+
+	c.poolTimes.Lock()
+	delete(c.poolTimes.firstSeen, key)
+	c.poolTimes.Unlock()
+
+	c.mergeableTimes.Lock()
+	for k, times := range c.mergeableTimes.firstSeen {
+		if k.org == org && k.repo == repo {
+			delete(times, number)
+		}
+	}
+	c.mergeableTimes.Unlock()
+}
+
+// ServeSync runs a sync on POST and responds once it completes. Passing
+// async=true responds with 202 Accepted right away instead. A sync that is
+// already running finishes before the requested one starts.
+func (c *Controller) ServeSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		go func() {
+			if err := c.Sync(); err != nil {
+				c.logger.WithError(err).Error("Error in requested sync.")
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "sync started")
+		return
+	}
+	if err := c.Sync(); err != nil {
+		c.logger.WithError(err).Error("Error in requested sync.")
+		http.Error(w, fmt.Sprintf("sync failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "sync complete")
+}
+
+// ServeCosts serves the cost of each query during the last sync.
+func (c *Controller) ServeCosts(w http.ResponseWriter, r *http.Request) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	b, err := json.Marshal(c.pools)
+	b, err := json.Marshal(c.costs)
+	if err != nil {
+		c.logger.WithError(err).Error("Encoding JSON.")
+		b = []byte("[]")
+	}
+	w.Write(b)
+}
+
+// recordQuery logs a search request at debug level and keeps it for
+// ServeQueries.
+func (c *Controller) recordQuery(sent SentQuery) {
+	c.logger.Debugf("Searching with query %q and cursor %q.", sent.Query, sent.Cursor)
+	c.sentQueries.Lock()
+	defer c.sentQueries.Unlock()
+	c.sentQueries.queries = append(c.sentQueries.queries, sent)
+	if extra := len(c.sentQueries.queries) - sentQueryLimit; extra > 0 {
+		c.sentQueries.queries = c.sentQueries.queries[extra:]
+	}
+}
+
+// ServeQueries serves the most recent search requests sent to GitHub, oldest
+// first, to debug queries that unexpectedly match nothing.
+func (c *Controller) ServeQueries(w http.ResponseWriter, r *http.Request) {
+	c.sentQueries.Lock()
+	b, err := json.Marshal(c.sentQueries.queries)
+	c.sentQueries.Unlock()
 	if err != nil {
-		c.logger.WithError(err).Error("Decoding JSON.")
+		c.logger.WithError(err).Error("Encoding JSON.")
 		b = []byte("[]")
 	}
-	fmt.Fprintf(w, string(b))
+	w.Write(b)
+}
+
+// ServeConfig serves the Tide config that the controller currently operates
+// with, to confirm that a config reload took effect. Credentials are read from
+// their own files, but the decision webhook URL often carries a token, so it
+// is redacted along with the committer email.
+func (c *Controller) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	tideConfig := c.ca.Config().Tide
+	if tideConfig.CommitterEmail != "" {
+		tideConfig.CommitterEmail = "<redacted>"
+	}
+	if tideConfig.DecisionWebhookURL != "" {
+		tideConfig.DecisionWebhookURL = "<redacted>"
+	}
+	b, err := json.Marshal(tideConfig)
+	if err != nil {
+		c.logger.WithError(err).Error("Encoding JSON.")
+		http.Error(w, "error encoding the config", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// marshalPools encodes the pools, the label conflicts and the last sync error,
+// if any, as a Status. Each pool is encoded on its own and the ones that fail
+// are left out, so that a single bad pool does not blank the whole status
+// page.
+func marshalPools(logger *logrus.Entry, pools []interface{}, conflicts []string, syncErr error, syncErrTime time.Time) []byte {
+	status := struct {
+		SchemaVersion     int
+		Pools             []json.RawMessage
+		LastSyncError     string     `json:",omitempty"`
+		LastSyncErrorTime *time.Time `json:",omitempty"`
+		LabelConflicts    []string   `json:",omitempty"`
+	}{
+		SchemaVersion:  SchemaVersion,
+		Pools:          make([]json.RawMessage, 0, len(pools)),
+		LabelConflicts: conflicts,
+	}
+	if syncErr != nil {
+		status.LastSyncError = syncErr.Error()
+		status.LastSyncErrorTime = &syncErrTime
+	}
+	for i, pool := range pools {
+		b, err := json.Marshal(pool)
+		if err != nil {
+			logger.WithError(err).Errorf("Encoding pool %d to JSON.", i)
+			continue
+		}
+		status.Pools = append(status.Pools, b)
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		logger.WithError(err).Error("Encoding JSON.")
+		return []byte(fmt.Sprintf(`{"SchemaVersion":%d,"Pools":[]}`, SchemaVersion))
+	}
+	return b
 }
 
 type simpleState string
@@ -156,6 +890,9 @@ const (
 	noneState    simpleState = "none"
 	pendingState simpleState = "pending"
 	successState simpleState = "success"
+	// errorState is a job that could not run to completion, most likely
+	// because of the infrastructure. It counts as none, but may be retried.
+	errorState simpleState = "error"
 )
 
 func toSimpleState(s kube.ProwJobState) simpleState {
@@ -163,63 +900,736 @@ func toSimpleState(s kube.ProwJobState) simpleState {
 		return pendingState
 	} else if s == kube.SuccessState {
 		return successState
+	} else if s == kube.ErrorState {
+		return errorState
 	}
 	return noneState
 }
 
-func pickSmallestPassingNumber(prs []PullRequest) (bool, PullRequest) {
-	smallestNumber := -1
-	var smallestPR PullRequest
-	for _, pr := range prs {
-		if smallestNumber != -1 && int(pr.Number) >= smallestNumber {
-			continue
+func prKey(pr PullRequest) string {
+	return fmt.Sprintf("%s#%d", string(pr.Repository.NameWithOwner), int(pr.Number))
+}
+
+func hasLabel(pr PullRequest, label string) bool {
+	if label == "" {
+		return false
+	}
+	for _, l := range pr.Labels.Nodes {
+		if string(l.Name) == label {
+			return true
 		}
-		if len(pr.Commits.Nodes) < 1 {
+	}
+	return false
+}
+
+// dedupePRs removes PRs that were returned by more than one query, keeping
+// the copy with the most data for each and preserving first-seen order.
+func dedupePRs(pool []PullRequest) []PullRequest {
+	index := make(map[string]int)
+	var deduped []PullRequest
+	for _, pr := range pool {
+		key := prKey(pr)
+		if i, ok := index[key]; ok {
+			if richness(pr) > richness(deduped[i]) {
+				deduped[i] = pr
+			}
 			continue
 		}
-		// TODO(spxtr): Check the actual statuses for individual jobs.
-		if string(pr.Commits.Nodes[0].Commit.Status.State) != "SUCCESS" {
-			continue
+		index[key] = len(deduped)
+		deduped = append(deduped, pr)
+	}
+	return deduped
+}
+
+// richness is a rough measure of how much optional data was fetched for a PR.
+func richness(pr PullRequest) int {
+	return len(pr.Labels.Nodes) + len(pr.Commits.Nodes)
+}
+
+// withLabel returns the PRs that carry the label.
+func withLabel(prs []PullRequest, label string) []PullRequest {
+	var labeled []PullRequest
+	for _, pr := range prs {
+		if hasLabel(pr, label) {
+			labeled = append(labeled, pr)
 		}
-		smallestNumber = int(pr.Number)
-		smallestPR = pr
 	}
-	return smallestNumber > -1, smallestPR
+	return labeled
 }
 
-// accumulateBatch returns a list of PRs that can be merged after passing batch
-// testing, if any exist. It also returns whether or not a batch is currently
-// running.
-func accumulateBatch(presubmits []string, prs []PullRequest, pjs []kube.ProwJob) ([]PullRequest, bool) {
-	prNums := make(map[int]PullRequest)
+// withAnyLabel returns the PRs that carry any of the labels.
+func withAnyLabel(prs []PullRequest, labels []string) []PullRequest {
+	var labeled []PullRequest
 	for _, pr := range prs {
-		prNums[int(pr.Number)] = pr
+		for _, label := range labels {
+			if hasLabel(pr, label) {
+				labeled = append(labeled, pr)
+				break
+			}
+		}
 	}
-	type accState struct {
-		prs       []PullRequest
-		jobStates map[string]simpleState
-		// Are the pull requests in the ref still acceptable? That is, do they
-		// still point to the heads of the PRs?
-		validPulls bool
+	return labeled
+}
+
+// pruneRetests forgets retest requests for PRs that are no longer in the pool.
+func (c *Controller) pruneRetests(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[prKey(pr)] = true
 	}
-	states := make(map[string]*accState)
-	for _, pj := range pjs {
-		if pj.Spec.Type != kube.BatchJob {
-			continue
+	c.retests.Lock()
+	defer c.retests.Unlock()
+	for key := range c.retests.times {
+		if !inPool[key] {
+			delete(c.retests.times, key)
 		}
-		// If any batch job is pending, return now.
-		if toSimpleState(pj.Status.State) == pendingState {
-			return nil, true
+	}
+}
+
+func changeKey(pr PullRequest) string {
+	return prKey(pr) + "@" + string(pr.HeadRef.Target.OID)
+}
+
+// pruneChanges forgets the changes of PR heads that are no longer in the pool.
+func (c *Controller) pruneChanges(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[changeKey(pr)] = true
+	}
+	c.changes.Lock()
+	defer c.changes.Unlock()
+	for key := range c.changes.changes {
+		if !inPool[key] {
+			delete(c.changes.changes, key)
 		}
-		// Otherwise, accumulate results.
-		ref := pj.Spec.Refs.String()
-		if _, ok := states[ref]; !ok {
-			states[ref] = &accState{
-				jobStates:  make(map[string]simpleState),
-				validPulls: true,
-			}
-			for _, pull := range pj.Spec.Refs.Pulls {
-				if pr, ok := prNums[pull.Number]; ok && string(pr.HeadRef.Target.OID) == pull.SHA {
+	}
+}
+
+// pruneBatchComments forgets the batch comments on PRs that are no longer in
+// the pool.
+func (c *Controller) pruneBatchComments(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[prKey(pr)] = true
+	}
+	c.batchComments.Lock()
+	defer c.batchComments.Unlock()
+	for key := range c.batchComments.commented {
+		if !inPool[key] {
+			delete(c.batchComments.commented, key)
+		}
+	}
+}
+
+// pruneBranchUpdates forgets the branch updates of PRs that are no longer in
+// the pool.
+func (c *Controller) pruneBranchUpdates(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[prKey(pr)] = true
+	}
+	c.branchUpdates.Lock()
+	defer c.branchUpdates.Unlock()
+	for key := range c.branchUpdates.updates {
+		if !inPool[key] {
+			delete(c.branchUpdates.updates, key)
+		}
+	}
+}
+
+// pruneMergeRefusals forgets the merge refusals of PRs that are no longer in
+// the pool.
+func (c *Controller) pruneMergeRefusals(pool []PullRequest) {
+	inPool := make(map[string]bool)
+	for _, pr := range pool {
+		inPool[prKey(pr)] = true
+	}
+	c.mergeRefusals.Lock()
+	defer c.mergeRefusals.Unlock()
+	for key := range c.mergeRefusals.reasons {
+		if !inPool[key] {
+			delete(c.mergeRefusals.reasons, key)
+		}
+	}
+}
+
+// recordMergeRefusal remembers why GitHub refused to merge the PR, or forgets
+// it if err is nil.
+func (c *Controller) recordMergeRefusal(pr PullRequest, err error) {
+	c.mergeRefusals.Lock()
+	defer c.mergeRefusals.Unlock()
+	if err == nil {
+		delete(c.mergeRefusals.reasons, prKey(pr))
+		return
+	}
+	if c.mergeRefusals.reasons == nil {
+		c.mergeRefusals.reasons = make(map[string]string)
+	}
+	c.mergeRefusals.reasons[prKey(pr)] = err.Error()
+}
+
+// mergeRefusalsFor returns the reasons GitHub refused to merge the PRs, keyed
+// by number.
+func (c *Controller) mergeRefusalsFor(prs []PullRequest) map[int]string {
+	c.mergeRefusals.Lock()
+	defer c.mergeRefusals.Unlock()
+	reasons := make(map[int]string)
+	for _, pr := range prs {
+		if reason, ok := c.mergeRefusals.reasons[prKey(pr)]; ok {
+			reasons[int(pr.Number)] = reason
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return reasons
+}
+
+// changedFiles returns the names of the files changed by the PR. The cache is
+// not locked while the changes are fetched, so that other subpools need not
+// wait on the call.
+func (c *Controller) changedFiles(sp subpool, pr PullRequest) ([]string, error) {
+	key := changeKey(pr)
+	c.changes.Lock()
+	changes, ok := c.changes.changes[key]
+	c.changes.Unlock()
+	if !ok {
+		ghc, err := c.github(sp.org)
+		if err != nil {
+			return nil, err
+		}
+		changes, err = ghc.GetPullRequestChanges(sp.org, sp.repo, int(pr.Number))
+		if err != nil {
+			return nil, fmt.Errorf("error getting changes for %s/%s#%d: %v", sp.org, sp.repo, int(pr.Number), err)
+		}
+		c.changes.Lock()
+		if c.changes.changes == nil {
+			c.changes.changes = make(map[string][]github.PullRequestChange)
+		}
+		c.changes.changes[key] = changes
+		c.changes.Unlock()
+	}
+	var files []string
+	for _, change := range changes {
+		files = append(files, change.Filename)
+	}
+	return files, nil
+}
+
+// meetsPathRequirements returns whether the PR changes the files needed for
+// the presubmit to be required. Presubmits without path requirements always
+// are.
+func (c *Controller) meetsPathRequirements(sp subpool, pr PullRequest, presubmit string) (bool, error) {
+	var reqs []config.TidePathRequirement
+	for _, r := range c.ca.Config().Tide.PathRequirements {
+		if r.Presubmit == presubmit {
+			reqs = append(reqs, r)
+		}
+	}
+	if len(reqs) == 0 {
+		return true, nil
+	}
+	files, err := c.changedFiles(sp, pr)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range reqs {
+		if r.Matches(files) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// branchPresubmits returns the presubmits that Tide considers for the
+// subpool's branch, before any per-PR path requirements are applied. These are
+// the ones that always run, except those the repo makes optional, along with
+// those that Tide is configured to require. Both accumulating and triggering
+// start from them, so they always agree on what is required.
+func (c *Controller) branchPresubmits(sp subpool) []config.Presubmit {
+	tideConfig := c.ca.Config().Tide
+	requested := make(map[string]bool)
+	for _, job := range tideConfig.RequiredJobsFor(sp.org, sp.repo) {
+		requested[job] = true
+	}
+	optional := make(map[string]bool)
+	for _, job := range tideConfig.OptionalJobsFor(sp.org, sp.repo) {
+		optional[job] = true
+	}
+	var presubmits []config.Presubmit
+	for _, ps := range c.ca.Config().Presubmits[sp.org+"/"+sp.repo] {
+		if ps.SkipReport || !((ps.AlwaysRun && !optional[ps.Name]) || requested[ps.Name]) || !ps.RunsAgainstBranch(sp.branch) {
+			continue
+		}
+		presubmits = append(presubmits, ps)
+	}
+	return presubmits
+}
+
+// batchPresubmits returns the presubmits that Tide requires, and triggers, for
+// batches only. Presubmits that every PR requires are not among them.
+func (c *Controller) batchPresubmits(sp subpool) []config.Presubmit {
+	requested := make(map[string]bool)
+	for _, job := range c.ca.Config().Tide.BatchRequiredJobsFor(sp.org, sp.repo) {
+		requested[job] = true
+	}
+	for _, ps := range c.branchPresubmits(sp) {
+		delete(requested, ps.Name)
+	}
+	var presubmits []config.Presubmit
+	for _, ps := range c.ca.Config().Presubmits[sp.org+"/"+sp.repo] {
+		if ps.SkipReport || !requested[ps.Name] || !ps.RunsAgainstBranch(sp.branch) {
+			continue
+		}
+		presubmits = append(presubmits, ps)
+	}
+	return presubmits
+}
+
+// batchContexts returns the contexts that batches of the PR must pass: those
+// the PR requires, then the ones of the batch-only presubmits.
+func batchContexts(required []string, batchOnly []config.Presubmit) []string {
+	seen := make(map[string]bool)
+	contexts := append([]string{}, required...)
+	for _, context := range required {
+		seen[context] = true
+	}
+	for _, ps := range batchOnly {
+		if context := presubmitContext(ps); !seen[context] {
+			seen[context] = true
+			contexts = append(contexts, context)
+		}
+	}
+	return contexts
+}
+
+// requiredPresubmits returns the presubmits that Tide requires, and triggers,
+// for the PR.
+func (c *Controller) requiredPresubmits(sp subpool, pr PullRequest) ([]config.Presubmit, error) {
+	var presubmits []config.Presubmit
+	for _, ps := range c.branchPresubmits(sp) {
+		if ok, err := c.meetsPathRequirements(sp, pr, ps.Name); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		presubmits = append(presubmits, ps)
+	}
+	return presubmits, nil
+}
+
+// presubmitsFor returns the status contexts that must pass for the PR,
+// including the externally-provided ones. Several presubmits may report to the
+// same context, in which case it is listed once.
+func (c *Controller) presubmitsFor(sp subpool, pr PullRequest) ([]string, error) {
+	required, err := c.requiredPresubmits(sp, pr)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var contexts []string
+	for _, ps := range required {
+		if context := presubmitContext(ps); !seen[context] {
+			seen[context] = true
+			contexts = append(contexts, context)
+		}
+	}
+	var external []string
+	external = append(external, c.ca.Config().Tide.ExternalContextsFor(sp.org, sp.repo)...)
+	external = append(external, c.matchedContexts(sp, pr)...)
+	for _, context := range external {
+		if !seen[context] {
+			seen[context] = true
+			contexts = append(contexts, context)
+		}
+	}
+	return contexts, nil
+}
+
+// externalContexts returns the set of required contexts for the subpool's
+// repo that are reported by systems other than Prow, including those that
+// match the external context patterns on any of its PRs.
+func (c *Controller) externalContexts(sp subpool) map[string]bool {
+	external := make(map[string]bool)
+	for _, context := range c.ca.Config().Tide.ExternalContextsFor(sp.org, sp.repo) {
+		external[context] = true
+	}
+	for _, pr := range sp.prs {
+		for _, context := range c.matchedContexts(sp, pr) {
+			external[context] = true
+		}
+	}
+	return external
+}
+
+// matchedContexts returns the contexts on the PR's head that match the repo's
+// external context patterns. Contexts that a presubmit of the repo reports to
+// are left out, since they are judged by their jobs.
+func (c *Controller) matchedContexts(sp subpool, pr PullRequest) []string {
+	cfg := c.ca.Config()
+	patterns := cfg.Tide.ExternalContextPatternsFor(sp.org, sp.repo)
+	if len(patterns) == 0 {
+		return nil
+	}
+	presubmits := make(map[string]bool)
+	for _, ps := range cfg.Presubmits[sp.org+"/"+sp.repo] {
+		presubmits[presubmitContext(ps)] = true
+	}
+	var matched []string
+	for _, context := range headContexts(pr) {
+		if presubmits[context] {
+			continue
+		}
+		for _, re := range patterns {
+			if re.MatchString(context) {
+				matched = append(matched, context)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// headContexts returns the names of the status contexts and check runs on the
+// PR's head commit, sorted and without duplicates.
+func headContexts(pr PullRequest) []string {
+	if len(pr.Commits.Nodes) == 0 {
+		return nil
+	}
+	commit := pr.Commits.Nodes[0].Commit
+	seen := make(map[string]bool)
+	for _, ctx := range commit.Status.Contexts {
+		seen[string(ctx.Context)] = true
+	}
+	for _, node := range commit.StatusCheckRollup.Contexts.Nodes {
+		seen[string(node.StatusContext.Context)] = true
+		seen[string(node.CheckRun.Name)] = true
+	}
+	delete(seen, "")
+	var contexts []string
+	for context := range seen {
+		contexts = append(contexts, context)
+	}
+	sort.Strings(contexts)
+	return contexts
+}
+
+// contextState returns the state of a status context or check run on the PR's
+// head commit. A context that has not been reported yet is pending, since Tide
+// cannot trigger whatever reports it and can only wait.
+func contextState(pr PullRequest, context string) simpleState {
+	if s, ok := reportedState(pr, context); ok {
+		return s
+	}
+	return pendingState
+}
+
+// reportedState returns the state of a status context or check run on the
+// PR's head commit, and false if it has not been reported.
+func reportedState(pr PullRequest, context string) (simpleState, bool) {
+	if len(pr.Commits.Nodes) == 0 {
+		return "", false
+	}
+	commit := pr.Commits.Nodes[0].Commit
+	for _, ctx := range commit.Status.Contexts {
+		if string(ctx.Context) == context {
+			return toSimpleStatusState(string(ctx.State)), true
+		}
+	}
+	for _, node := range commit.StatusCheckRollup.Contexts.Nodes {
+		if string(node.StatusContext.Context) == context {
+			return toSimpleStatusState(string(node.StatusContext.State)), true
+		}
+		if run := node.CheckRun; string(run.Name) == context {
+			if run.Status != "COMPLETED" {
+				return pendingState, true
+			}
+			if run.Conclusion == "SUCCESS" || run.Conclusion == "NEUTRAL" {
+				return successState, true
+			}
+			return noneState, true
+		}
+	}
+	return "", false
+}
+
+// toSimpleStatusState converts a GitHub status state. GitHub reports EXPECTED
+// for contexts that have yet to report, so it counts as pending.
+func toSimpleStatusState(state string) simpleState {
+	switch state {
+	case "SUCCESS":
+		return successState
+	case "PENDING", "EXPECTED":
+		return pendingState
+	default:
+		return noneState
+	}
+}
+
+// rollupState returns the combined state of the PR's head commit, preferring
+// the rollup that includes check runs. A PR whose state GitHub has yet to
+// compute has none.
+func rollupState(pr PullRequest) simpleState {
+	if len(pr.Commits.Nodes) == 0 {
+		return noneState
+	}
+	commit := pr.Commits.Nodes[0].Commit
+	if state := commit.StatusCheckRollup.State; state != "" {
+		return toSimpleStatusState(string(state))
+	}
+	return toSimpleStatusState(string(commit.Status.State))
+}
+
+// overriddenRollupState is rollupState, but leaves out the contexts that a
+// status override covers. Without any, it is the combined state itself.
+func overriddenRollupState(pr PullRequest, overridden []string) simpleState {
+	if len(overridden) == 0 {
+		return rollupState(pr)
+	}
+	skip := make(map[string]bool)
+	for _, context := range overridden {
+		skip[context] = true
+	}
+	state := successState
+	for _, context := range headContexts(pr) {
+		if skip[context] {
+			continue
+		}
+		switch contextState(pr, context) {
+		case noneState:
+			return noneState
+		case pendingState:
+			state = pendingState
+		}
+	}
+	return state
+}
+
+// presubmitContext returns the status context the presubmit reports to,
+// falling back to its name.
+func presubmitContext(ps config.Presubmit) string {
+	if ps.Context != "" {
+		return ps.Context
+	}
+	return ps.Name
+}
+
+// jobContext returns the status context the job reports to, falling back to
+// its name.
+func jobContext(pj kube.ProwJob) string {
+	if pj.Spec.Context != "" {
+		return pj.Spec.Context
+	}
+	return pj.Spec.Job
+}
+
+// unionPresubmits returns the presubmits required by any of the PRs, which is
+// what a batch of them must pass.
+func unionPresubmits(presubmits map[int][]string, prs []PullRequest) []string {
+	seen := make(map[string]bool)
+	var union []string
+	for _, pr := range prs {
+		for _, ps := range presubmits[int(pr.Number)] {
+			if !seen[ps] {
+				seen[ps] = true
+				union = append(union, ps)
+			}
+		}
+	}
+	return union
+}
+
+// retestCooldown is how long Tide waits before honoring another retest request
+// for the same PR. This stops a label that could not be removed from
+// re-triggering presubmits on every sync.
+const retestCooldown = 10 * time.Minute
+
+// dueRetests returns the PRs in the subpool with a retest request that is not
+// cooling down.
+func (c *Controller) dueRetests(sp subpool) []PullRequest {
+	label := c.ca.Config().Tide.RetestLabel
+	now := c.now()
+	c.retests.Lock()
+	defer c.retests.Unlock()
+	var due []PullRequest
+	for _, pr := range sp.prs {
+		if !hasLabel(pr, label) {
+			continue
+		}
+		if t, ok := c.retests.times[prKey(pr)]; ok && now.Sub(t) < retestCooldown {
+			continue
+		}
+		due = append(due, pr)
+	}
+	return due
+}
+
+// recordRetest notes that the PR was retriggered for its retest request at
+// the time, so that its earlier presubmits are stale from then on.
+func (c *Controller) recordRetest(pr PullRequest, t time.Time) {
+	c.retests.Lock()
+	defer c.retests.Unlock()
+	if c.retests.times == nil {
+		c.retests.times = make(map[string]time.Time)
+	}
+	c.retests.times[prKey(pr)] = t
+}
+
+// dropStaleJobs removes presubmits that started before the most recent retest
+// request for their PR.
+func dropStaleJobs(sp subpool, retests map[string]time.Time) []kube.ProwJob {
+	if len(retests) == 0 {
+		return sp.pjs
+	}
+	prs := make(map[int]PullRequest)
+	for _, pr := range sp.prs {
+		prs[int(pr.Number)] = pr
+	}
+	var fresh []kube.ProwJob
+	for _, pj := range sp.pjs {
+		if pj.Spec.Type == kube.PresubmitJob && len(pj.Spec.Refs.Pulls) > 0 {
+			if pr, ok := prs[pj.Spec.Refs.Pulls[0].Number]; ok {
+				if t, ok := retests[prKey(pr)]; ok && pj.Status.StartTime.Before(t) {
+					continue
+				}
+			}
+		}
+		fresh = append(fresh, pj)
+	}
+	return fresh
+}
+
+// onHeads returns the jobs without the presubmits that ran against a commit
+// that is no longer the head of their PR, such as from before its branch was
+// updated.
+func onHeads(sp subpool) []kube.ProwJob {
+	heads := make(map[int]string)
+	for _, pr := range sp.prs {
+		heads[int(pr.Number)] = string(pr.HeadRef.Target.OID)
+	}
+	var current []kube.ProwJob
+	for _, pj := range sp.pjs {
+		if pj.Spec.Type == kube.PresubmitJob && len(pj.Spec.Refs.Pulls) > 0 {
+			pull := pj.Spec.Refs.Pulls[0]
+			if head, ok := heads[pull.Number]; ok && pull.SHA != head {
+				continue
+			}
+		}
+		current = append(current, pj)
+	}
+	return current
+}
+
+// pickSmallestNumber returns the smallest numbered PR, if any.
+func pickSmallestNumber(prs []PullRequest) (bool, PullRequest) {
+	smallestNumber := -1
+	var smallestPR PullRequest
+	for _, pr := range prs {
+		if smallestNumber != -1 && int(pr.Number) >= smallestNumber {
+			continue
+		}
+		smallestNumber = int(pr.Number)
+		smallestPR = pr
+	}
+	return smallestNumber > -1, smallestPR
+}
+
+// pickHighestScoring returns the passing PR with the highest score. Ties go to
+// the smallest number, which is the only criterion with the default scoring.
+// The contexts overridden on a PR, keyed by its number, do not count against
+// it. PRs that GitHub reports as conflicting with their base are skipped, so
+// that they do not take the serial slot from PRs that can be merged.
+func pickHighestScoring(prs []PullRequest, overridden map[int][]string, scoring config.TideMergeScoring, now time.Time) (bool, PullRequest) {
+	var best PullRequest
+	var bestScore float64
+	found := false
+	for _, pr := range prs {
+		// TODO(spxtr): Check the actual statuses for individual jobs.
+		if overriddenRollupState(pr, overridden[int(pr.Number)]) != successState {
+			continue
+		}
+		if pr.Mergeable == githubql.MergeableStateConflicting {
+			continue
+		}
+		score := prScore(pr, scoring, now)
+		if !found || score > bestScore || (score == bestScore && pr.Number < best.Number) {
+			best, bestScore, found = pr, score, true
+		}
+	}
+	return found, best
+}
+
+// prScore scores the PR for picking which one to act on next.
+func prScore(pr PullRequest, scoring config.TideMergeScoring, now time.Time) float64 {
+	var labels []string
+	for _, l := range pr.Labels.Nodes {
+		labels = append(labels, string(l.Name))
+	}
+	var age time.Duration
+	if !pr.CreatedAt.IsZero() {
+		age = now.Sub(pr.CreatedAt.Time)
+	}
+	return scoring.Score(labels, age, int(pr.Reviews.TotalCount))
+}
+
+// pickPassing picks the passing PR to act on next using the configured
+// scoring.
+func (c *Controller) pickPassing(sp subpool, prs []PullRequest) (bool, PullRequest) {
+	return pickHighestScoring(prs, sp.overridden, c.ca.Config().Tide.MergeScoring, c.now())
+}
+
+// accumulateBatch returns a list of PRs that can be merged after passing batch
+// testing, if any exist. It also returns whether or not a batch is currently
+// running, along with the PRs in the pool that are part of it. The contexts
+// that batches of each PR require are keyed by PR number. They may be more
+// than the PR requires on its own. Jobs are matched to them
+// by the context they report to. External contexts are not tested in batches,
+// so every PR in the batch must pass them on its own. Only batches tested
+// against the base SHA count, so that a batch is never merged onto a base it
+// was not tested with.
+func accumulateBatch(presubmits map[int][]string, external map[string]bool, baseSHA string, prs []PullRequest, pjs []kube.ProwJob) ([]PullRequest, []PullRequest, bool) {
+	prNums := make(map[int]PullRequest)
+	for _, pr := range prs {
+		prNums[int(pr.Number)] = pr
+	}
+	type accState struct {
+		prs       []PullRequest
+		jobStates map[string]simpleState
+		// Are the pull requests in the ref still acceptable? That is, do they
+		// still point to the heads of the PRs?
+		validPulls bool
+	}
+	states := make(map[string]*accState)
+	var pending bool
+	var pendingPRs []PullRequest
+	pendingSeen := make(map[int]bool)
+	for _, pj := range pjs {
+		if pj.Spec.Type != kube.BatchJob || pj.Spec.Refs.BaseSHA != baseSHA {
+			continue
+		}
+		// If any batch job is pending, note its members. Nothing merges then.
+		if toSimpleState(pj.Status.State) == pendingState {
+			pending = true
+			for _, pull := range pj.Spec.Refs.Pulls {
+				if pr, ok := prNums[pull.Number]; ok && !pendingSeen[pull.Number] {
+					pendingSeen[pull.Number] = true
+					pendingPRs = append(pendingPRs, pr)
+				}
+			}
+			continue
+		}
+		if pending {
+			continue
+		}
+		// Otherwise, accumulate results.
+		ref := pj.Spec.Refs.String()
+		if _, ok := states[ref]; !ok {
+			states[ref] = &accState{
+				jobStates:  make(map[string]simpleState),
+				validPulls: true,
+			}
+			for _, pull := range pj.Spec.Refs.Pulls {
+				if pr, ok := prNums[pull.Number]; ok && string(pr.HeadRef.Target.OID) == pull.SHA {
 					states[ref].prs = append(states[ref].prs, pr)
 				} else {
 					states[ref].validPulls = false
@@ -231,231 +1641,1790 @@ func accumulateBatch(presubmits []string, prs []PullRequest, pjs []kube.ProwJob)
 			// The batch contains a PR ref that has changed. Skip it.
 			continue
 		}
-		job := pj.Spec.Job
-		if s, ok := states[ref].jobStates[job]; !ok || s == noneState {
+		job := jobContext(pj)
+		if s, ok := states[ref].jobStates[job]; !ok || s == noneState || s == errorState {
 			states[ref].jobStates[job] = toSimpleState(pj.Status.State)
 		}
 	}
+	if pending {
+		return nil, pendingPRs, true
+	}
 	for _, state := range states {
 		if !state.validPulls {
 			continue
 		}
 		passesAll := true
-		for _, p := range presubmits {
+		for _, p := range unionPresubmits(presubmits, state.prs) {
+			if external[p] {
+				for _, pr := range state.prs {
+					if contextState(pr, p) != successState {
+						passesAll = false
+					}
+				}
+				continue
+			}
 			if s, ok := state.jobStates[p]; !ok || s != successState {
 				passesAll = false
 				continue
 			}
 		}
-		if !passesAll {
-			continue
+		if !passesAll {
+			continue
+		}
+		return state.prs, nil, false
+	}
+	return nil, nil, false
+}
+
+// blockingState returns the worst state of the blocking checks on the PR. A
+// check that has not reported yet is pending.
+func blockingState(pr PullRequest, checks []string) simpleState {
+	state := successState
+	for _, check := range checks {
+		switch contextState(pr, check) {
+		case noneState:
+			return noneState
+		case pendingState:
+			state = pendingState
+		}
+	}
+	return state
+}
+
+// overrideContexts splits the PR's required contexts into those that must
+// still pass and those that a status override label on the PR covers. Only
+// the contexts listed by an override whose label the PR carries are covered.
+func overrideContexts(overrides []config.TideStatusOverride, pr PullRequest, required []string) (kept, overridden []string) {
+	covered := make(map[string]bool)
+	for _, override := range overrides {
+		if !hasLabel(pr, override.Label) {
+			continue
+		}
+		for _, context := range override.Contexts {
+			covered[context] = true
+		}
+	}
+	for _, context := range required {
+		if covered[context] {
+			overridden = append(overridden, context)
+		} else {
+			kept = append(kept, context)
+		}
+	}
+	return kept, overridden
+}
+
+// overrideLabels returns the status override labels that the PR carries.
+func overrideLabels(overrides []config.TideStatusOverride, pr PullRequest) []string {
+	var labels []string
+	for _, override := range overrides {
+		if hasLabel(pr, override.Label) {
+			labels = append(labels, override.Label)
+		}
+	}
+	return labels
+}
+
+// heldByProtectedPaths returns the PRs in the subpool that change files on a
+// protected path without carrying the label it requires.
+func (c *Controller) heldByProtectedPaths(sp subpool, paths []config.TideProtectedPath) ([]PullRequest, error) {
+	var held []PullRequest
+	for _, pr := range sp.prs {
+		files, err := c.changedFiles(sp, pr)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if path.Matches(files) && !hasLabel(pr, path.Label) {
+				c.logger.Infof("Holding %s/%s#%d: it changes the protected path %q without the label %q.", sp.org, sp.repo, int(pr.Number), path.Path, path.Label)
+				held = append(held, pr)
+				break
+			}
+		}
+	}
+	return held, nil
+}
+
+// unresolvedThreads returns whether the PR has review threads that are not
+// resolved.
+func unresolvedThreads(pr PullRequest) bool {
+	for _, thread := range pr.ReviewThreads.Nodes {
+		if !bool(thread.IsResolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// withUnresolvedThreads returns the PRs that have unresolved review threads.
+func withUnresolvedThreads(prs []PullRequest) []PullRequest {
+	var unresolved []PullRequest
+	for _, pr := range prs {
+		if unresolvedThreads(pr) {
+			unresolved = append(unresolved, pr)
+		}
+	}
+	return unresolved
+}
+
+// without returns the PRs that are not among the excluded ones.
+func without(prs, excluded []PullRequest) []PullRequest {
+	skip := make(map[int]bool)
+	for _, pr := range excluded {
+		skip[int(pr.Number)] = true
+	}
+	var kept []PullRequest
+	for _, pr := range prs {
+		if !skip[int(pr.Number)] {
+			kept = append(kept, pr)
+		}
+	}
+	return kept
+}
+
+// applyBlockingChecks moves the PRs that do not pass their blocking checks out
+// of the successes, regardless of their presubmits: to the pendings if a check
+// is pending, and to the nones if one is failing.
+func applyBlockingChecks(checks []string, successes, pendings, nones []PullRequest) ([]PullRequest, []PullRequest, []PullRequest) {
+	var passing, waiting []PullRequest
+	for _, pr := range successes {
+		switch blockingState(pr, checks) {
+		case successState:
+			passing = append(passing, pr)
+		case pendingState:
+			waiting = append(waiting, pr)
+		default:
+			nones = append(nones, pr)
+		}
+	}
+	for _, pr := range pendings {
+		if blockingState(pr, checks) == noneState {
+			nones = append(nones, pr)
+		} else {
+			waiting = append(waiting, pr)
+		}
+	}
+	return passing, waiting, nones
+}
+
+// accumulateRollup sorts the PRs into buckets by their combined GitHub status
+// alone, for when the ProwJobs are not available.
+func accumulateRollup(prs []PullRequest) (successes, pendings, nones []PullRequest) {
+	for _, pr := range prs {
+		switch rollupState(pr) {
+		case successState:
+			successes = append(successes, pr)
+		case pendingState:
+			pendings = append(pendings, pr)
+		default:
+			nones = append(nones, pr)
+		}
+	}
+	return
+}
+
+// accumulate returns the supplied PRs sorted into three buckets based on their
+// accumulated state across the required contexts, which are keyed by PR
+// number. Jobs are matched to contexts by the context they report to. When a
+// context has several jobs, the strategy decides which of them counts. External
+// contexts are judged by the status reported on the PR instead. Only jobs that
+// ran against the base SHA count, so a PR that passed on a stale base is tested
+// again.
+func accumulate(presubmits map[int][]string, external map[string]bool, baseSHA string, prs []PullRequest, pjs []kube.ProwJob, strategy string) (successes, pendings, nones []PullRequest) {
+	successes, pendings, nones, _, _ = accumulateStates(presubmits, external, baseSHA, prs, pjs, strategy)
+	return
+}
+
+// contextGaps are the required contexts of a PR that keep it from passing,
+// other than the pending ones.
+type contextGaps struct {
+	// Missing contexts have no result at all: no job for a Prow context, no
+	// status or check run for an external one.
+	Missing []string
+	// Failing contexts have a result that failed or errored.
+	Failing []string
+}
+
+// accumulateStates is accumulate, but also returns the state it found for
+// each required context, keyed by PR number and then by context. Contexts
+// without any result are in the none state. It also returns the missing and
+// failing contexts of the PRs that have any, keyed by PR number.
+func accumulateStates(presubmits map[int][]string, external map[string]bool, baseSHA string, prs []PullRequest, pjs []kube.ProwJob, strategy string) (successes, pendings, nones []PullRequest, states map[int]map[string]simpleState, gaps map[int]contextGaps) {
+	pjs = onBase(pjs, baseSHA)
+	states = make(map[int]map[string]simpleState)
+	gaps = make(map[int]contextGaps)
+	for _, pr := range prs {
+		psStates := jobStates(pr, pjs, strategy)
+		required := make(map[string]simpleState)
+		var gap contextGaps
+		// The overall result is the worst of the best.
+		overallState := successState
+		for _, ps := range presubmits[int(pr.Number)] {
+			s, ok := psStates[ps]
+			if external[ps] {
+				s, ok = reportedState(pr, ps)
+				if !ok {
+					// Tide waits for external contexts to be reported.
+					s = pendingState
+				}
+			}
+			if !ok {
+				gap.Missing = append(gap.Missing, ps)
+			} else if s == noneState || s == errorState {
+				gap.Failing = append(gap.Failing, ps)
+			}
+			if !ok && !external[ps] {
+				s = noneState
+			}
+			required[ps] = s
+			if s == noneState || s == errorState {
+				overallState = noneState
+			} else if s == pendingState && overallState == successState {
+				overallState = pendingState
+			}
+		}
+		states[int(pr.Number)] = required
+		if len(gap.Missing) > 0 || len(gap.Failing) > 0 {
+			gaps[int(pr.Number)] = gap
+		}
+		if overallState == successState {
+			successes = append(successes, pr)
+		} else if overallState == pendingState {
+			pendings = append(pendings, pr)
+		} else {
+			nones = append(nones, pr)
+		}
+	}
+	return
+}
+
+// onBase returns the jobs that ran against the base SHA.
+func onBase(pjs []kube.ProwJob, baseSHA string) []kube.ProwJob {
+	var current []kube.ProwJob
+	for _, pj := range pjs {
+		if pj.Spec.Refs.BaseSHA == baseSHA {
+			current = append(current, pj)
+		}
+	}
+	return current
+}
+
+// jobStates returns the best, or latest, result of the PR's presubmits for each
+// context. With the all strategy, it is the worst of the best results of each
+// presubmit that reports to the context.
+func jobStates(pr PullRequest, pjs []kube.ProwJob, strategy string) map[string]simpleState {
+	if strategy == config.TideAccumulateAll {
+		return allJobStates(pr, pjs)
+	}
+	psStates := make(map[string]simpleState)
+	psStarts := make(map[string]time.Time)
+	for _, pj := range pjs {
+		// Malformed jobs without pulls cannot be matched to any PR.
+		if pj.Spec.Type != kube.PresubmitJob || len(pj.Spec.Refs.Pulls) == 0 {
+			continue
+		}
+		if pj.Spec.Refs.Pulls[0].Number != int(pr.Number) {
+			continue
+		}
+		name := jobContext(pj)
+		oldState := psStates[name]
+		newState := toSimpleState(pj.Status.State)
+		if strategy == config.TideAccumulateLatest {
+			if start, ok := psStarts[name]; !ok || pj.Status.StartTime.After(start) {
+				psStates[name] = newState
+				psStarts[name] = pj.Status.StartTime
+			}
+		} else if oldState == noneState || oldState == errorState || oldState == "" {
+			psStates[name] = newState
+		} else if oldState == pendingState && newState == successState {
+			psStates[name] = successState
+		}
+	}
+	return psStates
+}
+
+// allJobStates returns, for each context, the worst of the best results of the
+// PR's presubmits that report to it. A failure is worse than an error, which
+// is worse than a pending run.
+func allJobStates(pr PullRequest, pjs []kube.ProwJob) map[string]simpleState {
+	byJob := make(map[string][]kube.ProwJob)
+	for _, pj := range pjs {
+		byJob[pj.Spec.Job] = append(byJob[pj.Spec.Job], pj)
+	}
+	rank := map[simpleState]int{noneState: 0, errorState: 1, pendingState: 2, successState: 3}
+	psStates := make(map[string]simpleState)
+	for _, runs := range byJob {
+		for context, s := range jobStates(pr, runs, config.TideAccumulateBest) {
+			if old, ok := psStates[context]; !ok || rank[s] < rank[old] {
+				psStates[context] = s
+			}
+		}
+	}
+	return psStates
+}
+
+// erroredContexts returns the required contexts of the PR that ended in the
+// error state and have not yet been retriggered limit times on its head. If
+// any required context is failing or missing instead, there is nothing worth
+// retriggering and it returns nil.
+func erroredContexts(presubmits []string, external map[string]bool, pr PullRequest, pjs []kube.ProwJob, strategy string, limit int) []string {
+	psStates := jobStates(pr, pjs, strategy)
+	var errored []string
+	for _, ps := range presubmits {
+		s, ok := psStates[ps]
+		if external[ps] {
+			s, ok = contextState(pr, ps), true
+		}
+		if s == noneState || !ok {
+			return nil
+		}
+		if s == errorState && errorCount(pr, pjs, ps) <= limit {
+			errored = append(errored, ps)
+		}
+	}
+	return errored
+}
+
+// missingContexts returns the required contexts of the PR that have no job at
+// all even though others have run, which happens when presubmits are added to
+// the config while the PR is being tested. If a context is failing instead,
+// the PR needs a full retest and it returns nil, as it does for PRs that have
+// not been tested yet. External contexts are not Tide's to trigger.
+func missingContexts(presubmits []string, external map[string]bool, pr PullRequest, pjs []kube.ProwJob, strategy string) []string {
+	psStates := jobStates(pr, pjs, strategy)
+	var missing []string
+	var tested bool
+	for _, ps := range presubmits {
+		if external[ps] {
+			continue
+		}
+		s, ok := psStates[ps]
+		if !ok {
+			missing = append(missing, ps)
+			continue
+		}
+		if s == noneState || s == errorState {
+			return nil
+		}
+		tested = true
+	}
+	if !tested {
+		return nil
+	}
+	return missing
+}
+
+// graceMissingJobs moves the PRs that entered the pool less than the grace
+// period ago from the nones to the pendings if none of their required
+// contexts are failing, only missing. Their missing contexts are marked
+// pending in the states.
+func (c *Controller) graceMissingJobs(grace time.Duration, presubmits map[int][]string, external map[string]bool, pjs []kube.ProwJob, strategy string, pendings, nones []PullRequest, states map[int]map[string]simpleState) ([]PullRequest, []PullRequest) {
+	var missing []PullRequest
+	for _, pr := range nones {
+		if d, ok := c.timeInPool(pr); !ok || d >= grace || !onlyMissing(presubmits[int(pr.Number)], external, pr, pjs, strategy) {
+			missing = append(missing, pr)
+			continue
+		}
+		pendings = append(pendings, pr)
+		for context, state := range states[int(pr.Number)] {
+			if state == noneState {
+				states[int(pr.Number)][context] = pendingState
+			}
+		}
+	}
+	return pendings, missing
+}
+
+// onlyMissing returns true if none of the PR's required contexts are failing
+// or errored, so that it is only held back by contexts without any job.
+func onlyMissing(presubmits []string, external map[string]bool, pr PullRequest, pjs []kube.ProwJob, strategy string) bool {
+	psStates := jobStates(pr, pjs, strategy)
+	for _, ps := range presubmits {
+		s, ok := psStates[ps]
+		if external[ps] {
+			s, ok = contextState(pr, ps), true
+		}
+		if ok && (s == noneState || s == errorState) {
+			return false
+		}
+	}
+	return true
+}
+
+// erroredBatch returns a batch that was tested against the base SHA, and the
+// contexts to retrigger for it, if each of its required contexts either passed
+// or ended in the error state, and the errored ones did so at most limit
+// times. Batches with PRs that changed since are skipped. External contexts
+// are not tested by the batch, so they are left out.
+func erroredBatch(presubmits map[int][]string, external map[string]bool, baseSHA string, prs []PullRequest, pjs []kube.ProwJob, limit int) ([]PullRequest, []string) {
+	prNums := make(map[int]PullRequest)
+	for _, pr := range prs {
+		prNums[int(pr.Number)] = pr
+	}
+	type batchState struct {
+		prs       []PullRequest
+		jobStates map[string]simpleState
+		errors    map[string]int
+	}
+	batches := make(map[string]*batchState)
+	var refs []string
+	for _, pj := range pjs {
+		if pj.Spec.Type != kube.BatchJob || pj.Spec.Refs.BaseSHA != baseSHA {
+			continue
+		}
+		ref := pj.Spec.Refs.String()
+		state, ok := batches[ref]
+		if !ok {
+			state = &batchState{
+				jobStates: make(map[string]simpleState),
+				errors:    make(map[string]int),
+			}
+			for _, pull := range pj.Spec.Refs.Pulls {
+				pr, ok := prNums[pull.Number]
+				if !ok || string(pr.HeadRef.Target.OID) != pull.SHA {
+					state = nil
+					break
+				}
+				state.prs = append(state.prs, pr)
+			}
+			batches[ref] = state
+			refs = append(refs, ref)
+		}
+		if state == nil {
+			continue
+		}
+		job := jobContext(pj)
+		s := toSimpleState(pj.Status.State)
+		if s == errorState {
+			state.errors[job]++
+		}
+		// A pass wins over anything, and anything wins over an error.
+		if old, ok := state.jobStates[job]; !ok || old == errorState || s == successState {
+			state.jobStates[job] = s
+		}
+	}
+	for _, ref := range refs {
+		state := batches[ref]
+		if state == nil {
+			continue
+		}
+		var errored []string
+		retriggerable := true
+		for _, p := range unionPresubmits(presubmits, state.prs) {
+			if external[p] {
+				continue
+			}
+			switch s, ok := state.jobStates[p]; {
+			case ok && s == successState:
+			case ok && s == errorState && state.errors[p] <= limit:
+				errored = append(errored, p)
+			default:
+				retriggerable = false
+			}
+		}
+		if retriggerable && len(errored) > 0 {
+			return state.prs, errored
+		}
+	}
+	return nil, nil
+}
+
+// errorCount returns how many of the PR's presubmits for the context ended in
+// the error state on its current head.
+func errorCount(pr PullRequest, pjs []kube.ProwJob, context string) int {
+	var count int
+	for _, pj := range pjs {
+		if pj.Spec.Type != kube.PresubmitJob || len(pj.Spec.Refs.Pulls) == 0 || pj.Status.State != kube.ErrorState || jobContext(pj) != context {
+			continue
+		}
+		if pull := pj.Spec.Refs.Pulls[0]; pull.Number == int(pr.Number) && pull.SHA == string(pr.HeadRef.Target.OID) {
+			count++
+		}
+	}
+	return count
+}
+
+func prNumbers(prs []PullRequest) []int {
+	var nums []int
+	for _, pr := range prs {
+		nums = append(nums, int(pr.Number))
+	}
+	return nums
+}
+
+// gitRepo is the part of a *git.Repo that batches are assembled with.
+type gitRepo interface {
+	Clean() error
+	Config(key, value string) error
+	Checkout(commitlike string) error
+	RevParse(commitlike string) (string, error)
+	Merge(commitlike string) (bool, error)
+	Rebase(commitlike string) (bool, error)
+}
+
+// clone returns a fresh clone of the repo.
+func (c *Controller) clone(repo string) (gitRepo, error) {
+	if c.cloneFor != nil {
+		return c.cloneFor(repo)
+	}
+	return c.gc.Clone(repo)
+}
+
+var (
+	// gitAttempts bounds how many times the git operations that assemble a
+	// batch are run.
+	gitAttempts = 3
+	// gitBackoff is the delay before the first retry of a git operation. It
+	// doubles after every failed attempt.
+	gitBackoff = time.Second
+)
+
+// retryGit runs the git operation, retrying errors with backoff, since they
+// may be transient, such as lock contention on the shared git cache. Merges
+// and rebases that conflict are not errors, so they are not retried.
+func (c *Controller) retryGit(op string, f func() error) error {
+	backoff := gitBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= gitAttempts {
+			return err
+		}
+		c.logger.WithError(err).Warningf("Error running git %s, retrying in %v.", op, backoff)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// configureIdentity sets the identity that the merge commits Tide creates in
+// the repo are attributed to.
+func (c *Controller) configureIdentity(r gitRepo) error {
+	name, email := "prow", "prow@localhost"
+	tideConfig := c.ca.Config().Tide
+	if tideConfig.CommitterName != "" {
+		name = tideConfig.CommitterName
+	}
+	if tideConfig.CommitterEmail != "" {
+		email = tideConfig.CommitterEmail
+	}
+	if err := r.Config("user.name", name); err != nil {
+		return err
+	}
+	return r.Config("user.email", email)
+}
+
+// pickBatch picks the passing PRs that merge cleanly onto the subpool's base,
+// or rebase cleanly if the repo is configured to. It returns the base SHA they
+// were picked against, which the batch must be triggered against too.
+func (c *Controller) pickBatch(sp subpool) ([]PullRequest, string, error) {
+	baseSHA := sp.sha
+	tideConfig := c.ca.Config().Tide
+	var candidates []PullRequest
+	for _, pr := range sp.prs {
+		// TODO(spxtr): Check the actual statuses for individual jobs.
+		if overriddenRollupState(pr, sp.overridden[int(pr.Number)]) != successState {
+			continue
+		}
+		if tideConfig.SkipConflictingPRs && pr.Mergeable == githubql.MergeableStateConflicting {
+			c.logger.Infof("Leaving %s out of the batch: GitHub reports that it conflicts with %s.", prKey(pr), sp.branch)
+			continue
+		}
+		if tideConfig.RequireResolvedThreadsFor(sp.org, sp.repo) && unresolvedThreads(pr) {
+			continue
+		}
+		candidates = append(candidates, pr)
+	}
+	if len(candidates) == 0 {
+		return nil, baseSHA, nil
+	}
+	candidates = prioritized(candidates, tideConfig.BatchPriorityLabel)
+	var r gitRepo
+	if err := c.retryGit("clone", func() (err error) {
+		r, err = c.clone(sp.org + "/" + sp.repo)
+		return err
+	}); err != nil {
+		return nil, "", err
+	}
+	defer r.Clean()
+	if err := c.configureIdentity(r); err != nil {
+		return nil, "", err
+	}
+	if err := c.retryGit("checkout", func() error { return r.Checkout(baseSHA) }); err != nil {
+		return nil, "", err
+	}
+	apply := r.Merge
+	if tideConfig.BatchMergeStrategyFor(sp.org, sp.repo) == config.MergeRebase {
+		apply = r.Rebase
+	}
+	// TODO(spxtr): Limit batch size.
+	var res []PullRequest
+	var changedFiles int
+	for _, pr := range candidates {
+		// The head may be unreachable, such as when the fork it came from
+		// was deleted. That only keeps the PR out of the batch.
+		head := string(pr.HeadRef.Target.OID)
+		if _, err := r.RevParse(head + "^{commit}"); err != nil {
+			c.logger.WithError(err).Warningf("Leaving %s out of the batch: its head is unreachable.", prKey(pr))
+			continue
+		}
+		var files []string
+		if tideConfig.MaxBatchChangedFiles > 0 {
+			var err error
+			if files, err = c.changedFiles(sp, pr); err != nil {
+				return nil, "", err
+			}
+			if changedFiles+len(files) > tideConfig.MaxBatchChangedFiles {
+				c.logger.Infof("Leaving %s out of the batch: its %d changed files would exceed max_batch_changed_files (%d).", prKey(pr), len(files), tideConfig.MaxBatchChangedFiles)
+				continue
+			}
+		}
+		var ok bool
+		if err := c.retryGit("merge", func() (err error) {
+			ok, err = apply(head)
+			return err
+		}); err != nil {
+			return nil, "", err
+		} else if ok {
+			res = append(res, pr)
+			changedFiles += len(files)
+		} else if tideConfig.BatchPriorityLabel != "" && hasLabel(pr, tideConfig.BatchPriorityLabel) {
+			c.logger.Warningf("Leaving %s out of the batch despite its %q label: it does not apply cleanly to %s.", prKey(pr), tideConfig.BatchPriorityLabel, sp.branch)
+		}
+	}
+	return res, baseSHA, nil
+}
+
+// prioritized returns the PRs with the label first, keeping the order of the
+// PRs otherwise.
+func prioritized(prs []PullRequest, label string) []PullRequest {
+	if label == "" {
+		return prs
+	}
+	var first, rest []PullRequest
+	for _, pr := range prs {
+		if hasLabel(pr, label) {
+			first = append(first, pr)
+		} else {
+			rest = append(rest, pr)
+		}
+	}
+	return append(first, rest...)
+}
+
+// approvalBody is the body of the reviews Tide approves PRs with. Tide finds
+// its own approvals by it.
+const approvalBody = "Approved by Tide for merging."
+
+// approve leaves an approving review on the PR's head, unless Tide's approval
+// is still standing.
+func (c *Controller) approve(ghc githubClient, sp subpool, pr PullRequest) error {
+	reviews, err := ghc.ListReviews(sp.org, sp.repo, int(pr.Number))
+	if err != nil {
+		return err
+	}
+	for _, review := range reviews {
+		if review.Body == approvalBody && review.State == "APPROVED" {
+			return nil
+		}
+	}
+	c.logger.Infof("Approving %s/%s#%d before merging it.", sp.org, sp.repo, int(pr.Number))
+	return ghc.CreateReview(sp.org, sp.repo, int(pr.Number), github.DraftReview{
+		CommitSHA: string(pr.HeadRef.Target.OID),
+		Body:      approvalBody,
+		Action:    github.Approve,
+	})
+}
+
+// closePRs closes the PRs without merging them.
+func (c *Controller) closePRs(sp subpool, prs []PullRequest) error {
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		return err
+	}
+	for _, pr := range prs {
+		c.logger.Infof("Closing %s/%s#%d because of its labels.", sp.org, sp.repo, int(pr.Number))
+		if err := ghc.ClosePR(sp.org, sp.repo, int(pr.Number)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergePRs merges the PRs. Once ctx is done, it stops before the next merge and
+// returns why.
+func (c *Controller) mergePRs(ctx context.Context, sp subpool, prs []PullRequest) error {
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		return err
+	}
+	tideConfig := c.ca.Config().Tide
+	methods := tideConfig.MergeMethodsFor(sp.org, sp.repo)
+	if sp.linearHistory {
+		methods = linearMergeMethods(methods)
+	}
+	var message string
+	if tmpl := tideConfig.BatchCommitTemplateFor(sp.org, sp.repo); tmpl != nil && len(prs) > 1 {
+		if message, err = batchCommitMessage(tmpl, prs); err != nil {
+			return err
+		}
+	}
+	var batch []PullRequest
+	var stopped error
+	for _, pr := range prs {
+		if stopped = ctx.Err(); stopped != nil {
+			break
+		}
+		if tideConfig.ApproveBeforeMerge {
+			if err := c.approve(ghc, sp, pr); err != nil {
+				return err
+			}
+		}
+		if err := c.merge(ghc, sp, pr, methods, message); err != nil {
+			if _, ok := err.(github.ModifiedHeadError); ok {
+				// This is a possible source of incorrect behavior. If someone
+				// modifies their PR as we try to merge it in a batch then we
+				// end up in an untested state. This is unlikely to cause any
+				// real problems.
+				c.logger.WithError(err).Info("Merge failed: PR was modified.")
+			} else if methodNotAllowed(err) {
+				c.logger.WithError(err).Errorf("Merge failed: %s/%s allows none of the merge methods %q.", sp.org, sp.repo, methods)
+				c.recordMergeRefusal(pr, err)
+			} else if _, ok = err.(github.UnmergablePRError); ok {
+				// GitHub refuses with a 405, such as when branch protection
+				// blocks the merge. The other PRs may still merge.
+				c.logger.WithError(err).Warningf("Merge failed: %s/%s#%d is unmergable. How did it pass tests?!", sp.org, sp.repo, int(pr.Number))
+				c.recordMergeRefusal(pr, err)
+			} else {
+				return err
+			}
+			continue
+		}
+		c.recordMergeRefusal(pr, nil)
+		if tideConfig.VerifyMerges {
+			if merged, err := c.verifyMerge(ghc, sp, pr); err != nil {
+				return err
+			} else if !merged {
+				c.logger.Warningf("Merge of %s/%s#%d succeeded, but GitHub does not report it as merged. It will be retried next sync.", sp.org, sp.repo, int(pr.Number))
+				continue
+			}
+		}
+		c.observeMerge(sp, pr)
+		batch = append(batch, pr)
+	}
+	if len(batch) > 0 {
+		c.recordMerge(sp)
+	}
+	// Only batches merge several PRs at once.
+	if tideConfig.CommentOnBatchMerge && len(batch) > 1 {
+		if err := c.commentOnBatch(ghc, sp, batch); err != nil {
+			return err
+		}
+	}
+	return stopped
+}
+
+// recordMerge notes that Tide just merged into the subpool's branch.
+func (c *Controller) recordMerge(sp subpool) {
+	c.lastMerges.Lock()
+	defer c.lastMerges.Unlock()
+	if c.lastMerges.times == nil {
+		c.lastMerges.times = make(map[string]time.Time)
+	}
+	c.lastMerges.times[fmt.Sprintf("%s/%s %s", sp.org, sp.repo, sp.branch)] = c.now()
+	if key, ok := cooldownKey(c.ca.Config().Tide, sp); ok {
+		c.lastMerges.times[key] = c.now()
+	}
+}
+
+// cooldownKey returns the key of the merge cooldown that the subpool shares,
+// by the merge cooldown scope, and false if its branch has no cooldown.
+func cooldownKey(t config.Tide, sp subpool) (string, bool) {
+	if t.MergeCooldownBranchRegex != nil && !t.MergeCooldownBranchRegex.MatchString(sp.branch) {
+		return "", false
+	}
+	switch t.MergeCooldownScope {
+	case config.TideCooldownOrg:
+		return sp.org, true
+	case config.TideCooldownRepo:
+		return sp.org + "/" + sp.repo, true
+	default:
+		return fmt.Sprintf("%s/%s %s", sp.org, sp.repo, sp.branch), true
+	}
+}
+
+// coolingDown returns whether Tide merged into the subpool's branch, or any
+// branch in the same merge cooldown scope, less than the merge cooldown ago.
+func (c *Controller) coolingDown(sp subpool) bool {
+	tideConfig := c.ca.Config().Tide
+	if tideConfig.MergeCooldown <= 0 {
+		return false
+	}
+	key, ok := cooldownKey(tideConfig, sp)
+	if !ok {
+		return false
+	}
+	cooldown := tideConfig.MergeCooldown
+	c.lastMerges.Lock()
+	defer c.lastMerges.Unlock()
+	last, ok := c.lastMerges.times[key]
+	return ok && c.now().Sub(last) < cooldown
+}
+
+// brokenByMerge returns true if the subpool's branch started failing within
+// the post-merge failure window of a merge into it and has not passed since.
+// A branch whose status is pending or unknown is still considered broken.
+func (c *Controller) brokenByMerge(sp subpool) bool {
+	window := c.ca.Config().Tide.PostMergeFailureWindow
+	if window <= 0 {
+		return false
+	}
+	key := fmt.Sprintf("%s/%s %s", sp.org, sp.repo, sp.branch)
+	c.lastMerges.Lock()
+	defer c.lastMerges.Unlock()
+	state, ok := baseState(sp)
+	if ok && state == successState {
+		delete(c.lastMerges.broken, key)
+		return false
+	}
+	if c.lastMerges.broken[key] {
+		return true
+	}
+	if !ok || state != noneState {
+		return false
+	}
+	if last, ok := c.lastMerges.times[key]; !ok || c.now().Sub(last) > window {
+		return false
+	}
+	if c.lastMerges.broken == nil {
+		c.lastMerges.broken = make(map[string]bool)
+	}
+	c.lastMerges.broken[key] = true
+	return true
+}
+
+// commentOnBatch comments on each PR that was merged in the batch, listing the
+// others, unless it has already done so.
+func (c *Controller) commentOnBatch(ghc githubClient, sp subpool, batch []PullRequest) error {
+	c.batchComments.Lock()
+	defer c.batchComments.Unlock()
+	if c.batchComments.commented == nil {
+		c.batchComments.commented = make(map[string]bool)
+	}
+	for _, pr := range batch {
+		if c.batchComments.commented[prKey(pr)] {
+			continue
+		}
+		if err := ghc.CreateComment(sp.org, sp.repo, int(pr.Number), batchComment(pr, batch)); err != nil {
+			return err
+		}
+		c.batchComments.commented[prKey(pr)] = true
+	}
+	return nil
+}
+
+// batchComment is the comment on a PR that was merged in a batch.
+func batchComment(pr PullRequest, batch []PullRequest) string {
+	var others []string
+	for _, other := range batch {
+		if other.Number != pr.Number {
+			others = append(others, fmt.Sprintf("#%d", int(other.Number)))
+		}
+	}
+	return fmt.Sprintf("Tide merged this PR in a batch together with %s.", strings.Join(others, ", "))
+}
+
+// requiresLinearHistory returns whether the branch protection of the subpool
+// requires a linear history. It is looked up only if one of the configured
+// merge methods would create a merge commit. If the lookup fails, the
+// configured merge methods are used as they are.
+func (c *Controller) requiresLinearHistory(sp subpool) bool {
+	var mergeCommits bool
+	for _, method := range c.ca.Config().Tide.MergeMethodsFor(sp.org, sp.repo) {
+		mergeCommits = mergeCommits || method == "" || method == config.MergeMerge
+	}
+	if !mergeCommits {
+		return false
+	}
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		c.logger.WithError(err).Warningf("Could not check whether %s/%s %s requires a linear history.", sp.org, sp.repo, sp.branch)
+		return false
+	}
+	protection, err := ghc.GetBranchProtection(sp.org, sp.repo, sp.branch)
+	if err != nil {
+		c.logger.WithError(err).Warningf("Could not check whether %s/%s %s requires a linear history.", sp.org, sp.repo, sp.branch)
+		return false
+	}
+	return protection != nil && protection.RequiredLinearHistory.Enabled
+}
+
+// linearMergeMethods returns the merge methods to use on a branch that
+// requires a linear history, which rejects merge commits. Merges, including
+// GitHub's default, are squashed instead.
+func linearMergeMethods(methods []string) []string {
+	var linear []string
+	seen := make(map[string]bool)
+	for _, method := range methods {
+		if method == "" || method == config.MergeMerge {
+			method = config.MergeSquash
+		}
+		if !seen[method] {
+			seen[method] = true
+			linear = append(linear, method)
+		}
+	}
+	return linear
+}
+
+// batchCommitPR is a PR as seen by batch commit templates.
+type batchCommitPR struct {
+	Number int
+	Title  string
+	Author string
+}
+
+// batchCommitMessage renders the commit message for merging the PRs in a
+// batch, listing them in the order they are merged.
+func batchCommitMessage(tmpl *template.Template, batch []PullRequest) (string, error) {
+	var data struct{ PRs []batchCommitPR }
+	for _, pr := range batch {
+		data.PRs = append(data.PRs, batchCommitPR{
+			Number: int(pr.Number),
+			Title:  string(pr.Title),
+			Author: string(pr.Author.Login),
+		})
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering the batch commit message: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// merge merges the PR with the first of the methods that the repo allows. An
+// empty message keeps GitHub's default commit message.
+func (c *Controller) merge(ghc githubClient, sp subpool, pr PullRequest, methods []string, message string) error {
+	var err error
+	for i, method := range methods {
+		err = ghc.Merge(sp.org, sp.repo, int(pr.Number), github.MergeDetails{
+			CommitMessage: message,
+			SHA:           string(pr.HeadRef.Target.OID),
+			MergeMethod:   method,
+		})
+		if methodNotAllowed(err) && i+1 < len(methods) {
+			c.logger.WithError(err).Warningf("Merge method %q rejected for %s/%s#%d, falling back to %q.", method, sp.org, sp.repo, int(pr.Number), methods[i+1])
+			continue
+		}
+		if err == nil {
+			c.logger.Infof("Merged %s/%s#%d with merge method %q.", sp.org, sp.repo, int(pr.Number), method)
+		}
+		break
+	}
+	return err
+}
+
+// methodNotAllowed returns whether GitHub refused the merge because the repo
+// does not allow its merge method. GitHub refuses those with a 405 like any
+// other merge it refuses, so only the message tells them apart.
+func methodNotAllowed(err error) bool {
+	refusal, ok := err.(github.UnmergablePRError)
+	return ok && strings.Contains(string(refusal), "not allowed")
+}
+
+var (
+	// verifyMergeAttempts bounds how many times verifyMerge checks a PR.
+	verifyMergeAttempts = 3
+	// verifyMergeBackoff is the delay before checking a PR again. It doubles
+	// after every check.
+	verifyMergeBackoff = time.Second
+)
+
+// verifyMerge returns whether GitHub reports the PR as merged, waiting a
+// little for merges that GitHub completes asynchronously.
+func (c *Controller) verifyMerge(ghc githubClient, sp subpool, pr PullRequest) (bool, error) {
+	backoff := verifyMergeBackoff
+	for attempt := 1; ; attempt++ {
+		merged, err := ghc.IsMerged(sp.org, sp.repo, int(pr.Number))
+		if err != nil || merged || attempt >= verifyMergeAttempts {
+			return merged, err
+		}
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// trigger starts the required presubmits for the PRs, tested against the base
+// SHA. Presubmits that report to an external context are left alone.
+func (c *Controller) trigger(sp subpool, baseSHA string, prs []PullRequest) error {
+	return c.triggerContexts(sp, baseSHA, prs, nil)
+}
+
+// triggerContexts triggers the required presubmits of the PRs that report to
+// the given contexts, or all of them if contexts is nil.
+func (c *Controller) triggerContexts(sp subpool, baseSHA string, prs []PullRequest, contexts map[string]bool) error {
+	external := c.externalContexts(sp)
+	required := make(map[string]bool)
+	for _, pr := range prs {
+		presubmits, err := c.requiredPresubmits(sp, pr)
+		if err != nil {
+			return err
+		}
+		for _, ps := range presubmits {
+			required[ps.Name] = true
+		}
+	}
+	if len(prs) > 1 {
+		for _, ps := range c.batchPresubmits(sp) {
+			required[ps.Name] = true
+		}
+	}
+	for _, job := range planJobs(sp, baseSHA, prs, c.ca.Config().Presubmits[sp.org+"/"+sp.repo], required, external, contexts) {
+		if _, err := c.kc.CreateProwJob(pjutil.NewProwJob(job.spec, c.jobLabels(prs, job.labels))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobLabels returns the labels of a job that tests the PRs: the presubmit's
+// own, then the configured ones, then the ones Tide computes.
+func (c *Controller) jobLabels(prs []PullRequest, presubmit map[string]string) map[string]string {
+	tideConfig := c.ca.Config().Tide
+	labels := make(map[string]string)
+	for k, v := range presubmit {
+		labels[k] = v
+	}
+	for k, v := range tideConfig.JobLabels {
+		labels[k] = v
+	}
+	labels[createdByTideLabel] = "true"
+	labels[triggerLabel] = "serial"
+	if len(prs) > 1 {
+		labels[triggerLabel] = "batch"
+	}
+	if len(prs) > 0 {
+		c.prQueries.Lock()
+		query, ok := c.prQueries.queries[prKey(prs[0])]
+		c.prQueries.Unlock()
+		for i, q := range tideConfig.Queries {
+			if ok && q == query {
+				labels[queryLabel] = strconv.Itoa(i)
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// plannedJob is a ProwJob that trigger would create.
+type plannedJob struct {
+	spec   kube.ProwJobSpec
+	labels map[string]string
+}
+
+// planJobs returns the jobs that test the PRs against the base SHA: one for
+// each of the presubmits that is required, does not report to an external
+// context, reports to one of the contexts unless they are nil, and is not
+// already running in the subpool. It has no side effects, so the jobs can be
+// checked before they are created.
+func planJobs(sp subpool, baseSHA string, prs []PullRequest, presubmits []config.Presubmit, required, external, contexts map[string]bool) []plannedJob {
+	refs := kube.Refs{
+		Org:     sp.org,
+		Repo:    sp.repo,
+		BaseRef: sp.branch,
+		BaseSHA: baseSHA,
+	}
+	for _, pr := range prs {
+		refs.Pulls = append(
+			refs.Pulls,
+			kube.Pull{
+				Number: int(pr.Number),
+				Author: string(pr.Author.Login),
+				SHA:    string(pr.HeadRef.Target.OID),
+			},
+		)
+	}
+	var jobs []plannedJob
+	for _, ps := range presubmits {
+		if !required[ps.Name] || external[presubmitContext(ps)] {
+			continue
+		}
+		if contexts != nil && !contexts[presubmitContext(ps)] {
+			continue
+		}
+		if alreadyRunning(sp.pjs, ps.Name, refs) {
+			continue
+		}
+		var spec kube.ProwJobSpec
+		if len(prs) == 1 {
+			spec = pjutil.PresubmitSpec(ps, refs)
+		} else {
+			spec = pjutil.BatchSpec(ps, refs)
+		}
+		jobs = append(jobs, plannedJob{spec: spec, labels: ps.Labels})
+	}
+	return jobs
+}
+
+// alreadyRunning returns true if one of the jobs is a triggered or pending run
+// of the job on the refs.
+func alreadyRunning(pjs []kube.ProwJob, job string, refs kube.Refs) bool {
+	for _, pj := range pjs {
+		if pj.Spec.Job != job || toSimpleState(pj.Status.State) != pendingState {
+			continue
+		}
+		if pj.Spec.Refs.Org == refs.Org && pj.Spec.Refs.Repo == refs.Repo && pj.Spec.Refs.String() == refs.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// retest triggers fresh presubmits for the PR, records the retest so that the
+// PR's earlier presubmits are stale, and then removes the retest label so that
+// the request is only honored once.
+func (c *Controller) retest(sp subpool, pr PullRequest) error {
+	start := c.now()
+	// The PR's jobs, even the pending ones, are stale once it is retested, so
+	// they must not keep trigger from starting fresh ones.
+	sp.pjs = dropStaleJobs(sp, map[string]time.Time{prKey(pr): start})
+	if err := c.trigger(sp, sp.sha, []PullRequest{pr}); err != nil {
+		return err
+	}
+	c.recordRetest(pr, start)
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		return err
+	}
+	return ghc.RemoveLabel(sp.org, sp.repo, int(pr.Number), c.ca.Config().Tide.RetestLabel)
+}
+
+// dependencies returns the numbers of the PRs in the same repo that the PR
+// depends on, going by its labels with the prefix.
+func dependencies(pr PullRequest, prefix string) []int {
+	if prefix == "" {
+		return nil
+	}
+	var deps []int
+	for _, l := range pr.Labels.Nodes {
+		name := string(l.Name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimPrefix(name, prefix)); err == nil {
+			deps = append(deps, number)
+		}
+	}
+	return deps
+}
+
+// blockedByDependencies returns the numbers of the PRs that cannot be merged
+// together yet because they depend, directly or through each other, on PRs
+// that are neither merged nor among them. PRs whose dependencies in the pool
+// form a cycle can never be merged, so they are always blocked.
+func (c *Controller) blockedByDependencies(sp subpool, prs []PullRequest) (map[int]bool, error) {
+	prefix := c.ca.Config().Tide.DependencyLabelPrefix
+	blocked := make(map[int]bool)
+	if prefix == "" {
+		return blocked, nil
+	}
+	open := make(map[int]PullRequest)
+	for _, pr := range sp.prs {
+		open[int(pr.Number)] = pr
+	}
+	together := make(map[int]bool)
+	for _, pr := range prs {
+		together[int(pr.Number)] = true
+	}
+	merged := make(map[int]bool)
+	isMerged := func(number int) (bool, error) {
+		if m, ok := merged[number]; ok {
+			return m, nil
+		}
+		ghc, err := c.github(sp.org)
+		if err != nil {
+			return false, err
+		}
+		m, err := ghc.IsMerged(sp.org, sp.repo, number)
+		if err != nil {
+			return false, fmt.Errorf("error checking whether dependency %s/%s#%d is merged: %v", sp.org, sp.repo, number, err)
+		}
+		merged[number] = m
+		return m, nil
+	}
+	for _, pr := range prs {
+		if dependsOnItself(pr, open, prefix) {
+			c.logger.Warningf("%s/%s#%d is part of a dependency cycle and cannot be merged.", sp.org, sp.repo, int(pr.Number))
+			blocked[int(pr.Number)] = true
+			continue
+		}
+		for _, dep := range dependencies(pr, prefix) {
+			if together[dep] {
+				continue
+			}
+			if _, ok := open[dep]; ok {
+				blocked[int(pr.Number)] = true
+				break
+			}
+			m, err := isMerged(dep)
+			if err != nil {
+				return nil, err
+			}
+			if !m {
+				blocked[int(pr.Number)] = true
+				break
+			}
+		}
+	}
+	// PRs that depend on blocked PRs are blocked too.
+	for changed := true; changed; {
+		changed = false
+		for _, pr := range prs {
+			if blocked[int(pr.Number)] {
+				continue
+			}
+			for _, dep := range dependencies(pr, prefix) {
+				if blocked[dep] {
+					blocked[int(pr.Number)] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return blocked, nil
+}
+
+// dependsOnItself returns true if following the dependencies of the PR
+// through the open PRs leads back to it.
+func dependsOnItself(pr PullRequest, open map[int]PullRequest, prefix string) bool {
+	visited := make(map[int]bool)
+	next := dependencies(pr, prefix)
+	for len(next) > 0 {
+		number := next[0]
+		next = next[1:]
+		if number == int(pr.Number) {
+			return true
+		}
+		if visited[number] {
+			continue
+		}
+		visited[number] = true
+		if dep, ok := open[number]; ok {
+			next = append(next, dependencies(dep, prefix)...)
+		}
+	}
+	return false
+}
+
+// mergeableAlone returns the PRs that can be merged on their own as far as
+// their dependencies are concerned.
+func (c *Controller) mergeableAlone(sp subpool, prs []PullRequest) ([]PullRequest, error) {
+	if c.ca.Config().Tide.DependencyLabelPrefix == "" {
+		return prs, nil
+	}
+	var mergeable []PullRequest
+	for _, pr := range prs {
+		blocked, err := c.blockedByDependencies(sp, []PullRequest{pr})
+		if err != nil {
+			return nil, err
+		}
+		if !blocked[int(pr.Number)] {
+			mergeable = append(mergeable, pr)
+		}
+	}
+	return mergeable, nil
+}
+
+// orderByDependencies orders the PRs so that each is merged after the ones
+// among them that it depends on, and otherwise keeps their order. The PRs must
+// not depend on each other in a cycle.
+func orderByDependencies(prs []PullRequest, prefix string) []PullRequest {
+	pending := make(map[int]bool)
+	for _, pr := range prs {
+		pending[int(pr.Number)] = true
+	}
+	var ordered []PullRequest
+	for len(ordered) < len(prs) {
+		progress := false
+		for _, pr := range prs {
+			if !pending[int(pr.Number)] {
+				continue
+			}
+			ready := true
+			for _, dep := range dependencies(pr, prefix) {
+				if pending[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, pr)
+				delete(pending, int(pr.Number))
+				progress = true
+			}
+		}
+		if !progress {
+			// Only a cycle can get here. Keep the remaining PRs as they are.
+			for _, pr := range prs {
+				if pending[int(pr.Number)] {
+					ordered = append(ordered, pr)
+				}
+			}
+			break
+		}
+	}
+	return ordered
+}
+
+// sortedNumbers returns the numbers in the set in increasing order.
+func sortedNumbers(set map[int]bool) []int {
+	var numbers []int
+	for number := range set {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// withContexts returns the PRs that have contexts to trigger, which are keyed
+// by PR number.
+func withContexts(prs []PullRequest, contexts map[int][]string) []PullRequest {
+	var matching []PullRequest
+	for _, pr := range prs {
+		if len(contexts[int(pr.Number)]) > 0 {
+			matching = append(matching, pr)
+		}
+	}
+	return matching
+}
+
+// retrigger triggers the PR's presubmits for just the contexts, which are
+// described as why in the logs.
+func (c *Controller) retrigger(sp subpool, pr PullRequest, contexts []string, why string) error {
+	c.logger.Infof("Retriggering %s/%s#%d for %s contexts: %s.", sp.org, sp.repo, int(pr.Number), why, strings.Join(contexts, ", "))
+	only := make(map[string]bool)
+	for _, name := range contexts {
+		only[name] = true
+	}
+	return c.triggerContexts(sp, sp.sha, []PullRequest{pr}, only)
+}
+
+// retriggerBatch retriggers the errored jobs of the subpool's errored batch.
+func (c *Controller) retriggerBatch(sp subpool) error {
+	c.logger.Infof("Retriggering the batch %v for errored contexts: %s.", prNumbers(sp.erroredBatch), strings.Join(sp.erroredBatchContexts, ", "))
+	only := make(map[string]bool)
+	for _, name := range sp.erroredBatchContexts {
+		only[name] = true
+	}
+	return c.triggerContexts(sp, sp.sha, sp.erroredBatch, only)
+}
+
+// takeAction picks the action to take on the subpool and takes it, unless
+// dry-running. When it waits, it also returns the reason why. Once ctx is done,
+// such as when the action was abandoned for the subpool timeout, it no longer
+// merges or triggers anything.
+func (c *Controller) takeAction(ctx context.Context, sp subpool, batchPending bool, successes, pendings, nones, batchMerges []PullRequest) (Action, []PullRequest, string, error) {
+	dryRun := c.dryRun
+	if c.isPaused() {
+		c.logger.Infof("Paused: %s/%s %s will not be acted on.", sp.org, sp.repo, sp.branch)
+		dryRun = true
+	}
+	// PRs with a close label are closed rather than merged, whatever their
+	// tests say.
+	if toClose := withAnyLabel(sp.prs, c.ca.Config().Tide.CloseLabels); len(toClose) > 0 {
+		if dryRun {
+			return Close, toClose, "", nil
+		}
+		return Close, toClose, "", unlessDone(ctx, func() error { return c.closePRs(sp, toClose) })
+	}
+	if c.coolingDown(sp) {
+		return Wait, nil, waitMergeCooldown, nil
+	}
+	// Nothing is merged into a frozen branch, but its PRs are still tested.
+	// The same goes for a subpool that is re-run only to be tested.
+	frozen := c.ca.Config().Tide.Frozen(sp.branch) || sp.triggerOnly
+	// PRs are never merged before the PRs they depend on.
+	mergeable, err := c.mergeableAlone(sp, successes)
+	if err != nil {
+		return Wait, nil, "", err
+	}
+	if blocked, err := c.blockedByDependencies(sp, batchMerges); err != nil {
+		return Wait, nil, "", err
+	} else if len(blocked) > 0 {
+		c.logger.Infof("Not merging the batch: its PRs %v depend on unmerged PRs.", sortedNumbers(blocked))
+		batchMerges = nil
+	} else {
+		batchMerges = orderByDependencies(batchMerges, c.ca.Config().Tide.DependencyLabelPrefix)
+	}
+	// Without ProwJobs, Tide cannot tell which jobs are already running, so
+	// it only merges.
+	if sp.rollupOnly {
+		if frozen {
+			return Wait, nil, waitFrozen, nil
+		}
+		if ok, pr := c.pickPassing(sp, mergeable); ok {
+			return c.mergeSerially(ctx, sp, pr, dryRun)
+		}
+		return Wait, nil, waitReason(sp, batchPending, false, pendings), nil
+	}
+	// Merge the batch!
+	if len(batchMerges) > 0 && !frozen {
+		if dryRun {
+			return MergeBatch, batchMerges, "", nil
+		}
+		return MergeBatch, batchMerges, "", c.mergePRs(ctx, sp, batchMerges)
+	}
+	// Retest requests discard existing results, so honor them before merging.
+	if ok, pr := pickSmallestNumber(sp.retests); ok {
+		if dryRun {
+			return Trigger, []PullRequest{pr}, "", nil
+		}
+		return Trigger, []PullRequest{pr}, "", unlessDone(ctx, func() error { return c.retest(sp, pr) })
+	}
+	// The force-merge label lets a passing PR skip waiting for a pending batch.
+	if batchPending && !frozen {
+		if ok, pr := c.pickPassing(sp, withLabel(mergeable, c.ca.Config().Tide.ForceMergeLabel)); ok {
+			c.logger.Warningf("Force merging %s/%s#%d while a batch is pending.", sp.org, sp.repo, int(pr.Number))
+			return c.mergeSerially(ctx, sp, pr, dryRun)
+		}
+	}
+	// Do not merge PRs while waiting for a batch to complete. We don't want to
+	// invalidate the old batch result.
+	if len(successes) > 0 && !batchPending && !frozen {
+		if ok, pr := c.pickPassing(sp, mergeable); ok {
+			return c.mergeSerially(ctx, sp, pr, dryRun)
+		}
+	}
+	// Errors are likely infrastructure flakes, so retrigger just those jobs.
+	if ok, pr := pickSmallestNumber(withContexts(nones, sp.errored)); ok {
+		if dryRun {
+			return Trigger, []PullRequest{pr}, "", nil
+		}
+		return Trigger, []PullRequest{pr}, "", unlessDone(ctx, func() error { return c.retrigger(sp, pr, sp.errored[int(pr.Number)], "errored") })
+	}
+	// Presubmits added to the config after a PR was tested never run for it
+	// otherwise, so trigger just those.
+	if ok, pr := pickSmallestNumber(withContexts(nones, sp.missing)); ok {
+		if dryRun {
+			return Trigger, []PullRequest{pr}, "", nil
+		}
+		return Trigger, []PullRequest{pr}, "", unlessDone(ctx, func() error { return c.retrigger(sp, pr, sp.missing[int(pr.Number)], "missing") })
+	}
+	minBatchSize := c.ca.Config().Tide.MinBatchSize
+	if minBatchSize < 2 {
+		minBatchSize = 2
+	}
+	batches := c.ca.Config().Tide.BatchesEnabledFor(sp.org, sp.repo)
+	// Right after a merge, the PRs left may be tested together against the
+	// new base rather than one at a time.
+	batchFirst := sp.afterMerge && c.ca.Config().Tide.BatchAfterMerge && batches && len(sp.prs) >= minBatchSize && !batchPending
+	// If we have no serial jobs pending or successful, trigger one. On a
+	// frozen branch the passing PRs wait, so the others are tested meanwhile.
+	if len(nones) > 0 && len(pendings) == 0 && (len(successes) == 0 || frozen) && !batchFirst {
+		if ok, pr := c.pickPassing(sp, nones); ok {
+			if dryRun {
+				return Trigger, []PullRequest{pr}, "", nil
+			}
+			return Trigger, []PullRequest{pr}, "", unlessDone(ctx, func() error { return c.trigger(sp, sp.sha, []PullRequest{pr}) })
+		}
+	}
+	// A batch whose jobs only errored is tested again as it is, rather than
+	// reshuffled into a new one.
+	if batches && len(sp.erroredBatch) > 0 && !batchPending {
+		if !c.batchAllowed(sp) {
+			return Wait, nil, waitBatchLimit, nil
+		}
+		c.addPendingBatch(sp)
+		if dryRun {
+			return TriggerBatch, sp.erroredBatch, "", nil
+		}
+		return TriggerBatch, sp.erroredBatch, "", unlessDone(ctx, func() error { return c.retriggerBatch(sp) })
+	}
+	// If we have no batch, trigger one. Batches too small to be worth testing
+	// together are left to serial merges.
+	// A passing batch that was not merged because the branch is frozen is not
+	// tested again.
+	tooSmall := batches && len(sp.prs) > 1 && !batchPending
+	if batches && len(sp.prs) >= minBatchSize && !batchPending && len(batchMerges) == 0 {
+		if !c.batchAllowed(sp) {
+			return Wait, nil, waitBatchLimit, nil
+		}
+		batch, baseSHA, err := c.pickBatch(sp)
+		if err != nil {
+			return Wait, nil, waitPickBatchError, err
 		}
-		return state.prs, false
+		if len(batch) >= minBatchSize {
+			c.addPendingBatch(sp)
+			if dryRun {
+				return TriggerBatch, batch, "", nil
+			}
+			return TriggerBatch, batch, "", unlessDone(ctx, func() error { return c.trigger(sp, baseSHA, batch) })
+		}
+		tooSmall = len(batch) > 0
 	}
-	return nil, false
+	if frozen && !sp.triggerOnly && (len(mergeable) > 0 || len(batchMerges) > 0) {
+		return Wait, nil, waitFrozen, nil
+	}
+	return Wait, nil, waitReason(sp, batchPending, tooSmall, pendings), nil
 }
 
-// accumulate returns the supplied PRs sorted into three buckets based on their
-// accumulated state across the presubmits.
-func accumulate(presubmits []string, prs []PullRequest, pjs []kube.ProwJob) (successes, pendings, nones []PullRequest) {
-	for _, pr := range prs {
-		// Accumulate the best result for each job.
-		psStates := make(map[string]simpleState)
-		for _, pj := range pjs {
-			if pj.Spec.Type != kube.PresubmitJob {
-				continue
-			}
-			if pj.Spec.Refs.Pulls[0].Number != int(pr.Number) {
-				continue
-			}
-			name := pj.Spec.Job
-			oldState := psStates[name]
-			newState := toSimpleState(pj.Status.State)
-			if oldState == noneState || oldState == "" {
-				psStates[name] = newState
-			} else if oldState == pendingState && newState == successState {
-				psStates[name] = successState
-			}
+// mergeSerially merges the PR on its own. If the repo wants branches to be up
+// to date, a PR that is behind the base has its branch updated instead, and
+// Tide waits for it to be tested again.
+func (c *Controller) mergeSerially(ctx context.Context, sp subpool, pr PullRequest, dryRun bool) (Action, []PullRequest, string, error) {
+	if c.ca.Config().Tide.UpdateBranchesFor(sp.org, sp.repo) {
+		behind, err := c.behindBase(sp, pr)
+		if err != nil {
+			return Wait, nil, "", err
 		}
-		// The overall result is the worst of the best.
-		overallState := successState
-		for _, ps := range presubmits {
-			if s, ok := psStates[ps]; s == noneState || !ok {
-				overallState = noneState
-				break
-			} else if s == pendingState {
-				overallState = pendingState
+		if behind {
+			if dryRun {
+				return Wait, nil, waitBranchUpdate, nil
 			}
-		}
-		if overallState == successState {
-			successes = append(successes, pr)
-		} else if overallState == pendingState {
-			pendings = append(pendings, pr)
-		} else {
-			nones = append(nones, pr)
+			return Wait, nil, waitBranchUpdate, unlessDone(ctx, func() error { return c.updateBranch(sp, pr) })
 		}
 	}
-	return
+	if dryRun {
+		return Merge, []PullRequest{pr}, "", nil
+	}
+	return Merge, []PullRequest{pr}, "", c.mergePRs(ctx, sp, []PullRequest{pr})
 }
 
-func prNumbers(prs []PullRequest) []int {
-	var nums []int
-	for _, pr := range prs {
-		nums = append(nums, int(pr.Number))
+// unlessDone runs act unless ctx is done, in which case it returns why.
+func unlessDone(ctx context.Context, act func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return nums
+	return act()
 }
 
-func (c *Controller) pickBatch(sp subpool) ([]PullRequest, error) {
-	r, err := c.gc.Clone(sp.org + "/" + sp.repo)
+// behindBase returns whether the PR's branch is behind the base SHA. A PR
+// whose branch was updated as many times as the limit allows is never
+// considered behind, so that it is merged as it is.
+func (c *Controller) behindBase(sp subpool, pr PullRequest) (bool, error) {
+	c.branchUpdates.Lock()
+	last := c.branchUpdates.updates[prKey(pr)]
+	c.branchUpdates.Unlock()
+	if last.count >= c.ca.Config().Tide.BranchUpdateLimit {
+		c.logger.Warningf("Not updating the branch of %s/%s#%d again: it was updated %d times.", sp.org, sp.repo, int(pr.Number), last.count)
+		return false, nil
+	}
+	ghc, err := c.github(sp.org)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer r.Clean()
-	if err := r.Config("user.name", "prow"); err != nil {
-		return nil, err
+	comparison, err := ghc.CompareCommits(sp.org, sp.repo, sp.sha, string(pr.HeadRef.Target.OID))
+	if err != nil {
+		return false, fmt.Errorf("error comparing %s/%s#%d with the base: %v", sp.org, sp.repo, int(pr.Number), err)
 	}
-	if err := r.Config("user.email", "prow@localhost"); err != nil {
-		return nil, err
+	return comparison.BehindBy > 0, nil
+}
+
+// updateBranch updates the PR's branch to the base SHA and records that it did.
+// It is not updated to the same base SHA again once its head moved on. If the
+// head is still the one it was updated from, the update did not land, so it is
+// tried again, which counts against the branch update limit.
+func (c *Controller) updateBranch(sp subpool, pr PullRequest) error {
+	head := string(pr.HeadRef.Target.OID)
+	c.branchUpdates.Lock()
+	last := c.branchUpdates.updates[prKey(pr)]
+	c.branchUpdates.Unlock()
+	if last.baseSHA == sp.sha && last.headSHA != head {
+		return nil
 	}
-	if err := r.Checkout(sp.sha); err != nil {
-		return nil, err
+	ghc, err := c.github(sp.org)
+	if err != nil {
+		return err
 	}
-	// TODO(spxtr): Limit batch size.
-	var res []PullRequest
-	for _, pr := range sp.prs {
-		// TODO(spxtr): Check the actual statuses for individual jobs.
-		if string(pr.Commits.Nodes[0].Commit.Status.State) != "SUCCESS" {
-			continue
-		}
-		if ok, err := r.Merge(string(pr.HeadRef.Target.OID)); err != nil {
-			return nil, err
-		} else if ok {
-			res = append(res, pr)
-		}
+	c.logger.Infof("Updating the branch of %s/%s#%d to %s.", sp.org, sp.repo, int(pr.Number), sp.sha)
+	if err := ghc.UpdateBranch(sp.org, sp.repo, int(pr.Number), head); err != nil {
+		return fmt.Errorf("error updating the branch of %s/%s#%d: %v", sp.org, sp.repo, int(pr.Number), err)
 	}
-	return res, nil
+	c.branchUpdates.Lock()
+	defer c.branchUpdates.Unlock()
+	if c.branchUpdates.updates == nil {
+		c.branchUpdates.updates = make(map[string]branchUpdate)
+	}
+	c.branchUpdates.updates[prKey(pr)] = branchUpdate{baseSHA: sp.sha, headSHA: head, count: last.count + 1}
+	return nil
 }
 
-func (c *Controller) mergePRs(sp subpool, prs []PullRequest) error {
-	for _, pr := range prs {
-		if err := c.ghc.Merge(sp.org, sp.repo, int(pr.Number), github.MergeDetails{
-			SHA: string(pr.HeadRef.Target.OID),
-		}); err != nil {
-			if _, ok := err.(github.ModifiedHeadError); ok {
-				// This is a possible source of incorrect behavior. If someone
-				// modifies their PR as we try to merge it in a batch then we
-				// end up in an untested state. This is unlikely to cause any
-				// real problems.
-				c.logger.WithError(err).Info("Merge failed: PR was modified.")
-			} else if _, ok = err.(github.UnmergablePRError); ok {
-				c.logger.WithError(err).Warning("Merge failed: PR is unmergable. How did it pass tests?!")
-			} else {
-				return err
-			}
+// countPendingBatches records the repos that have a pending batch job.
+func (c *Controller) countPendingBatches(pjs []kube.ProwJob) {
+	c.pendingBatches.Lock()
+	defer c.pendingBatches.Unlock()
+	c.pendingBatches.repos = make(map[string]bool)
+	for _, pj := range pjs {
+		if pj.Spec.Type == kube.BatchJob && toSimpleState(pj.Status.State) == pendingState {
+			c.pendingBatches.repos[pj.Spec.Refs.Org+"/"+pj.Spec.Refs.Repo] = true
 		}
 	}
-	return nil
 }
 
-func (c *Controller) trigger(sp subpool, prs []PullRequest) error {
-	for _, ps := range c.ca.Config().Presubmits[sp.org+"/"+sp.repo] {
-		if ps.SkipReport || !ps.AlwaysRun || !ps.RunsAgainstBranch(sp.branch) {
-			continue
-		}
+// batchAllowed returns false if the subpool's repo may not trigger a batch
+// because too many other repos have one pending.
+func (c *Controller) batchAllowed(sp subpool) bool {
+	limit := c.ca.Config().Tide.MaxPendingBatches
+	if limit <= 0 {
+		return true
+	}
+	c.pendingBatches.Lock()
+	defer c.pendingBatches.Unlock()
+	repos := c.pendingBatches.repos
+	return repos[sp.org+"/"+sp.repo] || len(repos) < limit
+}
 
-		var spec kube.ProwJobSpec
-		refs := kube.Refs{
-			Org:     sp.org,
-			Repo:    sp.repo,
-			BaseRef: sp.branch,
-			BaseSHA: sp.sha,
-		}
-		for _, pr := range prs {
-			refs.Pulls = append(
-				refs.Pulls,
-				kube.Pull{
-					Number: int(pr.Number),
-					Author: string(pr.Author.Login),
-					SHA:    string(pr.HeadRef.Target.OID),
-				},
-			)
-		}
-		if len(prs) == 1 {
-			spec = pjutil.PresubmitSpec(ps, refs)
-		} else {
-			spec = pjutil.BatchSpec(ps, refs)
-		}
-		pj := pjutil.NewProwJob(spec, ps.Labels)
-		if _, err := c.kc.CreateProwJob(pj); err != nil {
-			return err
-		}
+// addPendingBatch records that the subpool's repo now has a pending batch.
+func (c *Controller) addPendingBatch(sp subpool) {
+	c.pendingBatches.Lock()
+	defer c.pendingBatches.Unlock()
+	if c.pendingBatches.repos == nil {
+		c.pendingBatches.repos = make(map[string]bool)
 	}
-	return nil
+	c.pendingBatches.repos[sp.org+"/"+sp.repo] = true
 }
 
-func (c *Controller) takeAction(sp subpool, batchPending bool, successes, pendings, nones, batchMerges []PullRequest) (Action, []PullRequest, error) {
-	// Merge the batch!
-	if len(batchMerges) > 0 {
-		if c.dryRun {
-			return MergeBatch, batchMerges, nil
+// waitReason explains why takeAction found nothing to do.
+func waitReason(sp subpool, batchPending, batchTooSmall bool, pendings []PullRequest) string {
+	switch {
+	case len(sp.prs) == 0:
+		return waitNoCandidates
+	case batchPending:
+		return waitBatchPending
+	case batchTooSmall:
+		return waitBatchTooSmall
+	case len(pendings) > 0:
+		return waitPending
+	default:
+		return waitIneligible
+	}
+}
+
+func (c *Controller) syncSubpool(sp subpool) error {
+	c.logger.Infof("%s/%s %s: %d PRs, %d PJs.", sp.org, sp.repo, sp.branch, len(sp.prs), len(sp.pjs))
+	// Batches may require more contexts than PRs merged on their own.
+	presubmits := make(map[int][]string)
+	batchRequired := make(map[int][]string)
+	batchOnly := c.batchPresubmits(sp)
+	overridden := make(map[int][]string)
+	overrides := c.ca.Config().Tide.StatusOverridesFor(sp.org, sp.repo)
+	for _, pr := range sp.prs {
+		required, err := c.presubmitsFor(sp, pr)
+		if err != nil {
+			return err
 		}
-		return MergeBatch, batchMerges, c.mergePRs(sp, batchMerges)
+		batchRequired[int(pr.Number)], _ = overrideContexts(overrides, pr, batchContexts(required, batchOnly))
+		if required, overridden[int(pr.Number)] = overrideContexts(overrides, pr, required); len(overridden[int(pr.Number)]) > 0 {
+			c.logger.WithField("labels", overrideLabels(overrides, pr)).Warningf("Overriding the required contexts %v of %s/%s#%d.", overridden[int(pr.Number)], sp.org, sp.repo, int(pr.Number))
+		} else {
+			delete(overridden, int(pr.Number))
+		}
+		presubmits[int(pr.Number)] = required
 	}
-	// Do not merge PRs while waiting for a batch to complete. We don't want to
-	// invalidate the old batch result.
-	if len(successes) > 0 && !batchPending {
-		if ok, pr := pickSmallestPassingNumber(successes); ok {
-			if c.dryRun {
-				return Merge, []PullRequest{pr}, nil
+	sp.overridden = overridden
+	sp.retests = c.dueRetests(sp)
+	c.retests.Lock()
+	sp.pjs = dropStaleJobs(sp, c.retests.times)
+	c.retests.Unlock()
+	sp.pjs = onHeads(sp)
+	var successes, pendings, nones, batchMerge, batchPendingPRs []PullRequest
+	var states map[int]map[string]simpleState
+	var gaps map[int]contextGaps
+	var batchPending bool
+	if sp.rollupOnly {
+		successes, pendings, nones = accumulateRollup(sp.prs)
+	} else {
+		strategy := c.ca.Config().Tide.AccumulationStrategyFor(sp.org, sp.repo)
+		external := c.externalContexts(sp)
+		successes, pendings, nones, states, gaps = accumulateStates(presubmits, external, sp.sha, sp.prs, sp.pjs, strategy)
+		if grace := c.ca.Config().Tide.MissingJobGracePeriod; grace > 0 {
+			pendings, nones = c.graceMissingJobs(grace, presubmits, external, sp.pjs, strategy, pendings, nones, states)
+		}
+		if limit := c.ca.Config().Tide.ErrorRetriggers; limit > 0 {
+			sp.errored = make(map[int][]string)
+			for _, pr := range nones {
+				sp.errored[int(pr.Number)] = erroredContexts(presubmits[int(pr.Number)], external, pr, sp.pjs, strategy, limit)
+			}
+		}
+		sp.missing = make(map[int][]string)
+		for _, pr := range nones {
+			sp.missing[int(pr.Number)] = missingContexts(presubmits[int(pr.Number)], external, pr, sp.pjs, strategy)
+		}
+		if c.ca.Config().Tide.BatchesEnabledFor(sp.org, sp.repo) {
+			batchMerge, batchPendingPRs, batchPending = accumulateBatch(batchRequired, external, sp.sha, sp.prs, sp.pjs)
+			if limit := c.ca.Config().Tide.BatchErrorRetriggers; limit > 0 && !batchPending && len(batchMerge) == 0 {
+				sp.erroredBatch, sp.erroredBatchContexts = erroredBatch(batchRequired, external, sp.sha, sp.prs, sp.pjs, limit)
 			}
-			return Merge, []PullRequest{pr}, c.mergePRs(sp, []PullRequest{pr})
 		}
 	}
-	// If we have no serial jobs pending or successful, trigger one.
-	if len(nones) > 0 && len(pendings) == 0 && len(successes) == 0 {
-		if ok, pr := pickSmallestPassingNumber(nones); ok {
-			if c.dryRun {
-				return Trigger, []PullRequest{pr}, nil
+	if checks := c.ca.Config().Tide.BlockingChecksFor(sp.org, sp.repo); len(checks) > 0 {
+		successes, pendings, nones = applyBlockingChecks(checks, successes, pendings, nones)
+		for _, pr := range batchMerge {
+			if blockingState(pr, checks) != successState {
+				c.logger.Infof("Not merging the batch: %s/%s#%d does not pass its blocking checks.", sp.org, sp.repo, int(pr.Number))
+				batchMerge = nil
+				break
 			}
-			return Trigger, []PullRequest{pr}, c.trigger(sp, []PullRequest{pr})
 		}
 	}
-	// If we have no batch, trigger one.
-	if len(sp.prs) > 1 && !batchPending {
-		batch, err := c.pickBatch(sp)
-		if err != nil {
-			return Wait, nil, err
+	var held []PullRequest
+	if paths := c.ca.Config().Tide.ProtectedPaths; len(paths) > 0 {
+		var err error
+		if held, err = c.heldByProtectedPaths(sp, paths); err != nil {
+			return err
 		}
-		if len(batch) > 1 {
-			if c.dryRun {
-				return TriggerBatch, batch, nil
-			}
-			return TriggerBatch, batch, c.trigger(sp, batch)
+		successes = without(successes, held)
+		sp.prs = without(sp.prs, held)
+		if len(without(batchMerge, held)) < len(batchMerge) {
+			c.logger.Infof("Not merging the batch: it has PRs %v that change protected paths without the required label.", prNumbers(held))
+			batchMerge = nil
 		}
 	}
-	return Wait, nil, nil
-}
-
-func (c *Controller) syncSubpool(sp subpool) error {
-	c.logger.Infof("%s/%s %s: %d PRs, %d PJs.", sp.org, sp.repo, sp.branch, len(sp.prs), len(sp.pjs))
-	var presubmits []string
-	for _, ps := range c.ca.Config().Presubmits[sp.org+"/"+sp.repo] {
-		if ps.SkipReport || !ps.AlwaysRun || !ps.RunsAgainstBranch(sp.branch) {
-			continue
+	var unresolved []PullRequest
+	if c.ca.Config().Tide.RequireResolvedThreadsFor(sp.org, sp.repo) {
+		unresolved = withUnresolvedThreads(sp.prs)
+		successes = without(successes, unresolved)
+		if len(without(batchMerge, unresolved)) < len(batchMerge) {
+			c.logger.Infof("Not merging the batch: it has PRs %v with unresolved review threads.", prNumbers(unresolved))
+			batchMerge = nil
 		}
-		presubmits = append(presubmits, ps.Name)
 	}
-	successes, pendings, nones := accumulate(presubmits, sp.prs, sp.pjs)
-	batchMerge, batchPending := accumulateBatch(presubmits, sp.prs, sp.pjs)
+	c.reportStatuses(sp, presubmits, successes, pendings, nones)
 	c.logger.Infof("Passing PRs: %v", prNumbers(successes))
 	c.logger.Infof("Pending PRs: %v", prNumbers(pendings))
 	c.logger.Infof("Missing PRs: %v", prNumbers(nones))
 	c.logger.Infof("Passing batch: %v", prNumbers(batchMerge))
-	c.logger.Infof("Pending batch: %v", batchPending)
-	act, targets, err := c.takeAction(sp, batchPending, successes, pendings, nones, batchMerge)
+	c.logger.Infof("Pending batch: %v %v", batchPending, prNumbers(batchPendingPRs))
+	c.recordMergeable(sp, successes)
+	var act Action
+	var targets []PullRequest
+	var reason string
+	var err error
+	if c.unconfiguredOrgRepo(sp) {
+		c.logger.Warningf("%s/%s is only reached through an org-wide query and has no presubmits configured.", sp.org, sp.repo)
+	}
+	if c.missingRequiredPresubmits(sp) {
+		// With nothing required every PR looks like it passes. Merging would
+		// land untested code, so wait for the config to be fixed.
+		c.logger.Warningf("%s/%s has presubmits but none are required for %s. Refusing to merge.", sp.org, sp.repo, sp.branch)
+		act = Wait
+		reason = waitNotRequired
+	} else if c.unconfiguredOrgRepo(sp) && c.ca.Config().Tide.RequirePresubmits {
+		act = Wait
+		reason = waitUnconfigured
+	} else if c.ca.Config().Tide.BlockOnFailingBase && baseFailing(sp) {
+		c.logger.Warningf("%s/%s %s is failing its own tests at %s. Refusing to merge.", sp.org, sp.repo, sp.branch, sp.sha)
+		act = Wait
+		reason = waitFailingBase
+	} else if c.brokenByMerge(sp) {
+		c.logger.Warningf("%s/%s %s started failing its own tests after Tide merged into it. Pausing until it recovers.", sp.org, sp.repo, sp.branch)
+		act = Wait
+		reason = waitBrokenByMerge
+	} else {
+		act, targets, reason, err = c.takeActionTimeout(sp, batchPending, successes, pendings, nones, batchMerge)
+	}
 	c.logger.Infof("Action: %v, Targets: %v", act, targets)
-	c.pools = append(c.pools, Pool{
+	pool := Pool{
 		Org:    sp.org,
 		Repo:   sp.repo,
 		Branch: sp.branch,
@@ -464,12 +3433,211 @@ func (c *Controller) syncSubpool(sp subpool) error {
 		PendingPRs: pendings,
 		MissingPRs: nones,
 
-		Action: act,
-		Target: targets,
-	})
+		BatchPending:  batchPendingPRs,
+		HeldPRs:       held,
+		UnresolvedPRs: unresolved,
+
+		OverriddenContexts: overridden,
+
+		MergeRefusals: c.mergeRefusalsFor(sp.prs),
+
+		TimeInPool:     c.poolTimesFor(sp.prs),
+		BlockedByBatch: blockedByBatch(batchPending, successes, targets),
+
+		Jobs:     poolJobs(sp.pjs),
+		Contexts: poolContexts(states),
+
+		MissingContexts: missingFrom(gaps),
+		FailingContexts: failingFrom(gaps),
+
+		Action:     act,
+		Target:     targets,
+		WaitReason: reason,
+	}
+	if _, ok := err.(subpoolTimeoutError); ok {
+		// Record the timeout and let the rest of the sync proceed.
+		c.logger.WithError(err).Warningf("Abandoning %s/%s %s.", sp.org, sp.repo, sp.branch)
+		pool.Error = err.Error()
+		err = nil
+	}
+	c.pools = append(c.pools, pool)
+	c.postDecision(pool)
+	c.recordPlan(pool)
 	return err
 }
 
+// blockedByBatch returns the passing PRs that were not acted on only because a
+// batch is pending, keyed by PR number.
+func blockedByBatch(batchPending bool, successes, targets []PullRequest) map[int]bool {
+	if !batchPending {
+		return nil
+	}
+	blocked := make(map[int]bool)
+	for _, pr := range without(successes, targets) {
+		blocked[int(pr.Number)] = true
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+	return blocked
+}
+
+// poolContexts returns the states of the required contexts of each PR, keyed
+// by PR number and then by context.
+func poolContexts(states map[int]map[string]simpleState) map[int]map[string]string {
+	if len(states) == 0 {
+		return nil
+	}
+	contexts := make(map[int]map[string]string)
+	for number, required := range states {
+		contexts[number] = make(map[string]string)
+		for context, state := range required {
+			contexts[number][context] = string(state)
+		}
+	}
+	return contexts
+}
+
+// missingFrom returns the missing contexts of each PR that has any, keyed by
+// PR number.
+func missingFrom(gaps map[int]contextGaps) map[int][]string {
+	missing := make(map[int][]string)
+	for number, gap := range gaps {
+		if len(gap.Missing) > 0 {
+			missing[number] = gap.Missing
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return missing
+}
+
+// failingFrom returns the failing contexts of each PR that has any, keyed by
+// PR number.
+func failingFrom(gaps map[int]contextGaps) map[int][]string {
+	failing := make(map[int][]string)
+	for number, gap := range gaps {
+		if len(gap.Failing) > 0 {
+			failing[number] = gap.Failing
+		}
+	}
+	if len(failing) == 0 {
+		return nil
+	}
+	return failing
+}
+
+// poolJobs returns the presubmits that accumulate matches to each PR, keyed by
+// PR number.
+func poolJobs(pjs []kube.ProwJob) map[int][]PoolJob {
+	jobs := make(map[int][]PoolJob)
+	for _, pj := range pjs {
+		if pj.Spec.Type != kube.PresubmitJob || len(pj.Spec.Refs.Pulls) == 0 {
+			continue
+		}
+		number := pj.Spec.Refs.Pulls[0].Number
+		jobs[number] = append(jobs[number], PoolJob{
+			Name:    pj.Spec.Job,
+			Context: jobContext(pj),
+			State:   pj.Status.State,
+		})
+	}
+	return jobs
+}
+
+// missingRequiredPresubmits returns true if the repo has presubmits configured
+// but Tide would not require any of them for the subpool's branch, which is
+// most likely a misconfiguration.
+func (c *Controller) missingRequiredPresubmits(sp subpool) bool {
+	return len(c.ca.Config().Presubmits[sp.org+"/"+sp.repo]) > 0 && len(c.branchPresubmits(sp)) == 0
+}
+
+// baseFailing returns true if the combined status of the subpool's base SHA,
+// as reported with any of its PRs, is failing.
+func baseFailing(sp subpool) bool {
+	state, ok := baseState(sp)
+	return ok && state == noneState
+}
+
+// baseState returns the combined status of the subpool's base SHA, as reported
+// with any of its PRs, or false if there is none. The base of a PR fetched
+// before the branch moved is ignored.
+func baseState(sp subpool) (simpleState, bool) {
+	for _, pr := range sp.prs {
+		base := pr.BaseRef.Target.Commit
+		if string(base.OID) == sp.sha && base.Status.State != "" {
+			return toSimpleStatusState(string(base.Status.State)), true
+		}
+	}
+	return "", false
+}
+
+// unconfiguredOrgRepo returns true if the subpool's repo is not named by any
+// query, but is reached through an org-wide one, and has neither presubmits
+// nor external contexts configured. Every PR in such a repo passes, which is
+// likely not what was intended.
+func (c *Controller) unconfiguredOrgRepo(sp subpool) bool {
+	cfg := c.ca.Config()
+	name := sp.org + "/" + sp.repo
+	if len(cfg.Presubmits[name]) > 0 || len(cfg.Tide.ExternalContextsFor(sp.org, sp.repo)) > 0 || len(cfg.Tide.ExternalContextPatternsFor(sp.org, sp.repo)) > 0 {
+		return false
+	}
+	var orgWide bool
+	for _, q := range cfg.Tide.Queries {
+		for _, term := range strings.Fields(q) {
+			if term == "repo:"+name {
+				return false
+			}
+			if term == "org:"+sp.org {
+				orgWide = true
+			}
+		}
+	}
+	return orgWide
+}
+
+type subpoolTimeoutError time.Duration
+
+func (e subpoolTimeoutError) Error() string {
+	return fmt.Sprintf("subpool sync timed out after %v", time.Duration(e))
+}
+
+// takeActionTimeout runs takeAction, giving up on it after the configured
+// subpool timeout so that one slow subpool cannot hold up the whole sync. The
+// timeout only starts once the action has a concurrency slot, so waiting for
+// one does not count against it. An abandoned action is cancelled: it finishes
+// the call it is in, holding its slot until then, but merges and triggers
+// nothing more.
+func (c *Controller) takeActionTimeout(sp subpool, batchPending bool, successes, pendings, nones, batchMerges []PullRequest) (Action, []PullRequest, string, error) {
+	release := c.acquire()
+	timeout := c.ca.Config().Tide.SubpoolTimeout
+	if timeout <= 0 {
+		defer release()
+		return c.takeAction(context.Background(), sp, batchPending, successes, pendings, nones, batchMerges)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		act     Action
+		targets []PullRequest
+		reason  string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		act, targets, reason, err := c.takeAction(ctx, sp, batchPending, successes, pendings, nones, batchMerges)
+		done <- result{act, targets, reason, err}
+	}()
+	select {
+	case r := <-done:
+		return r.act, r.targets, r.reason, r.err
+	case <-ctx.Done():
+		return Wait, nil, waitTimedOut, subpoolTimeoutError(timeout)
+	}
+}
+
 type subpool struct {
 	org    string
 	repo   string
@@ -477,36 +3645,113 @@ type subpool struct {
 	sha    string
 	pjs    []kube.ProwJob
 	prs    []PullRequest
+
+	// retests are the PRs with a retest request due this sync.
+	retests []PullRequest
+	// errored are the contexts to retrigger because they ended in the error
+	// state, keyed by PR number.
+	errored map[int][]string
+	// missing are the contexts to trigger because they have no job even
+	// though the PR has been tested, keyed by PR number.
+	missing map[int][]string
+	// erroredBatch is a batch to retrigger because some of its jobs ended in
+	// the error state, and erroredBatchContexts are the contexts of those
+	// jobs.
+	erroredBatch         []PullRequest
+	erroredBatchContexts []string
+	// overridden are the required contexts that a status override label
+	// covers, keyed by PR number.
+	overridden map[int][]string
+
+	// rollupOnly is set when the ProwJobs could not be listed, in which case
+	// PRs are judged by their combined status alone.
+	rollupOnly bool
+	// afterMerge is set when the subpool is re-run right after merging into
+	// it.
+	afterMerge bool
+	// triggerOnly is set when the subpool is re-run only to test its PRs
+	// against the new head after a merge, so nothing is merged.
+	triggerOnly bool
+	// linearHistory is set when the branch protection requires a linear
+	// history. It is looked up once per sync and kept across re-runs.
+	linearHistory bool
+}
+
+var (
+	// getRefAttempts bounds how many times getRef calls GetRef.
+	getRefAttempts = 4
+	// getRefBackoff is the delay before the first GetRef retry. It doubles
+	// after every failed attempt.
+	getRefBackoff = time.Second
+	// sleep is overridden in tests.
+	sleep = time.Sleep
+)
+
+// getRef resolves the ref, retrying transient failures with backoff. A ref
+// that does not exist is not retried.
+func (c *Controller) getRef(org, repo, ref string) (string, error) {
+	ghc, err := c.github(org)
+	if err != nil {
+		return "", err
+	}
+	backoff := getRefBackoff
+	for attempt := 1; ; attempt++ {
+		sha, err := ghc.GetRef(org, repo, ref)
+		if err == nil {
+			return sha, nil
+		}
+		if _, ok := err.(*github.RefNotFound); ok || attempt >= getRefAttempts {
+			return "", err
+		}
+		c.logger.WithError(err).Warningf("Error getting %s/%s ref %s, retrying in %v.", org, repo, ref, backoff)
+		sleep(backoff)
+		backoff *= 2
+	}
 }
 
 // dividePool splits up the list of pull requests and prow jobs into a group
 // per repo and branch. It only keeps ProwJobs that match the latest branch.
+// Branches that no longer exist, or that Tide cannot access as a GitHub App,
+// are left out.
 func (c *Controller) dividePool(pool []PullRequest, pjs []kube.ProwJob) ([]subpool, error) {
 	sps := make(map[string]*subpool)
+	var branches []*subpool
+	var refs []string
 	for _, pr := range pool {
 		org := string(pr.Repository.Owner.Login)
 		repo := string(pr.Repository.Name)
 		branch := string(pr.BaseRef.Name)
-		branchRef := string(pr.BaseRef.Prefix) + string(pr.BaseRef.Name)
 		fn := fmt.Sprintf("%s/%s %s", org, repo, branch)
 		if sps[fn] == nil {
-			sha, err := c.ghc.GetRef(org, repo, strings.TrimPrefix(branchRef, "refs/"))
-			if err != nil {
-				return nil, err
-			}
 			sps[fn] = &subpool{
 				org:    org,
 				repo:   repo,
 				branch: branch,
-				sha:    sha,
 			}
+			branches = append(branches, sps[fn])
+			refs = append(refs, strings.TrimPrefix(string(pr.BaseRef.Prefix)+branch, "refs/"))
 		}
 		sps[fn].prs = append(sps[fn].prs, pr)
 	}
+	shas, errs := c.getRefs(branches, refs)
+	for i, sp := range branches {
+		fn := fmt.Sprintf("%s/%s %s", sp.org, sp.repo, sp.branch)
+		if _, ok := errs[i].(*github.RefNotFound); ok || isNotInstalled(errs[i]) {
+			c.logger.WithError(errs[i]).Warningf("Dropping subpool %s.", fn)
+			delete(sps, fn)
+		} else if errs[i] != nil {
+			return nil, errs[i]
+		}
+		sp.sha = shas[i]
+	}
 	for _, pj := range pjs {
 		if pj.Spec.Type != kube.PresubmitJob && pj.Spec.Type != kube.BatchJob {
 			continue
 		}
+		if len(pj.Spec.Refs.Pulls) == 0 {
+			c.logger.Warningf("Ignoring %s job %s (%s): it does not test any pulls.", pj.Spec.Type, pj.Spec.Job, pj.Metadata.Name)
+			continue
+		}
 		fn := fmt.Sprintf("%s/%s %s", pj.Spec.Refs.Org, pj.Spec.Refs.Repo, pj.Spec.Refs.BaseRef)
 		if sps[fn] == nil || pj.Spec.Refs.BaseSHA != sps[fn].sha {
 			continue
@@ -520,41 +3765,210 @@ func (c *Controller) dividePool(pool []PullRequest, pjs []kube.ProwJob) ([]subpo
 	return ret, nil
 }
 
-func (c *Controller) search(ctx context.Context, q string) ([]PullRequest, error) {
+// getRefs looks up the ref of each subpool's repo concurrently, up to the
+// configured bound. The SHAs and errors are returned in subpool order.
+func (c *Controller) getRefs(sps []*subpool, refs []string) ([]string, []error) {
+	concurrency := c.ca.Config().Tide.GetRefConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	shas := make([]string, len(sps))
+	errs := make([]error, len(sps))
+	sema := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, sp := range sps {
+		wg.Add(1)
+		sema <- struct{}{}
+		go func(i int, sp *subpool) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			release := c.acquire()
+			defer release()
+			shas[i], errs[i] = c.getRef(sp.org, sp.repo, refs[i])
+		}(i, sp)
+	}
+	wg.Wait()
+	return shas, errs
+}
+
+// prioritizeQueries returns the queries in the order to run them: highest
+// priority first, and otherwise in their configured order.
+func prioritizeQueries(queries []string, priorities map[string]int) []string {
+	ordered := append([]string(nil), queries...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return priorities[ordered[i]] > priorities[ordered[j]]
+	})
+	return ordered
+}
+
+// searchAll runs the queries with at most concurrency of them in flight at once,
+// within the controller's overall bound, and returns their results and costs in
+// query order. Unless maxPRs is zero, queries stop paginating once that many
+// distinct PRs were found across all of them, and the pool is deduplicated and
+// truncated to it. PRs that several queries return only count once.
+func (c *Controller) searchAll(ctx context.Context, queries []string, concurrency, maxPRs int) ([]PullRequest, []QueryCost, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([][]PullRequest, len(queries))
+	costs := make([]QueryCost, len(queries))
+	errs := make([]error, len(queries))
+	var (
+		lock      sync.Mutex
+		totalCost int
+		remaining = -1
+		found     = make(map[string]bool)
+	)
+	// full records that the PRs were found and reports whether the pool is
+	// full.
+	full := func(prs []PullRequest) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, pr := range prs {
+			found[prKey(pr)] = true
+		}
+		return maxPRs > 0 && len(found) >= maxPRs
+	}
+	sema := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, q := range queries {
+		wg.Add(1)
+		sema <- struct{}{}
+		go func(i int, q string) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			release := c.acquire()
+			defer release()
+			if full(nil) {
+				c.logger.Warningf("Skipping query %q: the pool is full.", q)
+				costs[i] = QueryCost{Query: q}
+				return
+			}
+			prs, cost, left, err := c.search(ctx, q, full)
+			if isNotInstalled(err) {
+				c.logger.WithError(err).Warningf("Skipping query %q.", q)
+				costs[i] = QueryCost{Query: q}
+				return
+			} else if err == github.ErrNoOrg {
+				// A GitHub App can only search one org at a time.
+				c.logger.Warningf("Skipping query %q: it needs to be limited to a single org with org: or repo: terms.", q)
+				costs[i] = QueryCost{Query: q}
+				return
+			} else if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = prs
+			costs[i] = QueryCost{Query: q, Cost: cost, Remaining: left, PRs: len(prs)}
+			lock.Lock()
+			defer lock.Unlock()
+			totalCost += cost
+			// Queries finish in any order, so the smallest budget is the latest.
+			if remaining == -1 || left < remaining {
+				remaining = left
+			}
+		}(i, q)
+	}
+	wg.Wait()
+	var pool []PullRequest
+	origins := make(map[string]string)
+	for i := range queries {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		pool = append(pool, results[i]...)
+		for _, pr := range results[i] {
+			if _, ok := origins[prKey(pr)]; !ok {
+				origins[prKey(pr)] = queries[i]
+			}
+		}
+	}
+	c.prQueries.Lock()
+	c.prQueries.queries = origins
+	c.prQueries.Unlock()
+	if full(nil) {
+		pool = dedupePRs(pool)
+		if len(pool) > maxPRs {
+			pool = pool[:maxPRs]
+		}
+		c.logger.Warningf("The pool reached max_pool_size (%d PRs). Queries stopped early, so some PRs may be missing from it.", maxPRs)
+	}
+	if len(queries) > 1 {
+		c.logger.Infof("Searching %d queries cost %d point(s). %d remaining.", len(queries), totalCost, remaining)
+	}
+	return pool, costs, nil
+}
+
+// search runs the query, following its pages until there are no more or full
+// reports that the pool is full. It tells full which PRs each page found.
+func (c *Controller) search(ctx context.Context, q string, full func([]PullRequest) bool) ([]PullRequest, int, int, error) {
 	var ret []PullRequest
 	vars := map[string]interface{}{
 		"query":        githubql.String(q),
 		"searchCursor": (*githubql.String)(nil),
 	}
+	ghc, err := c.github(queryOrg(q))
+	if err != nil {
+		return nil, 0, 0, err
+	}
 	var totalCost int
 	var remaining int
+	var cursor string
+	// The query only selects the fields that the configured features use.
+	sqType := searchQueryType(unusedFields(c.ca.Config().Tide))
 	for {
-		sq := searchQuery{}
-		if err := c.ghc.Query(ctx, &sq, vars); err != nil {
-			return nil, err
+		c.recordQuery(SentQuery{Time: c.now(), Org: queryOrg(q), Query: q, Cursor: cursor})
+		selected := reflect.New(sqType)
+		if err := ghc.Query(ctx, selected.Interface(), vars); err != nil {
+			return nil, 0, 0, err
 		}
+		sq := searchQuery{}
+		copyFields(reflect.ValueOf(&sq).Elem(), selected.Elem())
 		totalCost += int(sq.RateLimit.Cost)
 		remaining = int(sq.RateLimit.Remaining)
+		var page []PullRequest
 		for _, n := range sq.Search.Nodes {
-			ret = append(ret, n.PullRequest)
+			page = append(page, n.PullRequest)
 		}
-		if !sq.Search.PageInfo.HasNextPage {
+		ret = append(ret, page...)
+		poolFull := full(page)
+		if !bool(sq.Search.PageInfo.HasNextPage) || poolFull {
 			break
 		}
+		cursor = string(sq.Search.PageInfo.EndCursor)
 		vars["searchCursor"] = githubql.NewString(sq.Search.PageInfo.EndCursor)
 	}
 	c.logger.Infof("Search for query \"%s\" cost %d point(s). %d remaining.", q, totalCost, remaining)
-	return ret, nil
+	return ret, totalCost, remaining, nil
 }
 
 type PullRequest struct {
-	Number githubql.Int
-	Author struct {
+	Number    githubql.Int
+	Title     githubql.String
+	CreatedAt githubql.DateTime
+	Author    struct {
 		Login githubql.String
 	}
-	BaseRef struct {
+	// Mergeable is whether GitHub found the PR to conflict with its base
+	// branch. It may be UNKNOWN while GitHub is still computing it.
+	Mergeable githubql.MergeableState
+	BaseRef   struct {
 		Name   githubql.String
 		Prefix githubql.String
+		// Target is the head commit of the base branch, with the combined
+		// status of the branch's own tests.
+		Target struct {
+			Commit struct {
+				OID    githubql.String `graphql:"oid"`
+				Status struct {
+					State githubql.String
+				}
+			} `graphql:"... on Commit"`
+		}
 	}
 	Repository struct {
 		Name          githubql.String
@@ -563,6 +3977,21 @@ type PullRequest struct {
 			Login githubql.String
 		}
 	}
+	Labels struct {
+		Nodes []struct {
+			Name githubql.String
+		}
+	} `graphql:"labels(first: 100)"`
+	// Reviews counts the approving reviews.
+	Reviews struct {
+		TotalCount githubql.Int
+	} `graphql:"reviews(states: APPROVED)"`
+	// ReviewThreads are the review threads with whether each was resolved.
+	ReviewThreads struct {
+		Nodes []struct {
+			IsResolved githubql.Boolean
+		}
+	} `graphql:"reviewThreads(first: 100)"`
 	HeadRef struct {
 		Target struct {
 			OID githubql.String `graphql:"oid"`
@@ -570,15 +3999,45 @@ type PullRequest struct {
 	}
 	Commits struct {
 		Nodes []struct {
-			Commit struct {
-				Status struct {
-					State githubql.String
-				}
-			}
+			Commit Commit
 		}
 	} `graphql:"commits(last: 1)"`
 }
 
+// Commit is the head commit of a PR with its combined status.
+type Commit struct {
+	Status struct {
+		State githubql.String
+		// Contexts are the individual statuses that are combined.
+		Contexts []Context
+	}
+	// StatusCheckRollup combines the statuses with the check runs of the
+	// commit. It is preferred over Status when GitHub provides it.
+	StatusCheckRollup struct {
+		State    githubql.String
+		Contexts struct {
+			Nodes []RollupContext
+		} `graphql:"contexts(first: 100)"`
+	}
+}
+
+// Context is one status context of a commit.
+type Context struct {
+	Context githubql.String
+	State   githubql.String
+}
+
+// RollupContext is either a status context or a check run, depending on which
+// of the two is filled in.
+type RollupContext struct {
+	StatusContext Context `graphql:"... on StatusContext"`
+	CheckRun      struct {
+		Name       githubql.String
+		Status     githubql.String
+		Conclusion githubql.String
+	} `graphql:"... on CheckRun"`
+}
+
 type searchQuery struct {
 	RateLimit struct {
 		Cost      githubql.Int
@@ -17,13 +17,24 @@ limitations under the License.
 package tide
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/shurcooL/githubql"
 	"github.com/sirupsen/logrus"
 
@@ -52,6 +63,52 @@ func testPullsMatchList(t *testing.T, test string, actual []PullRequest, expecte
 	}
 }
 
+// newConfigAgent returns a config agent with the Tide config set.
+func newConfigAgent(tide config.Tide) *config.Agent {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: tide})
+	return ca
+}
+
+// newTestController returns a controller that reads its config from ca and
+// acts through the given clients, either of which may be nil.
+func newTestController(ca *config.Agent, ghc githubClient, kc kubeClient) *Controller {
+	return &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		ca:     ca,
+		ghc:    ghc,
+		kc:     kc,
+	}
+}
+
+// newTestPR returns o/r#number against master, with head-<number> as its
+// head, a passing combined status and the labels.
+func newTestPR(number int, labels ...string) PullRequest {
+	var pr PullRequest
+	pr.Number = githubql.Int(number)
+	pr.BaseRef.Name = "master"
+	pr.BaseRef.Prefix = "refs/heads/"
+	pr.Repository.Name = "r"
+	pr.Repository.NameWithOwner = "o/r"
+	pr.Repository.Owner.Login = "o"
+	pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", number))
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+	for _, label := range labels {
+		pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(label)})
+	}
+	return pr
+}
+
+// requireAll makes every PR require all of the presubmits.
+func requireAll(presubmits []string, prs []PullRequest) map[int][]string {
+	required := make(map[int][]string)
+	for _, pr := range prs {
+		required[int(pr.Number)] = presubmits
+	}
+	return required
+}
+
 func TestAccumulateBatch(t *testing.T) {
 	type pull struct {
 		number int
@@ -68,8 +125,9 @@ func TestAccumulateBatch(t *testing.T) {
 		pulls      []pull
 		prowJobs   []prowjob
 
-		merges  []int
-		pending bool
+		merges     []int
+		pending    bool
+		pendingPRs []int
 	}{
 		{
 			name: "no batches running",
@@ -80,6 +138,7 @@ func TestAccumulateBatch(t *testing.T) {
 			pulls:      []pull{{1, "a"}, {2, "b"}},
 			prowJobs:   []prowjob{{job: "foo", state: kube.PendingState, prs: []pull{{1, "a"}}}},
 			pending:    true,
+			pendingPRs: []int{1},
 		},
 		{
 			name:       "batch pending, successful previous run",
@@ -91,7 +150,19 @@ func TestAccumulateBatch(t *testing.T) {
 				{job: "bar", state: kube.SuccessState, prs: []pull{{2, "b"}}},
 				{job: "baz", state: kube.SuccessState, prs: []pull{{2, "b"}}},
 			},
-			pending: true,
+			pending:    true,
+			pendingPRs: []int{1},
+		},
+		{
+			name:       "batch pending, multiple PRs",
+			presubmits: []string{"foo", "bar"},
+			pulls:      []pull{{1, "a"}, {2, "b"}, {3, "c"}},
+			prowJobs: []prowjob{
+				{job: "foo", state: kube.SuccessState, prs: []pull{{1, "a"}, {3, "c"}}},
+				{job: "bar", state: kube.PendingState, prs: []pull{{1, "a"}, {3, "c"}}},
+			},
+			pending:    true,
+			pendingPRs: []int{1, 3},
 		},
 		{
 			name:       "successful run",
@@ -165,11 +236,12 @@ func TestAccumulateBatch(t *testing.T) {
 			}
 			pjs = append(pjs, npj)
 		}
-		merges, pending := accumulateBatch(test.presubmits, pulls, pjs)
+		merges, pendingPRs, pending := accumulateBatch(requireAll(test.presubmits, pulls), nil, "", pulls, pjs)
 		if pending != test.pending {
 			t.Errorf("For case \"%s\", got wrong pending.", test.name)
 		}
 		testPullsMatchList(t, test.name, merges, test.merges)
+		testPullsMatchList(t, test.name+" pending", pendingPRs, test.pendingPRs)
 	}
 }
 
@@ -308,7 +380,7 @@ func TestAccumulate(t *testing.T) {
 			})
 		}
 
-		successes, pendings, nones := accumulate(test.presubmits, pulls, pjs)
+		successes, pendings, nones := accumulate(requireAll(test.presubmits, pulls), nil, "", pulls, pjs, config.TideAccumulateBest)
 
 		t.Logf("test run %d", i)
 		testPullsMatchList(t, "successes", successes, test.successes)
@@ -317,21 +389,388 @@ func TestAccumulate(t *testing.T) {
 	}
 }
 
+func TestAccumulateStaleBase(t *testing.T) {
+	newJob := func(number int, baseSHA string, state kube.ProwJobState) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type: kube.PresubmitJob,
+				Job:  "unit",
+				Refs: kube.Refs{BaseSHA: baseSHA, Pulls: []kube.Pull{{Number: number}}},
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	prs := []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3)}
+	pjs := []kube.ProwJob{
+		// Passed against the current base.
+		newJob(1, "current", kube.SuccessState),
+		// Passed against an old base only.
+		newJob(2, "stale", kube.SuccessState),
+		// Passed against an old base and is being retested on the current one.
+		newJob(3, "stale", kube.SuccessState),
+		newJob(3, "current", kube.PendingState),
+	}
+	presubmits := map[int][]string{1: {"unit"}, 2: {"unit"}, 3: {"unit"}}
+	for _, strategy := range []string{config.TideAccumulateBest, config.TideAccumulateLatest} {
+		successes, pendings, nones := accumulate(presubmits, nil, "current", prs, pjs, strategy)
+		testPullsMatchList(t, "successes", successes, []int{1})
+		testPullsMatchList(t, "pendings", pendings, []int{3})
+		testPullsMatchList(t, "nones", nones, []int{2})
+	}
+}
+
+func TestAccumulateStates(t *testing.T) {
+	newJob := func(number int, context string, state kube.ProwJobState) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    kube.PresubmitJob,
+				Job:     context,
+				Context: context,
+				Refs:    kube.Refs{Pulls: []kube.Pull{{Number: number}}},
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	prs := []PullRequest{newTestPR(1), newTestPR(2)}
+	pjs := []kube.ProwJob{
+		newJob(1, "unit", kube.SuccessState),
+		newJob(1, "e2e", kube.PendingState),
+		newJob(1, "lint", kube.ErrorState),
+		newJob(2, "unit", kube.FailureState),
+		newJob(2, "e2e", kube.FailureState),
+		newJob(2, "e2e", kube.SuccessState),
+		// Not required, so not reported.
+		newJob(2, "optional", kube.SuccessState),
+	}
+	presubmits := map[int][]string{
+		1: {"unit", "e2e", "lint"},
+		2: {"unit", "e2e", "verify"},
+	}
+	successes, pendings, nones, states, _ := accumulateStates(presubmits, nil, "", prs, pjs, config.TideAccumulateBest)
+	testPullsMatchList(t, "successes", successes, []int{})
+	testPullsMatchList(t, "pendings", pendings, []int{})
+	testPullsMatchList(t, "nones", nones, []int{1, 2})
+	expected := map[int]map[string]simpleState{
+		1: {"unit": successState, "e2e": pendingState, "lint": errorState},
+		2: {"unit": noneState, "e2e": successState, "verify": noneState},
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected states %v, got %v.", expected, states)
+	}
+}
+
+func TestAccumulateContextGaps(t *testing.T) {
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.Contexts = []Context{
+		{Context: "external-passing", State: "SUCCESS"},
+		{Context: "external-failing", State: "FAILURE"},
+		{Context: "external-pending", State: "PENDING"},
+	}
+	newJob := func(context string, state kube.ProwJobState) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    kube.PresubmitJob,
+				Job:     context,
+				Context: context,
+				Refs:    kube.Refs{Pulls: []kube.Pull{{Number: 1}}},
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	pjs := []kube.ProwJob{
+		newJob("unit", kube.SuccessState),
+		newJob("e2e", kube.FailureState),
+		newJob("lint", kube.ErrorState),
+		newJob("verify", kube.PendingState),
+	}
+	presubmits := map[int][]string{
+		1: {"unit", "e2e", "lint", "verify", "integration", "external-passing", "external-failing", "external-pending", "external-absent"},
+	}
+	external := map[string]bool{
+		"external-passing": true,
+		"external-failing": true,
+		"external-pending": true,
+		"external-absent":  true,
+	}
+	_, _, nones, _, gaps := accumulateStates(presubmits, external, "", []PullRequest{pr}, pjs, config.TideAccumulateBest)
+	testPullsMatchList(t, "nones", nones, []int{1})
+	expected := map[int]contextGaps{
+		1: {
+			Missing: []string{"integration", "external-absent"},
+			Failing: []string{"e2e", "lint", "external-failing"},
+		},
+	}
+	if !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("Expected gaps %+v, got %+v.", expected, gaps)
+	}
+	if missing, failing := missingFrom(gaps), failingFrom(gaps); !reflect.DeepEqual(missing[1], expected[1].Missing) || !reflect.DeepEqual(failing[1], expected[1].Failing) {
+		t.Errorf("Expected the pool to list missing %v and failing %v, got %v and %v.", expected[1].Missing, expected[1].Failing, missing, failing)
+	}
+
+	// A passing PR has no gaps.
+	_, _, _, _, gaps = accumulateStates(map[int][]string{1: {"unit"}}, nil, "", []PullRequest{pr}, pjs, config.TideAccumulateBest)
+	if len(gaps) != 0 || missingFrom(gaps) != nil || failingFrom(gaps) != nil {
+		t.Errorf("Expected no gaps for a passing PR, got %+v.", gaps)
+	}
+}
+
+func TestAccumulateJobWithoutPulls(t *testing.T) {
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pjs := []kube.ProwJob{
+		{
+			Spec:   kube.ProwJobSpec{Type: kube.PresubmitJob, Job: "unit"},
+			Status: kube.ProwJobStatus{State: kube.ErrorState},
+		},
+		{
+			Spec: kube.ProwJobSpec{
+				Type: kube.PresubmitJob,
+				Job:  "unit",
+				Refs: kube.Refs{Pulls: []kube.Pull{{Number: 1}}},
+			},
+			Status: kube.ProwJobStatus{State: kube.PendingState},
+		},
+	}
+	presubmits := map[int][]string{1: {"unit"}}
+	successes, pendings, nones := accumulate(presubmits, nil, "", []PullRequest{pr}, pjs, config.TideAccumulateBest)
+	testPullsMatchList(t, "successes", successes, []int{})
+	testPullsMatchList(t, "pendings", pendings, []int{1})
+	testPullsMatchList(t, "nones", nones, []int{})
+	if errored := erroredContexts(presubmits[1], nil, pr, pjs, config.TideAccumulateBest, 1); len(errored) != 0 {
+		t.Errorf("Expected no errored contexts, got %v.", errored)
+	}
+
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := newTestController(ca, &fgc{refs: map[string]string{"o/r heads/master": "base"}}, nil)
+	pr.Repository.Owner.Login = "o"
+	pr.Repository.Name = "r"
+	pr.BaseRef.Name = "master"
+	pr.BaseRef.Prefix = "refs/heads/"
+	for i := range pjs {
+		pjs[i].Spec.Refs.Org, pjs[i].Spec.Refs.Repo = "o", "r"
+		pjs[i].Spec.Refs.BaseRef, pjs[i].Spec.Refs.BaseSHA = "master", "base"
+	}
+	sps, err := c.dividePool([]PullRequest{pr}, pjs)
+	if err != nil {
+		t.Fatalf("Error dividing pool: %v", err)
+	}
+	if len(sps) != 1 || len(sps[0].pjs) != 1 {
+		t.Errorf("Expected only the job with pulls in the subpool, got %+v.", sps)
+	}
+}
+
 type fgc struct {
-	refs   map[string]string
-	merged int
+	refs          map[string]string
+	merged        int
+	removedLabels []string
+	changes       map[int][]string
+	statuses      []github.Status
+	checkRuns     []github.CheckRun
+	// refLock guards the GetRef fields, which are used concurrently. refErrs
+	// are returned by successive GetRef calls before any refs. Each call
+	// takes refDelay.
+	refLock         sync.Mutex
+	refErrs         []error
+	refCalls        int
+	refDelay        time.Duration
+	refsInFlight    int
+	maxRefsInFlight int
+	// unmergedChecks is how many IsMerged calls report each PR as not merged
+	// before it is.
+	unmergedChecks map[int]int
+	isMergedCalls  int
+	// disallowedMethods are merge methods that Merge rejects. The methods of
+	// all merge attempts are recorded in mergeMethods.
+	disallowedMethods map[string]bool
+	mergeMethods      []string
+	// refusedMerges are the PRs that Merge refuses as unmergable.
+	refusedMerges map[int]bool
+	// onMerge is called after each successful merge.
+	onMerge func()
+	// mergeMessages are the commit messages of all merge attempts.
+	mergeMessages []string
+	// mergedNumbers are the PRs that were merged, in order.
+	mergedNumbers []int
+	// protection is returned for every branch.
+	protection *github.BranchProtection
+	// protectionCalls counts the branch protection lookups.
+	protectionCalls int
+	// comments are keyed by PR number.
+	comments map[int][]string
+	closed   []int
+	// reviews are keyed by PR number. CreateReview adds to them.
+	reviews        map[int][]github.Review
+	createdReviews int
+	// behindBy is how many commits of the base each head SHA lacks.
+	// UpdateBranch records the PRs it updates in updatedBranches.
+	behindBy        map[string]int
+	updatedBranches []int
+
+	// queryLock guards the query fields, which are used concurrently.
+	queryLock   sync.Mutex
+	queryPRs    map[string][]PullRequest
+	inFlight    int
+	maxInFlight int
+	// queryPageSize splits query results into pages of that size, if set.
+	queryPageSize int
+	queryCalls    int
+	// queries are the queries of all calls, in the order they were made.
+	queries []string
 }
 
 func (f *fgc) GetRef(o, r, ref string) (string, error) {
+	f.refLock.Lock()
+	f.refCalls++
+	f.refsInFlight++
+	if f.refsInFlight > f.maxRefsInFlight {
+		f.maxRefsInFlight = f.refsInFlight
+	}
+	f.refLock.Unlock()
+
+	time.Sleep(f.refDelay)
+
+	f.refLock.Lock()
+	defer f.refLock.Unlock()
+	f.refsInFlight--
+	if len(f.refErrs) > 0 {
+		err := f.refErrs[0]
+		f.refErrs = f.refErrs[1:]
+		return "", err
+	}
 	return f.refs[o+"/"+r+" "+ref], nil
 }
 
 func (f *fgc) Query(ctx context.Context, q interface{}, vars map[string]interface{}) error {
+	f.queryLock.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.queryCalls++
+	f.queries = append(f.queries, string(vars["query"].(githubql.String)))
+	prs := f.queryPRs[string(vars["query"].(githubql.String))]
+	f.queryLock.Unlock()
+
+	// Give other queries a chance to run alongside this one.
+	time.Sleep(10 * time.Millisecond)
+	// The query may select only some fields, which are filled in at the end.
+	sq := &searchQuery{}
+	defer copyFields(reflect.ValueOf(q).Elem(), reflect.ValueOf(sq).Elem())
+	sq.RateLimit.Cost = 1
+	if f.queryPageSize > 0 {
+		// The cursor is the offset of the page.
+		var offset int
+		if cursor := vars["searchCursor"].(*githubql.String); cursor != nil {
+			offset, _ = strconv.Atoi(string(*cursor))
+		}
+		prs = prs[offset:]
+		if len(prs) > f.queryPageSize {
+			prs = prs[:f.queryPageSize]
+			sq.Search.PageInfo.HasNextPage = true
+			sq.Search.PageInfo.EndCursor = githubql.String(strconv.Itoa(offset + f.queryPageSize))
+		}
+	}
+	for _, pr := range prs {
+		sq.Search.Nodes = append(sq.Search.Nodes, struct {
+			PullRequest PullRequest `graphql:"... on PullRequest"`
+		}{pr})
+	}
+
+	f.queryLock.Lock()
+	defer f.queryLock.Unlock()
+	f.inFlight--
 	return nil
 }
 
 func (f *fgc) Merge(org, repo string, number int, details github.MergeDetails) error {
+	f.mergeMethods = append(f.mergeMethods, details.MergeMethod)
+	f.mergeMessages = append(f.mergeMessages, details.CommitMessage)
+	if f.disallowedMethods[details.MergeMethod] {
+		return github.UnmergablePRError(fmt.Sprintf("%s merges are not allowed on this repository.", details.MergeMethod))
+	}
+	if f.refusedMerges[number] {
+		return github.UnmergablePRError("Required status check \"security\" is expected.")
+	}
 	f.merged++
+	f.mergedNumbers = append(f.mergedNumbers, number)
+	if f.onMerge != nil {
+		f.onMerge()
+	}
+	return nil
+}
+
+func (f *fgc) IsMerged(org, repo string, number int) (bool, error) {
+	f.isMergedCalls++
+	if f.unmergedChecks[number] > 0 {
+		f.unmergedChecks[number]--
+		return false, nil
+	}
+	return true, nil
+}
+
+func (f *fgc) GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error) {
+	var changes []github.PullRequestChange
+	for _, file := range f.changes[number] {
+		changes = append(changes, github.PullRequestChange{Filename: file})
+	}
+	return changes, nil
+}
+
+func (f *fgc) CreateStatus(org, repo, ref string, s github.Status) error {
+	f.statuses = append(f.statuses, s)
+	return nil
+}
+
+func (f *fgc) CreateCheckRun(org, repo string, cr github.CheckRun) error {
+	f.checkRuns = append(f.checkRuns, cr)
+	return nil
+}
+
+func (f *fgc) RemoveLabel(org, repo string, number int, label string) error {
+	f.removedLabels = append(f.removedLabels, fmt.Sprintf("%s/%s#%d:%s", org, repo, number, label))
+	return nil
+}
+
+func (f *fgc) GetBranchProtection(org, repo, branch string) (*github.BranchProtection, error) {
+	f.protectionCalls++
+	return f.protection, nil
+}
+
+func (f *fgc) ListReviews(org, repo string, number int) ([]github.Review, error) {
+	return f.reviews[number], nil
+}
+
+func (f *fgc) CreateReview(org, repo string, number int, review github.DraftReview) error {
+	if f.reviews == nil {
+		f.reviews = make(map[int][]github.Review)
+	}
+	f.createdReviews++
+	f.reviews[number] = append(f.reviews[number], github.Review{Body: review.Body, State: "APPROVED"})
+	return nil
+}
+
+func (f *fgc) CompareCommits(org, repo, base, head string) (*github.CommitComparison, error) {
+	return &github.CommitComparison{BehindBy: f.behindBy[head]}, nil
+}
+
+func (f *fgc) UpdateBranch(org, repo string, number int, expectedHeadSHA string) error {
+	f.updatedBranches = append(f.updatedBranches, number)
+	return nil
+}
+
+func (f *fgc) ClosePR(org, repo string, number int) error {
+	f.closed = append(f.closed, number)
+	return nil
+}
+
+func (f *fgc) CreateComment(org, repo string, number int, comment string) error {
+	if f.comments == nil {
+		f.comments = make(map[int][]string)
+	}
+	f.comments[number] = append(f.comments[number], comment)
 	return nil
 }
 
@@ -425,9 +864,9 @@ func TestDividePool(t *testing.T) {
 	fc := &fgc{
 		refs: map[string]string{"k/t-i heads/master": "123"},
 	}
-	c := &Controller{
-		ghc: fc,
-	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := newTestController(ca, fc, nil)
 	var pulls []PullRequest
 	for _, p := range testPulls {
 		npr := PullRequest{Number: githubql.Int(p.number)}
@@ -447,6 +886,7 @@ func TestDividePool(t *testing.T) {
 					Repo:    pj.repo,
 					BaseRef: pj.baseRef,
 					BaseSHA: pj.baseSHA,
+					Pulls:   []kube.Pull{{Number: 1}},
 				},
 			},
 		})
@@ -499,6 +939,8 @@ func TestPickBatch(t *testing.T) {
 	testprs := []struct {
 		files   map[string][]byte
 		success bool
+		// unreachable makes the PR's head a commit that isn't in the repo.
+		unreachable bool
 
 		included bool
 	}{
@@ -527,6 +969,17 @@ func TestPickBatch(t *testing.T) {
 			success:  true,
 			included: true,
 		},
+		{
+			files:       map[string][]byte{"fork": []byte("deleted")},
+			success:     true,
+			unreachable: true,
+			included:    false,
+		},
+		{
+			files:    map[string][]byte{"after": []byte("ok")},
+			success:  true,
+			included: true,
+		},
 	}
 	sp := subpool{
 		org:    "o",
@@ -546,21 +999,21 @@ func TestPickBatch(t *testing.T) {
 		}
 		var pr PullRequest
 		pr.Number = githubql.Int(i)
-		pr.Commits.Nodes = []struct {
-			Commit struct {
-				Status struct{ State githubql.String }
-			}
-		}{{}}
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
 		if testpr.success {
 			pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
 		}
 		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
+		if testpr.unreachable {
+			pr.HeadRef.Target.OID = "0123456789abcdef0123456789abcdef01234567"
+		}
 		sp.prs = append(sp.prs, pr)
 	}
-	c := &Controller{
-		gc: gc,
-	}
-	prs, err := c.pickBatch(sp)
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := newTestController(ca, nil, nil)
+	c.gc = gc
+	prs, _, err := c.pickBatch(sp)
 	if err != nil {
 		t.Fatalf("Error from pickBatch: %v", err)
 	}
@@ -580,71 +1033,389 @@ func TestPickBatch(t *testing.T) {
 
 type fkc struct {
 	createdJobs []kube.ProwJob
+	createDelay time.Duration
+	listErr     error
+	prowJobs    []kube.ProwJob
 }
 
 func (c *fkc) ListProwJobs(string) ([]kube.ProwJob, error) {
-	return nil, nil
+	return c.prowJobs, c.listErr
 }
 
 func (c *fkc) CreateProwJob(pj kube.ProwJob) (kube.ProwJob, error) {
+	time.Sleep(c.createDelay)
 	c.createdJobs = append(c.createdJobs, pj)
 	return pj, nil
 }
 
-func TestTakeAction(t *testing.T) {
-	// PRs 0-9 exist. All are mergable, and all are passing tests.
-	testcases := []struct {
-		name string
-
-		batchPending bool
-		successes    []int
-		pendings     []int
-		nones        []int
-		batchMerges  []int
+func TestPickBatchRebase(t *testing.T) {
+	lg, gc, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Error making local git: %v", err)
+	}
+	defer gc.Clean()
+	defer lg.Clean()
+	if err := lg.MakeFakeRepo("o", "r"); err != nil {
+		t.Fatalf("Error making fake repo: %v", err)
+	}
+	if err := lg.AddCommit("o", "r", map[string][]byte{"foo": []byte("foo")}); err != nil {
+		t.Fatalf("Adding initial commit: %v", err)
+	}
+	// PR 0 adds a file. PR 1 changes foo and then changes it back, which
+	// merges cleanly but cannot be rebased once foo changes on master.
+	prCommits := [][]map[string][]byte{
+		{{"bar": []byte("ok")}},
+		{{"foo": []byte("changed")}, {"foo": []byte("foo")}},
+	}
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+	}
+	for i, commits := range prCommits {
+		if err := lg.CheckoutNewBranch("o", "r", fmt.Sprintf("pr-%d", i)); err != nil {
+			t.Fatalf("Error checking out new branch: %v", err)
+		}
+		for _, files := range commits {
+			if err := lg.AddCommit("o", "r", files); err != nil {
+				t.Fatalf("Error adding commit: %v", err)
+			}
+		}
+		if err := lg.Checkout("o", "r", "master"); err != nil {
+			t.Fatalf("Error checking out master: %v", err)
+		}
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
+		sp.prs = append(sp.prs, pr)
+	}
+	if err := lg.AddCommit("o", "r", map[string][]byte{"foo": []byte("moved on")}); err != nil {
+		t.Fatalf("Error adding commit: %v", err)
+	}
 
-		merged            int
-		triggered         int
-		triggered_batches int
-		action            Action
+	for _, tc := range []struct {
+		strategy string
+		expected []int
 	}{
-		{
-			name: "no prs to test, should do nothing",
-
-			batchPending: true,
-			successes:    []int{},
-			pendings:     []int{},
-			nones:        []int{},
-			batchMerges:  []int{},
-
-			merged:    0,
-			triggered: 0,
-			action:    Wait,
-		},
-		{
-			name: "pending batch, pending serial, nothing to do",
-
-			batchPending: true,
-			successes:    []int{},
-			pendings:     []int{1},
-			nones:        []int{0, 2},
-			batchMerges:  []int{},
+		{strategy: config.MergeMerge, expected: []int{0, 1}},
+		{strategy: config.MergeRebase, expected: []int{0}},
+	} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{BatchMergeStrategies: map[string]string{"o/r": tc.strategy}}})
+		c := newTestController(ca, nil, nil)
+		c.gc = gc
+		prs, _, err := c.pickBatch(sp)
+		if err != nil {
+			t.Fatalf("%s: error from pickBatch: %v", tc.strategy, err)
+		}
+		testPullsMatchList(t, tc.strategy, prs, tc.expected)
+	}
+}
 
-			merged:    0,
-			triggered: 0,
-			action:    Wait,
-		},
-		{
-			name: "pending batch, successful serial, nothing to do",
+func TestPickBatchMaxChangedFiles(t *testing.T) {
+	lg, gc, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Error making local git: %v", err)
+	}
+	defer gc.Clean()
+	defer lg.Clean()
+	if err := lg.MakeFakeRepo("o", "r"); err != nil {
+		t.Fatalf("Error making fake repo: %v", err)
+	}
+	if err := lg.AddCommit("o", "r", map[string][]byte{"foo": []byte("foo")}); err != nil {
+		t.Fatalf("Adding initial commit: %v", err)
+	}
+	// PR 1 is too large to fit next to PR 0, but PR 2 still fits.
+	changes := map[int][]string{
+		0: {"a", "b"},
+		1: {"c", "d", "e"},
+		2: {"f"},
+	}
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+	}
+	for i := 0; i < len(changes); i++ {
+		if err := lg.CheckoutNewBranch("o", "r", fmt.Sprintf("pr-%d", i)); err != nil {
+			t.Fatalf("Error checking out new branch: %v", err)
+		}
+		files := make(map[string][]byte)
+		for _, file := range changes[i] {
+			files[file] = []byte("ok")
+		}
+		if err := lg.AddCommit("o", "r", files); err != nil {
+			t.Fatalf("Error adding commit: %v", err)
+		}
+		if err := lg.Checkout("o", "r", "master"); err != nil {
+			t.Fatalf("Error checking out master: %v", err)
+		}
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
+		sp.prs = append(sp.prs, pr)
+	}
 
-			batchPending: true,
-			successes:    []int{1},
-			pendings:     []int{},
-			nones:        []int{0, 2},
-			batchMerges:  []int{},
+	for _, tc := range []struct {
+		max      int
+		expected []int
+	}{
+		{max: 0, expected: []int{0, 1, 2}},
+		{max: 4, expected: []int{0, 2}},
+		{max: 5, expected: []int{0, 1}},
+	} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{MaxBatchChangedFiles: tc.max}})
+		c := newTestController(ca, &fgc{changes: changes}, nil)
+		c.gc = gc
+		prs, _, err := c.pickBatch(sp)
+		if err != nil {
+			t.Fatalf("Max %d: error from pickBatch: %v", tc.max, err)
+		}
+		testPullsMatchList(t, fmt.Sprintf("max %d", tc.max), prs, tc.expected)
+	}
+}
 
-			merged:    0,
-			triggered: 0,
+func TestPickBatchSkipConflicting(t *testing.T) {
+	lg, gc, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Error making local git: %v", err)
+	}
+	defer gc.Clean()
+	defer lg.Clean()
+	if err := lg.MakeFakeRepo("o", "r"); err != nil {
+		t.Fatalf("Error making fake repo: %v", err)
+	}
+	if err := lg.AddCommit("o", "r", map[string][]byte{"foo": []byte("foo")}); err != nil {
+		t.Fatalf("Adding initial commit: %v", err)
+	}
+	// Every PR merges cleanly, but GitHub reports PR 1 as conflicting.
+	mergeable := []githubql.MergeableState{
+		githubql.MergeableStateMergeable,
+		githubql.MergeableStateConflicting,
+		githubql.MergeableStateUnknown,
+	}
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+	}
+	for i, state := range mergeable {
+		if err := lg.CheckoutNewBranch("o", "r", fmt.Sprintf("pr-%d", i)); err != nil {
+			t.Fatalf("Error checking out new branch: %v", err)
+		}
+		if err := lg.AddCommit("o", "r", map[string][]byte{fmt.Sprintf("file-%d", i): []byte("ok")}); err != nil {
+			t.Fatalf("Error adding commit: %v", err)
+		}
+		if err := lg.Checkout("o", "r", "master"); err != nil {
+			t.Fatalf("Error checking out master: %v", err)
+		}
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		pr.Mergeable = state
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
+		sp.prs = append(sp.prs, pr)
+	}
+
+	for _, tc := range []struct {
+		skip     bool
+		expected []int
+	}{
+		{skip: false, expected: []int{0, 1, 2}},
+		{skip: true, expected: []int{0, 2}},
+	} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{SkipConflictingPRs: tc.skip}})
+		c := newTestController(ca, nil, nil)
+		c.gc = gc
+		prs, _, err := c.pickBatch(sp)
+		if err != nil {
+			t.Fatalf("Skip %t: error from pickBatch: %v", tc.skip, err)
+		}
+		testPullsMatchList(t, fmt.Sprintf("skip %t", tc.skip), prs, tc.expected)
+	}
+
+	// Without a candidate left, the repo is not cloned at all.
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{SkipConflictingPRs: true}})
+	c := newTestController(ca, nil, nil)
+	prs, _, err := c.pickBatch(subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: sp.prs[1:2]})
+	if err != nil || len(prs) != 0 {
+		t.Errorf("Expected no batch and no error with only conflicting PRs, got %v and %v.", prNumbers(prs), err)
+	}
+}
+
+// flakyRepo stands in for a clone whose git operations fail transiently.
+type flakyRepo struct {
+	// failCheckouts is how many checkouts fail before one succeeds.
+	failCheckouts int
+	// failMerges is how many merges of each head fail before one succeeds.
+	failMerges map[string]int
+	conflicts  map[string]bool
+
+	merges map[string]int
+}
+
+func (r *flakyRepo) Clean() error                   { return nil }
+func (r *flakyRepo) Config(key, value string) error { return nil }
+func (r *flakyRepo) Rebase(head string) (bool, error) {
+	return r.Merge(head)
+}
+
+func (r *flakyRepo) RevParse(commitlike string) (string, error) {
+	return commitlike, nil
+}
+
+func (r *flakyRepo) Checkout(commitlike string) error {
+	if r.failCheckouts > 0 {
+		r.failCheckouts--
+		return errors.New("unable to create index.lock")
+	}
+	return nil
+}
+
+func (r *flakyRepo) Merge(head string) (bool, error) {
+	r.merges[head]++
+	if r.failMerges[head] > 0 {
+		r.failMerges[head]--
+		return false, errors.New("unable to create index.lock")
+	}
+	return !r.conflicts[head], nil
+}
+
+func TestPickBatchRetriesGit(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	var prs []PullRequest
+	for _, n := range []int{1, 2, 3} {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", n))
+		prs = append(prs, pr)
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: prs}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+
+	repo := &flakyRepo{
+		failCheckouts: 1,
+		failMerges:    map[string]int{"head-1": 1},
+		conflicts:     map[string]bool{"head-2": true},
+		merges:        make(map[string]int),
+	}
+	var clones int
+	c := &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		ca:     ca,
+		cloneFor: func(string) (gitRepo, error) {
+			if clones++; clones == 1 {
+				return nil, errors.New("unable to lock the git cache")
+			}
+			return repo, nil
+		},
+	}
+	batch, _, err := c.pickBatch(sp)
+	if err != nil {
+		t.Fatalf("Error from pickBatch: %v", err)
+	}
+	testPullsMatchList(t, "transient errors", batch, []int{1, 3})
+	if clones != 2 {
+		t.Errorf("Expected the clone to be retried once, got %d clones.", clones)
+	}
+	// Conflicts are not retried.
+	if expected := map[string]int{"head-1": 2, "head-2": 1, "head-3": 1}; !reflect.DeepEqual(repo.merges, expected) {
+		t.Errorf("Expected merges %v, got %v.", expected, repo.merges)
+	}
+	if len(slept) != 3 {
+		t.Errorf("Expected a backoff for each of the three retries, got %v.", slept)
+	}
+
+	// Errors that persist still abort batch assembly.
+	repo = &flakyRepo{
+		failMerges: map[string]int{"head-1": gitAttempts},
+		merges:     make(map[string]int),
+	}
+	c.cloneFor = func(string) (gitRepo, error) { return repo, nil }
+	if _, _, err := c.pickBatch(sp); err == nil {
+		t.Error("Expected an error once the merge failed on every attempt.")
+	}
+	if repo.merges["head-1"] != gitAttempts {
+		t.Errorf("Expected %d merge attempts, got %d.", gitAttempts, repo.merges["head-1"])
+	}
+}
+
+func TestTakeAction(t *testing.T) {
+	// PRs 0-9 exist. All are mergable, and all are passing tests.
+	testcases := []struct {
+		name string
+
+		batchPending bool
+		successes    []int
+		pendings     []int
+		nones        []int
+		batchMerges  []int
+		minBatchSize int
+
+		merged            int
+		triggered         int
+		triggered_batches int
+		action            Action
+		reason            string
+	}{
+		{
+			name: "no prs to test, should do nothing",
+
+			batchPending: true,
+			successes:    []int{},
+			pendings:     []int{},
+			nones:        []int{},
+			batchMerges:  []int{},
+
+			merged:    0,
+			triggered: 0,
+			action:    Wait,
+			reason:    waitNoCandidates,
+		},
+		{
+			name: "pending batch, pending serial, nothing to do",
+
+			batchPending: true,
+			successes:    []int{},
+			pendings:     []int{1},
+			nones:        []int{0, 2},
+			batchMerges:  []int{},
+
+			merged:    0,
+			triggered: 0,
+			action:    Wait,
+			reason:    waitBatchPending,
+		},
+		{
+			name: "pending batch, successful serial, nothing to do",
+
+			batchPending: true,
+			successes:    []int{1},
+			pendings:     []int{},
+			nones:        []int{0, 2},
+			batchMerges:  []int{},
+
+			merged:    0,
+			triggered: 0,
 			action:    Wait,
+			reason:    waitBatchPending,
 		},
 		{
 			name: "pending batch, should trigger serial",
@@ -673,6 +1444,78 @@ func TestTakeAction(t *testing.T) {
 			triggered_batches: 1,
 			action:            TriggerBatch,
 		},
+		{
+			name: "two PRs, default minimum batch size, should trigger batch",
+
+			batchPending: false,
+			successes:    []int{},
+			pendings:     []int{0},
+			nones:        []int{1},
+			batchMerges:  []int{},
+
+			merged:            0,
+			triggered:         1,
+			triggered_batches: 1,
+			action:            TriggerBatch,
+		},
+		{
+			name: "batch of four at minimum batch size four, should trigger batch",
+
+			batchPending: false,
+			successes:    []int{},
+			pendings:     []int{0},
+			nones:        []int{1, 2, 3},
+			batchMerges:  []int{},
+			minBatchSize: 4,
+
+			merged:            0,
+			triggered:         1,
+			triggered_batches: 1,
+			action:            TriggerBatch,
+		},
+		{
+			name: "batch of four below minimum batch size five, should do nothing",
+
+			batchPending: false,
+			successes:    []int{},
+			pendings:     []int{0},
+			nones:        []int{1, 2, 3},
+			batchMerges:  []int{},
+			minBatchSize: 5,
+
+			merged:    0,
+			triggered: 0,
+			action:    Wait,
+			reason:    waitBatchTooSmall,
+		},
+		{
+			name: "pending serial, no batch, should do nothing",
+
+			batchPending: false,
+			successes:    []int{},
+			pendings:     []int{0},
+			nones:        []int{},
+			batchMerges:  []int{},
+
+			merged:    0,
+			triggered: 0,
+			action:    Wait,
+			reason:    waitPending,
+		},
+		{
+			name: "passing PR with a batch below the minimum size, should merge serially",
+
+			batchPending: false,
+			successes:    []int{0},
+			pendings:     []int{},
+			nones:        []int{1},
+			batchMerges:  []int{},
+			minBatchSize: 3,
+
+			merged:    1,
+			triggered: 0,
+			action:    Merge,
+		},
 		{
 			name: "one PR, should not trigger batch",
 
@@ -725,6 +1568,7 @@ func TestTakeAction(t *testing.T) {
 					},
 				},
 			},
+			Tide: config.Tide{MinBatchSize: tc.minBatchSize},
 		})
 		lg, gc, err := localgit.New()
 		if err != nil {
@@ -759,11 +1603,7 @@ func TestTakeAction(t *testing.T) {
 				}
 				var pr PullRequest
 				pr.Number = githubql.Int(i)
-				pr.Commits.Nodes = []struct {
-					Commit struct {
-						Status struct{ State githubql.String }
-					}
-				}{{}}
+				pr.Commits.Nodes = []struct{ Commit Commit }{{}}
 				pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
 				pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
 				sp.prs = append(sp.prs, pr)
@@ -773,19 +1613,16 @@ func TestTakeAction(t *testing.T) {
 		}
 		var fkc fkc
 		var fgc fgc
-		c := &Controller{
-			logger: logrus.WithField("controller", "tide"),
-			gc:     gc,
-			ghc:    &fgc,
-			ca:     ca,
-			kc:     &fkc,
-		}
+		c := newTestController(ca, &fgc, &fkc)
+		c.gc = gc
 		t.Logf("Test case: %s", tc.name)
-		if act, _, err := c.takeAction(sp, tc.batchPending, genPulls(tc.successes), genPulls(tc.pendings), genPulls(tc.nones), genPulls(tc.batchMerges)); err != nil {
+		if act, _, reason, err := c.takeAction(context.Background(), sp, tc.batchPending, genPulls(tc.successes), genPulls(tc.pendings), genPulls(tc.nones), genPulls(tc.batchMerges)); err != nil {
 			t.Errorf("Error in takeAction: %v", err)
 			continue
 		} else if act != tc.action {
 			t.Errorf("Wrong action. Got %v, wanted %v.", act, tc.action)
+		} else if reason != tc.reason {
+			t.Errorf("Wrong wait reason. Got %q, wanted %q.", reason, tc.reason)
 		}
 		if tc.triggered != len(fkc.createdJobs) {
 			t.Errorf("Wrong number of jobs triggered. Got %d, expected %d.", len(fkc.createdJobs), tc.triggered)
@@ -824,14 +1661,5163 @@ func TestServeHTTP(t *testing.T) {
 		t.Errorf("GET error: %v", err)
 	}
 	defer resp.Body.Close()
-	var pools []Pool
-	if err := json.NewDecoder(resp.Body).Decode(&pools); err != nil {
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
 		t.Errorf("JSON decoding error: %v", err)
 	}
+	pools := status.Pools
 	if len(pools) != 1 {
-		t.Errorf("Wrong number of pools. Got %d, want 1.", len(pools))
+		t.Fatalf("Wrong number of pools. Got %d, want 1.", len(pools))
 	}
 	if pools[0].Action != Merge {
 		t.Errorf("Wrong action. Got %v, want %v.", pools[0].Action, Merge)
 	}
 }
+
+type badPool struct{}
+
+func (badPool) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("cannot marshal")
+}
+
+func TestMarshalPools(t *testing.T) {
+	b := marshalPools(logrus.WithField("controller", "tide"), []interface{}{
+		Pool{Org: "o", Action: Merge},
+		badPool{},
+		Pool{Org: "o", Action: Wait},
+		Pool{Org: "o", Action: Close},
+	}, nil, nil, time.Time{})
+	var status Status
+	if err := json.Unmarshal(b, &status); err != nil {
+		t.Fatalf("JSON decoding error: %v", err)
+	}
+	if status.SchemaVersion != SchemaVersion {
+		t.Errorf("Wrong schema version. Got %d, want %d.", status.SchemaVersion, SchemaVersion)
+	}
+	pools := status.Pools
+	if len(pools) != 3 {
+		t.Fatalf("Wrong number of pools. Got %d, want 3.", len(pools))
+	}
+	if pools[0].Action != Merge || pools[1].Action != Wait || pools[2].Action != Close {
+		t.Errorf("Wrong actions. Got %v, %v and %v, want %v, %v and %v.", pools[0].Action, pools[1].Action, pools[2].Action, Merge, Wait, Close)
+	}
+	if !strings.Contains(string(b), `"Action":"CLOSE"`) {
+		t.Errorf("Expected the close action to be served as CLOSE, got %s.", b)
+	}
+}
+
+func TestDropStaleJobs(t *testing.T) {
+	now := time.Now()
+	var labeled, unlabeled PullRequest
+	labeled.Number = 1
+	labeled.Repository.NameWithOwner = "o/r"
+	unlabeled.Number = 2
+	unlabeled.Repository.NameWithOwner = "o/r"
+	newJob := func(name string, number int, jobType kube.ProwJobType, start time.Time) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  name,
+				Type: jobType,
+				Refs: kube.Refs{Pulls: []kube.Pull{{Number: number}}},
+			},
+			Status: kube.ProwJobStatus{StartTime: start},
+		}
+	}
+	sp := subpool{
+		prs: []PullRequest{labeled, unlabeled},
+		pjs: []kube.ProwJob{
+			newJob("stale", 1, kube.PresubmitJob, now.Add(-time.Hour)),
+			newJob("fresh", 1, kube.PresubmitJob, now.Add(time.Minute)),
+			newJob("other", 2, kube.PresubmitJob, now.Add(-time.Hour)),
+			newJob("batch", 1, kube.BatchJob, now.Add(-time.Hour)),
+		},
+	}
+	pjs := dropStaleJobs(sp, map[string]time.Time{"o/r#1": now})
+	var names []string
+	for _, pj := range pjs {
+		names = append(names, pj.Spec.Job)
+	}
+	if expected := []string{"fresh", "other", "batch"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected jobs %v, got %v.", expected, names)
+	}
+}
+
+func TestTakeActionRetestRequested(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "foo",
+					AlwaysRun: true,
+				},
+			},
+		},
+		Tide: config.Tide{RetestLabel: "tide/retest"},
+	})
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+	}
+	var passing, retest PullRequest
+	passing.Number = 1
+	retest.Number = 2
+	retest.Labels.Nodes = append(retest.Labels.Nodes, struct{ Name githubql.String }{Name: "tide/retest"})
+	sp.prs = []PullRequest{passing, retest}
+	sp.retests = []PullRequest{retest}
+
+	for _, dryRun := range []bool{false, true} {
+		var fkc fkc
+		var fgc fgc
+		c := newTestController(ca, &fgc, &fkc)
+		c.dryRun = dryRun
+		act, targets, _, err := c.takeAction(context.Background(), sp, false, []PullRequest{passing, retest}, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("Error in takeAction: %v", err)
+		}
+		if act != Trigger {
+			t.Errorf("Wrong action. Got %v, wanted %v.", act, Trigger)
+		}
+		testPullsMatchList(t, "retest targets", targets, []int{2})
+		if fgc.merged != 0 {
+			t.Errorf("Expected no merges, got %d.", fgc.merged)
+		}
+		var expectedJobs int
+		var expectedRemoved []string
+		if !dryRun {
+			expectedJobs = 1
+			expectedRemoved = []string{"o/r#2:tide/retest"}
+		}
+		if len(fkc.createdJobs) != expectedJobs {
+			t.Errorf("Expected %d jobs triggered, got %d.", expectedJobs, len(fkc.createdJobs))
+		}
+		if !reflect.DeepEqual(fgc.removedLabels, expectedRemoved) {
+			t.Errorf("Expected removed labels %v, got %v.", expectedRemoved, fgc.removedLabels)
+		}
+		if _, recorded := c.retests.times[prKey(retest)]; recorded == dryRun {
+			t.Errorf("Expected the retest to be recorded to be %t, got %t.", !dryRun, recorded)
+		}
+	}
+}
+
+func TestRetestPendingJobs(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+		Tide:       config.Tide{RetestLabel: "tide/retest"},
+	})
+	fc := &fakeClock{now: time.Now()}
+	pr := newTestPR(1, "tide/retest")
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: []PullRequest{pr}, retests: []PullRequest{pr}}
+
+	// The PR's job from before the retest request is still running.
+	var earlier fkc
+	c := newTestController(ca, &fgc{}, &earlier)
+	c.clock = fc
+	if err := c.trigger(sp, sp.sha, []PullRequest{pr}); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	pending := earlier.createdJobs[0]
+	pending.Status = kube.ProwJobStatus{State: kube.PendingState, StartTime: fc.Now().Add(-time.Hour)}
+	sp.pjs = []kube.ProwJob{pending}
+
+	var kc fkc
+	c = newTestController(ca, &fgc{}, &kc)
+	c.clock = fc
+	act, _, _, err := c.takeAction(context.Background(), sp, false, nil, []PullRequest{pr}, nil, nil)
+	if err != nil {
+		t.Fatalf("Error taking action: %v", err)
+	}
+	if act != Trigger {
+		t.Errorf("Wrong action. Got %v, wanted %v.", act, Trigger)
+	}
+	if len(kc.createdJobs) != 1 {
+		t.Errorf("Expected the retest to trigger a fresh job despite the pending one, got %d jobs.", len(kc.createdJobs))
+	}
+}
+
+func TestRetestOnlyRetriggered(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+		Tide:       config.Tide{RetestLabel: "tide/retest", MinBatchSize: 10},
+	})
+	fc := &fakeClock{now: time.Now()}
+	newPR := func(number int) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Repository.NameWithOwner = "o/r"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", number))
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: "tide/retest"})
+		return pr
+	}
+	var pjs []kube.ProwJob
+	for _, number := range []int{1, 2} {
+		pjs = append(pjs, kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: kube.PresubmitJob,
+				Refs: kube.Refs{Org: "o", Repo: "r", BaseSHA: "base", Pulls: []kube.Pull{{Number: number, SHA: fmt.Sprintf("head-%d", number)}}},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState, StartTime: fc.Now().Add(-time.Hour)},
+		})
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: []PullRequest{newPR(1), newPR(2)}, pjs: pjs}
+
+	for _, paused := range []bool{true, false} {
+		c := newTestController(ca, &fgc{}, &fkc{})
+		c.clock = fc
+		c.SetPaused(paused)
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("Error syncing subpool: %v", err)
+		}
+		pool := c.pools[0]
+		if pool.Action != Trigger {
+			t.Errorf("Expected a retest to be triggered, got %s.", pool.Action)
+		}
+		testPullsMatchList(t, "retest targets", pool.Target, []int{1})
+		if paused {
+			if len(c.retests.times) != 0 {
+				t.Errorf("Expected no retest to be recorded while paused, got %v.", c.retests.times)
+			}
+			continue
+		}
+		if _, ok := c.retests.times["o/r#1"]; !ok || len(c.retests.times) != 1 {
+			t.Errorf("Expected only the retriggered PR to be recorded, got %v.", c.retests.times)
+		}
+
+		// The PR that was not retriggered keeps its results.
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("Error syncing subpool: %v", err)
+		}
+		testPullsMatchList(t, "passing after the retest", c.pools[1].SuccessPRs, []int{2})
+	}
+}
+
+func TestErroredContexts(t *testing.T) {
+	var pr PullRequest
+	pr.Number = 1
+	pr.HeadRef.Target.OID = "head"
+	pj := func(context, sha string, state kube.ProwJobState, start int64) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    kube.PresubmitJob,
+				Context: context,
+				Refs:    kube.Refs{Pulls: []kube.Pull{{Number: 1, SHA: sha}}},
+			},
+			Status: kube.ProwJobStatus{State: state, StartTime: time.Unix(start, 0)},
+		}
+	}
+	testcases := []struct {
+		name string
+		pjs  []kube.ProwJob
+
+		expected []string
+	}{
+		{
+			name:     "one context errored",
+			pjs:      []kube.ProwJob{pj("a", "head", kube.ErrorState, 1), pj("b", "head", kube.SuccessState, 1)},
+			expected: []string{"a"},
+		},
+		{
+			name:     "errors alongside a pending context",
+			pjs:      []kube.ProwJob{pj("a", "head", kube.ErrorState, 1), pj("b", "head", kube.PendingState, 1)},
+			expected: []string{"a"},
+		},
+		{
+			name: "another context failed",
+			pjs:  []kube.ProwJob{pj("a", "head", kube.ErrorState, 1), pj("b", "head", kube.FailureState, 1)},
+		},
+		{
+			name: "another context is missing",
+			pjs:  []kube.ProwJob{pj("a", "head", kube.ErrorState, 1)},
+		},
+		{
+			name: "errored too often",
+			pjs: []kube.ProwJob{
+				pj("a", "head", kube.ErrorState, 1),
+				pj("a", "head", kube.ErrorState, 2),
+				pj("a", "head", kube.ErrorState, 3),
+				pj("b", "head", kube.SuccessState, 1),
+			},
+		},
+		{
+			name: "errors on an old head do not count",
+			pjs: []kube.ProwJob{
+				pj("a", "old", kube.ErrorState, 1),
+				pj("a", "old", kube.ErrorState, 2),
+				pj("a", "head", kube.ErrorState, 3),
+				pj("b", "head", kube.SuccessState, 1),
+			},
+			expected: []string{"a"},
+		},
+		{
+			name: "retriggered job is pending",
+			pjs: []kube.ProwJob{
+				pj("a", "head", kube.ErrorState, 1),
+				pj("a", "head", kube.PendingState, 2),
+				pj("b", "head", kube.SuccessState, 1),
+			},
+		},
+	}
+	for _, tc := range testcases {
+		for _, strategy := range []string{config.TideAccumulateBest, config.TideAccumulateLatest} {
+			actual := erroredContexts([]string{"a", "b"}, nil, pr, tc.pjs, strategy, 2)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("%s (%s): expected errored contexts %v, got %v.", tc.name, strategy, tc.expected, actual)
+			}
+		}
+		// Errored PRs are not passing.
+		if successes, _, _ := accumulate(map[int][]string{1: {"a", "b"}}, nil, "", []PullRequest{pr}, tc.pjs, config.TideAccumulateBest); len(successes) != 0 {
+			t.Errorf("%s: expected the PR not to pass.", tc.name)
+		}
+	}
+}
+
+func TestTakeActionRetriggerErrors(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{Name: "foo", AlwaysRun: true},
+				{Name: "bar", AlwaysRun: true},
+			},
+		},
+		Tide: config.Tide{ErrorRetriggers: 1},
+	})
+	var errored, failed PullRequest
+	errored.Number = 2
+	failed.Number = 1
+	sp := subpool{
+		org:     "o",
+		repo:    "r",
+		branch:  "master",
+		sha:     "master",
+		prs:     []PullRequest{failed, errored},
+		errored: map[int][]string{2: {"bar"}},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		var fkc fkc
+		c := newTestController(ca, &fgc{}, &fkc)
+		c.dryRun = dryRun
+		act, targets, _, err := c.takeAction(context.Background(), sp, false, nil, nil, []PullRequest{failed, errored}, nil)
+		if err != nil {
+			t.Fatalf("Error in takeAction: %v", err)
+		}
+		if act != Trigger {
+			t.Errorf("Wrong action. Got %v, wanted %v.", act, Trigger)
+		}
+		testPullsMatchList(t, "retrigger targets", targets, []int{2})
+		var expectedJobs []string
+		if !dryRun {
+			expectedJobs = []string{"bar"}
+		}
+		var jobs []string
+		for _, pj := range fkc.createdJobs {
+			jobs = append(jobs, pj.Spec.Job)
+		}
+		if !reflect.DeepEqual(jobs, expectedJobs) {
+			t.Errorf("Expected jobs %v triggered, got %v.", expectedJobs, jobs)
+		}
+	}
+}
+
+func TestTakeActionClose(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{CloseLabels: []string{"wontfix", "invalid"}}})
+	passing := newTestPR(2, "lgtm")
+	passing.Commits.Nodes = []struct{ Commit Commit }{{}}
+	passing.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+		prs:    []PullRequest{newTestPR(1, "wontfix"), passing, newTestPR(3, "lgtm", "invalid")},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		fgc := &fgc{}
+		c := newTestController(ca, fgc, &fkc{})
+		c.dryRun = dryRun
+		act, targets, _, err := c.takeAction(context.Background(), sp, false, []PullRequest{passing}, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("Error in takeAction: %v", err)
+		}
+		if act != Close {
+			t.Errorf("Wrong action. Got %v, wanted %v.", act, Close)
+		}
+		testPullsMatchList(t, "close targets", targets, []int{1, 3})
+		var expectedClosed []int
+		if !dryRun {
+			expectedClosed = []int{1, 3}
+		}
+		if !reflect.DeepEqual(fgc.closed, expectedClosed) {
+			t.Errorf("Expected PRs %v closed, got %v.", expectedClosed, fgc.closed)
+		}
+		if fgc.merged != 0 {
+			t.Errorf("Expected no merges, got %d.", fgc.merged)
+		}
+	}
+
+	// Without close labels configured, the passing PR is merged instead.
+	ca.Set(&config.Config{})
+	fgc := &fgc{}
+	c := newTestController(ca, fgc, &fkc{})
+	if act, _, _, err := c.takeAction(context.Background(), sp, false, []PullRequest{passing}, nil, nil, nil); err != nil {
+		t.Fatalf("Error in takeAction: %v", err)
+	} else if act != Merge {
+		t.Errorf("Wrong action without close labels. Got %v, wanted %v.", act, Merge)
+	}
+	if len(fgc.closed) != 0 {
+		t.Errorf("Expected no PRs closed, got %v.", fgc.closed)
+	}
+}
+
+func TestSearchAllMaxPRs(t *testing.T) {
+	newPRs := func(first, n int) []PullRequest {
+		var prs []PullRequest
+		for i := first; i < first+n; i++ {
+			var pr PullRequest
+			pr.Number = githubql.Int(i)
+			prs = append(prs, pr)
+		}
+		return prs
+	}
+	testcases := []struct {
+		name    string
+		queries map[string][]PullRequest
+		maxPRs  int
+
+		expectedPRs   int
+		expectedCalls int
+	}{
+		{
+			name:          "unlimited",
+			queries:       map[string][]PullRequest{"a": newPRs(0, 25)},
+			expectedPRs:   25,
+			expectedCalls: 4,
+		},
+		{
+			name:          "stops paginating once full",
+			queries:       map[string][]PullRequest{"a": newPRs(0, 25)},
+			maxPRs:        15,
+			expectedPRs:   15,
+			expectedCalls: 2,
+		},
+		{
+			name:          "later queries are skipped once full",
+			queries:       map[string][]PullRequest{"a": newPRs(0, 25), "b": newPRs(100, 5)},
+			maxPRs:        10,
+			expectedPRs:   10,
+			expectedCalls: 1,
+		},
+		{
+			name:          "PRs found by several queries count once",
+			queries:       map[string][]PullRequest{"a": newPRs(0, 10), "b": newPRs(0, 25)},
+			maxPRs:        15,
+			expectedPRs:   15,
+			expectedCalls: 3,
+		},
+	}
+	for _, tc := range testcases {
+		fc := &fgc{queryPRs: tc.queries, queryPageSize: 10}
+		c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+		// One query at a time, so that they run in order.
+		pool, _, err := c.searchAll(context.Background(), []string{"a", "b"}, 1, tc.maxPRs)
+		if err != nil {
+			t.Fatalf("%s: error searching: %v", tc.name, err)
+		}
+		if len(pool) != tc.expectedPRs {
+			t.Errorf("%s: expected %d PRs, got %d.", tc.name, tc.expectedPRs, len(pool))
+		}
+		if distinct := len(dedupePRs(pool)); distinct != len(pool) {
+			t.Errorf("%s: expected distinct PRs, got %d duplicates.", tc.name, len(pool)-distinct)
+		}
+		if fc.queryCalls != tc.expectedCalls {
+			t.Errorf("%s: expected %d queries, got %d.", tc.name, tc.expectedCalls, fc.queryCalls)
+		}
+	}
+}
+
+func TestSearchAll(t *testing.T) {
+	queries := []string{"a", "b", "c", "d", "e"}
+	fc := &fgc{queryPRs: make(map[string][]PullRequest)}
+	var expected []int
+	for i, q := range queries {
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		fc.queryPRs[q] = []PullRequest{pr}
+		expected = append(expected, i)
+	}
+	for _, concurrency := range []int{0, 1, 2, 10} {
+		fc.maxInFlight = 0
+		c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+		prs, costs, err := c.searchAll(context.Background(), queries, concurrency, 0)
+		if err != nil {
+			t.Fatalf("Error searching with concurrency %d: %v", concurrency, err)
+		}
+		if nums := prNumbers(prs); !reflect.DeepEqual(nums, expected) {
+			t.Errorf("With concurrency %d, expected PRs %v in query order, got %v.", concurrency, expected, nums)
+		}
+		if len(costs) != len(queries) {
+			t.Errorf("With concurrency %d, expected %d costs, got %d.", concurrency, len(queries), len(costs))
+		}
+		limit := concurrency
+		if limit < 1 {
+			limit = 1
+		}
+		if fc.maxInFlight > limit {
+			t.Errorf("With concurrency %d, got %d queries in flight.", concurrency, fc.maxInFlight)
+		}
+	}
+}
+
+func TestDedupePRs(t *testing.T) {
+	newPR := func(repo string, number int, labels ...string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Repository.NameWithOwner = githubql.String(repo)
+		for _, l := range labels {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(l)})
+		}
+		return pr
+	}
+	fc := &fgc{queryPRs: map[string][]PullRequest{
+		"lgtm":     {newPR("o/r", 1), newPR("o/r", 2), newPR("o/other", 1)},
+		"approved": {newPR("o/r", 2, "approved"), newPR("o/r", 3)},
+	}}
+	c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+	pool, _, err := c.searchAll(context.Background(), []string{"lgtm", "approved"}, 2, 0)
+	if err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	if len(pool) != 5 {
+		t.Fatalf("Expected overlapping queries to return 5 PRs, got %d.", len(pool))
+	}
+	deduped := dedupePRs(pool)
+	var keys []string
+	for _, pr := range deduped {
+		keys = append(keys, prKey(pr))
+	}
+	if expected := []string{"o/r#1", "o/r#2", "o/other#1", "o/r#3"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected PRs %v, got %v.", expected, keys)
+	}
+	if !hasLabel(deduped[1], "approved") {
+		t.Error("Expected the richer copy of o/r#2 to be kept.")
+	}
+}
+
+func TestSyncSubpoolTimeout(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "foo",
+					AlwaysRun: true,
+				},
+			},
+		},
+		Tide: config.Tide{SubpoolTimeout: 10 * time.Millisecond},
+	})
+	var pr PullRequest
+	pr.Number = 1
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+		prs:    []PullRequest{pr},
+	}
+	c := newTestController(ca, &fgc{}, &fkc{createDelay: time.Second})
+	start := time.Now()
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Expected a timed out subpool not to fail the sync, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the subpool to be abandoned, but it took %v.", elapsed)
+	}
+	if len(c.pools) != 1 {
+		t.Fatalf("Expected one pool, got %d.", len(c.pools))
+	}
+	if c.pools[0].Action != Wait {
+		t.Errorf("Wrong action. Got %v, wanted %v.", c.pools[0].Action, Wait)
+	}
+	if c.pools[0].WaitReason != waitTimedOut {
+		t.Errorf("Wrong wait reason. Got %q, wanted %q.", c.pools[0].WaitReason, waitTimedOut)
+	}
+	if c.pools[0].Error == "" {
+		t.Error("Expected the timeout to be recorded in the pool.")
+	}
+}
+
+func TestSyncSubpoolTimeoutQueued(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "foo", AlwaysRun: true}},
+		},
+		Tide: config.Tide{SubpoolTimeout: 100 * time.Millisecond},
+	})
+	stuck := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: []PullRequest{newTestPR(1)}}
+	queued := subpool{org: "o", repo: "other", branch: "master", sha: "master"}
+	c := newTestController(ca, &fgc{}, &fkc{createDelay: 400 * time.Millisecond})
+	c.setMaxConcurrency(1)
+	if err := c.syncSubpool(stuck); err != nil {
+		t.Fatalf("Error syncing the stuck subpool: %v", err)
+	}
+	// The abandoned action holds the only slot for a while yet, but waiting
+	// for it does not count against the queued subpool's timeout.
+	if err := c.syncSubpool(queued); err != nil {
+		t.Fatalf("Error syncing the queued subpool: %v", err)
+	}
+	if len(c.pools) != 2 {
+		t.Fatalf("Expected two pools, got %d.", len(c.pools))
+	}
+	if c.pools[0].Error == "" {
+		t.Error("Expected the stuck subpool to time out.")
+	}
+	if c.pools[1].Error != "" || c.pools[1].WaitReason == waitTimedOut {
+		t.Errorf("Expected the queued subpool not to time out, got %q (%s).", c.pools[1].Error, c.pools[1].WaitReason)
+	}
+}
+
+func TestTakeActionCancelled(t *testing.T) {
+	newPR := func(n int, state string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		return pr
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "foo", AlwaysRun: true}},
+		},
+	})
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// An abandoned action neither merges nor triggers.
+	for _, tc := range []struct {
+		name      string
+		pr        PullRequest
+		successes []PullRequest
+		nones     []PullRequest
+	}{
+		{name: "merge", pr: newPR(1, "SUCCESS"), successes: []PullRequest{newPR(1, "SUCCESS")}},
+		{name: "trigger", pr: newPR(1, "SUCCESS"), nones: []PullRequest{newPR(1, "SUCCESS")}},
+	} {
+		fc := &fgc{}
+		kc := &fkc{}
+		c := newTestController(ca, fc, kc)
+		sp.prs = []PullRequest{tc.pr}
+		if _, _, _, err := c.takeAction(cancelled, sp, false, tc.successes, nil, tc.nones, nil); err != context.Canceled {
+			t.Errorf("%s: expected the action to be cancelled, got: %v", tc.name, err)
+		}
+		if fc.merged != 0 || len(kc.createdJobs) != 0 {
+			t.Errorf("%s: expected nothing to be done, got %d merges and %d jobs.", tc.name, fc.merged, len(kc.createdJobs))
+		}
+	}
+
+	// A batch being merged when its action is abandoned stops before the next
+	// merge.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fc := &fgc{onMerge: cancel}
+	c := newTestController(ca, fc, nil)
+	if err := c.mergePRs(ctx, sp, []PullRequest{newPR(1, "SUCCESS"), newPR(2, "SUCCESS")}); err != context.Canceled {
+		t.Errorf("Expected the merge to be cancelled, got: %v", err)
+	}
+	if !reflect.DeepEqual(fc.mergedNumbers, []int{1}) {
+		t.Errorf("Expected only #1 to be merged, got %v.", fc.mergedNumbers)
+	}
+}
+
+func TestServeCosts(t *testing.T) {
+	fc := &fgc{queryPRs: map[string][]PullRequest{"a": {{}}, "b": {{}}}}
+	c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+	_, costs, err := c.searchAll(context.Background(), []string{"a", "b"}, 1, 0)
+	if err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	c.costs = costs
+	s := httptest.NewServer(http.HandlerFunc(c.ServeCosts))
+	defer s.Close()
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	defer resp.Body.Close()
+	var served []QueryCost
+	if err := json.NewDecoder(resp.Body).Decode(&served); err != nil {
+		t.Fatalf("JSON decoding error: %v", err)
+	}
+	expected := []QueryCost{{Query: "a", Cost: 1, PRs: 1}, {Query: "b", Cost: 1, PRs: 1}}
+	if !reflect.DeepEqual(served, expected) {
+		t.Errorf("Expected costs %+v, got %+v.", expected, served)
+	}
+}
+
+func TestServeConfig(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries:            []string{"label:lgtm"},
+			CommitterEmail:     "bot@example.com",
+			DecisionWebhookURL: "https://hooks.example.com/tide?token=s3cret",
+		},
+	})
+	c := newTestController(ca, nil, nil)
+	s := httptest.NewServer(http.HandlerFunc(c.ServeConfig))
+	defer s.Close()
+	get := func() config.Tide {
+		resp, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		defer resp.Body.Close()
+		var served config.Tide
+		if err := json.NewDecoder(resp.Body).Decode(&served); err != nil {
+			t.Fatalf("JSON decoding error: %v", err)
+		}
+		return served
+	}
+
+	served := get()
+	if !reflect.DeepEqual(served.Queries, []string{"label:lgtm"}) {
+		t.Errorf("Expected the configured queries, got %q.", served.Queries)
+	}
+	if served.CommitterEmail != "<redacted>" {
+		t.Errorf("Expected the committer email to be redacted, got %q.", served.CommitterEmail)
+	}
+	if served.DecisionWebhookURL != "<redacted>" {
+		t.Errorf("Expected the decision webhook URL to be redacted, got %q.", served.DecisionWebhookURL)
+	}
+	if ca.Config().Tide.CommitterEmail != "bot@example.com" {
+		t.Errorf("Expected the config itself to be left alone, got committer email %q.", ca.Config().Tide.CommitterEmail)
+	}
+
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries:     []string{"label:approved"},
+			MaxPoolSize: 100,
+		},
+	})
+	served = get()
+	if !reflect.DeepEqual(served.Queries, []string{"label:approved"}) || served.MaxPoolSize != 100 {
+		t.Errorf("Expected the reloaded config, got queries %q and max pool size %d.", served.Queries, served.MaxPoolSize)
+	}
+}
+
+func TestPathRequirements(t *testing.T) {
+	requirements := []config.TidePathRequirement{{Presubmit: "e2e", Path: "^pkg/"}}
+	if err := config.SetPathRequirementRegexes(requirements); err != nil {
+		t.Fatalf("Error compiling path requirements: %v", err)
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "unit",
+					AlwaysRun: true,
+				},
+				{
+					Name:      "e2e",
+					AlwaysRun: true,
+				},
+			},
+		},
+		Tide: config.Tide{PathRequirements: requirements},
+	})
+	fc := &fgc{changes: map[int][]string{
+		1: {"pkg/foo.go", "README.md"},
+		2: {"docs/README.md"},
+	}}
+	var fkc fkc
+	c := newTestController(ca, fc, &fkc)
+	var touchesPkg, docsOnly PullRequest
+	touchesPkg.Number = 1
+	docsOnly.Number = 2
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+		prs:    []PullRequest{touchesPkg, docsOnly},
+	}
+
+	presubmits := make(map[int][]string)
+	for _, pr := range sp.prs {
+		required, err := c.presubmitsFor(sp, pr)
+		if err != nil {
+			t.Fatalf("Error getting presubmits for PR %d: %v", int(pr.Number), err)
+		}
+		presubmits[int(pr.Number)] = required
+	}
+	expected := map[int][]string{1: {"unit", "e2e"}, 2: {"unit"}}
+	if !reflect.DeepEqual(presubmits, expected) {
+		t.Errorf("Expected required presubmits %v, got %v.", expected, presubmits)
+	}
+
+	if err := c.trigger(sp, sp.sha, []PullRequest{docsOnly}); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	if len(fkc.createdJobs) != 1 || fkc.createdJobs[0].Spec.Job != "unit" {
+		t.Errorf("Expected only unit to be triggered for a docs change, got %+v.", fkc.createdJobs)
+	}
+	fkc.createdJobs = nil
+	if err := c.trigger(sp, sp.sha, []PullRequest{touchesPkg, docsOnly}); err != nil {
+		t.Fatalf("Error triggering batch: %v", err)
+	}
+	if len(fkc.createdJobs) != 2 {
+		t.Errorf("Expected a batch touching pkg/ to trigger both jobs, got %d.", len(fkc.createdJobs))
+	}
+
+	var pjs []kube.ProwJob
+	for _, pr := range sp.prs {
+		pjs = append(pjs, kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: kube.PresubmitJob,
+				Refs: kube.Refs{Pulls: []kube.Pull{{Number: int(pr.Number)}}},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		})
+	}
+	successes, _, nones := accumulate(presubmits, nil, "", sp.prs, pjs, config.TideAccumulateBest)
+	testPullsMatchList(t, "successes", successes, []int{2})
+	testPullsMatchList(t, "nones", nones, []int{1})
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestRetestCooldown(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{RetestLabel: "tide/retest"}})
+	fc := &fakeClock{now: time.Date(2017, time.November, 1, 0, 0, 0, 0, time.UTC)}
+	c := &Controller{
+		clock: fc,
+		ca:    ca,
+	}
+	var pr PullRequest
+	pr.Number = 1
+	pr.Repository.NameWithOwner = "o/r"
+	pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: "tide/retest"})
+	sp := subpool{prs: []PullRequest{pr}}
+
+	steps := []struct {
+		advance   time.Duration
+		retrigger bool
+		due       bool
+	}{
+		{due: true},
+		// A request that was not acted on stays due.
+		{advance: time.Minute, due: true, retrigger: true},
+		{advance: time.Minute, due: false},
+		{advance: retestCooldown - 2*time.Minute, due: false},
+		{advance: time.Minute, due: true, retrigger: true},
+		{advance: time.Second, due: false},
+	}
+	for i, step := range steps {
+		fc.Advance(step.advance)
+		due := c.dueRetests(sp)
+		if (len(due) == 1) != step.due {
+			t.Errorf("Step %d: expected due to be %t, got PRs %v.", i, step.due, prNumbers(due))
+		}
+		if step.retrigger {
+			c.recordRetest(pr, fc.Now())
+		}
+	}
+}
+
+func TestTakeActionForceMerge(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{ForceMergeLabel: "tide/force-merge"}})
+	newPR := func(number int, state string, labels ...string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		for _, l := range labels {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(l)})
+		}
+		return pr
+	}
+	testcases := []struct {
+		name      string
+		successes []PullRequest
+
+		action Action
+		merged int
+	}{
+		{
+			name:      "no force-merge label, wait for the batch",
+			successes: []PullRequest{newPR(1, "SUCCESS"), newPR(2, "SUCCESS")},
+			action:    Wait,
+		},
+		{
+			name:      "force-merge label on a passing PR, merge it",
+			successes: []PullRequest{newPR(1, "SUCCESS"), newPR(2, "SUCCESS", "tide/force-merge")},
+			action:    Merge,
+			merged:    2,
+		},
+		{
+			name:      "force-merge label on a PR that isn't green, wait for the batch",
+			successes: []PullRequest{newPR(1, "SUCCESS"), newPR(2, "PENDING", "tide/force-merge")},
+			action:    Wait,
+		},
+	}
+	for _, tc := range testcases {
+		var fgc fgc
+		c := newTestController(ca, &fgc, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+		act, targets, _, err := c.takeAction(context.Background(), sp, true, tc.successes, nil, nil, nil)
+		if err != nil {
+			t.Errorf("For case %q, error in takeAction: %v", tc.name, err)
+			continue
+		}
+		if act != tc.action {
+			t.Errorf("For case %q, wrong action. Got %v, wanted %v.", tc.name, act, tc.action)
+		}
+		if tc.merged != 0 {
+			testPullsMatchList(t, tc.name, targets, []int{tc.merged})
+			if fgc.merged != 1 {
+				t.Errorf("For case %q, expected one merge, got %d.", tc.name, fgc.merged)
+			}
+		} else if fgc.merged != 0 {
+			t.Errorf("For case %q, expected no merges, got %d.", tc.name, fgc.merged)
+		}
+	}
+}
+
+func TestSyncSubpoolEmptyRequiredSet(t *testing.T) {
+	var pr PullRequest
+	pr.Number = 1
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+	testcases := []struct {
+		name       string
+		presubmits []config.Presubmit
+
+		action Action
+		merged int
+	}{
+		{
+			name:       "no presubmits required on the branch, refuse to merge",
+			presubmits: []config.Presubmit{{Name: "foo", AlwaysRun: false}},
+			action:     Wait,
+		},
+		{
+			name:       "presubmits only run on other branches, refuse to merge",
+			presubmits: []config.Presubmit{{Name: "foo", AlwaysRun: true, Brancher: config.Brancher{Branches: []string{"release"}}}},
+			action:     Wait,
+		},
+		{
+			name:   "repo has no presubmits at all, merge",
+			action: Merge,
+			merged: 1,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Presubmits: map[string][]config.Presubmit{"o/r": tc.presubmits}})
+		fc := &fgc{}
+		c := newTestController(ca, fc, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: []PullRequest{pr}}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		if c.pools[0].Action != tc.action {
+			t.Errorf("For case %q, wrong action. Got %v, wanted %v.", tc.name, c.pools[0].Action, tc.action)
+		}
+		if fc.merged != tc.merged {
+			t.Errorf("For case %q, expected %d merges, got %d.", tc.name, tc.merged, fc.merged)
+		}
+	}
+}
+
+func TestConfigureIdentity(t *testing.T) {
+	lg, gc, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Error making local git: %v", err)
+	}
+	defer gc.Clean()
+	defer lg.Clean()
+	if err := lg.MakeFakeRepo("o", "r"); err != nil {
+		t.Fatalf("Error making fake repo: %v", err)
+	}
+	testcases := []struct {
+		name   string
+		config config.Tide
+
+		expectedName  string
+		expectedEmail string
+	}{
+		{
+			name:          "defaults",
+			expectedName:  "prow",
+			expectedEmail: "prow@localhost",
+		},
+		{
+			name:          "configured identity",
+			config:        config.Tide{CommitterName: "merge-bot", CommitterEmail: "merge-bot@example.com"},
+			expectedName:  "merge-bot",
+			expectedEmail: "merge-bot@example.com",
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: tc.config})
+		c := &Controller{ca: ca}
+		r, err := gc.Clone("o/r")
+		if err != nil {
+			t.Fatalf("Error cloning: %v", err)
+		}
+		if err := c.configureIdentity(r); err != nil {
+			t.Fatalf("For case %q, error configuring identity: %v", tc.name, err)
+		}
+		for key, expected := range map[string]string{"user.name": tc.expectedName, "user.email": tc.expectedEmail} {
+			cmd := exec.Command("git", "config", key)
+			cmd.Dir = r.Dir
+			b, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("For case %q, error reading %s: %v", tc.name, key, err)
+			}
+			if actual := strings.TrimSpace(string(b)); actual != expected {
+				t.Errorf("For case %q, expected %s to be %q, got %q.", tc.name, key, expected, actual)
+			}
+		}
+		r.Clean()
+	}
+}
+
+func TestDividePoolGetRefRetry(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	badGateway := errors.New("status code 502 not one of [200 404]")
+	testcases := []struct {
+		name    string
+		refErrs []error
+
+		expectedSubpools int
+		expectedCalls    int
+		expectedSleeps   []time.Duration
+		expectErr        bool
+	}{
+		{
+			name:             "502 twice then success",
+			refErrs:          []error{badGateway, badGateway},
+			expectedSubpools: 1,
+			expectedCalls:    3,
+			expectedSleeps:   []time.Duration{getRefBackoff, 2 * getRefBackoff},
+		},
+		{
+			name:           "502 on every attempt",
+			refErrs:        []error{badGateway, badGateway, badGateway, badGateway},
+			expectedCalls:  getRefAttempts,
+			expectedSleeps: []time.Duration{getRefBackoff, 2 * getRefBackoff, 4 * getRefBackoff},
+			expectErr:      true,
+		},
+		{
+			name:          "404 drops the subpool without retrying",
+			refErrs:       []error{&github.RefNotFound{}},
+			expectedCalls: 1,
+		},
+	}
+	for _, tc := range testcases {
+		slept = nil
+		fc := &fgc{
+			refs:    map[string]string{"o/r heads/master": "123"},
+			refErrs: tc.refErrs,
+		}
+		ca := &config.Agent{}
+		ca.Set(&config.Config{})
+		c := &Controller{
+			ghc:    fc,
+			ca:     ca,
+			logger: logrus.WithField("component", "tide"),
+		}
+		var pr PullRequest
+		pr.Number = 1
+		pr.BaseRef.Name = "master"
+		pr.BaseRef.Prefix = "refs/heads/"
+		pr.Repository.Name = "r"
+		pr.Repository.Owner.Login = "o"
+		sps, err := c.dividePool([]PullRequest{pr, pr}, nil)
+		if err != nil && !tc.expectErr {
+			t.Fatalf("For case %q, unexpected error: %v", tc.name, err)
+		} else if err == nil && tc.expectErr {
+			t.Fatalf("For case %q, expected an error.", tc.name)
+		}
+		if len(sps) != tc.expectedSubpools {
+			t.Errorf("For case %q, expected %d subpools, got %d.", tc.name, tc.expectedSubpools, len(sps))
+		} else if len(sps) == 1 && (sps[0].sha != "123" || len(sps[0].prs) != 2) {
+			t.Errorf("For case %q, got unexpected subpool %+v.", tc.name, sps[0])
+		}
+		if fc.refCalls != tc.expectedCalls {
+			t.Errorf("For case %q, expected %d GetRef calls, got %d.", tc.name, tc.expectedCalls, fc.refCalls)
+		}
+		if !reflect.DeepEqual(slept, tc.expectedSleeps) {
+			t.Errorf("For case %q, expected sleeps %v, got %v.", tc.name, tc.expectedSleeps, slept)
+		}
+	}
+}
+
+func TestTakeActionPaused(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "foo",
+					AlwaysRun: true,
+				},
+			},
+		},
+	})
+	testcases := []struct {
+		name        string
+		successes   []PullRequest
+		nones       []PullRequest
+		batchMerges []PullRequest
+
+		action Action
+	}{
+		{
+			name:      "merge",
+			successes: []PullRequest{newTestPR(1)},
+			action:    Merge,
+		},
+		{
+			name:        "merge batch",
+			batchMerges: []PullRequest{newTestPR(1), newTestPR(2)},
+			action:      MergeBatch,
+		},
+		{
+			name:   "trigger",
+			nones:  []PullRequest{newTestPR(1)},
+			action: Trigger,
+		},
+	}
+	for _, tc := range testcases {
+		fgc := &fgc{}
+		fkc := &fkc{}
+		c := newTestController(ca, fgc, fkc)
+		s := httptest.NewServer(http.HandlerFunc(c.ServePause))
+		resp, err := http.Post(s.URL, "", nil)
+		if err != nil {
+			t.Fatalf("POST error: %v", err)
+		}
+		resp.Body.Close()
+		s.Close()
+		if !c.isPaused() {
+			t.Fatalf("For case %q, expected the controller to be paused.", tc.name)
+		}
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+		act, targets, _, err := c.takeAction(context.Background(), sp, false, tc.successes, nil, tc.nones, tc.batchMerges)
+		if err != nil {
+			t.Errorf("For case %q, error in takeAction: %v", tc.name, err)
+			continue
+		}
+		if act != tc.action {
+			t.Errorf("For case %q, wrong action. Got %v, wanted %v.", tc.name, act, tc.action)
+		}
+		if len(targets) == 0 {
+			t.Errorf("For case %q, expected the paused controller to report its targets.", tc.name)
+		}
+		if fgc.merged != 0 {
+			t.Errorf("For case %q, paused controller merged %d PRs.", tc.name, fgc.merged)
+		}
+		if len(fkc.createdJobs) != 0 {
+			t.Errorf("For case %q, paused controller created %d jobs.", tc.name, len(fkc.createdJobs))
+		}
+
+		c.SetPaused(false)
+		if _, _, _, err := c.takeAction(context.Background(), sp, false, tc.successes, nil, tc.nones, tc.batchMerges); err != nil {
+			t.Errorf("For case %q, error in takeAction after resuming: %v", tc.name, err)
+		}
+		if fgc.merged == 0 && len(fkc.createdJobs) == 0 {
+			t.Errorf("For case %q, resumed controller took no action.", tc.name)
+		}
+	}
+}
+
+func TestServePause(t *testing.T) {
+	testcases := []struct {
+		name   string
+		method string
+		query  string
+
+		expectedCode   int
+		expectedPaused bool
+	}{
+		{
+			name:           "POST pauses",
+			method:         http.MethodPost,
+			expectedCode:   http.StatusOK,
+			expectedPaused: true,
+		},
+		{
+			name:         "POST can resume",
+			method:       http.MethodPost,
+			query:        "?paused=false",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "GET is rejected",
+			method:       http.MethodGet,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:         "bad value is rejected",
+			method:       http.MethodPost,
+			query:        "?paused=maybe",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testcases {
+		c := &Controller{logger: logrus.WithField("controller", "tide")}
+		w := httptest.NewRecorder()
+		c.ServePause(w, httptest.NewRequest(tc.method, "/pause"+tc.query, nil))
+		if w.Code != tc.expectedCode {
+			t.Errorf("For case %q, expected code %d, got %d.", tc.name, tc.expectedCode, w.Code)
+		}
+		if c.isPaused() != tc.expectedPaused {
+			t.Errorf("For case %q, expected paused to be %t.", tc.name, tc.expectedPaused)
+		}
+	}
+}
+
+func TestAccumulateByContext(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "pull-unit-fast",
+					Context:   "unit",
+					AlwaysRun: true,
+				},
+				{
+					Name:      "pull-unit-slow",
+					Context:   "unit",
+					AlwaysRun: true,
+				},
+				{
+					Name:      "pull-lint",
+					AlwaysRun: true,
+				},
+			},
+		},
+	})
+	c := &Controller{ca: ca}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+	var pr PullRequest
+	pr.Number = 1
+	pr.HeadRef.Target.OID = "head"
+	required, err := c.presubmitsFor(sp, pr)
+	if err != nil {
+		t.Fatalf("Error getting presubmits: %v", err)
+	}
+	if expected := []string{"unit", "pull-lint"}; !reflect.DeepEqual(required, expected) {
+		t.Fatalf("Expected required contexts %v, got %v.", expected, required)
+	}
+	presubmits := map[int][]string{1: required}
+
+	newJob := func(jobType kube.ProwJobType, job, context string) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    jobType,
+				Job:     job,
+				Context: context,
+				Refs:    kube.Refs{Pulls: []kube.Pull{{Number: 1, SHA: "head"}}},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		}
+	}
+	// The job name differs from the presubmit reporting to the same context.
+	pjs := []kube.ProwJob{
+		newJob(kube.PresubmitJob, "pull-unit-renamed", "unit"),
+		newJob(kube.PresubmitJob, "pull-lint", ""),
+	}
+	successes, pendings, nones := accumulate(presubmits, nil, "", []PullRequest{pr}, pjs, config.TideAccumulateBest)
+	if len(successes) != 1 || len(pendings) != 0 || len(nones) != 0 {
+		t.Errorf("Expected the PR to pass, got successes %v, pendings %v, nones %v.", prNumbers(successes), prNumbers(pendings), prNumbers(nones))
+	}
+	successes, _, _ = accumulate(presubmits, nil, "", []PullRequest{pr}, pjs[1:], config.TideAccumulateBest)
+	if len(successes) != 0 {
+		t.Error("Expected the PR not to pass without a job reporting to the unit context.")
+	}
+
+	batchJobs := []kube.ProwJob{
+		newJob(kube.BatchJob, "batch-unit", "unit"),
+		newJob(kube.BatchJob, "pull-lint", ""),
+	}
+	merges, _, _ := accumulateBatch(presubmits, nil, "", []PullRequest{pr}, batchJobs)
+	if len(merges) != 1 {
+		t.Errorf("Expected the batch to pass, got merges %v.", prNumbers(merges))
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	queries := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	fc := &fgc{queryPRs: map[string][]PullRequest{}}
+	for _, q := range queries {
+		fc.queryPRs[q] = []PullRequest{{}}
+	}
+	c := newTestController(newConfigAgent(config.Tide{}), fc, nil)
+	c.setMaxConcurrency(3)
+
+	// Hold every slot, so no query may start until they are released.
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		releases = append(releases, c.acquire())
+	}
+	done := make(chan error)
+	go func() {
+		_, _, err := c.searchAll(context.Background(), queries, len(queries), 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fc.queryLock.Lock()
+	started := fc.maxInFlight
+	fc.queryLock.Unlock()
+	if started != 0 {
+		t.Errorf("Expected no queries to start while all slots are held, but %d did.", started)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	if fc.maxInFlight > 3 {
+		t.Errorf("Expected at most 3 queries in flight, got %d.", fc.maxInFlight)
+	}
+
+	// Without a bound, the query concurrency is the only limit.
+	c.setMaxConcurrency(0)
+	fc.maxInFlight = 0
+	if _, _, err := c.searchAll(context.Background(), queries, len(queries), 0); err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	if fc.maxInFlight <= 3 {
+		t.Errorf("Expected more than 3 queries in flight without a bound, got %d.", fc.maxInFlight)
+	}
+}
+
+func TestServeHTTPRoundTrip(t *testing.T) {
+	var pr PullRequest
+	pr.Number = 1
+	pr.Author.Login = "author"
+	pr.HeadRef.Target.OID = "abc"
+	pr.Repository.NameWithOwner = "o/r"
+	pools := []Pool{
+		{
+			Org:          "o",
+			Repo:         "r",
+			Branch:       "master",
+			SuccessPRs:   []PullRequest{pr},
+			BatchPending: []PullRequest{pr},
+			Action:       MergeBatch,
+			Target:       []PullRequest{pr},
+			Error:        "subpool sync timed out after 1m0s",
+		},
+		{
+			Org:    "o",
+			Repo:   "r",
+			Branch: "release",
+			Action: Wait,
+		},
+	}
+	c := newTestController(nil, nil, nil)
+	c.pools = pools
+	s := httptest.NewServer(c)
+	defer s.Close()
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	defer resp.Body.Close()
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("JSON decoding error: %v", err)
+	}
+	expected := Status{SchemaVersion: SchemaVersion, Pools: pools}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Round trip changed the status. Got %+v, want %+v.", status, expected)
+	}
+}
+
+func TestServeSyncSerializes(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{Queries: []string{"org:o"}, QueryConcurrency: 1}})
+	fc := &fgc{queryPRs: map[string][]PullRequest{}}
+	c := newTestController(ca, fc, &fkc{})
+	s := httptest.NewServer(http.HandlerFunc(c.ServeSync))
+	defer s.Close()
+
+	const requests = 5
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(s.URL, "", nil)
+			if err != nil {
+				t.Errorf("POST error: %v", err)
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d.", http.StatusOK, code)
+		}
+	}
+	if fc.maxInFlight != 1 {
+		t.Errorf("Expected syncs to run one at a time, but %d queries ran at once.", fc.maxInFlight)
+	}
+
+	w := httptest.NewRecorder()
+	c.ServeSync(w, httptest.NewRequest(http.MethodGet, "/sync", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected with %d, got %d.", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestAccumulateSharedContext(t *testing.T) {
+	start := time.Date(2017, time.November, 1, 0, 0, 0, 0, time.UTC)
+	newJob := func(job string, state kube.ProwJobState, started time.Time) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    kube.PresubmitJob,
+				Job:     job,
+				Context: "tests",
+				Refs:    kube.Refs{Pulls: []kube.Pull{{Number: 1}}},
+			},
+			Status: kube.ProwJobStatus{State: state, StartTime: started},
+		}
+	}
+	testcases := []struct {
+		name string
+		pjs  []kube.ProwJob
+
+		best   simpleState
+		latest simpleState
+		all    simpleState
+	}{
+		{
+			name:   "one job passed, the later one failed",
+			pjs:    []kube.ProwJob{newJob("unit", kube.SuccessState, start), newJob("unit-alt", kube.FailureState, start.Add(time.Hour))},
+			best:   successState,
+			latest: noneState,
+			all:    noneState,
+		},
+		{
+			name:   "one job failed, the later one passed",
+			pjs:    []kube.ProwJob{newJob("unit", kube.FailureState, start), newJob("unit-alt", kube.SuccessState, start.Add(time.Hour))},
+			best:   successState,
+			latest: successState,
+			all:    noneState,
+		},
+		{
+			name:   "one job passed, the later one is running",
+			pjs:    []kube.ProwJob{newJob("unit", kube.SuccessState, start), newJob("unit-alt", kube.PendingState, start.Add(time.Hour))},
+			best:   successState,
+			latest: pendingState,
+			all:    pendingState,
+		},
+		{
+			name:   "both jobs passed, one after a failed run",
+			pjs:    []kube.ProwJob{newJob("unit", kube.SuccessState, start), newJob("unit-alt", kube.FailureState, start), newJob("unit-alt", kube.SuccessState, start.Add(time.Hour))},
+			best:   successState,
+			latest: successState,
+			all:    successState,
+		},
+	}
+	var pr PullRequest
+	pr.Number = 1
+	for _, tc := range testcases {
+		for strategy, expected := range map[string]simpleState{
+			config.TideAccumulateBest:   tc.best,
+			config.TideAccumulateLatest: tc.latest,
+			config.TideAccumulateAll:    tc.all,
+		} {
+			if actual := jobStates(pr, tc.pjs, strategy)["tests"]; actual != expected {
+				t.Errorf("For case %q, expected %s with the %s strategy, got %s.", tc.name, expected, strategy, actual)
+			}
+		}
+	}
+}
+
+func TestAccumulateStrategies(t *testing.T) {
+	start := time.Date(2017, time.November, 1, 0, 0, 0, 0, time.UTC)
+	newJob := func(state kube.ProwJobState, started time.Time) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type: kube.PresubmitJob,
+				Job:  "unit",
+				Refs: kube.Refs{Pulls: []kube.Pull{{Number: 1}}},
+			},
+			Status: kube.ProwJobStatus{State: state, StartTime: started},
+		}
+	}
+	testcases := []struct {
+		name string
+		pjs  []kube.ProwJob
+
+		best   simpleState
+		latest simpleState
+	}{
+		{
+			name:   "rerun failed after passing",
+			pjs:    []kube.ProwJob{newJob(kube.SuccessState, start), newJob(kube.FailureState, start.Add(time.Hour))},
+			best:   successState,
+			latest: noneState,
+		},
+		{
+			name:   "rerun is still running after passing",
+			pjs:    []kube.ProwJob{newJob(kube.PendingState, start.Add(time.Hour)), newJob(kube.SuccessState, start)},
+			best:   successState,
+			latest: pendingState,
+		},
+		{
+			name:   "rerun passed after failing",
+			pjs:    []kube.ProwJob{newJob(kube.FailureState, start), newJob(kube.SuccessState, start.Add(time.Hour))},
+			best:   successState,
+			latest: successState,
+		},
+	}
+	bucket := func(successes, pendings, nones []PullRequest) simpleState {
+		switch {
+		case len(successes) == 1:
+			return successState
+		case len(pendings) == 1:
+			return pendingState
+		default:
+			return noneState
+		}
+	}
+	var pr PullRequest
+	pr.Number = 1
+	presubmits := map[int][]string{1: {"unit"}}
+	for _, tc := range testcases {
+		if actual := bucket(accumulate(presubmits, nil, "", []PullRequest{pr}, tc.pjs, config.TideAccumulateBest)); actual != tc.best {
+			t.Errorf("For case %q, expected %s with the best strategy, got %s.", tc.name, tc.best, actual)
+		}
+		if actual := bucket(accumulate(presubmits, nil, "", []PullRequest{pr}, tc.pjs, config.TideAccumulateLatest)); actual != tc.latest {
+			t.Errorf("For case %q, expected %s with the latest strategy, got %s.", tc.name, tc.latest, actual)
+		}
+	}
+}
+
+func TestSyncFallbackToRollupStatus(t *testing.T) {
+	newPR := func(number int, state string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.BaseRef.Name = "master"
+		pr.BaseRef.Prefix = "refs/heads/"
+		pr.Repository.Name = "r"
+		pr.Repository.NameWithOwner = "o/r"
+		pr.Repository.Owner.Login = "o"
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		return pr
+	}
+	for _, fallback := range []bool{false, true} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				Queries:                []string{"org:o"},
+				QueryConcurrency:       1,
+				FallbackToRollupStatus: fallback,
+			},
+		})
+		fgc := &fgc{
+			refs:     map[string]string{"o/r heads/master": "123"},
+			queryPRs: map[string][]PullRequest{"org:o": {newPR(1, "FAILURE"), newPR(2, "SUCCESS"), newPR(3, "PENDING")}},
+		}
+		fkc := &fkc{listErr: errors.New("kube is down")}
+		c := newTestController(ca, fgc, fkc)
+		err := c.Sync()
+		if !fallback {
+			if err == nil {
+				t.Error("Expected the sync to fail without the fallback.")
+			}
+			if fgc.merged != 0 {
+				t.Errorf("Expected no merges without the fallback, got %d.", fgc.merged)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error syncing with the fallback: %v", err)
+		}
+		if fgc.merged != 1 {
+			t.Errorf("Expected the passing PR to merge, got %d merges.", fgc.merged)
+		}
+		if len(fkc.createdJobs) != 0 {
+			t.Errorf("Expected nothing to be triggered, got %d jobs.", len(fkc.createdJobs))
+		}
+		if len(c.pools) != 1 {
+			t.Fatalf("Expected one pool, got %d.", len(c.pools))
+		}
+		pool := c.pools[0]
+		if pool.Action != Merge {
+			t.Errorf("Expected action %v, got %v.", Merge, pool.Action)
+		}
+		testPullsMatchList(t, "success", pool.SuccessPRs, []int{2})
+		testPullsMatchList(t, "pending", pool.PendingPRs, []int{3})
+		testPullsMatchList(t, "missing", pool.MissingPRs, []int{1})
+	}
+}
+
+func TestBatchBaseAdvances(t *testing.T) {
+	lg, gc, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Error making local git: %v", err)
+	}
+	defer gc.Clean()
+	defer lg.Clean()
+	if err := lg.MakeFakeRepo("o", "r"); err != nil {
+		t.Fatalf("Error making fake repo: %v", err)
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+	for i := 1; i <= 2; i++ {
+		if err := lg.CheckoutNewBranch("o", "r", fmt.Sprintf("pr-%d", i)); err != nil {
+			t.Fatalf("Error checking out new branch: %v", err)
+		}
+		if err := lg.AddCommit("o", "r", map[string][]byte{fmt.Sprintf("%d", i): []byte("WOW")}); err != nil {
+			t.Fatalf("Error adding commit: %v", err)
+		}
+		if err := lg.Checkout("o", "r", "master"); err != nil {
+			t.Fatalf("Error checking out master: %v", err)
+		}
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("origin/pr-%d", i))
+		sp.prs = append(sp.prs, pr)
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "foo",
+					AlwaysRun: true,
+				},
+			},
+		},
+	})
+	fkc := &fkc{}
+	c := newTestController(ca, &fgc{}, fkc)
+	c.gc = gc
+	act, _, _, err := c.takeAction(context.Background(), sp, false, nil, sp.prs, nil, nil)
+	if err != nil {
+		t.Fatalf("Error in takeAction: %v", err)
+	}
+	if act != TriggerBatch || len(fkc.createdJobs) != 1 {
+		t.Fatalf("Expected one batch to be triggered, got action %v and %d jobs.", act, len(fkc.createdJobs))
+	}
+	batch := fkc.createdJobs[0]
+	if batch.Spec.Refs.BaseSHA != sp.sha {
+		t.Errorf("Expected the batch to be tested against %q, got %q.", sp.sha, batch.Spec.Refs.BaseSHA)
+	}
+	batch.Status.State = kube.SuccessState
+
+	presubmits := requireAll([]string{"foo"}, sp.prs)
+	if merges, _, _ := accumulateBatch(presubmits, nil, sp.sha, sp.prs, []kube.ProwJob{batch}); len(merges) != 2 {
+		t.Errorf("Expected the batch to merge onto the base it was tested against, got %v.", prNumbers(merges))
+	}
+	// The base advances after the batch was picked.
+	merges, pendingPRs, pending := accumulateBatch(presubmits, nil, "advanced", sp.prs, []kube.ProwJob{batch})
+	if len(merges) != 0 || len(pendingPRs) != 0 || pending {
+		t.Errorf("Expected the batch tested against an old base to be ignored, got merges %v, pending %t.", prNumbers(merges), pending)
+	}
+}
+
+func TestServeLastSyncError(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{Queries: []string{"org:o"}, QueryConcurrency: 1}})
+	var pr PullRequest
+	pr.Number = 1
+	pr.BaseRef.Name = "master"
+	pr.BaseRef.Prefix = "refs/heads/"
+	pr.Repository.Name = "r"
+	pr.Repository.NameWithOwner = "o/r"
+	pr.Repository.Owner.Login = "o"
+	fgc := &fgc{
+		refs:     map[string]string{"o/r heads/master": "123"},
+		queryPRs: map[string][]PullRequest{"org:o": {pr}},
+	}
+	fkc := &fkc{listErr: errors.New("kube is down")}
+	clock := &fakeClock{now: time.Date(2017, time.November, 1, 12, 0, 0, 0, time.UTC)}
+	c := newTestController(ca, fgc, fkc)
+	c.clock = clock
+	s := httptest.NewServer(c)
+	defer s.Close()
+	getStatus := func() Status {
+		resp, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		defer resp.Body.Close()
+		var status Status
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("JSON decoding error: %v", err)
+		}
+		return status
+	}
+
+	if err := c.Sync(); err == nil {
+		t.Fatal("Expected the sync to fail.")
+	}
+	status := getStatus()
+	if !strings.Contains(status.LastSyncError, "kube is down") {
+		t.Errorf("Expected the sync error in the status, got %q.", status.LastSyncError)
+	}
+	if status.LastSyncErrorTime == nil || !status.LastSyncErrorTime.Equal(clock.now) {
+		t.Errorf("Expected the sync error time %v, got %v.", clock.now, status.LastSyncErrorTime)
+	}
+
+	fkc.listErr = nil
+	clock.Advance(time.Minute)
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	status = getStatus()
+	if status.LastSyncError != "" || status.LastSyncErrorTime != nil {
+		t.Errorf("Expected a successful sync to clear the error, got %q at %v.", status.LastSyncError, status.LastSyncErrorTime)
+	}
+}
+
+func TestSyncEmptyPool(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{Queries: []string{"org:o"}, QueryConcurrency: 1}})
+	var pr PullRequest
+	pr.Number = 1
+	pr.BaseRef.Name = "master"
+	pr.BaseRef.Prefix = "refs/heads/"
+	pr.Repository.Name = "r"
+	pr.Repository.NameWithOwner = "o/r"
+	pr.Repository.Owner.Login = "o"
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	fgc := &fgc{
+		refs:     map[string]string{"o/r heads/master": "123"},
+		queryPRs: map[string][]PullRequest{"org:o": {pr}},
+	}
+	c := newTestController(ca, fgc, &fkc{})
+	emptySyncs := func() float64 {
+		var m dto.Metric
+		if err := emptyPoolSyncs.Write(&m); err != nil {
+			t.Fatalf("Error reading metric: %v", err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	if len(c.pools) != 1 {
+		t.Fatalf("Expected one pool, got %d.", len(c.pools))
+	}
+	before := emptySyncs()
+
+	fgc.queryPRs = nil
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Error syncing the empty pool: %v", err)
+	}
+	if c.pools == nil || len(c.pools) != 0 {
+		t.Errorf("Expected the pools to be cleared, got %+v.", c.pools)
+	}
+	if after := emptySyncs(); after != before+1 {
+		t.Errorf("Expected the empty pool to be counted once, got %v more.", after-before)
+	}
+}
+
+func TestTriggerSkipsRunningJobs(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{Name: "foo", AlwaysRun: true},
+				{Name: "bar", AlwaysRun: true},
+				{Name: "baz", AlwaysRun: true},
+			},
+		},
+	})
+	newJob := func(job, headSHA string, state kube.ProwJobState) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type: kube.PresubmitJob,
+				Job:  job,
+				Refs: kube.Refs{
+					Org:     "o",
+					Repo:    "r",
+					BaseRef: "master",
+					BaseSHA: "base",
+					Pulls:   []kube.Pull{{Number: 1, SHA: headSHA}},
+				},
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "base",
+		pjs: []kube.ProwJob{
+			// Already running on the PR's head, so not triggered again.
+			newJob("foo", "head-1", kube.PendingState),
+			// Finished, so triggered again.
+			newJob("bar", "head-1", kube.FailureState),
+			// Running on an older head, so triggered again.
+			newJob("baz", "old", kube.PendingState),
+		},
+	}
+	testcases := []struct {
+		name string
+		prs  []PullRequest
+
+		expected []string
+	}{
+		{
+			name:     "single PR",
+			prs:      []PullRequest{newTestPR(1)},
+			expected: []string{"bar", "baz"},
+		},
+		{
+			name:     "batch containing the PR",
+			prs:      []PullRequest{newTestPR(1), newTestPR(2)},
+			expected: []string{"foo", "bar", "baz"},
+		},
+	}
+	for _, tc := range testcases {
+		var fkc fkc
+		c := newTestController(ca, nil, &fkc)
+		if err := c.trigger(sp, sp.sha, tc.prs); err != nil {
+			t.Fatalf("%s: error triggering: %v", tc.name, err)
+		}
+		var jobs []string
+		for _, pj := range fkc.createdJobs {
+			jobs = append(jobs, pj.Spec.Job)
+		}
+		if !reflect.DeepEqual(jobs, tc.expected) {
+			t.Errorf("%s: expected jobs %v triggered, got %v.", tc.name, tc.expected, jobs)
+		}
+	}
+}
+
+func TestPlanJobs(t *testing.T) {
+	presubmits := []config.Presubmit{
+		{Name: "unit", Labels: map[string]string{"team": "a"}},
+		{Name: "e2e", Context: "ci/e2e"},
+		{Name: "cla-mirror", Context: "cla"},
+		{Name: "optional"},
+	}
+	required := map[string]bool{"unit": true, "e2e": true, "cla-mirror": true}
+	external := map[string]bool{"cla": true}
+	newPR := func(number int) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Author.Login = "author"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", number))
+		return pr
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base"}
+	running := sp
+	running.pjs = []kube.ProwJob{{
+		Spec: kube.ProwJobSpec{
+			Type: kube.PresubmitJob,
+			Job:  "unit",
+			Refs: kube.Refs{
+				Org:     "o",
+				Repo:    "r",
+				BaseRef: "master",
+				BaseSHA: "base",
+				Pulls:   []kube.Pull{{Number: 1, Author: "author", SHA: "head-1"}},
+			},
+		},
+		Status: kube.ProwJobStatus{State: kube.PendingState},
+	}}
+	testcases := []struct {
+		name     string
+		sp       subpool
+		prs      []PullRequest
+		contexts map[string]bool
+
+		expectedJobs []string
+		expectedType kube.ProwJobType
+	}{
+		{
+			name:         "single PR",
+			sp:           sp,
+			prs:          []PullRequest{newPR(1)},
+			expectedJobs: []string{"unit", "e2e"},
+			expectedType: kube.PresubmitJob,
+		},
+		{
+			name:         "batch",
+			sp:           sp,
+			prs:          []PullRequest{newPR(1), newPR(2)},
+			expectedJobs: []string{"unit", "e2e"},
+			expectedType: kube.BatchJob,
+		},
+		{
+			name:         "only some contexts",
+			sp:           sp,
+			prs:          []PullRequest{newPR(1)},
+			contexts:     map[string]bool{"ci/e2e": true},
+			expectedJobs: []string{"e2e"},
+			expectedType: kube.PresubmitJob,
+		},
+		{
+			name:         "already running",
+			sp:           running,
+			prs:          []PullRequest{newPR(1)},
+			expectedJobs: []string{"e2e"},
+			expectedType: kube.PresubmitJob,
+		},
+	}
+	for _, tc := range testcases {
+		jobs := planJobs(tc.sp, "base", tc.prs, presubmits, required, external, tc.contexts)
+		var names []string
+		for _, job := range jobs {
+			names = append(names, job.spec.Job)
+			if job.spec.Type != tc.expectedType {
+				t.Errorf("%s: expected %s to be a %s job, got %s.", tc.name, job.spec.Job, tc.expectedType, job.spec.Type)
+			}
+			if job.spec.Refs.BaseSHA != "base" || len(job.spec.Refs.Pulls) != len(tc.prs) {
+				t.Errorf("%s: wrong refs for %s: %s.", tc.name, job.spec.Job, job.spec.Refs)
+			}
+			if job.spec.Job == "unit" && job.labels["team"] != "a" {
+				t.Errorf("%s: expected the presubmit's labels, got %v.", tc.name, job.labels)
+			}
+		}
+		if !reflect.DeepEqual(names, tc.expectedJobs) {
+			t.Errorf("%s: expected jobs %v, got %v.", tc.name, tc.expectedJobs, names)
+		}
+	}
+}
+
+func TestExternalContexts(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{
+					Name:      "unit",
+					AlwaysRun: true,
+				},
+				{
+					Name:      "cla-mirror",
+					Context:   "cla",
+					AlwaysRun: true,
+				},
+			},
+		},
+		Tide: config.Tide{ExternalContexts: map[string][]string{"o/r": {"cla", "ci/external"}}},
+	})
+	var fkc fkc
+	c := newTestController(ca, nil, &fkc)
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master"}
+	var pr PullRequest
+	pr.Number = 1
+	required, err := c.presubmitsFor(sp, pr)
+	if err != nil {
+		t.Fatalf("Error getting presubmits: %v", err)
+	}
+	if expected := []string{"unit", "cla", "ci/external"}; !reflect.DeepEqual(required, expected) {
+		t.Errorf("Expected required contexts %v, got %v.", expected, required)
+	}
+	if err := c.trigger(sp, sp.sha, []PullRequest{pr}); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	if len(fkc.createdJobs) != 1 || fkc.createdJobs[0].Spec.Job != "unit" {
+		t.Errorf("Expected only the Prow-owned presubmit to be triggered, got %+v.", fkc.createdJobs)
+	}
+
+	external := c.externalContexts(sp)
+	presubmits := map[int][]string{1: required}
+	unit := kube.ProwJob{
+		Spec: kube.ProwJobSpec{
+			Job:  "unit",
+			Type: kube.PresubmitJob,
+			Refs: kube.Refs{Pulls: []kube.Pull{{Number: 1}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.SuccessState},
+	}
+	cla := unit
+	cla.Spec.Job = "cla-mirror"
+	cla.Spec.Context = "cla"
+	testcases := []struct {
+		name     string
+		pjs      []kube.ProwJob
+		contexts map[string]string
+
+		expected simpleState
+	}{
+		{
+			name:     "Prow job passed, external contexts not reported yet",
+			pjs:      []kube.ProwJob{unit},
+			expected: pendingState,
+		},
+		{
+			name:     "Prow job passed, external contexts expected",
+			pjs:      []kube.ProwJob{unit},
+			contexts: map[string]string{"cla": "EXPECTED", "ci/external": "SUCCESS"},
+			expected: pendingState,
+		},
+		{
+			name:     "all passed",
+			pjs:      []kube.ProwJob{unit},
+			contexts: map[string]string{"cla": "SUCCESS", "ci/external": "SUCCESS"},
+			expected: successState,
+		},
+		{
+			name:     "external context failed",
+			pjs:      []kube.ProwJob{unit},
+			contexts: map[string]string{"cla": "SUCCESS", "ci/external": "FAILURE"},
+			expected: noneState,
+		},
+		{
+			name:     "Prow job missing, external contexts passed",
+			contexts: map[string]string{"cla": "SUCCESS", "ci/external": "SUCCESS"},
+			expected: noneState,
+		},
+		{
+			name:     "a job reporting to an external context does not count",
+			pjs:      []kube.ProwJob{unit, cla},
+			contexts: map[string]string{"ci/external": "SUCCESS"},
+			expected: pendingState,
+		},
+	}
+	for _, tc := range testcases {
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		for context, state := range tc.contexts {
+			pr.Commits.Nodes[0].Commit.Status.Contexts = append(pr.Commits.Nodes[0].Commit.Status.Contexts, Context{
+				Context: githubql.String(context),
+				State:   githubql.String(state),
+			})
+		}
+		successes, pendings, nones := accumulate(presubmits, external, "", []PullRequest{pr}, tc.pjs, config.TideAccumulateBest)
+		var actual simpleState
+		switch {
+		case len(successes) == 1:
+			actual = successState
+		case len(pendings) == 1:
+			actual = pendingState
+		case len(nones) == 1:
+			actual = noneState
+		}
+		if actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s.", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestExternalContextPatterns(t *testing.T) {
+	testcases := []struct {
+		name     string
+		contexts map[string]string
+
+		required []string
+		expected simpleState
+	}{
+		{
+			name:     "no matching context is vacuously satisfied",
+			contexts: map[string]string{"other": "FAILURE"},
+			expected: successState,
+		},
+		{
+			name:     "all matching contexts passed",
+			contexts: map[string]string{"pull-foo-e2e-gce": "SUCCESS", "pull-foo-e2e-aws": "SUCCESS", "other": "FAILURE"},
+			required: []string{"pull-foo-e2e-aws", "pull-foo-e2e-gce"},
+			expected: successState,
+		},
+		{
+			name:     "a matching context failed",
+			contexts: map[string]string{"pull-foo-e2e-gce": "SUCCESS", "pull-foo-e2e-aws": "FAILURE"},
+			required: []string{"pull-foo-e2e-aws", "pull-foo-e2e-gce"},
+			expected: noneState,
+		},
+		{
+			name:     "a matching context is pending",
+			contexts: map[string]string{"pull-foo-e2e-gce": "PENDING"},
+			required: []string{"pull-foo-e2e-gce"},
+			expected: pendingState,
+		},
+		{
+			name:     "patterns match whole names",
+			contexts: map[string]string{"pull-foo-e2e-gce-canary": "FAILURE", "x-pull-foo-e2e-gce": "FAILURE"},
+			expected: successState,
+		},
+		{
+			name:     "presubmit contexts are judged by their jobs",
+			contexts: map[string]string{"pull-foo-e2e-prow": "FAILURE"},
+			expected: successState,
+		},
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "pull-foo-e2e-prow"}},
+		},
+		Tide: config.Tide{
+			ExternalContextPatterns: map[string][]*regexp.Regexp{"o/r": {regexp.MustCompile("^(?:pull-foo-e2e-(gce|aws|prow))$")}},
+		},
+	})
+	c := newTestController(ca, nil, nil)
+	for _, tc := range testcases {
+		var pr PullRequest
+		pr.Number = 1
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		for context, state := range tc.contexts {
+			pr.Commits.Nodes[0].Commit.Status.Contexts = append(pr.Commits.Nodes[0].Commit.Status.Contexts, Context{
+				Context: githubql.String(context),
+				State:   githubql.String(state),
+			})
+		}
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: []PullRequest{pr}}
+		required, err := c.presubmitsFor(sp, pr)
+		if err != nil {
+			t.Fatalf("%s: error getting presubmits: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(required, tc.required) {
+			t.Errorf("%s: expected required contexts %v, got %v.", tc.name, tc.required, required)
+		}
+		successes, pendings, nones := accumulate(map[int][]string{1: required}, c.externalContexts(sp), "", []PullRequest{pr}, nil, config.TideAccumulateBest)
+		var actual simpleState
+		switch {
+		case len(successes) == 1:
+			actual = successState
+		case len(pendings) == 1:
+			actual = pendingState
+		case len(nones) == 1:
+			actual = noneState
+		}
+		if actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s.", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestRollupState(t *testing.T) {
+	testcases := []struct {
+		name     string
+		status   string
+		rollup   string
+		expected simpleState
+	}{
+		{name: "not computed yet", expected: noneState},
+		{name: "status success", status: "SUCCESS", expected: successState},
+		{name: "status expected", status: "EXPECTED", expected: pendingState},
+		{name: "status pending", status: "PENDING", expected: pendingState},
+		{name: "status failure", status: "FAILURE", expected: noneState},
+		{name: "rollup expected overrides status", status: "SUCCESS", rollup: "EXPECTED", expected: pendingState},
+		{name: "rollup failure overrides status", status: "SUCCESS", rollup: "FAILURE", expected: noneState},
+		{name: "rollup success", rollup: "SUCCESS", expected: successState},
+	}
+	for _, tc := range testcases {
+		var pr PullRequest
+		pr.Number = 1
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(tc.status)
+		pr.Commits.Nodes[0].Commit.StatusCheckRollup.State = githubql.String(tc.rollup)
+		if actual := rollupState(pr); actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s.", tc.name, tc.expected, actual)
+		}
+		successes, pendings, nones := accumulateRollup([]PullRequest{pr})
+		var bucket simpleState
+		switch {
+		case len(successes) == 1:
+			bucket = successState
+		case len(pendings) == 1:
+			bucket = pendingState
+		case len(nones) == 1:
+			bucket = noneState
+		}
+		if bucket != tc.expected {
+			t.Errorf("%s: expected the PR in %s, got %s.", tc.name, tc.expected, bucket)
+		}
+	}
+}
+
+func TestContextStateFromRollup(t *testing.T) {
+	var pr PullRequest
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	nodes := make([]RollupContext, 4)
+	nodes[0].StatusContext = Context{Context: "status", State: "EXPECTED"}
+	nodes[1].CheckRun.Name = "done"
+	nodes[1].CheckRun.Status = "COMPLETED"
+	nodes[1].CheckRun.Conclusion = "SUCCESS"
+	nodes[2].CheckRun.Name = "running"
+	nodes[2].CheckRun.Status = "IN_PROGRESS"
+	nodes[3].CheckRun.Name = "failed"
+	nodes[3].CheckRun.Status = "COMPLETED"
+	nodes[3].CheckRun.Conclusion = "FAILURE"
+	pr.Commits.Nodes[0].Commit.StatusCheckRollup.Contexts.Nodes = nodes
+	for context, expected := range map[string]simpleState{
+		"status":  pendingState,
+		"done":    successState,
+		"running": pendingState,
+		"failed":  noneState,
+		"missing": pendingState,
+	} {
+		if actual := contextState(pr, context); actual != expected {
+			t.Errorf("For context %q, expected %s, got %s.", context, expected, actual)
+		}
+	}
+}
+
+func TestVerifyMerges(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	testcases := []struct {
+		name           string
+		verify         bool
+		unmergedChecks int
+
+		expectedChecks int
+		expectedSleeps []time.Duration
+		expectedMerged bool
+	}{
+		{
+			name:           "verification disabled",
+			unmergedChecks: 5,
+			expectedMerged: true,
+		},
+		{
+			name:           "merged right away",
+			verify:         true,
+			expectedChecks: 1,
+			expectedMerged: true,
+		},
+		{
+			name:           "merged asynchronously",
+			verify:         true,
+			unmergedChecks: 1,
+			expectedChecks: 2,
+			expectedSleeps: []time.Duration{time.Second},
+			expectedMerged: true,
+		},
+		{
+			name:           "merge call succeeded but PR is not merged",
+			verify:         true,
+			unmergedChecks: 5,
+			expectedChecks: 3,
+			expectedSleeps: []time.Duration{time.Second, 2 * time.Second},
+		},
+	}
+	for _, tc := range testcases {
+		slept = nil
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{VerifyMerges: tc.verify}})
+		fgc := &fgc{unmergedChecks: map[int]int{1: tc.unmergedChecks}}
+		clock := &fakeClock{now: time.Now()}
+		c := newTestController(ca, fgc, nil)
+		c.clock = clock
+		var pr PullRequest
+		pr.Number = 1
+		c.recordPoolTimes([]PullRequest{pr})
+		clock.Advance(time.Hour)
+		// Each case observes merges under its own repo label.
+		sp := subpool{org: "verify", repo: tc.name, branch: "master"}
+		if err := c.mergePRs(context.Background(), sp, []PullRequest{pr}); err != nil {
+			t.Fatalf("%s: error merging: %v", tc.name, err)
+		}
+		if fgc.isMergedCalls != tc.expectedChecks {
+			t.Errorf("%s: expected %d merge checks, got %d.", tc.name, tc.expectedChecks, fgc.isMergedCalls)
+		}
+		if !reflect.DeepEqual(slept, tc.expectedSleeps) {
+			t.Errorf("%s: expected sleeps %v, got %v.", tc.name, tc.expectedSleeps, slept)
+		}
+		var m dto.Metric
+		if err := timeInPoolHistogram.WithLabelValues(sp.org, sp.repo).Write(&m); err != nil {
+			t.Fatalf("%s: error reading metric: %v", tc.name, err)
+		}
+		if merged := m.GetHistogram().GetSampleCount() > 0; merged != tc.expectedMerged {
+			t.Errorf("%s: expected the merge to be recorded: %t, but got %t.", tc.name, tc.expectedMerged, merged)
+		}
+	}
+}
+
+func TestMergeMethodFallback(t *testing.T) {
+	testcases := []struct {
+		name       string
+		methods    []string
+		disallowed []string
+
+		expectedAttempts []string
+		expectedMerged   int
+	}{
+		{
+			name:             "GitHub's default",
+			expectedAttempts: []string{""},
+			expectedMerged:   1,
+		},
+		{
+			name:             "first method allowed",
+			methods:          []string{"squash", "merge"},
+			expectedAttempts: []string{"squash"},
+			expectedMerged:   1,
+		},
+		{
+			name:             "first method rejected, second succeeds",
+			methods:          []string{"squash", "merge"},
+			disallowed:       []string{"squash"},
+			expectedAttempts: []string{"squash", "merge"},
+			expectedMerged:   1,
+		},
+		{
+			name:             "every method rejected",
+			methods:          []string{"squash", "rebase"},
+			disallowed:       []string{"squash", "rebase"},
+			expectedAttempts: []string{"squash", "rebase"},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{MergeMethods: map[string][]string{"o/r": tc.methods}}})
+		fgc := &fgc{disallowedMethods: make(map[string]bool)}
+		for _, method := range tc.disallowed {
+			fgc.disallowedMethods[method] = true
+		}
+		c := newTestController(ca, fgc, nil)
+		var pr PullRequest
+		pr.Number = 1
+		sp := subpool{org: "o", repo: "r", branch: "master"}
+		if err := c.mergePRs(context.Background(), sp, []PullRequest{pr}); err != nil {
+			t.Errorf("%s: error merging: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(fgc.mergeMethods, tc.expectedAttempts) {
+			t.Errorf("%s: expected merge attempts %q, got %q.", tc.name, tc.expectedAttempts, fgc.mergeMethods)
+		}
+		if fgc.merged != tc.expectedMerged {
+			t.Errorf("%s: expected %d merges, got %d.", tc.name, tc.expectedMerged, fgc.merged)
+		}
+	}
+}
+
+func TestCommentOnBatchMerge(t *testing.T) {
+	newPRs := func(numbers ...int) []PullRequest {
+		var prs []PullRequest
+		for _, n := range numbers {
+			var pr PullRequest
+			pr.Number = githubql.Int(n)
+			pr.Repository.Name = "r"
+			pr.Repository.Owner.Login = "o"
+			prs = append(prs, pr)
+		}
+		return prs
+	}
+	testcases := []struct {
+		name    string
+		enabled bool
+		prs     []PullRequest
+
+		expectedComments map[int][]string
+	}{
+		{
+			name: "disabled",
+			prs:  newPRs(1, 2),
+		},
+		{
+			name:    "single PR",
+			enabled: true,
+			prs:     newPRs(1),
+		},
+		{
+			name:    "batch",
+			enabled: true,
+			prs:     newPRs(1, 2, 3),
+			expectedComments: map[int][]string{
+				1: {"Tide merged this PR in a batch together with #2, #3."},
+				2: {"Tide merged this PR in a batch together with #1, #3."},
+				3: {"Tide merged this PR in a batch together with #1, #2."},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{CommentOnBatchMerge: tc.enabled}})
+		fgc := &fgc{}
+		c := newTestController(ca, fgc, nil)
+		sp := subpool{org: "o", repo: "r", branch: "master"}
+		// Merging the same batch again must not comment twice.
+		for i := 0; i < 2; i++ {
+			if err := c.mergePRs(context.Background(), sp, tc.prs); err != nil {
+				t.Fatalf("%s: error merging: %v", tc.name, err)
+			}
+		}
+		if len(fgc.comments) != len(tc.expectedComments) || (len(tc.expectedComments) > 0 && !reflect.DeepEqual(fgc.comments, tc.expectedComments)) {
+			t.Errorf("%s: expected comments %v, got %v.", tc.name, tc.expectedComments, fgc.comments)
+		}
+
+		// Comments are forgotten once their PRs leave the pool.
+		c.pruneBatchComments(tc.prs[:1])
+		if len(c.batchComments.commented) > 1 {
+			t.Errorf("%s: expected pruning to forget PRs that left the pool, still remembering %v.", tc.name, c.batchComments.commented)
+		}
+	}
+}
+
+func TestApproveBeforeMerge(t *testing.T) {
+	testcases := []struct {
+		name    string
+		enabled bool
+		reviews []github.Review
+
+		expectedCreated int
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:            "not yet approved",
+			enabled:         true,
+			reviews:         []github.Review{{Body: "LGTM", State: "APPROVED"}},
+			expectedCreated: 1,
+		},
+		{
+			name:            "approval was dismissed",
+			enabled:         true,
+			reviews:         []github.Review{{Body: approvalBody, State: "DISMISSED"}},
+			expectedCreated: 1,
+		},
+		{
+			name:    "already approved",
+			enabled: true,
+			reviews: []github.Review{{Body: approvalBody, State: "APPROVED"}},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{ApproveBeforeMerge: tc.enabled}})
+		fgc := &fgc{reviews: map[int][]github.Review{1: tc.reviews}}
+		approvedWhenMerged := false
+		fgc.onMerge = func() {
+			for _, review := range fgc.reviews[1] {
+				if review.Body == approvalBody && review.State == "APPROVED" {
+					approvedWhenMerged = true
+				}
+			}
+		}
+		c := newTestController(ca, fgc, nil)
+		var pr PullRequest
+		pr.Number = 1
+		sp := subpool{org: "o", repo: "r", branch: "master"}
+		// Merging again, as after a failed verification, must not approve twice.
+		for i := 0; i < 2; i++ {
+			if err := c.mergePRs(context.Background(), sp, []PullRequest{pr}); err != nil {
+				t.Fatalf("%s: error merging: %v", tc.name, err)
+			}
+		}
+		if fgc.createdReviews != tc.expectedCreated {
+			t.Errorf("%s: expected %d reviews created, got %d.", tc.name, tc.expectedCreated, fgc.createdReviews)
+		}
+		if tc.enabled && !approvedWhenMerged {
+			t.Errorf("%s: expected the PR to be approved by the time it was merged.", tc.name)
+		}
+	}
+}
+
+func TestDividePoolConcurrentGetRefs(t *testing.T) {
+	const branches = 30
+	fc := &fgc{
+		refs:     make(map[string]string),
+		refDelay: 10 * time.Millisecond,
+	}
+	var pool []PullRequest
+	for i := 0; i < branches; i++ {
+		branch := fmt.Sprintf("release-%d", i)
+		fc.refs["o/r heads/"+branch] = fmt.Sprintf("sha-%d", i)
+		// Two PRs per branch, so each ref should only be looked up once.
+		for j := 0; j < 2; j++ {
+			var pr PullRequest
+			pr.Number = githubql.Int(2*i + j)
+			pr.BaseRef.Name = githubql.String(branch)
+			pr.BaseRef.Prefix = "refs/heads/"
+			pr.Repository.Name = "r"
+			pr.Repository.Owner.Login = "o"
+			pool = append(pool, pr)
+		}
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{GetRefConcurrency: 5}})
+	c := newTestController(ca, fc, nil)
+	sps, err := c.dividePool(pool, nil)
+	if err != nil {
+		t.Fatalf("Error dividing pool: %v", err)
+	}
+	if len(sps) != branches {
+		t.Fatalf("Expected %d subpools, got %d.", branches, len(sps))
+	}
+	for _, sp := range sps {
+		if expected := "sha-" + strings.TrimPrefix(sp.branch, "release-"); sp.sha != expected {
+			t.Errorf("Expected %s to be at %s, got %s.", sp.branch, expected, sp.sha)
+		}
+		if len(sp.prs) != 2 {
+			t.Errorf("Expected 2 PRs for %s, got %d.", sp.branch, len(sp.prs))
+		}
+	}
+	if fc.refCalls != branches {
+		t.Errorf("Expected one GetRef per branch, got %d calls.", fc.refCalls)
+	}
+	if fc.maxRefsInFlight > 5 {
+		t.Errorf("Expected at most 5 GetRefs in flight, got %d.", fc.maxRefsInFlight)
+	}
+	if fc.maxRefsInFlight < 2 {
+		t.Errorf("Expected GetRefs to run concurrently, got %d in flight.", fc.maxRefsInFlight)
+	}
+
+	// An error for any branch fails the whole division, as before.
+	fc.refErrs = []error{errors.New("status code 500 not one of [200 404]")}
+	attempts := getRefAttempts
+	getRefAttempts, sleep = 1, func(time.Duration) {}
+	defer func() { getRefAttempts, sleep = attempts, time.Sleep }()
+	if _, err := c.dividePool(pool, nil); err == nil {
+		t.Error("Expected an error when a ref cannot be looked up.")
+	}
+}
+
+func TestPoolJobsDebug(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+		// Keep Tide from cloning the repo to try a batch.
+		Tide: config.Tide{MinBatchSize: 3},
+	})
+	c := newTestController(ca, &fgc{}, &fkc{})
+	newJob := func(name, context string, jobType kube.ProwJobType, state kube.ProwJobState, numbers ...int) kube.ProwJob {
+		pj := kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:     name,
+				Context: context,
+				Type:    jobType,
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+		for _, n := range numbers {
+			pj.Spec.Refs.Pulls = append(pj.Spec.Refs.Pulls, kube.Pull{Number: n})
+		}
+		return pj
+	}
+	var first, second PullRequest
+	first.Number = 1
+	second.Number = 2
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "master",
+		prs:    []PullRequest{first, second},
+		pjs: []kube.ProwJob{
+			newJob("unit", "", kube.PresubmitJob, kube.FailureState, 1),
+			newJob("unit", "", kube.PresubmitJob, kube.PendingState, 1),
+			newJob("e2e", "ci/e2e", kube.PresubmitJob, kube.SuccessState, 2),
+			newJob("unit", "", kube.BatchJob, kube.SuccessState, 1, 2),
+		},
+	}
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Error syncing subpool: %v", err)
+	}
+	expected := map[int][]PoolJob{
+		1: {
+			{Name: "unit", Context: "unit", State: kube.FailureState},
+			{Name: "unit", Context: "unit", State: kube.PendingState},
+		},
+		2: {
+			{Name: "e2e", Context: "ci/e2e", State: kube.SuccessState},
+		},
+	}
+	if !reflect.DeepEqual(c.pools[0].Jobs, expected) {
+		t.Errorf("Expected jobs %+v, got %+v.", expected, c.pools[0].Jobs)
+	}
+
+	s := httptest.NewServer(c)
+	defer s.Close()
+	for _, debug := range []bool{false, true} {
+		resp, err := http.Get(fmt.Sprintf("%s?debug=%t", s.URL, debug))
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		var status Status
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("JSON decoding error: %v", err)
+		}
+		if debug && !reflect.DeepEqual(status.Pools[0].Jobs, expected) {
+			t.Errorf("Expected debug status to have jobs %+v, got %+v.", expected, status.Pools[0].Jobs)
+		} else if !debug && status.Pools[0].Jobs != nil {
+			t.Errorf("Expected no jobs without debug, got %+v.", status.Pools[0].Jobs)
+		}
+		if debug && len(status.Pools[0].Contexts) != 2 {
+			t.Errorf("Expected debug status to have the contexts of both PRs, got %+v.", status.Pools[0].Contexts)
+		} else if !debug && status.Pools[0].Contexts != nil {
+			t.Errorf("Expected no contexts without debug, got %+v.", status.Pools[0].Contexts)
+		}
+	}
+}
+
+func TestPickHighestScoring(t *testing.T) {
+	now := time.Date(2017, time.December, 1, 0, 0, 0, 0, time.UTC)
+	newPR := func(number int, state string, age time.Duration, approvals int, labels ...string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.CreatedAt = githubql.DateTime{Time: now.Add(-age)}
+		pr.Reviews.TotalCount = githubql.Int(approvals)
+		for _, label := range labels {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(label)})
+		}
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		return pr
+	}
+	prs := []PullRequest{
+		newPR(5, "SUCCESS", 2*time.Hour, 1, "priority/important"),
+		newPR(3, "SUCCESS", 10*time.Hour, 0),
+		newPR(4, "SUCCESS", time.Hour, 3, "size/XS"),
+		// The highest scoring PR is not passing, so it is never picked.
+		newPR(1, "PENDING", 100*time.Hour, 9, "priority/important"),
+		newPR(2, "SUCCESS", time.Hour, 0),
+	}
+	testcases := []struct {
+		name    string
+		scoring config.TideMergeScoring
+
+		expected int
+	}{
+		{
+			name:     "default scoring picks the smallest number",
+			expected: 2,
+		},
+		{
+			name:     "label weights",
+			scoring:  config.TideMergeScoring{LabelWeights: map[string]float64{"priority/important": 10, "size/XS": 1}},
+			expected: 5,
+		},
+		{
+			name:     "negative label weight",
+			scoring:  config.TideMergeScoring{LabelWeights: map[string]float64{"size/XS": -1}},
+			expected: 2,
+		},
+		{
+			name:     "oldest first",
+			scoring:  config.TideMergeScoring{AgeWeight: 1},
+			expected: 3,
+		},
+		{
+			name:     "most approved first",
+			scoring:  config.TideMergeScoring{ApprovalWeight: 1},
+			expected: 4,
+		},
+		{
+			name: "combined",
+			scoring: config.TideMergeScoring{
+				LabelWeights:   map[string]float64{"priority/important": 5},
+				AgeWeight:      1,
+				ApprovalWeight: 2,
+			},
+			// PR 3 scores 10 for its age, beating PR 5's 9.
+			expected: 3,
+		},
+		{
+			name:     "ties go to the smallest number",
+			scoring:  config.TideMergeScoring{LabelWeights: map[string]float64{"priority/important": 2}, ApprovalWeight: 1},
+			expected: 4,
+		},
+	}
+	for _, tc := range testcases {
+		ok, pr := pickHighestScoring(prs, nil, tc.scoring, now)
+		if !ok {
+			t.Errorf("%s: expected a PR to be picked.", tc.name)
+		} else if int(pr.Number) != tc.expected {
+			t.Errorf("%s: expected PR %d, got %d.", tc.name, tc.expected, int(pr.Number))
+		}
+	}
+	if ok, _ := pickHighestScoring(prs[3:4], nil, config.TideMergeScoring{}, now); ok {
+		t.Error("Expected no PR to be picked when none are passing.")
+	}
+}
+
+func TestSyncMergeRequeues(t *testing.T) {
+	var pjs []kube.ProwJob
+	for _, number := range []int{1, 2, 3} {
+		pjs = append(pjs, kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: kube.PresubmitJob,
+				Refs: kube.Refs{
+					Org:     "o",
+					Repo:    "r",
+					BaseRef: "master",
+					BaseSHA: "base-1",
+					Pulls:   []kube.Pull{{Number: number, SHA: fmt.Sprintf("head-%d", number)}},
+				},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		})
+	}
+	testcases := []struct {
+		name     string
+		requeues int
+
+		expectedMerged    int
+		expectedTriggered int
+		expectedAction    Action
+	}{
+		{
+			name:           "requeues disabled",
+			expectedMerged: 1,
+			expectedAction: Merge,
+		},
+		{
+			name:              "one requeue triggers against the new base",
+			requeues:          1,
+			expectedMerged:    1,
+			expectedTriggered: 1,
+			expectedAction:    Trigger,
+		},
+		{
+			name:              "requeues stop once nothing merges",
+			requeues:          5,
+			expectedMerged:    1,
+			expectedTriggered: 1,
+			expectedAction:    Trigger,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+			Tide: config.Tide{
+				Queries:          []string{"org:o"},
+				QueryConcurrency: 1,
+				MergeRequeues:    tc.requeues,
+				// Keep Tide from cloning the repo to try a batch.
+				MinBatchSize: 10,
+			},
+		})
+		fgc := &fgc{
+			refs:     map[string]string{"o/r heads/master": "base-1"},
+			queryPRs: map[string][]PullRequest{"org:o": {newTestPR(1), newTestPR(2), newTestPR(3)}},
+		}
+		fgc.onMerge = func() {
+			fgc.refs["o/r heads/master"] = fmt.Sprintf("base-%d", fgc.merged+1)
+		}
+		fkc := &fkc{prowJobs: pjs}
+		c := newTestController(ca, fgc, fkc)
+		if err := c.Sync(); err != nil {
+			t.Fatalf("%s: error syncing: %v", tc.name, err)
+		}
+		if fgc.merged != tc.expectedMerged {
+			t.Errorf("%s: expected %d merges, got %d.", tc.name, tc.expectedMerged, fgc.merged)
+		}
+		if len(fkc.createdJobs) != tc.expectedTriggered {
+			t.Errorf("%s: expected %d jobs triggered, got %d.", tc.name, tc.expectedTriggered, len(fkc.createdJobs))
+		}
+		for _, pj := range fkc.createdJobs {
+			if pj.Spec.Refs.BaseSHA != "base-2" || pj.Spec.Refs.Pulls[0].Number != 2 {
+				t.Errorf("%s: expected PR 2 to be triggered against base-2, got %+v.", tc.name, pj.Spec.Refs)
+			}
+		}
+		if len(c.pools) != 1 {
+			t.Fatalf("%s: expected one pool, got %d.", tc.name, len(c.pools))
+		}
+		if c.pools[0].Action != tc.expectedAction {
+			t.Errorf("%s: expected action %v, got %v.", tc.name, tc.expectedAction, c.pools[0].Action)
+		}
+	}
+}
+
+func TestSyncMergeThenBatch(t *testing.T) {
+	var pjs []kube.ProwJob
+	for _, number := range []int{1, 2, 3} {
+		pjs = append(pjs, kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: kube.PresubmitJob,
+				Refs: kube.Refs{
+					Org:     "o",
+					Repo:    "r",
+					BaseRef: "master",
+					BaseSHA: "base-1",
+					Pulls:   []kube.Pull{{Number: number, SHA: fmt.Sprintf("head-%d", number)}},
+				},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		})
+	}
+	testcases := []struct {
+		name       string
+		batchAfter bool
+
+		expectedAction Action
+		expectedPulls  []int
+	}{
+		{
+			name:           "a single PR is tested after the merge",
+			expectedAction: Trigger,
+			expectedPulls:  []int{2},
+		},
+		{
+			name:           "the rest are batched after the merge",
+			batchAfter:     true,
+			expectedAction: TriggerBatch,
+			expectedPulls:  []int{2, 3},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+			Tide: config.Tide{
+				Queries:          []string{"org:o"},
+				QueryConcurrency: 1,
+				MergeRequeues:    1,
+				BatchAfterMerge:  tc.batchAfter,
+				MinBatchSize:     2,
+			},
+		})
+		fgc := &fgc{
+			refs:     map[string]string{"o/r heads/master": "base-1"},
+			queryPRs: map[string][]PullRequest{"org:o": {newTestPR(1), newTestPR(2), newTestPR(3)}},
+		}
+		fgc.onMerge = func() {
+			fgc.refs["o/r heads/master"] = fmt.Sprintf("base-%d", fgc.merged+1)
+		}
+		fkc := &fkc{prowJobs: pjs}
+		c := newTestController(ca, fgc, fkc)
+		c.cloneFor = func(string) (gitRepo, error) {
+			return &flakyRepo{merges: make(map[string]int)}, nil
+		}
+		if err := c.Sync(); err != nil {
+			t.Fatalf("%s: error syncing: %v", tc.name, err)
+		}
+		if fgc.merged != 1 {
+			t.Errorf("%s: expected one merge, got %d.", tc.name, fgc.merged)
+		}
+		if len(c.pools) != 1 {
+			t.Fatalf("%s: expected one pool, got %d.", tc.name, len(c.pools))
+		}
+		if c.pools[0].Action != tc.expectedAction {
+			t.Errorf("%s: expected action %v, got %v.", tc.name, tc.expectedAction, c.pools[0].Action)
+		}
+		if len(fkc.createdJobs) != 1 {
+			t.Fatalf("%s: expected one job triggered, got %d.", tc.name, len(fkc.createdJobs))
+		}
+		refs := fkc.createdJobs[0].Spec.Refs
+		if refs.BaseSHA != "base-2" {
+			t.Errorf("%s: expected the job to run against base-2, got %s.", tc.name, refs.BaseSHA)
+		}
+		var pulls []int
+		for _, pull := range refs.Pulls {
+			pulls = append(pulls, pull.Number)
+		}
+		if !reflect.DeepEqual(pulls, tc.expectedPulls) {
+			t.Errorf("%s: expected PRs %v to be triggered, got %v.", tc.name, tc.expectedPulls, pulls)
+		}
+	}
+}
+
+func TestSyncRefreshBaseAfterMerge(t *testing.T) {
+	newJob := func(number int, baseSHA string) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: kube.PresubmitJob,
+				Refs: kube.Refs{
+					Org:     "o",
+					Repo:    "r",
+					BaseRef: "master",
+					BaseSHA: baseSHA,
+					Pulls:   []kube.Pull{{Number: number, SHA: fmt.Sprintf("head-%d", number)}},
+				},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		}
+	}
+	testcases := []struct {
+		name    string
+		refresh bool
+		pjs     []kube.ProwJob
+
+		expectedAction Action
+		expectedPulls  []int
+	}{
+		{
+			name:           "the merge waits for the next sync",
+			pjs:            []kube.ProwJob{newJob(1, "base-1"), newJob(2, "base-1")},
+			expectedAction: Merge,
+		},
+		{
+			name:           "the PR left is tested against the new head",
+			refresh:        true,
+			pjs:            []kube.ProwJob{newJob(1, "base-1"), newJob(2, "base-1")},
+			expectedAction: Trigger,
+			expectedPulls:  []int{2},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+			Tide: config.Tide{
+				Queries:               []string{"org:o"},
+				QueryConcurrency:      1,
+				RefreshBaseAfterMerge: tc.refresh,
+				MinBatchSize:          10,
+			},
+		})
+		fgc := &fgc{
+			refs:     map[string]string{"o/r heads/master": "base-1"},
+			queryPRs: map[string][]PullRequest{"org:o": {newTestPR(1), newTestPR(2), newTestPR(3)}},
+		}
+		fgc.onMerge = func() {
+			fgc.refs["o/r heads/master"] = fmt.Sprintf("base-%d", fgc.merged+1)
+		}
+		fkc := &fkc{prowJobs: tc.pjs}
+		c := newTestController(ca, fgc, fkc)
+		if err := c.Sync(); err != nil {
+			t.Fatalf("%s: error syncing: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(fgc.mergedNumbers, []int{1}) {
+			t.Errorf("%s: expected only #1 to be merged, got %v.", tc.name, fgc.mergedNumbers)
+		}
+		if len(c.pools) != 1 {
+			t.Fatalf("%s: expected one pool, got %d.", tc.name, len(c.pools))
+		}
+		if c.pools[0].Action != tc.expectedAction {
+			t.Errorf("%s: expected action %v, got %v.", tc.name, tc.expectedAction, c.pools[0].Action)
+		}
+		var pulls []int
+		for _, pj := range fkc.createdJobs {
+			if pj.Spec.Refs.BaseSHA != "base-2" {
+				t.Errorf("%s: expected the job to run against base-2, got %s.", tc.name, pj.Spec.Refs.BaseSHA)
+			}
+			for _, pull := range pj.Spec.Refs.Pulls {
+				pulls = append(pulls, pull.Number)
+			}
+		}
+		if !reflect.DeepEqual(pulls, tc.expectedPulls) {
+			t.Errorf("%s: expected PRs %v to be triggered, got %v.", tc.name, tc.expectedPulls, pulls)
+		}
+	}
+
+	// A PR passing against the new head is left for the next sync to merge.
+	c := newTestController(newConfigAgent(config.Tide{MinBatchSize: 10}), &fgc{}, nil)
+	c.dryRun = true
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base-2", prs: []PullRequest{newTestPR(2), newTestPR(3)}, triggerOnly: true}
+	act, targets, _, err := c.takeAction(context.Background(), sp, false, []PullRequest{newTestPR(2)}, nil, []PullRequest{newTestPR(3)}, nil)
+	if err != nil {
+		t.Fatalf("Error taking action: %v", err)
+	}
+	if act != Trigger {
+		t.Errorf("Expected action %v, got %v.", Trigger, act)
+	}
+	testPullsMatchList(t, "targets", targets, []int{3})
+}
+
+func TestSyncMaxSubpoolsPerSync(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries:            []string{"org:o"},
+			QueryConcurrency:   1,
+			MaxSubpoolsPerSync: 2,
+			// Keep Tide from cloning the repos to try a batch.
+			MinBatchSize: 10,
+		},
+	})
+	fgc := &fgc{
+		refs:     make(map[string]string),
+		queryPRs: make(map[string][]PullRequest),
+	}
+	for i := 0; i < 5; i++ {
+		repo := fmt.Sprintf("r%d", i)
+		fgc.refs["o/"+repo+" heads/master"] = "base"
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		pr.BaseRef.Name = "master"
+		pr.BaseRef.Prefix = "refs/heads/"
+		pr.Repository.Name = githubql.String(repo)
+		pr.Repository.NameWithOwner = githubql.String("o/" + repo)
+		pr.Repository.Owner.Login = "o"
+		fgc.queryPRs["org:o"] = append(fgc.queryPRs["org:o"], pr)
+	}
+	c := newTestController(ca, fgc, &fkc{})
+	c.dryRun = true
+	expected := [][]string{
+		{"r0", "r1"},
+		{"r2", "r3"},
+		{"r4", "r0"},
+		{"r1", "r2"},
+	}
+	for i, repos := range expected {
+		if err := c.Sync(); err != nil {
+			t.Fatalf("Sync %d: error syncing: %v", i, err)
+		}
+		// Synced subpools come first, then the ones left for later syncs.
+		var synced []string
+		for _, pool := range c.pools[:len(repos)] {
+			synced = append(synced, pool.Repo)
+		}
+		if !reflect.DeepEqual(synced, repos) {
+			t.Errorf("Sync %d: expected subpools %v to be synced, got %v.", i, repos, synced)
+		}
+		// A subpool has no pool until it has been synced once.
+		expectedPools := []int{2, 4, 5, 5}[i]
+		if len(c.pools) != expectedPools {
+			t.Errorf("Sync %d: expected %d pools, got %d.", i, expectedPools, len(c.pools))
+		}
+	}
+}
+
+func TestApplyBlockingChecks(t *testing.T) {
+	newPR := func(number int, contexts map[string]string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		for name, state := range contexts {
+			pr.Commits.Nodes[0].Commit.Status.Contexts = append(pr.Commits.Nodes[0].Commit.Status.Contexts, Context{
+				Context: githubql.String(name),
+				State:   githubql.String(state),
+			})
+		}
+		return pr
+	}
+	checks := []string{"security-scan", "dco"}
+	passing := newPR(1, map[string]string{"security-scan": "SUCCESS", "dco": "SUCCESS"})
+	failing := newPR(2, map[string]string{"security-scan": "FAILURE", "dco": "SUCCESS"})
+	missing := newPR(3, map[string]string{"dco": "SUCCESS"})
+	pendingTests := newPR(4, map[string]string{"security-scan": "ERROR", "dco": "SUCCESS"})
+	failingTests := newPR(5, map[string]string{"security-scan": "SUCCESS", "dco": "SUCCESS"})
+
+	successes, pendings, nones := applyBlockingChecks(checks,
+		[]PullRequest{passing, failing, missing},
+		[]PullRequest{pendingTests},
+		[]PullRequest{failingTests},
+	)
+	testPullsMatchList(t, "successes", successes, []int{1})
+	testPullsMatchList(t, "pendings", pendings, []int{3})
+	testPullsMatchList(t, "nones", nones, []int{5, 2, 4})
+}
+
+func TestRequeueSubpoolRefreshesBase(t *testing.T) {
+	newJob := func(baseSHA string) kube.ProwJob {
+		return kube.ProwJob{Spec: kube.ProwJobSpec{Refs: kube.Refs{BaseSHA: baseSHA}}}
+	}
+	sp := subpool{
+		org:    "o",
+		repo:   "r",
+		branch: "master",
+		sha:    "old",
+		prs:    []PullRequest{newTestPR(1), newTestPR(2)},
+		pjs:    []kube.ProwJob{newJob("old"), newJob("new")},
+	}
+	fgc := &fgc{refs: map[string]string{"o/r heads/master": "new"}}
+	c := newTestController(nil, fgc, nil)
+	next, err := c.requeueSubpool(sp, []PullRequest{newTestPR(1)})
+	if err != nil {
+		t.Fatalf("Error requeueing: %v", err)
+	}
+	if next.sha != "new" {
+		t.Errorf("Expected the base SHA to be refreshed to new, got %q.", next.sha)
+	}
+	testPullsMatchList(t, "remaining PRs", next.prs, []int{2})
+	if len(next.pjs) != 1 || next.pjs[0].Spec.Refs.BaseSHA != "new" {
+		t.Errorf("Expected only the job on the new base to be kept, got %+v.", next.pjs)
+	}
+
+	// Nothing landed, so there is nothing to re-run.
+	fgc.refs["o/r heads/master"] = "old"
+	if next, err := c.requeueSubpool(sp, []PullRequest{newTestPR(1)}); err != nil {
+		t.Fatalf("Error requeueing: %v", err)
+	} else if len(next.prs) != 0 {
+		t.Errorf("Expected an empty subpool when the base did not move, got %d PRs.", len(next.prs))
+	}
+}
+
+func TestWaitReasons(t *testing.T) {
+	newPR := func(number int, state string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String(state)
+		return pr
+	}
+	failing := newPR(1, "FAILURE")
+	pending := newPR(2, "PENDING")
+
+	ca := &config.Agent{}
+	ca.Set(&config.Config{})
+	c := newTestController(ca, &fgc{}, &fkc{})
+	testcases := []struct {
+		name     string
+		prs      []PullRequest
+		pendings []PullRequest
+		nones    []PullRequest
+		reason   string
+	}{
+		{
+			name:   "empty pool",
+			reason: waitNoCandidates,
+		},
+		{
+			name:     "pending PR",
+			prs:      []PullRequest{pending},
+			pendings: []PullRequest{pending},
+			reason:   waitPending,
+		},
+		{
+			name:   "failing PR",
+			prs:    []PullRequest{failing},
+			nones:  []PullRequest{failing},
+			reason: waitIneligible,
+		},
+	}
+	for _, tc := range testcases {
+		sp := subpool{org: "o", repo: "r", branch: "master", prs: tc.prs, rollupOnly: true}
+		act, _, reason, err := c.takeAction(context.Background(), sp, false, nil, tc.pendings, tc.nones, nil)
+		if err != nil {
+			t.Fatalf("For case %q, error in takeAction: %v", tc.name, err)
+		}
+		if act != Wait {
+			t.Errorf("For case %q, expected to wait, got %v.", tc.name, act)
+		}
+		if reason != tc.reason {
+			t.Errorf("For case %q, expected reason %q, got %q.", tc.name, tc.reason, reason)
+		}
+	}
+
+	// A repo whose presubmits all skip the branch is not acted on at all.
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "foo", AlwaysRun: true, Brancher: config.Brancher{Branches: []string{"release"}}}},
+		},
+	})
+	if err := c.syncSubpool(subpool{org: "o", repo: "r", branch: "master", prs: []PullRequest{failing}}); err != nil {
+		t.Fatalf("Error syncing subpool: %v", err)
+	}
+	if len(c.pools) != 1 || c.pools[0].Action != Wait || c.pools[0].WaitReason != waitNotRequired {
+		t.Errorf("Expected to wait because nothing is required, got %+v.", c.pools)
+	}
+}
+
+func TestRequiredJobs(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{Name: "foo", Context: "foo", AlwaysRun: true},
+				{Name: "bar", Context: "bar"},
+				{Name: "baz", Context: "baz"},
+			},
+		},
+		Tide: config.Tide{
+			RequiredJobs: map[string][]string{"o/r": {"bar"}},
+		},
+	})
+	var fkc fkc
+	c := newTestController(ca, nil, &fkc)
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base"}
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pr.HeadRef.Target.OID = githubql.String("head")
+
+	required, err := c.presubmitsFor(sp, pr)
+	if err != nil {
+		t.Fatalf("Error getting required contexts: %v", err)
+	}
+	if expected := []string{"foo", "bar"}; !reflect.DeepEqual(required, expected) {
+		t.Errorf("Expected required contexts %v, got %v.", expected, required)
+	}
+
+	if err := c.trigger(sp, sp.sha, []PullRequest{pr}); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	var triggered []string
+	for _, pj := range fkc.createdJobs {
+		triggered = append(triggered, pj.Spec.Job)
+	}
+	if expected := []string{"foo", "bar"}; !reflect.DeepEqual(triggered, expected) {
+		t.Errorf("Expected triggered jobs %v, got %v.", expected, triggered)
+	}
+
+	// A PR that passes the always-run job alone is not done yet.
+	pjs := []kube.ProwJob{{
+		Spec: kube.ProwJobSpec{
+			Type:    kube.PresubmitJob,
+			Job:     "foo",
+			Context: "foo",
+			Refs:    kube.Refs{Pulls: []kube.Pull{{Number: 1, SHA: "head"}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.SuccessState},
+	}}
+	presubmits := map[int][]string{1: required}
+	successes, pendings, nones := accumulate(presubmits, nil, "", []PullRequest{pr}, pjs, config.TideAccumulateBest)
+	if len(successes) != 0 || len(pendings) != 0 || len(nones) != 1 {
+		t.Errorf("Expected the PR to still need bar, got successes %v, pendings %v, nones %v.", prNumbers(successes), prNumbers(pendings), prNumbers(nones))
+	}
+}
+
+func TestTriggerAndAccumulateAgree(t *testing.T) {
+	presubmits := []config.Presubmit{
+		{Name: "unit", Context: "unit", AlwaysRun: true},
+		{Name: "lint", Context: "lint", AlwaysRun: true},
+		{Name: "e2e", Context: "e2e"},
+		{Name: "silent", Context: "silent", AlwaysRun: true, SkipReport: true},
+		{Name: "release-only", Context: "release-only", AlwaysRun: true, Brancher: config.Brancher{Branches: []string{"release"}}},
+	}
+	testcases := []struct {
+		name     string
+		required []string
+		optional []string
+
+		expected []string
+	}{
+		{
+			name:     "always-run jobs",
+			expected: []string{"unit", "lint"},
+		},
+		{
+			name:     "required job that does not always run",
+			required: []string{"e2e"},
+			expected: []string{"unit", "lint", "e2e"},
+		},
+		{
+			name:     "optional job that always runs",
+			optional: []string{"lint"},
+			expected: []string{"unit"},
+		},
+		{
+			name:     "required and optional jobs",
+			required: []string{"e2e"},
+			optional: []string{"unit", "lint"},
+			expected: []string{"e2e"},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: map[string][]config.Presubmit{"o/r": presubmits},
+			Tide: config.Tide{
+				RequiredJobs: map[string][]string{"o/r": tc.required},
+				OptionalJobs: map[string][]string{"o/r": tc.optional},
+			},
+		})
+		var fkc fkc
+		c := newTestController(ca, nil, &fkc)
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "base"}
+		var pr PullRequest
+		pr.Number = githubql.Int(1)
+		pr.HeadRef.Target.OID = githubql.String("head")
+
+		required, err := c.presubmitsFor(sp, pr)
+		if err != nil {
+			t.Fatalf("For case %q, error getting required contexts: %v", tc.name, err)
+		}
+		if err := c.trigger(sp, sp.sha, []PullRequest{pr}); err != nil {
+			t.Fatalf("For case %q, error triggering: %v", tc.name, err)
+		}
+		var triggered []string
+		for _, pj := range fkc.createdJobs {
+			triggered = append(triggered, pj.Spec.Context)
+		}
+		if !reflect.DeepEqual(required, tc.expected) {
+			t.Errorf("For case %q, expected required contexts %v, got %v.", tc.name, tc.expected, required)
+		}
+		if !reflect.DeepEqual(triggered, required) {
+			t.Errorf("For case %q, expected the triggered contexts %v to be the required ones %v.", tc.name, triggered, required)
+		}
+	}
+}
+
+func TestUnconfiguredOrgRepo(t *testing.T) {
+	testcases := []struct {
+		name       string
+		queries    []string
+		presubmits map[string][]config.Presubmit
+		external   map[string][]string
+
+		expected bool
+	}{
+		{
+			name:     "org-wide query, unconfigured repo",
+			queries:  []string{"org:o label:lgtm"},
+			expected: true,
+		},
+		{
+			name:    "org-wide query, repo with presubmits",
+			queries: []string{"org:o label:lgtm"},
+			presubmits: map[string][]config.Presubmit{
+				"o/r": {{Name: "unit", AlwaysRun: true}},
+			},
+		},
+		{
+			name:     "org-wide query, repo with external contexts",
+			queries:  []string{"org:o label:lgtm"},
+			external: map[string][]string{"o/r": {"ci/external"}},
+		},
+		{
+			name:    "repo named by another query",
+			queries: []string{"org:o label:lgtm", "repo:o/r label:approved"},
+		},
+		{
+			name:    "query for another org",
+			queries: []string{"org:other label:lgtm"},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: tc.presubmits,
+			Tide:       config.Tide{Queries: tc.queries, ExternalContexts: tc.external},
+		})
+		c := &Controller{ca: ca}
+		if actual := c.unconfiguredOrgRepo(subpool{org: "o", repo: "r"}); actual != tc.expected {
+			t.Errorf("For case %q, expected %t, got %t.", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestSyncSubpoolUnconfiguredOrgRepo(t *testing.T) {
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+	for _, require := range []bool{false, true} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				Queries:           []string{"org:o label:lgtm"},
+				RequirePresubmits: require,
+			},
+		})
+		c := newTestController(ca, &fgc{}, &fkc{})
+		c.dryRun = true
+		if err := c.syncSubpool(subpool{org: "o", repo: "r", branch: "master", prs: []PullRequest{pr}}); err != nil {
+			t.Fatalf("Error syncing subpool: %v", err)
+		}
+		if require && (c.pools[0].Action != Wait || c.pools[0].WaitReason != waitUnconfigured) {
+			t.Errorf("Expected to refuse to merge in the unconfigured repo, got %s (%q).", c.pools[0].Action, c.pools[0].WaitReason)
+		} else if !require && c.pools[0].Action != Merge {
+			t.Errorf("Expected to only warn about the unconfigured repo, got %s.", c.pools[0].Action)
+		}
+	}
+}
+
+func TestBatchCommitMessage(t *testing.T) {
+	newPR := func(number int, title, author string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Title = githubql.String(title)
+		pr.Author.Login = githubql.String(author)
+		return pr
+	}
+	batch := []PullRequest{newPR(3, "Fix the flake", "alice"), newPR(1, "Add a flag", "bob")}
+	tmpl := template.Must(template.New("BatchCommit").Parse("Merge batch\n{{range .PRs}}\n#{{.Number}} {{.Title}} (@{{.Author}}){{end}}"))
+
+	message, err := batchCommitMessage(tmpl, batch)
+	if err != nil {
+		t.Fatalf("Error rendering message: %v", err)
+	}
+	if expected := "Merge batch\n\n#3 Fix the flake (@alice)\n#1 Add a flag (@bob)"; message != expected {
+		t.Errorf("Expected message %q, got %q.", expected, message)
+	}
+
+	for _, prs := range [][]PullRequest{batch, batch[:1]} {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				BatchCommitTemplates: map[string]*template.Template{"o/r": tmpl},
+			},
+		})
+		fgc := &fgc{}
+		c := newTestController(ca, fgc, nil)
+		if err := c.mergePRs(context.Background(), subpool{org: "o", repo: "r", branch: "master"}, prs); err != nil {
+			t.Fatalf("Error merging: %v", err)
+		}
+		for _, actual := range fgc.mergeMessages {
+			if len(prs) > 1 && actual != message {
+				t.Errorf("Expected batch merges to use message %q, got %q.", message, actual)
+			} else if len(prs) == 1 && actual != "" {
+				t.Errorf("Expected a single merge to keep the default message, got %q.", actual)
+			}
+		}
+	}
+}
+
+func TestMergeRequiredLinearHistory(t *testing.T) {
+	linear := &github.BranchProtection{}
+	linear.RequiredLinearHistory.Enabled = true
+	testcases := []struct {
+		name       string
+		methods    []string
+		protection *github.BranchProtection
+
+		expected []string
+	}{
+		{
+			name:     "unprotected branch keeps the default method",
+			expected: []string{""},
+		},
+		{
+			name:       "protected branch without linear history keeps the methods",
+			methods:    []string{config.MergeMerge, config.MergeRebase},
+			protection: &github.BranchProtection{},
+			expected:   []string{config.MergeMerge},
+		},
+		{
+			name:       "linear history squashes by default",
+			protection: linear,
+			expected:   []string{config.MergeSquash},
+		},
+		{
+			name:       "linear history squashes merges",
+			methods:    []string{config.MergeMerge, config.MergeRebase},
+			protection: linear,
+			expected:   []string{config.MergeSquash},
+		},
+		{
+			name:       "linear history keeps rebases",
+			methods:    []string{config.MergeRebase, config.MergeMerge, config.MergeSquash},
+			protection: linear,
+			expected:   []string{config.MergeRebase},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				MergeMethods: map[string][]string{"o/r": tc.methods},
+			},
+		})
+		fgc := &fgc{protection: tc.protection}
+		c := newTestController(ca, fgc, nil)
+		var pr PullRequest
+		pr.Number = githubql.Int(1)
+		sp := subpool{org: "o", repo: "r", branch: "master"}
+		sp.linearHistory = c.requiresLinearHistory(sp)
+		if err := c.mergePRs(context.Background(), sp, []PullRequest{pr}); err != nil {
+			t.Fatalf("For case %q, error merging: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(fgc.mergeMethods, tc.expected) {
+			t.Errorf("For case %q, expected merge methods %q, got %q.", tc.name, tc.expected, fgc.mergeMethods)
+		}
+	}
+}
+
+func TestSyncBranchProtectionOncePerSync(t *testing.T) {
+	linear := &github.BranchProtection{}
+	linear.RequiredLinearHistory.Enabled = true
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries:                []string{"org:o"},
+			QueryConcurrency:       1,
+			MergeRequeues:          2,
+			FallbackToRollupStatus: true,
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 10,
+		},
+	})
+	fgc := &fgc{
+		protection: linear,
+		refs:       map[string]string{"o/r heads/master": "base-1"},
+		queryPRs:   map[string][]PullRequest{"org:o": {newTestPR(1), newTestPR(2), newTestPR(3)}},
+	}
+	fgc.onMerge = func() {
+		fgc.refs["o/r heads/master"] = fmt.Sprintf("base-%d", fgc.merged+1)
+	}
+	// Judge PRs by their combined status so that every re-run merges one.
+	c := newTestController(ca, fgc, &fkc{listErr: errors.New("no jobs")})
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	if fgc.merged != 3 {
+		t.Errorf("Expected three merges, got %d.", fgc.merged)
+	}
+	if fgc.protectionCalls != 1 {
+		t.Errorf("Expected the branch protection to be looked up once, got %d lookups.", fgc.protectionCalls)
+	}
+	if expected := []string{config.MergeSquash, config.MergeSquash, config.MergeSquash}; !reflect.DeepEqual(fgc.mergeMethods, expected) {
+		t.Errorf("Expected merge methods %q, got %q.", expected, fgc.mergeMethods)
+	}
+}
+
+func TestSyncSubpoolFailingBase(t *testing.T) {
+	newPR := func(number int, baseSHA, baseState string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.BaseRef.Target.Commit.OID = githubql.String(baseSHA)
+		pr.BaseRef.Target.Commit.Status.State = githubql.String(baseState)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+		return pr
+	}
+	testcases := []struct {
+		name  string
+		block bool
+		prs   []PullRequest
+
+		action Action
+		reason string
+	}{
+		{
+			name:   "failing base blocks merges",
+			block:  true,
+			prs:    []PullRequest{newPR(1, "base", "FAILURE"), newPR(2, "base", "FAILURE")},
+			action: Wait,
+			reason: waitFailingBase,
+		},
+		{
+			name:   "erroring base blocks merges",
+			block:  true,
+			prs:    []PullRequest{newPR(1, "base", "ERROR")},
+			action: Wait,
+			reason: waitFailingBase,
+		},
+		{
+			name:   "failing base is ignored unless configured",
+			prs:    []PullRequest{newPR(1, "base", "FAILURE")},
+			action: Merge,
+		},
+		{
+			name:   "passing base",
+			block:  true,
+			prs:    []PullRequest{newPR(1, "base", "SUCCESS")},
+			action: Merge,
+		},
+		{
+			name:   "pending base",
+			block:  true,
+			prs:    []PullRequest{newPR(1, "base", "PENDING")},
+			action: Merge,
+		},
+		{
+			name:   "failing status of an old base",
+			block:  true,
+			prs:    []PullRequest{newPR(1, "old", "FAILURE")},
+			action: Merge,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			// Keep Tide from cloning the repo to try a batch.
+			Tide: config.Tide{BlockOnFailingBase: tc.block, MinBatchSize: 3},
+		})
+		fgc := &fgc{}
+		c := newTestController(ca, fgc, &fkc{})
+		if err := c.syncSubpool(subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: tc.prs}); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		if pool := c.pools[0]; pool.Action != tc.action || pool.WaitReason != tc.reason {
+			t.Errorf("For case %q, expected %s (%q), got %s (%q).", tc.name, tc.action, tc.reason, pool.Action, pool.WaitReason)
+		}
+		if tc.action == Wait && fgc.merged != 0 {
+			t.Errorf("For case %q, expected no merges, got %d.", tc.name, fgc.merged)
+		}
+	}
+}
+
+func TestSyncQueryPriorities(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries: []string{"label:low", "label:default", "label:high", "label:other"},
+			QueryPriorities: map[string]int{
+				"label:low":  -1,
+				"label:high": 10,
+			},
+			QueryConcurrency: 1,
+		},
+	})
+	fgc := &fgc{}
+	c := newTestController(ca, fgc, &fkc{})
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	expected := []string{"label:high", "label:default", "label:other", "label:low"}
+	if !reflect.DeepEqual(fgc.queries, expected) {
+		t.Errorf("Expected queries to run in order %q, got %q.", expected, fgc.queries)
+	}
+	if queries := ca.Config().Tide.Queries; queries[0] != "label:low" {
+		t.Errorf("Expected the configured queries to be left alone, got %q.", queries)
+	}
+}
+
+func TestTriggerMissingContexts(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{Name: "foo", Context: "foo", AlwaysRun: true},
+				// Added to the config after the PRs were tested.
+				{Name: "bar", Context: "bar", AlwaysRun: true},
+			},
+		},
+		// Keep Tide from cloning the repo to try a batch.
+		Tide: config.Tide{MinBatchSize: 10},
+	})
+	newPR := func(number int) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", number))
+		return pr
+	}
+	newJob := func(number int, state kube.ProwJobState) kube.ProwJob {
+		return kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Type:    kube.PresubmitJob,
+				Job:     "foo",
+				Context: "foo",
+				Refs: kube.Refs{
+					Org:     "o",
+					Repo:    "r",
+					BaseRef: "master",
+					BaseSHA: "base",
+					Pulls:   []kube.Pull{{Number: number, SHA: fmt.Sprintf("head-%d", number)}},
+				},
+			},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	testcases := []struct {
+		name string
+		pjs  []kube.ProwJob
+
+		action    Action
+		pr        int
+		triggered []string
+	}{
+		{
+			name:      "passing PR missing the new presubmit",
+			pjs:       []kube.ProwJob{newJob(1, kube.SuccessState), newJob(2, kube.PendingState)},
+			action:    Trigger,
+			pr:        1,
+			triggered: []string{"bar"},
+		},
+		{
+			name:      "pending PR missing the new presubmit",
+			pjs:       []kube.ProwJob{newJob(1, kube.PendingState), newJob(2, kube.PendingState)},
+			action:    Trigger,
+			pr:        1,
+			triggered: []string{"bar"},
+		},
+		{
+			name:      "pending PR missing the new presubmit, failing PR",
+			pjs:       []kube.ProwJob{newJob(1, kube.FailureState), newJob(2, kube.PendingState)},
+			action:    Trigger,
+			pr:        2,
+			triggered: []string{"bar"},
+		},
+		{
+			name:   "failing PRs need a full retest instead",
+			pjs:    []kube.ProwJob{newJob(1, kube.FailureState), newJob(2, kube.FailureState)},
+			action: Wait,
+		},
+	}
+	for _, tc := range testcases {
+		fkc := &fkc{}
+		c := newTestController(ca, &fgc{}, fkc)
+		sp := subpool{
+			org:    "o",
+			repo:   "r",
+			branch: "master",
+			sha:    "base",
+			prs:    []PullRequest{newPR(1), newPR(2)},
+			pjs:    tc.pjs,
+		}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		if act := c.pools[0].Action; act != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, act)
+		}
+		var triggered []string
+		for _, pj := range fkc.createdJobs {
+			if pulls := pj.Spec.Refs.Pulls; len(pulls) != 1 || pulls[0].Number != tc.pr {
+				t.Errorf("For case %q, expected a job for PR %d only, got %+v.", tc.name, tc.pr, pulls)
+			}
+			triggered = append(triggered, pj.Spec.Job)
+		}
+		if !reflect.DeepEqual(triggered, tc.triggered) {
+			t.Errorf("For case %q, expected jobs %v to be triggered, got %v.", tc.name, tc.triggered, triggered)
+		}
+	}
+}
+
+func TestMissingJobGracePeriod(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "foo", Context: "foo", AlwaysRun: true}},
+		},
+		Tide: config.Tide{
+			MissingJobGracePeriod: 10 * time.Minute,
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 10,
+		},
+	})
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+	failed := kube.ProwJob{
+		Spec: kube.ProwJobSpec{
+			Type:    kube.PresubmitJob,
+			Job:     "foo",
+			Context: "foo",
+			Refs:    kube.Refs{BaseSHA: "base", Pulls: []kube.Pull{{Number: 1}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.FailureState},
+	}
+	testcases := []struct {
+		name    string
+		elapsed time.Duration
+		pjs     []kube.ProwJob
+
+		pending bool
+		action  Action
+	}{
+		{
+			name:    "missing job within the grace period",
+			elapsed: 5 * time.Minute,
+			pending: true,
+			action:  Wait,
+		},
+		{
+			name:    "missing job after the grace period",
+			elapsed: 11 * time.Minute,
+			action:  Trigger,
+		},
+		{
+			name:    "failed job within the grace period",
+			elapsed: 5 * time.Minute,
+			pjs:     []kube.ProwJob{failed},
+			action:  Trigger,
+		},
+	}
+	for _, tc := range testcases {
+		clock := &fakeClock{now: time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)}
+		c := newTestController(ca, &fgc{}, &fkc{})
+		c.clock = clock
+		c.recordPoolTimes([]PullRequest{pr})
+		clock.Advance(tc.elapsed)
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: []PullRequest{pr}, pjs: tc.pjs}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pending := len(pool.PendingPRs) == 1; pending != tc.pending {
+			t.Errorf("For case %q, expected pending %t, got pending PRs %v and missing PRs %v.", tc.name, tc.pending, prNumbers(pool.PendingPRs), prNumbers(pool.MissingPRs))
+		}
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+	}
+}
+
+func TestMergeDependencies(t *testing.T) {
+	newPR := func(number int, deps ...int) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+		for _, dep := range deps {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(fmt.Sprintf("depends-on/%d", dep))})
+		}
+		return pr
+	}
+	testcases := []struct {
+		name        string
+		prs         []PullRequest
+		batchMerges []PullRequest
+		// unmerged are the PRs outside of the pool that are not merged.
+		unmerged []int
+
+		action Action
+		merged []int
+	}{
+		{
+			name:   "dependency merges first",
+			prs:    []PullRequest{newPR(2, 1), newPR(1)},
+			action: Merge,
+			merged: []int{1},
+		},
+		{
+			name:   "dependency outside of the pool is merged",
+			prs:    []PullRequest{newPR(2, 1)},
+			action: Merge,
+			merged: []int{2},
+		},
+		{
+			name:     "dependency outside of the pool is not merged",
+			prs:      []PullRequest{newPR(2, 1)},
+			unmerged: []int{1},
+			action:   Wait,
+		},
+		{
+			name:        "batch merges in dependency order",
+			prs:         []PullRequest{newPR(2, 1), newPR(1), newPR(3, 2)},
+			batchMerges: []PullRequest{newPR(3, 2), newPR(2, 1), newPR(1)},
+			action:      MergeBatch,
+			merged:      []int{1, 2, 3},
+		},
+		{
+			name:        "batch with a dependency outside of it",
+			prs:         []PullRequest{newPR(2, 1), newPR(1), newPR(3, 2)},
+			batchMerges: []PullRequest{newPR(3, 2), newPR(2, 1)},
+			action:      Merge,
+			merged:      []int{1},
+		},
+		{
+			name:        "cycle",
+			prs:         []PullRequest{newPR(1, 2), newPR(2, 1)},
+			batchMerges: []PullRequest{newPR(1, 2), newPR(2, 1)},
+			action:      Wait,
+		},
+		{
+			name:   "longer cycle",
+			prs:    []PullRequest{newPR(1, 3), newPR(2, 1), newPR(3, 2), newPR(4)},
+			action: Merge,
+			merged: []int{4},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				DependencyLabelPrefix: "depends-on/",
+				// Keep Tide from cloning the repo to try a batch.
+				MinBatchSize: 10,
+			},
+		})
+		fgc := &fgc{unmergedChecks: make(map[int]int)}
+		for _, number := range tc.unmerged {
+			fgc.unmergedChecks[number] = 100
+		}
+		c := newTestController(ca, fgc, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", prs: tc.prs}
+		act, _, _, err := c.takeAction(context.Background(), sp, false, tc.prs, nil, nil, tc.batchMerges)
+		if err != nil {
+			t.Fatalf("For case %q, error in takeAction: %v", tc.name, err)
+		}
+		if act != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, act)
+		}
+		if !reflect.DeepEqual(fgc.mergedNumbers, tc.merged) {
+			t.Errorf("For case %q, expected PRs %v to be merged, got %v.", tc.name, tc.merged, fgc.mergedNumbers)
+		}
+	}
+}
+
+func TestMergeCooldown(t *testing.T) {
+	var pr PullRequest
+	pr.Number = githubql.Int(1)
+	pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+	pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+	prs := []PullRequest{pr}
+
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			MergeCooldown: time.Minute,
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 10,
+		},
+	})
+	clock := &fakeClock{now: time.Now()}
+	c := newTestController(ca, &fgc{}, &fkc{})
+	c.clock = clock
+	master := subpool{org: "o", repo: "r", branch: "master", prs: prs}
+	release := subpool{org: "o", repo: "r", branch: "release", prs: prs}
+	check := func(name string, sp subpool, action Action, reason string) {
+		act, _, why, err := c.takeAction(context.Background(), sp, false, prs, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: error in takeAction: %v", name, err)
+		}
+		if act != action || why != reason {
+			t.Errorf("%s: expected action %s with reason %q, got %s with reason %q.", name, action, reason, act, why)
+		}
+	}
+
+	check("first merge", master, Merge, "")
+	clock.Advance(time.Minute - time.Second)
+	check("within the cooldown", master, Wait, waitMergeCooldown)
+	check("other branch", release, Merge, "")
+	clock.Advance(time.Second)
+	check("cooldown passed", master, Merge, "")
+}
+
+func TestMergeCooldownScopes(t *testing.T) {
+	master := subpool{org: "o", repo: "r", branch: "master"}
+	release := subpool{org: "o", repo: "r", branch: "release-1.0"}
+	otherRelease := subpool{org: "o", repo: "r", branch: "release-1.1"}
+	otherRepo := subpool{org: "o", repo: "other", branch: "master"}
+	otherOrg := subpool{org: "p", repo: "r", branch: "master"}
+	testcases := []struct {
+		name     string
+		scope    string
+		branches string
+		merged   subpool
+
+		blocked []subpool
+		free    []subpool
+	}{
+		{
+			name:    "branch",
+			scope:   config.TideCooldownBranch,
+			merged:  master,
+			blocked: []subpool{master},
+			free:    []subpool{release, otherRepo, otherOrg},
+		},
+		{
+			name:    "repo",
+			scope:   config.TideCooldownRepo,
+			merged:  master,
+			blocked: []subpool{master, release},
+			free:    []subpool{otherRepo, otherOrg},
+		},
+		{
+			name:    "org",
+			scope:   config.TideCooldownOrg,
+			merged:  master,
+			blocked: []subpool{master, release, otherRepo},
+			free:    []subpool{otherOrg},
+		},
+		{
+			name:     "repo, release branches only",
+			scope:    config.TideCooldownRepo,
+			branches: `release-.*`,
+			merged:   release,
+			blocked:  []subpool{release, otherRelease},
+			free:     []subpool{master, otherRepo},
+		},
+		{
+			name:     "repo, merge into a branch without cooldown",
+			scope:    config.TideCooldownRepo,
+			branches: `release-.*`,
+			merged:   master,
+			free:     []subpool{master, release, otherRelease},
+		},
+	}
+	for _, tc := range testcases {
+		tideConfig := config.Tide{
+			MergeCooldown:      time.Minute,
+			MergeCooldownScope: tc.scope,
+		}
+		if tc.branches != "" {
+			tideConfig.MergeCooldownBranchRegex = regexp.MustCompile("^(?:" + tc.branches + ")$")
+		}
+		c := &Controller{
+			ca:    newConfigAgent(tideConfig),
+			clock: &fakeClock{now: time.Now()},
+		}
+		c.recordMerge(tc.merged)
+		for _, sp := range tc.blocked {
+			if !c.coolingDown(sp) {
+				t.Errorf("For case %q, expected %s/%s %s to be cooling down.", tc.name, sp.org, sp.repo, sp.branch)
+			}
+		}
+		for _, sp := range tc.free {
+			if c.coolingDown(sp) {
+				t.Errorf("For case %q, expected %s/%s %s not to be cooling down.", tc.name, sp.org, sp.repo, sp.branch)
+			}
+		}
+	}
+}
+
+func TestPostMergeFailurePause(t *testing.T) {
+	newPR := func(number int, baseSHA, baseState string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.BaseRef.Target.Commit.OID = githubql.String(baseSHA)
+		pr.BaseRef.Target.Commit.Status.State = githubql.String(baseState)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+		return pr
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			PostMergeFailureWindow: 10 * time.Minute,
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 3,
+		},
+	})
+	clock := &fakeClock{now: time.Now()}
+	c := newTestController(ca, &fgc{}, &fkc{})
+	c.clock = clock
+	steps := []struct {
+		name    string
+		advance time.Duration
+		branch  string
+		state   string
+
+		action Action
+		reason string
+	}{
+		{name: "merge into a passing branch", state: "SUCCESS", action: Merge},
+		{name: "branch fails after the merge", advance: 5 * time.Minute, state: "FAILURE", action: Wait, reason: waitBrokenByMerge},
+		{name: "still failing after the window", advance: 20 * time.Minute, state: "FAILURE", action: Wait, reason: waitBrokenByMerge},
+		{name: "pending fix", state: "PENDING", action: Wait, reason: waitBrokenByMerge},
+		{name: "branch recovers", state: "SUCCESS", action: Merge},
+		{name: "failure long after the merge", advance: 20 * time.Minute, state: "FAILURE", action: Merge},
+		{name: "failing branch Tide did not merge into", branch: "release", state: "FAILURE", action: Merge},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		branch := step.branch
+		if branch == "" {
+			branch = "master"
+		}
+		sha := fmt.Sprintf("sha%d", i)
+		sp := subpool{org: "o", repo: "r", branch: branch, sha: sha, prs: []PullRequest{newPR(i, sha, step.state)}}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("%s: error syncing subpool: %v", step.name, err)
+		}
+		pool := c.pools[len(c.pools)-1]
+		if pool.Action != step.action || pool.WaitReason != step.reason {
+			t.Errorf("%s: expected action %s with reason %q, got %s with reason %q.", step.name, step.action, step.reason, pool.Action, pool.WaitReason)
+		}
+	}
+}
+
+func TestProtectedPaths(t *testing.T) {
+	paths := []config.TideProtectedPath{{Path: "(^|/)OWNERS$", Label: "owners-approved"}}
+	if err := config.SetProtectedPathRegexes(paths); err != nil {
+		t.Fatalf("Error compiling protected paths: %v", err)
+	}
+	testcases := []struct {
+		name        string
+		prs         []PullRequest
+		batchMerges []PullRequest
+
+		action  Action
+		targets []int
+		held    []int
+	}{
+		{
+			name:   "protected path without the label is held",
+			prs:    []PullRequest{newTestPR(1), newTestPR(2)},
+			action: Merge,
+			// PR 1 is the smallest, but is held.
+			targets: []int{2},
+			held:    []int{1},
+		},
+		{
+			name:    "protected path with the label is merged",
+			prs:     []PullRequest{newTestPR(1, "owners-approved"), newTestPR(2)},
+			action:  Merge,
+			targets: []int{1},
+		},
+		{
+			name:        "batch with a held PR is not merged",
+			prs:         []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3)},
+			batchMerges: []PullRequest{newTestPR(1), newTestPR(2)},
+			action:      Merge,
+			targets:     []int{2},
+			held:        []int{1},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				ProtectedPaths: paths,
+				// Keep Tide from cloning the repo to try a batch.
+				MinBatchSize: 10,
+			},
+		})
+		c := &Controller{
+			logger: logrus.WithField("controller", "tide"),
+			ca:     ca,
+			ghc: &fgc{changes: map[int][]string{
+				1: {"pkg/OWNERS", "pkg/foo.go"},
+				2: {"README.md"},
+				3: {"OWNERS_ALIASES"},
+			}},
+			kc: &fkc{},
+		}
+		sp := subpool{org: "o", repo: "r", branch: "master", prs: tc.prs}
+		if len(tc.batchMerges) > 0 {
+			batch := kube.ProwJob{
+				Spec: kube.ProwJobSpec{
+					Job:  "batch",
+					Type: kube.BatchJob,
+				},
+				Status: kube.ProwJobStatus{State: kube.SuccessState},
+			}
+			for _, pr := range tc.batchMerges {
+				batch.Spec.Refs.Pulls = append(batch.Spec.Refs.Pulls, kube.Pull{Number: int(pr.Number)})
+			}
+			sp.pjs = []kube.ProwJob{batch}
+		}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		testPullsMatchList(t, tc.name+" targets", pool.Target, tc.targets)
+		testPullsMatchList(t, tc.name+" held", pool.HeldPRs, tc.held)
+	}
+}
+
+func TestResolvedReviewThreads(t *testing.T) {
+	newPR := func(number int, resolved ...bool) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = githubql.String("SUCCESS")
+		for _, r := range resolved {
+			pr.ReviewThreads.Nodes = append(pr.ReviewThreads.Nodes, struct{ IsResolved githubql.Boolean }{IsResolved: githubql.Boolean(r)})
+		}
+		return pr
+	}
+	testcases := []struct {
+		name     string
+		required bool
+		prs      []PullRequest
+
+		action     Action
+		targets    []int
+		unresolved []int
+	}{
+		{
+			name:       "unresolved threads are excluded",
+			required:   true,
+			prs:        []PullRequest{newPR(1, true, false), newPR(2)},
+			action:     Merge,
+			targets:    []int{2},
+			unresolved: []int{1},
+		},
+		{
+			name:     "resolved threads proceed",
+			required: true,
+			prs:      []PullRequest{newPR(1, true, true), newPR(2)},
+			action:   Merge,
+			targets:  []int{1},
+		},
+		{
+			name:    "unresolved threads proceed when not required",
+			prs:     []PullRequest{newPR(1, false), newPR(2)},
+			action:  Merge,
+			targets: []int{1},
+		},
+		{
+			name:       "nothing merges while all are unresolved",
+			required:   true,
+			prs:        []PullRequest{newPR(1, false)},
+			action:     Wait,
+			unresolved: []int{1},
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				RequireResolvedThreads: map[string]bool{"o/r": tc.required},
+				// Keep Tide from cloning the repo to try a batch.
+				MinBatchSize: 10,
+			},
+		})
+		c := newTestController(ca, &fgc{}, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", prs: tc.prs}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		testPullsMatchList(t, tc.name+" targets", pool.Target, tc.targets)
+		testPullsMatchList(t, tc.name+" unresolved", pool.UnresolvedPRs, tc.unresolved)
+	}
+}
+
+func TestFrozenBranches(t *testing.T) {
+	passed := func(jobType kube.ProwJobType, numbers ...int) kube.ProwJob {
+		pj := kube.ProwJob{
+			Spec: kube.ProwJobSpec{
+				Job:  "unit",
+				Type: jobType,
+				Refs: kube.Refs{Org: "o", Repo: "r", BaseSHA: "base"},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		}
+		for _, number := range numbers {
+			pj.Spec.Refs.Pulls = append(pj.Spec.Refs.Pulls, kube.Pull{Number: number, SHA: fmt.Sprintf("head-%d", number)})
+		}
+		return pj
+	}
+	testcases := []struct {
+		name   string
+		branch string
+		prs    []PullRequest
+		pjs    []kube.ProwJob
+
+		action  Action
+		targets []int
+		reason  string
+	}{
+		{
+			name:    "passing PR is merged into an unfrozen branch",
+			branch:  "master",
+			prs:     []PullRequest{newTestPR(1)},
+			pjs:     []kube.ProwJob{passed(kube.PresubmitJob, 1)},
+			action:  Merge,
+			targets: []int{1},
+		},
+		{
+			name:   "passing PR waits on a frozen branch",
+			branch: "release-1.10",
+			prs:    []PullRequest{newTestPR(1)},
+			pjs:    []kube.ProwJob{passed(kube.PresubmitJob, 1)},
+			action: Wait,
+			reason: waitFrozen,
+		},
+		{
+			name:    "other PRs are triggered on a frozen branch",
+			branch:  "release-1.10",
+			prs:     []PullRequest{newTestPR(1), newTestPR(2)},
+			pjs:     []kube.ProwJob{passed(kube.PresubmitJob, 1)},
+			action:  Trigger,
+			targets: []int{2},
+		},
+		{
+			name:   "passing batch is neither merged nor retested on a frozen branch",
+			branch: "release-1.10",
+			prs:    []PullRequest{newTestPR(1), newTestPR(2)},
+			pjs:    []kube.ProwJob{passed(kube.PresubmitJob, 1), passed(kube.PresubmitJob, 2), passed(kube.BatchJob, 1, 2)},
+			action: Wait,
+			reason: waitFrozen,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+			Tide: config.Tide{
+				FrozenBranchRegexes: []*regexp.Regexp{regexp.MustCompile("^(?:release-.*)$")},
+				MinBatchSize:        2,
+			},
+		})
+		fgc := &fgc{}
+		fkc := &fkc{}
+		c := newTestController(ca, fgc, fkc)
+		c.cloneFor = func(string) (gitRepo, error) {
+			return &flakyRepo{merges: make(map[string]int)}, nil
+		}
+		sp := subpool{org: "o", repo: "r", branch: tc.branch, sha: "base", prs: tc.prs, pjs: tc.pjs}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		if pool.WaitReason != tc.reason {
+			t.Errorf("For case %q, expected wait reason %q, got %q.", tc.name, tc.reason, pool.WaitReason)
+		}
+		testPullsMatchList(t, tc.name+" targets", pool.Target, tc.targets)
+		if tc.action == Wait && (fgc.merged > 0 || len(fkc.createdJobs) > 0) {
+			t.Errorf("For case %q, expected nothing to be merged or triggered, got %d merges and %d jobs.", tc.name, fgc.merged, len(fkc.createdJobs))
+		}
+	}
+}
+
+func TestBlockedByBatch(t *testing.T) {
+	pendingBatch := kube.ProwJob{
+		Spec: kube.ProwJobSpec{
+			Job:  "batch",
+			Type: kube.BatchJob,
+			Refs: kube.Refs{Pulls: []kube.Pull{{Number: 1, SHA: "head-1"}, {Number: 2, SHA: "head-2"}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.PendingState},
+	}
+	testcases := []struct {
+		name string
+		prs  []PullRequest
+		pjs  []kube.ProwJob
+
+		action  Action
+		blocked map[int]bool
+	}{
+		{
+			name:    "passing PRs wait for the pending batch",
+			prs:     []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3)},
+			pjs:     []kube.ProwJob{pendingBatch},
+			action:  Wait,
+			blocked: map[int]bool{1: true, 2: true, 3: true},
+		},
+		{
+			name:    "force merged PR is not blocked",
+			prs:     []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3, "tide/merge-now")},
+			pjs:     []kube.ProwJob{pendingBatch},
+			action:  Merge,
+			blocked: map[int]bool{1: true, 2: true},
+		},
+		{
+			name:   "no pending batch",
+			prs:    []PullRequest{newTestPR(1), newTestPR(2)},
+			action: Merge,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				ForceMergeLabel: "tide/merge-now",
+				// Keep Tide from cloning the repo to try a batch.
+				MinBatchSize: 10,
+			},
+		})
+		c := newTestController(ca, &fgc{}, &fkc{})
+		if err := c.syncSubpool(subpool{org: "o", repo: "r", branch: "master", prs: tc.prs, pjs: tc.pjs}); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		if !reflect.DeepEqual(pool.BlockedByBatch, tc.blocked) {
+			t.Errorf("For case %q, expected blocked PRs %v, got %v.", tc.name, tc.blocked, pool.BlockedByBatch)
+		}
+	}
+}
+
+func TestMaxPendingBatches(t *testing.T) {
+	var prs []PullRequest
+	for _, n := range []int{1, 2} {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", n))
+		prs = append(prs, pr)
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{MinBatchSize: 2, MaxPendingBatches: 2}})
+	var clones int
+	c := newTestController(ca, &fgc{}, &fkc{})
+	c.cloneFor = func(string) (gitRepo, error) {
+		clones++
+		return &flakyRepo{merges: make(map[string]int)}, nil
+	}
+	c.countPendingBatches([]kube.ProwJob{
+		{
+			Spec: kube.ProwJobSpec{
+				Type: kube.BatchJob,
+				Refs: kube.Refs{Org: "o", Repo: "other"},
+			},
+			Status: kube.ProwJobStatus{State: kube.PendingState},
+		},
+		{
+			Spec: kube.ProwJobSpec{
+				Type: kube.BatchJob,
+				Refs: kube.Refs{Org: "o", Repo: "done"},
+			},
+			Status: kube.ProwJobStatus{State: kube.SuccessState},
+		},
+	})
+	// The PRs are being tested serially, so only a batch can be triggered.
+	check := func(name, repo string, action Action, reason string) {
+		sp := subpool{org: "o", repo: repo, branch: "master", sha: "master", prs: prs}
+		act, _, why, err := c.takeAction(context.Background(), sp, false, nil, prs, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: error in takeAction: %v", name, err)
+		}
+		if act != action || why != reason {
+			t.Errorf("%s: expected action %s with reason %q, got %s with reason %q.", name, action, reason, act, why)
+		}
+	}
+
+	check("one batch pending elsewhere", "r", TriggerBatch, "")
+	check("limit reached", "third", Wait, waitBatchLimit)
+	if clones != 1 {
+		t.Errorf("Expected no clone once the limit is reached, got %d clones.", clones)
+	}
+	check("repo with a pending batch", "other", TriggerBatch, "")
+}
+
+func TestSentQueries(t *testing.T) {
+	var prs []PullRequest
+	for i := 0; i < 25; i++ {
+		var pr PullRequest
+		pr.Number = githubql.Int(i)
+		prs = append(prs, pr)
+	}
+	query := "is:pr state:open org:o label:lgtm"
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	logger.Level = logrus.DebugLevel
+	clock := &fakeClock{now: time.Now()}
+	c := &Controller{
+		logger: logrus.NewEntry(logger),
+		ca:     newConfigAgent(config.Tide{}),
+		ghc:    &fgc{queryPRs: map[string][]PullRequest{query: prs}, queryPageSize: 10},
+		clock:  clock,
+	}
+	if _, _, _, err := c.search(context.Background(), query, func([]PullRequest) bool { return false }); err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	expected := []SentQuery{
+		{Time: clock.now, Org: "o", Query: query},
+		{Time: clock.now, Org: "o", Query: query, Cursor: "10"},
+		{Time: clock.now, Org: "o", Query: query, Cursor: "20"},
+	}
+	if !reflect.DeepEqual(c.sentQueries.queries, expected) {
+		t.Errorf("Expected the sent queries %+v, got %+v.", expected, c.sentQueries.queries)
+	}
+	for _, sent := range expected {
+		// logrus quotes the message, escaping the quotes around the query and cursor.
+		line := strings.Replace(fmt.Sprintf("Searching with query %q and cursor %q.", sent.Query, sent.Cursor), `"`, `\"`, -1)
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("Expected the log to contain %s, got:\n%s", line, logs.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeQueries(rec, httptest.NewRequest("GET", "/queries", nil))
+	var served []SentQuery
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("JSON decoding error: %v", err)
+	}
+	if len(served) != len(expected) || served[2].Cursor != "20" {
+		t.Errorf("Expected the served queries to match %+v, got %+v.", expected, served)
+	}
+
+	// Only the most recent queries are kept.
+	for i := 0; i < sentQueryLimit; i++ {
+		c.recordQuery(SentQuery{Query: strconv.Itoa(i)})
+	}
+	if queries := c.sentQueries.queries; len(queries) != sentQueryLimit || queries[0].Query != "0" {
+		t.Errorf("Expected only the last %d queries to be kept, got %d starting with %+v.", sentQueryLimit, len(queries), queries[0])
+	}
+}
+
+func TestStatusOverrides(t *testing.T) {
+	newPR := func(number int, labels ...string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.Contexts = []Context{
+			{Context: "security-scan", State: "FAILURE"},
+			{Context: "license-check", State: "FAILURE"},
+		}
+		for _, label := range labels {
+			pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: githubql.String(label)})
+		}
+		return pr
+	}
+	overrides := []config.TideStatusOverride{{Label: "tide/override-status", Contexts: []string{"security-scan"}}}
+	required := []string{"security-scan", "license-check"}
+
+	testcases := []struct {
+		name     string
+		required []string
+		labels   []string
+
+		kept       []string
+		overridden []string
+		success    bool
+	}{
+		{
+			name:     "without the label nothing is overridden",
+			required: []string{"security-scan"},
+			kept:     []string{"security-scan"},
+		},
+		{
+			name:       "with the label the configured context is overridden",
+			required:   []string{"security-scan"},
+			labels:     []string{"tide/override-status"},
+			overridden: []string{"security-scan"},
+			success:    true,
+		},
+		{
+			name:       "only the configured contexts are overridden",
+			required:   required,
+			labels:     []string{"tide/override-status"},
+			kept:       []string{"license-check"},
+			overridden: []string{"security-scan"},
+		},
+		{
+			name:     "other labels do not override",
+			required: required,
+			labels:   []string{"lgtm"},
+			kept:     required,
+		},
+	}
+	for _, tc := range testcases {
+		pr := newPR(1, tc.labels...)
+		kept, overridden := overrideContexts(overrides, pr, tc.required)
+		if !reflect.DeepEqual(kept, tc.kept) || !reflect.DeepEqual(overridden, tc.overridden) {
+			t.Errorf("For case %q, expected kept %v and overridden %v, got %v and %v.", tc.name, tc.kept, tc.overridden, kept, overridden)
+		}
+		external := map[string]bool{"security-scan": true, "license-check": true}
+		successes, _, _ := accumulate(map[int][]string{1: kept}, external, "", []PullRequest{pr}, nil, config.TideAccumulateBest)
+		if success := len(successes) == 1; success != tc.success {
+			t.Errorf("For case %q, expected success to be %t, got %t.", tc.name, tc.success, success)
+		}
+	}
+
+	// The controller applies the overrides and reports them in the pool.
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			ExternalContexts: map[string][]string{"o/r": {"security-scan"}},
+			StatusOverrides:  map[string][]config.TideStatusOverride{"o/r": overrides},
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 10,
+		},
+	})
+	c := newTestController(ca, &fgc{}, &fkc{})
+	prs := []PullRequest{newPR(1), newPR(2, "tide/override-status")}
+	for i := range prs {
+		// Only the overridden context fails.
+		prs[i].Commits.Nodes[0].Commit.Status.Contexts = prs[i].Commits.Nodes[0].Commit.Status.Contexts[:1]
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", prs: prs}
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Error syncing subpool: %v", err)
+	}
+	pool := c.pools[0]
+	if pool.Action != Merge {
+		t.Errorf("Expected action %s, got %s.", Merge, pool.Action)
+	}
+	testPullsMatchList(t, "overridden targets", pool.Target, []int{2})
+	if expected := map[int][]string{2: {"security-scan"}}; !reflect.DeepEqual(pool.OverriddenContexts, expected) {
+		t.Errorf("Expected the overridden contexts %v, got %v.", expected, pool.OverriddenContexts)
+	}
+}
+
+func TestDisabledBatches(t *testing.T) {
+	var prs []PullRequest
+	for n := 1; n <= 5; n++ {
+		var pr PullRequest
+		pr.Number = githubql.Int(n)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		pr.HeadRef.Target.OID = githubql.String(fmt.Sprintf("head-%d", n))
+		prs = append(prs, pr)
+	}
+	batch := kube.ProwJob{
+		Spec: kube.ProwJobSpec{
+			Job:  "batch",
+			Type: kube.BatchJob,
+			Refs: kube.Refs{BaseSHA: "master", Pulls: []kube.Pull{{Number: 1, SHA: "head-1"}, {Number: 2, SHA: "head-2"}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.SuccessState},
+	}
+	newController := func(enabled bool) *Controller {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{Tide: config.Tide{EnableBatches: map[string]bool{"o/r": enabled}}})
+		return &Controller{
+			logger: logrus.WithField("controller", "tide"),
+			ca:     ca,
+			ghc:    &fgc{},
+			kc:     &fkc{},
+			dryRun: true,
+			cloneFor: func(string) (gitRepo, error) {
+				return &flakyRepo{merges: make(map[string]int)}, nil
+			},
+		}
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: prs}
+
+	// With every PR's tests pending, a batch is triggered only when enabled.
+	for _, tc := range []struct {
+		enabled bool
+		action  Action
+	}{
+		{enabled: true, action: TriggerBatch},
+		{enabled: false, action: Wait},
+	} {
+		act, _, _, err := newController(tc.enabled).takeAction(context.Background(), sp, false, nil, prs, nil, nil)
+		if err != nil {
+			t.Fatalf("Error taking action: %v", err)
+		}
+		if act != tc.action {
+			t.Errorf("With batches enabled %t, expected action %s, got %s.", tc.enabled, tc.action, act)
+		}
+	}
+
+	// A passing batch is not merged as such, and the PRs are merged serially.
+	for _, tc := range []struct {
+		enabled bool
+		action  Action
+		targets []int
+	}{
+		{enabled: true, action: MergeBatch, targets: []int{1, 2}},
+		{enabled: false, action: Merge, targets: []int{1}},
+	} {
+		c := newController(tc.enabled)
+		sp.pjs = []kube.ProwJob{batch}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("Error syncing subpool: %v", err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("With batches enabled %t, expected action %s, got %s.", tc.enabled, tc.action, pool.Action)
+		}
+		testPullsMatchList(t, fmt.Sprintf("batches enabled %t", tc.enabled), pool.Target, tc.targets)
+	}
+}
+
+func TestTakeActionSkipsConflicting(t *testing.T) {
+	newPR := func(number int, mergeable githubql.MergeableState) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Mergeable = mergeable
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		return pr
+	}
+	ca := &config.Agent{}
+	// Keep Tide from cloning the repo to try a batch.
+	ca.Set(&config.Config{Tide: config.Tide{MinBatchSize: 10}})
+	testcases := []struct {
+		name string
+		prs  []PullRequest
+
+		action  Action
+		targets []int
+	}{
+		{
+			name:    "smallest passing PR is conflicting",
+			prs:     []PullRequest{newPR(1, githubql.MergeableStateConflicting), newPR(2, githubql.MergeableStateMergeable)},
+			action:  Merge,
+			targets: []int{2},
+		},
+		{
+			name:    "unknown mergeability is not skipped",
+			prs:     []PullRequest{newPR(1, githubql.MergeableStateUnknown), newPR(2, githubql.MergeableStateMergeable)},
+			action:  Merge,
+			targets: []int{1},
+		},
+		{
+			name:   "every passing PR is conflicting",
+			prs:    []PullRequest{newPR(1, githubql.MergeableStateConflicting)},
+			action: Wait,
+		},
+	}
+	for _, tc := range testcases {
+		fgc := &fgc{}
+		c := newTestController(ca, fgc, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: tc.prs}
+		act, targets, _, err := c.takeAction(context.Background(), sp, false, tc.prs, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("For case %q, error in takeAction: %v", tc.name, err)
+		}
+		if act != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, act)
+		}
+		testPullsMatchList(t, tc.name, targets, tc.targets)
+	}
+}
+
+func TestUpdateBehindBranch(t *testing.T) {
+	newPR := func(head string) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(1)
+		pr.Repository.NameWithOwner = "o/r"
+		pr.HeadRef.Target.OID = githubql.String(head)
+		pr.Commits.Nodes = []struct{ Commit Commit }{{}}
+		pr.Commits.Nodes[0].Commit.Status.State = "SUCCESS"
+		return pr
+	}
+	fgc := &fgc{}
+	c := &Controller{
+		logger: logrus.WithField("controller", "tide"),
+		// Go through clientFor, as a production controller does.
+		clientFor: func(org string) (githubClient, error) { return fgc, nil },
+		ca: newConfigAgent(config.Tide{
+			UpdateBranches:    map[string]bool{"o/r": true},
+			BranchUpdateLimit: 3,
+			// Keep Tide from cloning the repo to try a batch.
+			MinBatchSize: 10,
+		}),
+		kc: &fkc{},
+	}
+	steps := []struct {
+		name     string
+		baseSHA  string
+		head     string
+		behindBy int
+
+		action  Action
+		reason  string
+		updates []int
+	}{
+		{name: "passing but behind", baseSHA: "base1", head: "head1", behindBy: 1, action: Wait, reason: waitBranchUpdate, updates: []int{1}},
+		{name: "head unchanged by the update", baseSHA: "base1", head: "head1", behindBy: 1, action: Wait, reason: waitBranchUpdate, updates: []int{1, 1}},
+		{name: "update still in progress", baseSHA: "base1", head: "head2", behindBy: 1, action: Wait, reason: waitBranchUpdate, updates: []int{1, 1}},
+		{name: "updated and tested again", baseSHA: "base1", head: "head3", action: Merge, updates: []int{1, 1}},
+		{name: "base moved on", baseSHA: "base2", head: "head3", behindBy: 1, action: Wait, reason: waitBranchUpdate, updates: []int{1, 1, 1}},
+		{name: "update limit reached", baseSHA: "base3", head: "head3", behindBy: 1, action: Merge, updates: []int{1, 1, 1}},
+	}
+	for _, step := range steps {
+		fgc.behindBy = map[string]int{step.head: step.behindBy}
+		fgc.merged = 0
+		prs := []PullRequest{newPR(step.head)}
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: step.baseSHA, prs: prs}
+		act, _, reason, err := c.takeAction(context.Background(), sp, false, prs, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("For step %q, error in takeAction: %v", step.name, err)
+		}
+		if act != step.action || reason != step.reason {
+			t.Errorf("For step %q, expected action %s with reason %q, got %s with reason %q.", step.name, step.action, step.reason, act, reason)
+		}
+		if act == Merge && fgc.merged != 1 {
+			t.Errorf("For step %q, expected the PR to be merged.", step.name)
+		}
+		if !reflect.DeepEqual(fgc.updatedBranches, step.updates) {
+			t.Errorf("For step %q, expected branch updates %v, got %v.", step.name, step.updates, fgc.updatedBranches)
+		}
+	}
+
+	// The results from before the update do not make the updated PR pass.
+	c.ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{"o/r": {{Name: "unit", AlwaysRun: true}}},
+		Tide:       config.Tide{MinBatchSize: 10},
+	})
+	oldHead := kube.ProwJob{
+		Spec: kube.ProwJobSpec{
+			Job:  "unit",
+			Type: kube.PresubmitJob,
+			Refs: kube.Refs{Org: "o", Repo: "r", BaseSHA: "base", Pulls: []kube.Pull{{Number: 1, SHA: "head1"}}},
+		},
+		Status: kube.ProwJobStatus{State: kube.SuccessState},
+	}
+	fgc.merged = 0
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: []PullRequest{newPR("head2")}, pjs: []kube.ProwJob{oldHead}}
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Error syncing subpool: %v", err)
+	}
+	if pool := c.pools[len(c.pools)-1]; len(pool.SuccessPRs) > 0 || fgc.merged > 0 {
+		t.Errorf("Expected the PR not to pass on the results of its old head, got action %s with passing PRs %v.", pool.Action, prNumbers(pool.SuccessPRs))
+	}
+}
+
+func TestTriggerJobLabels(t *testing.T) {
+	queries := []string{"is:pr org:o label:lgtm", "is:pr org:o label:approved"}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			Queries:   queries,
+			JobLabels: map[string]string{"dashboard": "tide", "tier": "merge"},
+		},
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "unit", AlwaysRun: true, Labels: map[string]string{"team": "a", "tier": "presubmit"}}},
+		},
+	})
+	prs := []PullRequest{newTestPR(1), newTestPR(2)}
+	var fkc fkc
+	c := newTestController(ca, &fgc{queryPRs: map[string][]PullRequest{queries[1]: prs}}, &fkc)
+	if _, _, err := c.searchAll(context.Background(), queries, 1, 0); err != nil {
+		t.Fatalf("Error searching: %v", err)
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: prs}
+	if err := c.trigger(sp, sp.sha, prs[:1]); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	if err := c.trigger(sp, sp.sha, prs); err != nil {
+		t.Fatalf("Error triggering: %v", err)
+	}
+	if len(fkc.createdJobs) != 2 {
+		t.Fatalf("Expected two jobs, got %d.", len(fkc.createdJobs))
+	}
+	for i, trigger := range []string{"serial", "batch"} {
+		expected := map[string]string{
+			"team":      "a",
+			"dashboard": "tide",
+			// The configured labels win over the presubmit's.
+			"tier":             "merge",
+			createdByTideLabel: "true",
+			triggerLabel:       trigger,
+			queryLabel:         "1",
+		}
+		if actual := fkc.createdJobs[i].Metadata.Labels; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected the %s job to have labels %v, got %v.", trigger, expected, actual)
+		}
+	}
+}
+
+func TestRetriggerErroredBatch(t *testing.T) {
+	refs := func(numbers ...int) kube.Refs {
+		refs := kube.Refs{Org: "o", Repo: "r", BaseRef: "master", BaseSHA: "base"}
+		for _, n := range numbers {
+			refs.Pulls = append(refs.Pulls, kube.Pull{Number: n, SHA: fmt.Sprintf("head-%d", n)})
+		}
+		return refs
+	}
+	newJob := func(job string, jobType kube.ProwJobType, state kube.ProwJobState, refs kube.Refs) kube.ProwJob {
+		return kube.ProwJob{
+			Spec:   kube.ProwJobSpec{Type: jobType, Job: job, Context: job, Refs: refs},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	prs := []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3)}
+	// Each PR is being tested on its own, so nothing is triggered serially.
+	var serial []kube.ProwJob
+	for _, n := range []int{1, 2, 3} {
+		serial = append(serial, newJob("unit", kube.PresubmitJob, kube.PendingState, refs(n)), newJob("e2e", kube.PresubmitJob, kube.PendingState, refs(n)))
+	}
+	testcases := []struct {
+		name  string
+		batch []kube.ProwJob
+
+		action    Action
+		targets   []int
+		triggered []string
+	}{
+		{
+			name: "errored batch is retriggered",
+			batch: []kube.ProwJob{
+				newJob("unit", kube.BatchJob, kube.SuccessState, refs(1, 2)),
+				newJob("e2e", kube.BatchJob, kube.ErrorState, refs(1, 2)),
+			},
+			action:    TriggerBatch,
+			targets:   []int{1, 2},
+			triggered: []string{"e2e"},
+		},
+		{
+			name: "batch that errored too often is given up on",
+			batch: []kube.ProwJob{
+				newJob("unit", kube.BatchJob, kube.SuccessState, refs(1, 2)),
+				newJob("e2e", kube.BatchJob, kube.ErrorState, refs(1, 2)),
+				newJob("e2e", kube.BatchJob, kube.ErrorState, refs(1, 2)),
+			},
+			action: Wait,
+		},
+		{
+			name: "failed batch is not retriggered",
+			batch: []kube.ProwJob{
+				newJob("unit", kube.BatchJob, kube.FailureState, refs(1, 2)),
+				newJob("e2e", kube.BatchJob, kube.ErrorState, refs(1, 2)),
+			},
+			action: Wait,
+		},
+	}
+	for _, tc := range testcases {
+		ca := &config.Agent{}
+		ca.Set(&config.Config{
+			Tide: config.Tide{
+				BatchErrorRetriggers: 1,
+				// Keep Tide from cloning the repo to try a new batch.
+				MinBatchSize: 10,
+			},
+			Presubmits: map[string][]config.Presubmit{
+				"o/r": {
+					{Name: "unit", Context: "unit", AlwaysRun: true},
+					{Name: "e2e", Context: "e2e", AlwaysRun: true},
+				},
+			},
+		})
+		var fkc fkc
+		c := newTestController(ca, &fgc{}, &fkc)
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: prs, pjs: append(append([]kube.ProwJob{}, serial...), tc.batch...)}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		testPullsMatchList(t, tc.name, pool.Target, tc.targets)
+		var triggered []string
+		for _, pj := range fkc.createdJobs {
+			if pj.Spec.Type != kube.BatchJob {
+				t.Errorf("For case %q, expected a batch job, got a %s job.", tc.name, pj.Spec.Type)
+			}
+			triggered = append(triggered, pj.Spec.Job)
+		}
+		if !reflect.DeepEqual(triggered, tc.triggered) {
+			t.Errorf("For case %q, expected jobs %v triggered, got %v.", tc.name, tc.triggered, triggered)
+		}
+	}
+}
+
+func TestBatchRequiredJobs(t *testing.T) {
+	refs := func(numbers ...int) kube.Refs {
+		refs := kube.Refs{Org: "o", Repo: "r", BaseRef: "master", BaseSHA: "base"}
+		for _, n := range numbers {
+			refs.Pulls = append(refs.Pulls, kube.Pull{Number: n, SHA: fmt.Sprintf("head-%d", n)})
+		}
+		return refs
+	}
+	newJob := func(job string, jobType kube.ProwJobType, state kube.ProwJobState, refs kube.Refs) kube.ProwJob {
+		return kube.ProwJob{
+			Spec:   kube.ProwJobSpec{Type: jobType, Job: job, Context: job, Refs: refs},
+			Status: kube.ProwJobStatus{State: state},
+		}
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Tide: config.Tide{
+			BatchRequiredJobs: map[string][]string{"o/r": {"integration"}},
+			// Keep Tide from cloning the repo to try a new batch.
+			MinBatchSize: 10,
+		},
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {
+				{Name: "unit", Context: "unit", AlwaysRun: true},
+				{Name: "integration", Context: "integration"},
+			},
+		},
+	})
+	prs := []PullRequest{newTestPR(1), newTestPR(2)}
+	testcases := []struct {
+		name string
+		pjs  []kube.ProwJob
+
+		action  Action
+		targets []int
+	}{
+		{
+			name: "batch without the batch-only job is not merged",
+			pjs: []kube.ProwJob{
+				newJob("unit", kube.BatchJob, kube.SuccessState, refs(1, 2)),
+				newJob("unit", kube.PresubmitJob, kube.PendingState, refs(1)),
+				newJob("unit", kube.PresubmitJob, kube.PendingState, refs(2)),
+			},
+			action: Wait,
+		},
+		{
+			name: "batch passing the batch-only job is merged",
+			pjs: []kube.ProwJob{
+				newJob("unit", kube.BatchJob, kube.SuccessState, refs(1, 2)),
+				newJob("integration", kube.BatchJob, kube.SuccessState, refs(1, 2)),
+			},
+			action:  MergeBatch,
+			targets: []int{1, 2},
+		},
+		{
+			name: "PR merged on its own does not need the batch-only job",
+			pjs: []kube.ProwJob{
+				newJob("unit", kube.PresubmitJob, kube.SuccessState, refs(1)),
+			},
+			action:  Merge,
+			targets: []int{1},
+		},
+	}
+	for _, tc := range testcases {
+		c := newTestController(ca, &fgc{}, &fkc{})
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: prs, pjs: tc.pjs}
+		if err := c.syncSubpool(sp); err != nil {
+			t.Fatalf("For case %q, error syncing subpool: %v", tc.name, err)
+		}
+		pool := c.pools[0]
+		if pool.Action != tc.action {
+			t.Errorf("For case %q, expected action %s, got %s.", tc.name, tc.action, pool.Action)
+		}
+		testPullsMatchList(t, tc.name, pool.Target, tc.targets)
+	}
+
+	// Batches are triggered with the batch-only job, single PRs without it.
+	for _, tc := range []struct {
+		prs  []PullRequest
+		jobs []string
+	}{
+		{prs: prs, jobs: []string{"unit", "integration"}},
+		{prs: prs[:1], jobs: []string{"unit"}},
+	} {
+		var fkc fkc
+		c := newTestController(ca, &fgc{}, &fkc)
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: prs}
+		if err := c.trigger(sp, "base", tc.prs); err != nil {
+			t.Fatalf("Error triggering %v: %v", prNumbers(tc.prs), err)
+		}
+		var triggered []string
+		for _, pj := range fkc.createdJobs {
+			triggered = append(triggered, pj.Spec.Job)
+		}
+		if !reflect.DeepEqual(triggered, tc.jobs) {
+			t.Errorf("Expected jobs %v triggered for %v, got %v.", tc.jobs, prNumbers(tc.prs), triggered)
+		}
+	}
+}
+
+func TestMergeRefused(t *testing.T) {
+	refs := kube.Refs{Org: "o", Repo: "r", BaseRef: "master", BaseSHA: "base"}
+	for _, n := range []int{1, 2, 3} {
+		refs.Pulls = append(refs.Pulls, kube.Pull{Number: n, SHA: fmt.Sprintf("head-%d", n)})
+	}
+	ca := &config.Agent{}
+	ca.Set(&config.Config{
+		Presubmits: map[string][]config.Presubmit{
+			"o/r": {{Name: "unit", Context: "unit", AlwaysRun: true}},
+		},
+	})
+	fgc := &fgc{refusedMerges: map[int]bool{2: true}}
+	c := newTestController(ca, fgc, &fkc{})
+	prs := []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3)}
+	batch := kube.ProwJob{
+		Spec:   kube.ProwJobSpec{Type: kube.BatchJob, Job: "unit", Context: "unit", Refs: refs},
+		Status: kube.ProwJobStatus{State: kube.SuccessState},
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", sha: "base", prs: prs, pjs: []kube.ProwJob{batch}}
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Expected the refused merge not to fail the sync, got: %v", err)
+	}
+	pool := c.pools[0]
+	if pool.Action != MergeBatch {
+		t.Errorf("Expected action %s, got %s.", MergeBatch, pool.Action)
+	}
+	if expected := []int{1, 3}; !reflect.DeepEqual(fgc.mergedNumbers, expected) {
+		t.Errorf("Expected PRs %v to be merged around the refused one, got %v.", expected, fgc.mergedNumbers)
+	}
+	if reason := pool.MergeRefusals[2]; !strings.Contains(reason, "security") || len(pool.MergeRefusals) != 1 {
+		t.Errorf("Expected the refusal of PR 2 in the pool, got %v.", pool.MergeRefusals)
+	}
+
+	// Once merged, the PR no longer has a refusal.
+	fgc.refusedMerges = nil
+	c.pools = nil
+	sp.prs = prs[1:2]
+	sp.pjs = nil
+	sp.rollupOnly = true
+	if err := c.syncSubpool(sp); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	if pool := c.pools[0]; pool.Action != Merge || pool.MergeRefusals != nil {
+		t.Errorf("Expected PR 2 to be merged without a refusal, got %s with %v.", pool.Action, pool.MergeRefusals)
+	}
+}
+
+func TestServeReset(t *testing.T) {
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{RetestLabel: "tide/retest"}})
+	fc := &fakeClock{now: time.Date(2017, time.November, 1, 0, 0, 0, 0, time.UTC)}
+	c := newTestController(ca, nil, nil)
+	c.clock = fc
+	newPR := func(number int) PullRequest {
+		var pr PullRequest
+		pr.Number = githubql.Int(number)
+		pr.Repository.NameWithOwner = "o/r"
+		pr.Labels.Nodes = append(pr.Labels.Nodes, struct{ Name githubql.String }{Name: "tide/retest"})
+		return pr
+	}
+	sp := subpool{org: "o", repo: "r", branch: "master", prs: []PullRequest{newPR(1), newPR(2)}}
+	c.recordPoolTimes(sp.prs)
+	for _, pr := range sp.prs {
+		c.recordRetest(pr, fc.Now())
+	}
+	fc.Advance(time.Minute)
+	if due := c.dueRetests(sp); len(due) != 0 {
+		t.Fatalf("Expected the retests to be cooling down, got PRs %v due.", prNumbers(due))
+	}
+
+	for _, tc := range []struct {
+		method string
+		query  string
+
+		expectedCode int
+	}{
+		{method: http.MethodGet, query: "?org=o&repo=r&number=1", expectedCode: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, query: "?org=o&repo=r&number=one", expectedCode: http.StatusBadRequest},
+		{method: http.MethodPost, query: "?org=o&number=1", expectedCode: http.StatusBadRequest},
+		{method: http.MethodPost, query: "?org=o&repo=r&number=1", expectedCode: http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		c.ServeReset(rec, httptest.NewRequest(tc.method, "/reset"+tc.query, nil))
+		if rec.Code != tc.expectedCode {
+			t.Errorf("For %s %s, expected code %d, got %d.", tc.method, tc.query, tc.expectedCode, rec.Code)
+		}
+	}
+
+	// Only the reset PR is treated as new.
+	due := c.dueRetests(sp)
+	testPullsMatchList(t, "retests after reset", due, []int{1})
+	if _, ok := c.timeInPool(newPR(1)); ok {
+		t.Error("Expected the time in pool of the reset PR to be forgotten.")
+	}
+	if _, ok := c.timeInPool(newPR(2)); !ok {
+		t.Error("Expected the time in pool of the other PR to be kept.")
+	}
+}
+
+func TestPickBatchPriorityLabel(t *testing.T) {
+	testcases := []struct {
+		name      string
+		label     string
+		conflicts map[string]bool
+
+		expected []int
+	}{
+		{
+			name:     "labeled PR goes first",
+			label:    "tide/batch-priority",
+			expected: []int{3, 1, 2},
+		},
+		{
+			name:     "without the label configured, the order is kept",
+			expected: []int{1, 2, 3},
+		},
+		{
+			name:      "conflicting labeled PR is left out",
+			label:     "tide/batch-priority",
+			conflicts: map[string]bool{"head-3": true},
+			expected:  []int{1, 2},
+		},
+	}
+	for _, tc := range testcases {
+		c := &Controller{
+			logger: logrus.WithField("controller", "tide"),
+			ca:     newConfigAgent(config.Tide{BatchPriorityLabel: tc.label}),
+			cloneFor: func(string) (gitRepo, error) {
+				return &flakyRepo{conflicts: tc.conflicts, merges: make(map[string]int)}, nil
+			},
+		}
+		sp := subpool{org: "o", repo: "r", branch: "master", sha: "master", prs: []PullRequest{newTestPR(1), newTestPR(2), newTestPR(3, "tide/batch-priority")}}
+		batch, _, err := c.pickBatch(sp)
+		if err != nil {
+			t.Fatalf("For case %q, error from pickBatch: %v", tc.name, err)
+		}
+		if actual := prNumbers(batch); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("For case %q, expected the batch %v, got %v.", tc.name, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// signatureHeader carries the HMAC-SHA256 of a decision payload, keyed with
+// the webhook secret, as "sha256=<hex>".
+const signatureHeader = "X-Tide-Signature"
+
+// webhookClient posts decisions without a slow webhook backing up the queue
+// for long.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// decisionBacklog is how many decisions may wait to be posted. Decisions past
+// it are dropped rather than holding up the sync.
+const decisionBacklog = 100
+
+// decisionPost is a decision waiting to be posted.
+type decisionPost struct {
+	url      string
+	decision Decision
+	secret   []byte
+}
+
+// decisionQueue posts decisions to the webhook from its own goroutine, in the
+// order they were made, so that a slow webhook cannot hold up the sync.
+type decisionQueue struct {
+	once  sync.Once
+	posts chan decisionPost
+	// pending counts the decisions that were queued and not posted yet.
+	pending sync.WaitGroup
+}
+
+// Decision is what Tide posts to the decision webhook after syncing a
+// subpool.
+type Decision struct {
+	Org    string
+	Repo   string
+	Branch string
+
+	Action Action
+	// Targets are the numbers of the PRs the action was taken on.
+	Targets []int `json:",omitempty"`
+}
+
+// SetWebhookSecret sets the secret that the decisions posted to the decision
+// webhook are signed with.
+func (c *Controller) SetWebhookSecret(secret []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.webhookSecret = secret
+}
+
+// postDecision queues the action taken on the pool to be posted to the
+// decision webhook, if one is configured. Failures are logged but are not
+// fatal. The caller must hold m.
+func (c *Controller) postDecision(pool Pool) {
+	url := c.ca.Config().Tide.DecisionWebhookURL
+	if url == "" {
+		return
+	}
+	decision := Decision{
+		Org:    pool.Org,
+		Repo:   pool.Repo,
+		Branch: pool.Branch,
+		Action: pool.Action,
+	}
+	for _, pr := range pool.Target {
+		decision.Targets = append(decision.Targets, int(pr.Number))
+	}
+	c.decisions.once.Do(func() {
+		c.decisions.posts = make(chan decisionPost, decisionBacklog)
+		go c.drainDecisions()
+	})
+	c.decisions.pending.Add(1)
+	select {
+	case c.decisions.posts <- decisionPost{url: url, decision: decision, secret: c.webhookSecret}:
+	default:
+		c.decisions.pending.Done()
+		c.logger.Warningf("Dropping the decision for %s/%s %s: %d decisions are already waiting to be posted.", pool.Org, pool.Repo, pool.Branch, decisionBacklog)
+	}
+}
+
+// drainDecisions posts the queued decisions one at a time.
+func (c *Controller) drainDecisions() {
+	for post := range c.decisions.posts {
+		d := post.decision
+		if err := postSigned(post.url, d, post.secret); err != nil {
+			c.logger.WithError(err).Warningf("Failed to post the decision for %s/%s %s.", d.Org, d.Repo, d.Branch)
+		}
+		c.decisions.pending.Done()
+	}
+}
+
+// postSigned posts v as JSON to the URL, signed with the secret.
+func postSigned(url string, v interface{}, secret []byte) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, "sha256="+sign(b, secret))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("response has status %q", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the payload.
+func sign(payload, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
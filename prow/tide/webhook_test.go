@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tide
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubql"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestPostDecision(t *testing.T) {
+	secret := []byte("s3cret")
+	var received []Decision
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error reading payload: %v", err)
+			return
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(payload)
+		if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(signatureHeader) != expected {
+			t.Errorf("Expected the signature %q, got %q.", expected, r.Header.Get(signatureHeader))
+		}
+		var decision Decision
+		if err := json.Unmarshal(payload, &decision); err != nil {
+			t.Errorf("Error decoding payload: %v", err)
+			return
+		}
+		received = append(received, decision)
+		if decision.Action == Wait {
+			http.Error(w, "refused", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	ca := &config.Agent{}
+	ca.Set(&config.Config{Tide: config.Tide{DecisionWebhookURL: server.URL}})
+	c := newTestController(ca, nil, nil)
+	c.SetWebhookSecret(secret)
+	var pr PullRequest
+	pr.Number = githubql.Int(3)
+	c.postDecision(Pool{Org: "o", Repo: "r", Branch: "master", Action: Merge, Target: []PullRequest{pr}})
+	// A refused decision is only logged.
+	c.postDecision(Pool{Org: "o", Repo: "r", Branch: "release", Action: Wait})
+	c.decisions.pending.Wait()
+
+	expected := []Decision{
+		{Org: "o", Repo: "r", Branch: "master", Action: Merge, Targets: []int{3}},
+		{Org: "o", Repo: "r", Branch: "release", Action: Wait},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected the decisions %+v, got %+v.", expected, received)
+	}
+
+	// Nothing is posted without a URL.
+	ca.Set(&config.Config{})
+	c.postDecision(Pool{Org: "o", Repo: "r", Branch: "master", Action: Merge})
+	c.decisions.pending.Wait()
+	if len(received) != len(expected) {
+		t.Errorf("Expected no decision to be posted without a webhook URL, got %+v.", received[len(expected):])
+	}
+}
+
+func TestPostDecisionHangingWebhook(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		received++
+	}))
+	defer server.Close()
+
+	c := newTestController(newConfigAgent(config.Tide{DecisionWebhookURL: server.URL}), nil, nil)
+	start := time.Now()
+	// The first decision hangs while being posted, and the backlog fills up
+	// behind it. The rest are dropped.
+	for i := 0; i < decisionBacklog+5; i++ {
+		c.postDecision(Pool{Org: "o", Repo: "r", Branch: "master", Action: Wait})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a hanging webhook not to hold up posting decisions, but it took %v.", elapsed)
+	}
+	close(release)
+	c.decisions.pending.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	// One decision may have been taken off the queue before the rest were
+	// queued behind it.
+	if received < decisionBacklog || received > decisionBacklog+1 {
+		t.Errorf("Expected %d or %d decisions to be posted, got %d.", decisionBacklog, decisionBacklog+1, received)
+	}
+}